@@ -0,0 +1,102 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// anomaly kinds, see Anomaly
+const (
+	// a message other than an auth request from downstream, or an auth
+	// reply from upstream, during auth. Dropped if the connection goes on.
+	AnomalyUnknownAuthMsg = "unknown-auth-msg"
+
+	// a packet piped with a payload above 35000 bytes, piped as is if the
+	// connection goes on
+	AnomalyOversizedPacket = "oversized-packet"
+
+	// a banner of upstream beyond the 16th during auth, dropped if the
+	// connection goes on
+	AnomalyBannerFlood = "banner-flood"
+)
+
+// the total packet size every implementation handles, RFC 4253 section
+// 6.1, peers of well behaved clients and servers stay below
+const maxSanePayload = 35000
+
+// upstream banners relayed during auth before they flood
+const maxAuthBanners = 16
+
+// Anomaly is a peer straying from the protocol in a way the piper can get
+// over, see SSHPiper.AnomalyHook
+type Anomaly struct {
+	Kind string
+
+	// sent by upstream, by downstream otherwise
+	Upstream bool
+
+	MsgType byte
+	// payload in bytes
+	Size int
+}
+
+func (a Anomaly) String() string {
+	from := "downstream"
+	if a.Upstream {
+		from = "upstream"
+	}
+	return fmt.Sprintf("%v from %v, msg %d of %d bytes", a.Kind, from, a.MsgType, a.Size)
+}
+
+// readAuthPacket reads downstream's next packet during auth, an auth
+// request or one of also. Others are anomalies, dropped once anomaly lets
+// the connection go on, and returned as is without an anomaly hook.
+func (d *downstream) readAuthPacket(also ...byte) ([]byte, error) {
+	for {
+		packet, err := d.transport.readPacket()
+		if err != nil || d.anomaly == nil {
+			return packet, err
+		}
+
+		msgType := packetType(packet)
+		if msgType == msgUserAuthRequest || bytes.IndexByte(also, msgType) >= 0 {
+			return packet, nil
+		}
+
+		if err := d.anomaly(Anomaly{Kind: AnomalyUnknownAuthMsg, MsgType: msgType, Size: len(packet)}); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readAuthReply reads upstream's next packet during auth. Packets other
+// than auth replies and banners beyond maxAuthBanners are anomalies,
+// dropped once anomaly lets the connection go on, and returned as is
+// without an anomaly hook.
+func (pipe *pipedConn) readAuthReply() ([]byte, error) {
+	anomaly := pipe.downstream.anomaly
+
+	for {
+		packet, err := pipe.upstream.transport.readPacket()
+		if err != nil || anomaly == nil {
+			return packet, err
+		}
+
+		a := Anomaly{Upstream: true, MsgType: packetType(packet), Size: len(packet)}
+		switch a.MsgType {
+		case msgUserAuthSuccess, msgUserAuthFailure, msgUserAuthInfoRequest:
+			return packet, nil
+		case msgUserAuthBanner:
+			if pipe.banners++; pipe.banners <= maxAuthBanners {
+				return packet, nil
+			}
+			a.Kind = AnomalyBannerFlood
+		default:
+			a.Kind = AnomalyUnknownAuthMsg
+		}
+
+		if err := anomaly(a); err != nil {
+			return nil, err
+		}
+	}
+}
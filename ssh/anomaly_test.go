@@ -0,0 +1,88 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestAnomalyHook(t *testing.T) {
+	up := observedUpstream(t)
+	defer up.Close()
+
+	errStrict := errors.New("strict")
+
+	for _, terminate := range []bool{false, true} {
+		var mu sync.Mutex
+		var anomalies []Anomaly
+
+		piper := &SSHPiper{
+			FindUpstream: func(conn ConnMetadata) (net.Conn, *ClientConfig, error) {
+				c, err := net.Dial("tcp", up.Addr().String())
+				return c, &ClientConfig{User: conn.User(), Auth: []AuthMethod{Password("pw")}}, err
+			},
+			MapPublicKey: func(conn ConnMetadata, key PublicKey) (Signer, error) {
+				return nil, nil
+			},
+			AnomalyHook: func(conn ConnMetadata, a Anomaly) error {
+				mu.Lock()
+				defer mu.Unlock()
+				anomalies = append(anomalies, a)
+
+				if terminate {
+					return errStrict
+				}
+				return nil
+			},
+		}
+		piper.DownstreamConfig.AddHostKey(testSigners["rsa"])
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		served := make(chan error, 1)
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				served <- err
+				return
+			}
+			served <- piper.Serve(c)
+		}()
+
+		client, err := Dial("tcp", l.Addr().String(), &ClientConfig{
+			User: "alice",
+			Auth: []AuthMethod{Password("pw")},
+		})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+
+		if _, _, err := client.SendRequest("small@sshpiper", true, make([]byte, 100)); err != nil {
+			t.Fatalf("SendRequest: %v", err)
+		}
+
+		_, _, err = client.SendRequest("large@sshpiper", true, make([]byte, maxSanePayload))
+		if terminate && err == nil {
+			t.Errorf("oversized packet piped despite an error of the hook")
+		}
+		if !terminate && err != nil {
+			t.Errorf("oversized packet not piped: %v", err)
+		}
+
+		client.Close()
+		if err := <-served; terminate && err != errStrict {
+			t.Errorf("Serve returned %v, want the error of the hook", err)
+		}
+
+		mu.Lock()
+		if len(anomalies) != 1 || anomalies[0].Kind != AnomalyOversizedPacket || anomalies[0].Upstream {
+			t.Errorf("got anomalies %v, want one oversized packet from downstream", anomalies)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,224 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AuthState is the state upstream auth of a pipe is in. Auth goes from
+// AuthRequest through AuthPrompts and AuthReply to AuthNext and around
+// again until AuthDone.
+type AuthState int
+
+const (
+	// an auth request from downstream is mapped and sent upstream
+	AuthRequest AuthState = iota
+	// banners and keyboard-interactive prompts of upstream are relayed
+	AuthPrompts
+	// the reply of upstream is relayed to downstream
+	AuthReply
+	// the next auth request is read from downstream
+	AuthNext
+	// upstream accepted auth
+	AuthDone
+)
+
+func (s AuthState) String() string {
+	switch s {
+	case AuthRequest:
+		return "request"
+	case AuthPrompts:
+		return "prompts"
+	case AuthReply:
+		return "reply"
+	case AuthNext:
+		return "next"
+	case AuthDone:
+		return "done"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// authFlow relays auth between the legs of a pipe, each state has a step
+// of its own which picks the state after
+type authFlow struct {
+	pipe  *pipedConn
+	state AuthState
+
+	// the request of downstream being relayed, and its method
+	msg    *userAuthRequestMsg
+	method string
+	// keyboard-interactive of downstream relayed as password
+	bridged bool
+
+	// upstream's last packet, nil if the request was ignored
+	packet []byte
+}
+
+func (pipe *pipedConn) pipeAuth(initUserAuthMsg *userAuthRequestMsg) error {
+	err := pipe.upstream.sendAuthReq()
+	if err != nil && pipe.redial != nil && isDropped(err) {
+		err = pipe.reconnect()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	f := &authFlow{pipe: pipe, msg: initUserAuthMsg}
+	f.enter(AuthRequest, msgUserAuthRequest)
+
+	return f.run()
+}
+
+func (f *authFlow) run() error {
+	for {
+		var err error
+
+		switch f.state {
+		case AuthRequest:
+			err = f.request()
+		case AuthPrompts:
+			err = f.prompts()
+		case AuthReply:
+			err = f.reply()
+		case AuthNext:
+			err = f.next()
+		case AuthDone:
+			return nil
+		default:
+			err = fmt.Errorf("ssh: unknown auth state %v", f.state)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *authFlow) enter(state AuthState, msgType byte) {
+	f.state = state
+	if f.pipe.authState != nil {
+		f.pipe.authState(state, msgType)
+	}
+}
+
+// packetType is the type of p, 0 for none
+func packetType(p []byte) byte {
+	if len(p) == 0 {
+		return 0
+	}
+	return p[0]
+}
+
+// request sends the request upstream, bridged if need be, and reads the
+// reply
+func (f *authFlow) request() error {
+	pipe := f.pipe
+	f.method = f.msg.Method
+
+	// asked once, a redialed upstream gets the same password
+	f.bridged = pipe.passwordPrompt != "" && f.msg.Method == "keyboard-interactive"
+	if f.bridged {
+		msg, err := pipe.keyboardInteractivePassword(f.msg)
+		if err != nil {
+			return err
+		}
+		f.msg = msg
+	}
+
+	packet, err := pipe.relayAuthMsg(f.msg)
+	if err != nil && pipe.redial != nil && isDropped(err) {
+		if err = pipe.reconnect(); err == nil {
+			packet, err = pipe.relayAuthMsg(f.msg)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	f.packet = packet
+	f.enter(AuthPrompts, packetType(packet))
+	return nil
+}
+
+// prompts relays banners and prompts, downstream may give up on them for
+// another request
+func (f *authFlow) prompts() error {
+	packet, next, err := f.pipe.relayPrompts(f.packet, f.msg.Method == "keyboard-interactive")
+	if err != nil {
+		return err
+	}
+
+	if next != nil {
+		f.msg = next
+		f.enter(AuthRequest, msgUserAuthRequest)
+		return nil
+	}
+
+	f.packet = packet
+	f.enter(AuthReply, packetType(packet))
+	return nil
+}
+
+// reply relays upstream's answer to the request, nil for ignored
+func (f *authFlow) reply() error {
+	pipe, packet := f.pipe, f.packet
+
+	// downstream is in keyboard-interactive and would read a password
+	// change request as prompts
+	if f.bridged && packetType(packet) == msgUserAuthPasswdChangeReq {
+		return errors.New("ssh: upstream requires a password change")
+	}
+
+	if packet != nil && pipe.authLog != nil {
+		switch packet[0] {
+		case msgUserAuthSuccess:
+			pipe.authLog(f.method, nil)
+		case msgUserAuthFailure:
+			pipe.authLog(f.method, errRejectedByUpstream)
+		}
+	}
+
+	if packetType(packet) == msgUserAuthFailure && pipe.authMethods != nil {
+		var err error
+		if packet, err = pipe.relayFailure(packet); err != nil {
+			return err
+		}
+	}
+
+	if packet == nil {
+		f.enter(AuthNext, 0)
+		return nil
+	}
+
+	msgType := packet[0]
+	if msgType == msgUserAuthSuccess && f.method == "publickey" {
+		pipe.downstream.acceptLastKey()
+	}
+
+	// writePacket consumes packet
+	if err := pipe.downstream.transport.writePacket(packet); err != nil {
+		return err
+	}
+
+	if msgType == msgUserAuthSuccess {
+		f.enter(AuthDone, msgType)
+	} else {
+		f.enter(AuthNext, msgType)
+	}
+	return nil
+}
+
+// next reads downstream's next request
+func (f *authFlow) next() error {
+	msg, err := f.pipe.downstream.nextAuthMsg()
+	if err != nil {
+		return err
+	}
+
+	f.msg = msg
+	f.enter(AuthRequest, msgUserAuthRequest)
+	return nil
+}
@@ -75,7 +75,12 @@ func NewClientConn(c net.Conn, addr string, config *ClientConfig) (Conn, <-chan
 		c.Close()
 		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %v", err)
 	}
+	if err := conn.clientAuthenticate(&fullConf); err != nil {
+		c.Close()
+		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %v", err)
+	}
 	conn.mux = newMux(conn.transport)
+	go conn.mux.loop()
 	return conn, conn.mux.incomingChannels, conn.mux.incomingRequests, nil
 }
 
@@ -105,7 +110,8 @@ func (c *connection) clientHandshake(dialAddress string, config *ClientConfig) e
 	} else if packet[0] != msgNewKeys {
 		return unexpectedMessageError(msgNewKeys, packet[0])
 	}
-	//return c.clientAuthenticate(config)
+	// auth is not part of the handshake, the piper relays it from downstream.
+	// NewClientConn calls clientAuthenticate itself.
 	return nil
 }
 
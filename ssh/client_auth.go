@@ -322,7 +322,11 @@ func handleAuthResponse(c packetConn) (bool, []string, error) {
 		case msgUserAuthSuccess:
 			return true, nil, nil
 		case msgDisconnect:
-			return false, nil, io.EOF
+			var msg disconnectMsg
+			if err := Unmarshal(packet, &msg); err != nil {
+				return false, nil, io.EOF
+			}
+			return false, nil, &msg
 		default:
 			return false, nil, unexpectedMessageError(msgUserAuthSuccess, packet[0])
 		}
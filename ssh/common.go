@@ -194,6 +194,18 @@ type Config struct {
 	// The allowed MAC algorithms. If unspecified then a sensible default
 	// is used.
 	MACs []string
+
+	// The maximum number of bytes of received packets waiting to be
+	// read, counted by the size of their buffers. Once reached, no more
+	// packets are read from the network until some are consumed, which
+	// pushes back on the peer. A single packet is always let through. If
+	// unspecified, only the number of waiting packets is limited. The
+	// piper shares the budget of DownstreamConfig between both legs of a
+	// connection, the one of upstream configs is not used.
+	MaxBufferedBytes int
+
+	// budget, if not nil, is shared with the other leg of a pipe
+	budget *bufferBudget
 }
 
 // SetDefaults sets sensible values for unset fields in config. This is
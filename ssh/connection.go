@@ -95,6 +95,9 @@ type connection struct {
 }
 
 func (c *connection) Close() error {
+	if c.transport != nil {
+		return c.transport.Close()
+	}
 	return c.sshConn.conn.Close()
 }
 
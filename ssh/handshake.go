@@ -65,11 +65,26 @@ type handshakeTransport struct {
 	incoming  chan []byte
 	readError error
 
+	// bytes waiting in incoming count against budget, see
+	// Config.MaxBufferedBytes. buffered and bufferClosed are guarded by
+	// budget.mu.
+	budget       *bufferBudget
+	buffered     int
+	bufferClosed bool
+
 	// data for host key checking
 	hostKeyCallback func(hostname string, remote net.Addr, key PublicKey) error
 	dialAddress     string
 	remoteAddr      net.Addr
 
+	// agreed by the last key exchange, and the host key the server proved
+	// on client side
+	kexMu     sync.Mutex
+	algs      *algorithms
+	remoteKey PublicKey
+	// called after each key exchange from now on, see onKex
+	kexHook func(algs *algorithms)
+
 	readSinceKex uint64
 
 	// Protects the writing side of the connection
@@ -86,9 +101,20 @@ func newHandshakeTransport(conn keyingTransport, config *Config, clientVersion,
 		conn:          conn,
 		serverVersion: serverVersion,
 		clientVersion: clientVersion,
-		incoming:      make(chan []byte, 16),
 		config:        config,
+		budget:        config.budget,
+	}
+	if t.budget == nil {
+		t.budget = newBufferBudget(config.MaxBufferedBytes)
+	}
+
+	// the bytes are the limit, not the count of packets
+	n := 16
+	if t.budget.max > 0 {
+		n = maxBufferedPackets
 	}
+	t.incoming = make(chan []byte, n)
+
 	t.cond = sync.NewCond(&t.mu)
 	return t
 }
@@ -125,9 +151,68 @@ func (t *handshakeTransport) readPacket() ([]byte, error) {
 	if !ok {
 		return nil, t.readError
 	}
+
+	b := t.budget
+	b.mu.Lock()
+	t.buffered -= cap(p)
+	b.used -= cap(p)
+	// the other leg may wait on a shared budget too
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
 	return p, nil
 }
 
+// maxBufferedPackets bounds incoming when bytes are bounded by a budget
+const maxBufferedPackets = 1024
+
+var errTransportClosed = errors.New("ssh: transport closed")
+
+// bufferBudget bounds the bytes of received packets waiting to be read, of
+// one transport, or both legs of a pipe which share it
+type bufferBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int
+	used int
+}
+
+func newBufferBudget(max int) *bufferBudget {
+	b := &bufferBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// waitBuffer blocks until n more bytes fit in the budget, false if the
+// transport was closed meanwhile. A transport with nothing waiting always
+// gets one packet through, so a leg is never starved by the other.
+func (t *handshakeTransport) waitBuffer(n int) bool {
+	b := t.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.max > 0 && t.buffered > 0 && b.used+n > b.max && !t.bufferClosed {
+		b.cond.Wait()
+	}
+	if t.bufferClosed {
+		return false
+	}
+
+	t.buffered += n
+	b.used += n
+	return true
+}
+
+// closeBuffer wakes readLoop if it waits for the budget, nobody reads the
+// transport anymore
+func (t *handshakeTransport) closeBuffer() {
+	b := t.budget
+	b.mu.Lock()
+	t.bufferClosed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
 func (t *handshakeTransport) readLoop() {
 	for {
 		p, err := t.readOnePacket()
@@ -137,8 +222,15 @@ func (t *handshakeTransport) readLoop() {
 			break
 		}
 		if p[0] == msgIgnore || p[0] == msgDebug {
+			putPacketBuffer(p)
 			continue
 		}
+		if !t.waitBuffer(cap(p)) {
+			putPacketBuffer(p)
+			t.readError = errTransportClosed
+			close(t.incoming)
+			break
+		}
 		t.incoming <- p
 	}
 }
@@ -278,6 +370,7 @@ func (t *handshakeTransport) writePacket(p []byte) error {
 }
 
 func (t *handshakeTransport) Close() error {
+	t.closeBuffer()
 	return t.conn.Close()
 }
 
@@ -352,9 +445,33 @@ func (t *handshakeTransport) enterKeyExchange(otherInitPacket []byte) error {
 	} else if packet[0] != msgNewKeys {
 		return unexpectedMessageError(msgNewKeys, packet[0])
 	}
+
+	t.kexMu.Lock()
+	t.algs = algs
+	hook := t.kexHook
+	t.kexMu.Unlock()
+
+	if hook != nil {
+		hook(algs)
+	}
 	return nil
 }
 
+// onKex calls hook after each key exchange done from now on
+func (t *handshakeTransport) onKex(hook func(algs *algorithms)) {
+	t.kexMu.Lock()
+	t.kexHook = hook
+	t.kexMu.Unlock()
+}
+
+// agreed returns the algorithms and remote host key of the last key
+// exchange, nil before the first
+func (t *handshakeTransport) agreed() (*algorithms, PublicKey) {
+	t.kexMu.Lock()
+	defer t.kexMu.Unlock()
+	return t.algs, t.remoteKey
+}
+
 func (t *handshakeTransport) server(kex kexAlgorithm, algs *algorithms, magics *handshakeMagics) (*kexResult, error) {
 	var hostKey Signer
 	for _, k := range t.hostKeys {
@@ -389,5 +506,9 @@ func (t *handshakeTransport) client(kex kexAlgorithm, algs *algorithms, magics *
 		}
 	}
 
+	t.kexMu.Lock()
+	t.remoteKey = hostKey
+	t.kexMu.Unlock()
+
 	return result, nil
 }
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 )
 
 type testChecker struct {
@@ -309,3 +310,81 @@ func TestHandshakeAutoRekeyRead(t *testing.T) {
 
 	<-sync.called
 }
+
+func TestHandshakeMaxBufferedBytes(t *testing.T) {
+	trans := newHandshakeTransport(nil, &Config{MaxBufferedBytes: 10}, nil, nil)
+
+	trans.waitBuffer(8)
+	trans.incoming <- make([]byte, 8)
+
+	done := make(chan struct{})
+	go func() {
+		trans.waitBuffer(8)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("packet over MaxBufferedBytes not held back")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := trans.readPacket(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("packet not let through after buffer consumed")
+	}
+}
+
+func TestHandshakeSharedBuffer(t *testing.T) {
+	down := newHandshakeTransport(nil, &Config{MaxBufferedBytes: 10}, nil, nil)
+	up := newHandshakeTransport(nil, &Config{budget: down.budget}, nil, nil)
+
+	if cap(up.incoming) != maxBufferedPackets {
+		t.Errorf("incoming of %d packets, want %d", cap(up.incoming), maxBufferedPackets)
+	}
+
+	// a leg with nothing waiting always gets one through
+	down.waitBuffer(8)
+	down.incoming <- make([]byte, 1, 8)
+	up.waitBuffer(2)
+	up.incoming <- make([]byte, 2)
+
+	done := make(chan bool)
+	go func() {
+		done <- up.waitBuffer(8)
+	}()
+
+	// consuming the other leg frees the shared budget
+	select {
+	case <-done:
+		t.Fatal("packet over the shared budget not held back")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := down.readPacket(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("packet not let through after the other leg consumed")
+	}
+
+	// up is over budget again, closing wakes the wait
+	go func() {
+		done <- up.waitBuffer(8)
+	}()
+	up.closeBuffer()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("packet let through a closed transport")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait not woken by close")
+	}
+}
@@ -31,6 +31,12 @@ const (
 	KeyAlgoECDSA521 = "ecdsa-sha2-nistp521"
 )
 
+// Signature algorithms of rsa keys besides ssh-rsa, RFC 8332
+const (
+	SigAlgoRSASHA2256 = "rsa-sha2-256"
+	SigAlgoRSASHA2512 = "rsa-sha2-512"
+)
+
 // parsePubKey parses a public key of the given algorithm.
 // Use ParsePublicKey for keys with prepended algorithm.
 func parsePubKey(in []byte, algo string) (pubKey PublicKey, rest []byte, err error) {
@@ -258,13 +264,28 @@ func (r *rsaPublicKey) Marshal() []byte {
 }
 
 func (r *rsaPublicKey) Verify(data []byte, sig *Signature) error {
-	if sig.Format != r.Type() {
+	hash, ok := rsaSigHashes[sig.Format]
+	if !ok {
 		return fmt.Errorf("ssh: signature type %s for key type %s", sig.Format, r.Type())
 	}
-	h := crypto.SHA1.New()
+	h := hash.New()
 	h.Write(data)
 	digest := h.Sum(nil)
-	return rsa.VerifyPKCS1v15((*rsa.PublicKey)(r), crypto.SHA1, digest, sig.Blob)
+	return rsa.VerifyPKCS1v15((*rsa.PublicKey)(r), hash, digest, sig.Blob)
+}
+
+// rsaSigHashes are the hashes of rsa signature algorithms
+var rsaSigHashes = map[string]crypto.Hash{
+	KeyAlgoRSA:        crypto.SHA1,
+	SigAlgoRSASHA2256: crypto.SHA256,
+	SigAlgoRSASHA2512: crypto.SHA512,
+}
+
+// AlgorithmSigner is a Signer which also signs with algorithms other than
+// the one of its key type, e.g. SigAlgoRSASHA2256 for rsa keys
+type AlgorithmSigner interface {
+	Signer
+	SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error)
 }
 
 type rsaPrivateKey struct {
@@ -276,15 +297,23 @@ func (r *rsaPrivateKey) PublicKey() PublicKey {
 }
 
 func (r *rsaPrivateKey) Sign(rand io.Reader, data []byte) (*Signature, error) {
-	h := crypto.SHA1.New()
+	return r.SignWithAlgorithm(rand, data, KeyAlgoRSA)
+}
+
+func (r *rsaPrivateKey) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	hash, ok := rsaSigHashes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("ssh: unsupported signature algorithm %s for rsa keys", algorithm)
+	}
+	h := hash.New()
 	h.Write(data)
 	digest := h.Sum(nil)
-	blob, err := rsa.SignPKCS1v15(rand, r.PrivateKey, crypto.SHA1, digest)
+	blob, err := rsa.SignPKCS1v15(rand, r.PrivateKey, hash, digest)
 	if err != nil {
 		return nil, err
 	}
 	return &Signature{
-		Format: r.PublicKey().Type(),
+		Format: algorithm,
 		Blob:   blob,
 	}, nil
 }
@@ -125,7 +125,8 @@ func newMux(p packetConn) *mux {
 		m.chanList.offset = atomic.AddUint32(&globalOff, 1)
 	}
 
-	//go m.loop()
+	// the loop is not started here, the piper reads packets from conn
+	// directly. callers using channels must start it with go m.loop().
 	return m
 }
 
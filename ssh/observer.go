@@ -0,0 +1,61 @@
+package ssh
+
+// Observers set as SSHPiper.Observer implement any of PacketObserver,
+// RekeyObserver and AuthObserver, and are told of those events only. They
+// are called from the goroutines reading each leg and must not block.
+
+// PacketObserver is told of every packet piped once both legs are authed,
+// after PacketFilter, e.g. to count messages and bytes by type
+type PacketObserver interface {
+	// PacketPiped is called before the packet is written to the other
+	// side, size is its payload in bytes
+	PacketPiped(conn ConnMetadata, fromUpstream bool, msgType byte, size int)
+}
+
+// RekeyObserver is told of key exchanges after the handshake of each leg
+type RekeyObserver interface {
+	// Rekeyed is called once the new keys are in use, upstream tells the
+	// leg, algs are the ones agreed toward and from the peer of the leg
+	Rekeyed(conn ConnMetadata, upstream bool, algs Algorithms)
+}
+
+// AuthObserver is told of each auth attempt of downstream, as
+// DownstreamConfig's AuthLogCallback is
+type AuthObserver interface {
+	AuthAttempt(conn ConnMetadata, method string, err error)
+}
+
+// exported returns algs as seen from outside the package
+func (algs *algorithms) exported() Algorithms {
+	return Algorithms{
+		Kex:     algs.kex,
+		HostKey: algs.hostKey,
+		Write:   DirectionAlgorithms(algs.w),
+		Read:    DirectionAlgorithms(algs.r),
+	}
+}
+
+// logAuth tells AuthLogCallback and the AuthObserver, if any, of an auth
+// attempt
+func (piper *SSHPiper) logAuth(conn ConnMetadata, method string, err error) {
+	if authLog := piper.DownstreamConfig.AuthLogCallback; authLog != nil {
+		authLog(conn, method, err)
+	}
+
+	if o, ok := piper.Observer.(AuthObserver); ok {
+		o.AuthAttempt(conn, method, err)
+	}
+}
+
+// observeRekeys tells the RekeyObserver, if any, of key exchanges of t
+// from now on
+func (piper *SSHPiper) observeRekeys(conn ConnMetadata, t *handshakeTransport, upstream bool) {
+	o, ok := piper.Observer.(RekeyObserver)
+	if !ok {
+		return
+	}
+
+	t.onKex(func(algs *algorithms) {
+		o.Rekeyed(conn, upstream, algs.exported())
+	})
+}
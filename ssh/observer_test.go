@@ -0,0 +1,152 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+type testObserver struct {
+	mu      sync.Mutex
+	packets map[bool]int
+	rekeys  map[bool]int
+	auths   []error
+}
+
+func (o *testObserver) PacketPiped(conn ConnMetadata, fromUpstream bool, msgType byte, size int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.packets[fromUpstream]++
+}
+
+func (o *testObserver) Rekeyed(conn ConnMetadata, upstream bool, algs Algorithms) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.rekeys[upstream]++
+}
+
+func (o *testObserver) AuthAttempt(conn ConnMetadata, method string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.auths = append(o.auths, err)
+}
+
+// observedUpstream accepts password pw and answers global requests
+func observedUpstream(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			if string(password) != "pw" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(testSigners["ecdsa"])
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				conn, chans, reqs, err := NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				go func() {
+					for req := range reqs {
+						req.Reply(true, nil)
+					}
+				}()
+				for ch := range chans {
+					ch.Reject(Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestObserver(t *testing.T) {
+	up := observedUpstream(t)
+	defer up.Close()
+
+	o := &testObserver{packets: make(map[bool]int), rekeys: make(map[bool]int)}
+
+	piper := &SSHPiper{
+		FindUpstream: func(conn ConnMetadata) (net.Conn, *ClientConfig, error) {
+			c, err := net.Dial("tcp", up.Addr().String())
+			return c, &ClientConfig{User: conn.User()}, err
+		},
+		MapPublicKey: func(conn ConnMetadata, key PublicKey) (Signer, error) {
+			return nil, nil
+		},
+		Observer: o,
+	}
+	piper.DownstreamConfig.AddHostKey(testSigners["rsa"])
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		piper.Serve(c)
+	}()
+
+	config := &ClientConfig{
+		User: "alice",
+		Auth: []AuthMethod{PublicKeys(testSigners["ecdsa"]), Password("pw")},
+	}
+	// rekeys after a few requests
+	config.RekeyThreshold = minRekeyThreshold
+
+	client, err := Dial("tcp", l.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	payload := make([]byte, 200)
+	for i := 0; i < 8; i++ {
+		if _, _, err := client.SendRequest("test@sshpiper", true, payload); err != nil {
+			t.Fatalf("SendRequest: %v", err)
+		}
+	}
+
+	client.Close()
+	<-served
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.packets[false] < 8 || o.packets[true] < 8 {
+		t.Errorf("got %d packets to upstream and %d to downstream, want 8 each at least", o.packets[false], o.packets[true])
+	}
+
+	if o.rekeys[false] == 0 {
+		t.Errorf("no rekey of downstream observed")
+	}
+
+	if len(o.auths) != 2 || o.auths[0] == nil || o.auths[1] != nil {
+		t.Errorf("got auth attempts %v, want one failed then one passed", o.auths)
+	}
+}
@@ -0,0 +1,66 @@
+package ssh
+
+import (
+	"sync"
+)
+
+// pooledPacketSize is the capacity of the largest pooled buffers. It is
+// large enough to hold a full channel data packet (payload plus message
+// header), which is what almost all piped packets are.
+const pooledPacketSize = channelMaxPacket + 512
+
+// minPooledPacket is the smallest packet read into a pooled buffer,
+// smaller ones, e.g. window adjusts, are allocated at their size
+const minPooledPacket = 1024
+
+// packetClasses are the capacities of pooled buffers, a packet gets the
+// smallest which holds it, so a packet held on to, e.g. by a mux, pins at
+// most a few times its size
+var packetClasses = []int{4 << 10, 16 << 10, pooledPacketSize}
+
+// packetPools holds decrypted packet buffers of each class, so that
+// readPacket does not allocate a fresh buffer for every packet passing
+// through a pipe.
+var packetPools = func() []*sync.Pool {
+	pools := make([]*sync.Pool, len(packetClasses))
+	for i, size := range packetClasses {
+		size := size
+		pools[i] = &sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &b
+			},
+		}
+	}
+	return pools
+}()
+
+// getPacketBuffer returns a buffer of length n. buffers smaller than
+// minPooledPacket or larger than pooledPacketSize are allocated directly.
+func getPacketBuffer(n int) []byte {
+	if n < minPooledPacket || n > pooledPacketSize {
+		return make([]byte, n)
+	}
+
+	for i, size := range packetClasses {
+		if n <= size {
+			b := packetPools[i].Get().(*[]byte)
+			return (*b)[:n]
+		}
+	}
+
+	panic("unreachable")
+}
+
+// putPacketBuffer gives a buffer from getPacketBuffer back to the pool.
+// the caller must not touch p after, and must be sure no one else holds
+// a reference to it (e.g. a message Unmarshaled from p).
+func putPacketBuffer(p []byte) {
+	for i, size := range packetClasses {
+		if cap(p) == size {
+			p = p[:cap(p)]
+			packetPools[i].Put(&p)
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package ssh
+
+import (
+	"testing"
+)
+
+func TestPacketBufferSize(t *testing.T) {
+	for _, n := range []int{0, 1, 1024, pooledPacketSize, pooledPacketSize + 1, maxPacket} {
+		p := getPacketBuffer(n)
+		if len(p) != n {
+			t.Errorf("getPacketBuffer(%d) got len %d", n, len(p))
+		}
+		putPacketBuffer(p)
+	}
+}
+
+func TestPacketBufferClass(t *testing.T) {
+	for _, tt := range []struct {
+		n, cap int
+	}{
+		{1, 1},
+		{minPooledPacket - 1, minPooledPacket - 1},
+		{minPooledPacket, 4 << 10},
+		{4<<10 + 1, 16 << 10},
+		{channelMaxPacket, pooledPacketSize},
+		{pooledPacketSize + 1, pooledPacketSize + 1},
+	} {
+		p := getPacketBuffer(tt.n)
+		if cap(p) != tt.cap {
+			t.Errorf("getPacketBuffer(%d) got cap %d, want %d", tt.n, cap(p), tt.cap)
+		}
+		putPacketBuffer(p)
+	}
+}
+
+func TestPutPacketBufferIgnoresForeign(t *testing.T) {
+	// must not panic nor hand out a short buffer later
+	putPacketBuffer(make([]byte, 10))
+	putPacketBuffer(nil)
+
+	p := getPacketBuffer(pooledPacketSize)
+	if len(p) != pooledPacketSize {
+		t.Fatalf("got len %d, want %d", len(p), pooledPacketSize)
+	}
+}
+
+func BenchmarkPacketBuffer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		putPacketBuffer(getPacketBuffer(channelMaxPacket))
+	}
+}
@@ -0,0 +1,79 @@
+package ssh
+
+import (
+	"time"
+)
+
+// RateLimit bounds the bytes piped each way of a connection, see
+// SSHPiper.RateLimit
+type RateLimit struct {
+	// Rate is the sustained bytes per second each way, 0 or negative for
+	// no bound
+	Rate int64
+
+	// Burst is the bytes which may pass at once after the pipe was idle, 0
+	// for one second of Rate. A packet larger passes after a longer wait.
+	Burst int64
+}
+
+// rateLimiter is a token bucket of bytes, for one direction of a pipe, so
+// it is used by one goroutine only
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil if l has no bound
+func newRateLimiter(l RateLimit) *rateLimiter {
+	if l.Rate <= 0 {
+		return nil
+	}
+
+	burst := l.Burst
+	if burst <= 0 {
+		burst = l.Rate
+	}
+
+	return &rateLimiter{
+		rate:   float64(l.Rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// take takes n bytes at now and returns how long to wait before they may
+// pass
+func (r *rateLimiter) take(n int, now time.Time) time.Duration {
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+	}
+	r.last = now
+
+	r.tokens -= float64(n)
+	if r.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// wait blocks until n bytes may pass or done is closed
+func (r *rateLimiter) wait(n int, done <-chan struct{}) {
+	d := r.take(n, time.Now())
+	if d <= 0 {
+		return
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-done:
+	}
+}
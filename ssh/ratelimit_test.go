@@ -0,0 +1,39 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(RateLimit{}) != nil {
+		t.Errorf("limiter without a rate")
+	}
+
+	r := newRateLimiter(RateLimit{Rate: 1000, Burst: 2000})
+	now := time.Unix(1e9, 0)
+
+	// the burst passes at once
+	if d := r.take(2000, now); d != 0 {
+		t.Errorf("burst waits %v", d)
+	}
+
+	// then the rate
+	if d := r.take(500, now); d != 500*time.Millisecond {
+		t.Errorf("after the burst waits %v, want 500ms", d)
+	}
+
+	// refilled while idle, never beyond the burst
+	now = now.Add(time.Hour)
+	if d := r.take(2000, now); d != 0 {
+		t.Errorf("after idle waits %v", d)
+	}
+	if d := r.take(1000, now); d != time.Second {
+		t.Errorf("beyond the burst waits %v, want 1s", d)
+	}
+
+	// one second of rate by default
+	if r := newRateLimiter(RateLimit{Rate: 1000}); r.burst != 1000 {
+		t.Errorf("default burst %v", r.burst)
+	}
+}
@@ -138,11 +138,17 @@ func NewServerConn(c net.Conn, config *ServerConfig) (*ServerConn, <-chan NewCha
 	s := &connection{
 		sshConn: sshConn{conn: c},
 	}
-	perms, err := s.serverHandshake(&fullConf)
+	_, err := s.serverHandshake(&fullConf)
 	if err != nil {
 		c.Close()
 		return nil, nil, nil, err
 	}
+	perms, err := s.serverAuthenticate(&fullConf)
+	if err != nil {
+		c.Close()
+		return nil, nil, nil, err
+	}
+	go s.mux.loop()
 	return &ServerConn{s, perms}, s.mux.incomingChannels, s.mux.incomingRequests, nil
 }
 
@@ -202,12 +208,9 @@ func (s *connection) serverHandshake(config *ServerConfig) (*Permissions, error)
 		return nil, err
 	}
 
-	//perms, err := s.serverAuthenticate(config)
-	//if err != nil {
-	//	return nil, err
-	//}
+	// auth is not part of the handshake, the piper relays it to upstream.
+	// NewServerConn calls serverAuthenticate itself.
 	s.mux = newMux(s.transport)
-	//return perms, err
 	return nil, nil
 }
 
@@ -3,157 +3,1141 @@ package ssh
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type SSHPiper struct {
+	// DownstreamConfig's AuthLogCallback, if not nil, is called for each
+	// auth attempt of downstream, once upstream or the piper answered it.
 	DownstreamConfig ServerConfig
 
+	// AdditionalChallenge, if not nil, is asked of downstream before
+	// upstream auth, with DialAfterAuth once downstream is verified. conn
+	// implements UpstreamWaiter and VerifiedConn.
 	AdditionalChallenge func(conn ConnMetadata, client KeyboardInteractiveChallenge) (bool, error)
-	FindUpstream        func(conn ConnMetadata) (net.Conn, *ClientConfig, error)
-	MapPublicKey        func(conn ConnMetadata, key PublicKey) (Signer, error)
+
+	FindUpstream func(conn ConnMetadata) (net.Conn, *ClientConfig, error)
+	MapPublicKey func(conn ConnMetadata, key PublicKey) (Signer, error)
+
+	// MapHostbased, if not nil, relays hostbased auth. It is called once
+	// downstream's signature verifies, with the host key it signed with and
+	// the client host and user it claims. The claimed host is not checked
+	// against the address of conn, that is up to MapHostbased. The signer
+	// and client host returned sign again toward upstream, nil signer for
+	// none auth.
+	MapHostbased func(conn ConnMetadata, hostKey PublicKey, clientHost, clientUser string) (Signer, string, error)
+
+	// AuthMethods, if not nil, returns the auth methods listed to
+	// downstream in auth failures, in order, given the ones upstream lists.
+	// Methods upstream does not list are dropped, whatever is returned.
+	AuthMethods func(conn ConnMetadata, upstreamMethods []string) []string
+
+	// UpstreamAuth, if not nil, returns the methods relayed to upstream once
+	// it is dialed, in the order tried. "certificate" is publickey with a
+	// certificate signer from MapPublicKey, "publickey" with the key it
+	// certifies or a plain signer. Other methods downstream sends are
+	// replaced with none and not listed to downstream. nil relays every
+	// method as downstream sends it, certificates before their keys.
+	UpstreamAuth func(conn ConnMetadata) []string
+
+	// PasswordPrompt, if not nil, returns the prompt keyboard-interactive
+	// auth from downstream is answered with, the answer is relayed to
+	// upstream as password auth. Downstream is listed keyboard-interactive
+	// wherever upstream lists password. Empty relays keyboard-interactive
+	// as is.
+	PasswordPrompt func(conn ConnMetadata) string
+
+	// VerifyPassword, if not nil, checks password auth from downstream in
+	// the piper. The signer returned logs in upstream with publickey in
+	// place of the password, nil signer relays the password as is. An error
+	// fails the attempt. Downstream is listed password wherever upstream
+	// lists publickey.
+	VerifyPassword func(conn ConnMetadata, password []byte) (Signer, error)
+
+	// DialAfterAuth, if true, calls FindUpstream only once downstream is
+	// verified by the piper, it signed with a key MapPublicKey maps, or
+	// VerifyPassword returned a signer for its password, and passed
+	// AdditionalChallenge after. Until then downstream is offered those methods only and
+	// answered without upstream, so peers which are not verified never
+	// make the piper dial out. Passwords relayed as is are checked by
+	// upstream, they cannot verify downstream.
+	DialAfterAuth bool
+
+	// ChallengeNeeded, if not nil, tells whether conn has to pass
+	// AdditionalChallenge, nil for every conn.
+	ChallengeNeeded func(conn ConnMetadata) bool
+
+	// LoginGraceTime, if not zero, is the time allowed from accepting a
+	// connection until both legs are authed, like OpenSSH's LoginGraceTime.
+	// stalled peers are disconnected after.
+	LoginGraceTime time.Duration
+
+	// Timeouts bound each stage before PhasePiping on its own.
+	Timeouts Timeouts
+
+	// PhaseHook, if not nil, is called when conn enters a new PipePhase.
+	PhaseHook func(conn net.Conn, phase PipePhase)
+
+	// AuthStateHook, if not nil, is called when upstream auth of conn
+	// enters a new AuthState, with the type of the packet which led there,
+	// e.g. to trace auth with clients or servers which do not interop.
+	AuthStateHook func(conn ConnMetadata, state AuthState, msgType byte)
+
+	// ErrorMessage, if not nil, returns the text sent to downstream in a
+	// disconnect message when Serve fails during auth, empty to just close.
+	ErrorMessage func(conn ConnMetadata, err error) string
+
+	// Banner, if not empty, is sent to downstream when auth starts, see
+	// RFC 4252 section 5.4.
+	Banner string
+
+	// PacketFilter, if not nil, is called right before a connection enters
+	// PhasePiping and the filter returned sees every packet piped on it.
+	PacketFilter func(conn PipeConn) PacketFilter
+
+	// RateLimit, if not nil, is called right before a connection enters
+	// PhasePiping, packets piped on it are held back to keep each way
+	// within the limit returned. Packet filters see them before.
+	RateLimit func(conn ConnMetadata) RateLimit
+
+	// Observer, if not nil, is told of packets piped, rekeys and auth
+	// attempts of every connection, by the ones of PacketObserver,
+	// RekeyObserver and AuthObserver it implements, e.g. for metrics
+	// without wrapping net.Conn.
+	Observer interface{}
+
+	// AnomalyHook, if not nil, is called for each Anomaly of a peer. An
+	// error ends the connection, Serve returns it, nil drops the packet
+	// or pipes it as the Anomaly's kind tells. Without a hook nothing is
+	// checked.
+	AnomalyHook func(conn ConnMetadata, a Anomaly) error
+}
+
+// ErrAdditionalChallengeFailed is returned by Serve when downstream failed
+// AdditionalChallenge
+var ErrAdditionalChallengeFailed = errors.New("additional challenge failed")
+
+// UpstreamError is returned by Serve when the handshake with upstream failed
+type UpstreamError struct {
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return "upstream: " + e.Err.Error()
+}
+
+// UpstreamClosedError is returned by Serve when upstream ended a pipe
+// without disconnecting, e.g. its sshd or host died mid-session. Downstream
+// is sent ErrorMessage of it, a disconnect from upstream is piped as is.
+type UpstreamClosedError struct {
+	Addr string
+	// what reading from upstream failed with, io.EOF once it closed
+	Err error
+}
+
+func (e *UpstreamClosedError) Error() string {
+	return fmt.Sprintf("upstream %v closed the connection: %v", e.Addr, e.Err)
+}
+
+// Timeouts bound stages of a connection until both legs are authed, zero
+// for no bound of its own. LoginGraceTime still bounds them all.
+type Timeouts struct {
+	// version and key exchange of downstream
+	DownstreamKex time.Duration
+
+	// from downstream's key exchange until its first auth request
+	FirstAuth time.Duration
+
+	// AdditionalChallenge, from downstream asking keyboard-interactive
+	Challenge time.Duration
+
+	// FindUpstream, the provider finding and dialing the upstream
+	FindUpstream time.Duration
+
+	// version and key exchange of upstream
+	UpstreamKex time.Duration
+
+	// auth relayed to upstream, until both legs are authed
+	UpstreamAuth time.Duration
+}
+
+// TimeoutError is a stage which took longer than its timeout or what was
+// left of LoginGraceTime
+type TimeoutError struct {
+	Stage string
+	After time.Duration
+
+	// LoginGraceTime expired, not the stage's timeout
+	LoginGrace bool
+
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	limit := e.After.String()
+	if e.LoginGrace {
+		limit = "login grace time " + limit
+	}
+	return fmt.Sprintf("ssh: %v timed out after %v: %v", e.Stage, limit, e.Err)
+}
+
+// stage is the deadline of one stage, the earlier of its timeout and the
+// login grace deadline
+type stage struct {
+	name     string
+	timeout  time.Duration
+	grace    time.Duration
+	deadline time.Time
+
+	// the grace deadline is the earlier
+	byGrace bool
+}
+
+func (piper *SSHPiper) stage(name string, timeout time.Duration, grace time.Time) stage {
+	s := stage{name: name, timeout: timeout, grace: piper.LoginGraceTime, deadline: grace}
+
+	if timeout > 0 {
+		if d := time.Now().Add(timeout); grace.IsZero() || d.Before(grace) {
+			s.deadline = d
+			return s
+		}
+	}
+
+	s.byGrace = true
+	return s
+}
+
+// wrap reports err as the stage's timeout if a deadline expired
+func (s stage) wrap(err error) error {
+	if !isTimeout(err) {
+		return err
+	}
+
+	if s.byGrace {
+		return &TimeoutError{Stage: s.name, After: s.grace, LoginGrace: true, Err: err}
+	}
+	return &TimeoutError{Stage: s.name, After: s.timeout, Err: err}
+}
+
+func isTimeout(err error) bool {
+	if _, ok := err.(*TimeoutError); ok {
+		return true
+	}
+
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// HandshakeError is returned by Serve when downstream failed before key
+// exchange completed, e.g. a port scanner or a client of another protocol
+type HandshakeError struct {
+	// ClientVersion is the identification string downstream sent, nil if
+	// it sent none
+	ClientVersion []byte
+	Err           error
+}
+
+func (e *HandshakeError) Error() string {
+	return e.Err.Error()
+}
+
+// PacketFilter sees raw packets, message type first, piped after auth.
+// It returns p, a new packet or nil to drop it. p must not be used after
+// the call returns.
+type PacketFilter interface {
+	FromDownstream(p []byte) ([]byte, error)
+	FromUpstream(p []byte) ([]byte, error)
+}
+
+// PipeConn is a piped connection as seen by a PacketFilter, ConnMetadata is
+// the downstream's.
+type PipeConn interface {
+	ConnMetadata
+
+	// write a packet of the filter's own
+	WriteDownstream(p []byte) error
+	WriteUpstream(p []byte) error
+
+	// Done is closed when the pipe ends
+	Done() <-chan struct{}
+
+	// Close closes downstream, which ends the pipe
+	Close() error
+
+	// UpstreamIdentity is who the pipe talks to
+	UpstreamIdentity() UpstreamIdentity
+}
+
+// DirectionAlgorithms are the algorithms of one direction of a connection
+type DirectionAlgorithms struct {
+	Cipher      string
+	MAC         string
+	Compression string
+}
+
+// Algorithms are agreed by a key exchange, Write toward the peer and Read
+// from it
+type Algorithms struct {
+	Kex     string
+	HostKey string
+	Write   DirectionAlgorithms
+	Read    DirectionAlgorithms
+}
+
+// UpstreamIdentity is the upstream server as of its last key exchange
+type UpstreamIdentity struct {
+	// verified by ClientConfig.HostKeyCallback
+	HostKey       PublicKey
+	ServerVersion string
+	Algorithms    Algorithms
+}
+
+// PipePhase is the stage a connection served by SSHPiper is in
+type PipePhase int
+
+const (
+	// downstream key exchange
+	PhaseHandshake PipePhase = iota
+	// upstream dial and handshake, additional challenge and auth
+	PhaseAuth
+	// authed, packets are piped
+	PhasePiping
+	// Serve returned
+	PhaseClosed
+)
+
+func (p PipePhase) String() string {
+	switch p {
+	case PhaseHandshake:
+		return "handshake"
+	case PhaseAuth:
+		return "auth"
+	case PhasePiping:
+		return "piping"
+	case PhaseClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("phase(%d)", int(p))
+}
+
+func (piper *SSHPiper) enterPhase(conn net.Conn, phase PipePhase) {
+	if piper.PhaseHook != nil {
+		piper.PhaseHook(conn, phase)
+	}
 }
 
 type upstream struct{ *connection }
-type downstream struct{ *connection }
+type downstream struct {
+	*connection
+
+	keysMu  sync.Mutex
+	offered []OfferedKey
+
+	// closed once the upstream dialed along the challenge is up or failed
+	// with dialErr, nil while nothing is dialed
+	dialed  chan struct{}
+	dialErr error
+
+	// the signer VerifyPassword returned for the password which verified
+	// downstream before the dial, see DialAfterAuth, used once
+	passwordSigner Signer
+
+	// downstream was verified by the piper, see DialAfterAuth
+	verified bool
+
+	// AnomalyHook for the conn, anomalies of either leg go through it
+	anomaly func(a Anomaly) error
+}
+
+// OfferedKey is a public key downstream offered in a publickey auth msg
+type OfferedKey struct {
+	Key PublicKey
+
+	// Signed is true if downstream signed with the key, false if it only
+	// asked whether the key is accepted
+	Signed bool
+
+	// Accepted is true if auth passed with the key
+	Accepted bool
+}
+
+// KeyOffers is implemented by the ConnMetadata SSHPiper passes to its
+// callbacks and hooks, e.g. for routing by the key which passed auth or to
+// audit keys which did not
+type KeyOffers interface {
+	// OfferedKeys returns the keys downstream offered so far, one per
+	// publickey auth msg, in order. A key is usually asked about first and
+	// then signed with, in two msgs.
+	OfferedKeys() []OfferedKey
+}
+
+func (d *downstream) OfferedKeys() []OfferedKey {
+	d.keysMu.Lock()
+	defer d.keysMu.Unlock()
+
+	return append([]OfferedKey(nil), d.offered...)
+}
+
+// UpstreamWaiter is implemented by the ConnMetadata SSHPiper passes to
+// AdditionalChallenge, e.g. for a challenge telling the user why the login
+// cannot pass rather than asking for a code in vain
+type UpstreamWaiter interface {
+	// WaitUpstream waits for the upstream dialed along the challenge to be
+	// found, dialed and its handshake done, and returns the error. nil once
+	// it is up or if nothing is dialed before the challenge, see
+	// DialAfterAuth.
+	WaitUpstream() error
+}
+
+func (d *downstream) WaitUpstream() error {
+	if d.dialed == nil {
+		return nil
+	}
+
+	<-d.dialed
+	return d.dialErr
+}
+
+// VerifiedConn is implemented by the ConnMetadata SSHPiper passes to
+// AdditionalChallenge, e.g. for a challenge which must not act on a user
+// name anyone may send
+type VerifiedConn interface {
+	// Verified tells whether the piper verified downstream before the
+	// challenge, see DialAfterAuth
+	Verified() bool
+}
+
+func (d *downstream) Verified() bool {
+	return d.verified
+}
+
+func (d *downstream) offerKey(key PublicKey, signed bool) {
+	d.keysMu.Lock()
+	defer d.keysMu.Unlock()
+
+	d.offered = append(d.offered, OfferedKey{Key: key, Signed: signed})
+}
+
+// acceptLastKey marks the key offered last as the one auth passed with
+func (d *downstream) acceptLastKey() {
+	d.keysMu.Lock()
+	defer d.keysMu.Unlock()
+
+	if len(d.offered) > 0 {
+		d.offered[len(d.offered)-1].Accepted = true
+	}
+}
 
 type pipedConn struct {
 	upstream   *upstream
 	downstream *downstream
 
 	processAuthMsg func(msg *userAuthRequestMsg) (*userAuthRequestMsg, error)
+
+	// authMethods, if not nil, rewrites methods in auth failures
+	authMethods func(methods []string) []string
+
+	filter    PacketFilter
+	rateLimit RateLimit
+	done      chan struct{}
+
+	// called when upstream ended the pipe with an UpstreamClosedError
+	upstreamClosed func(err error)
+
+	// redial, if not nil, connects upstream again, once
+	redial func() (*upstream, error)
+
+	// authLog, if not nil, is called with downstream's method and the
+	// result of each auth attempt upstream answered
+	authLog func(method string, err error)
+
+	// passwordPrompt, if not empty, bridges keyboard-interactive from
+	// downstream to password toward upstream
+	passwordPrompt string
+
+	// verifiesPassword is true if VerifyPassword checks password auth,
+	// downstream is listed password wherever upstream lists publickey
+	verifiesPassword bool
+
+	// authState, if not nil, is called when auth enters a state
+	authState func(state AuthState, msgType byte)
+
+	// onUpstream, if not nil, is called with each upstream of the pipe,
+	// a redialed one too
+	onUpstream func(u *upstream)
+
+	// piped, if not nil, is called for each packet piped before it is
+	// written to the other side
+	piped func(fromUpstream bool, msgType byte, size int)
+
+	// upstream's answers to publickey queries during auth
+	queries keyQueries
+
+	// upstream banners relayed during auth
+	banners int
+}
+
+type pipeConn struct {
+	*downstream
+	pipe *pipedConn
+}
+
+func (c pipeConn) WriteDownstream(p []byte) error {
+	return c.pipe.downstream.mux.conn.writePacket(p)
+}
+
+func (c pipeConn) WriteUpstream(p []byte) error {
+	return c.pipe.upstream.mux.conn.writePacket(p)
+}
+
+func (c pipeConn) Done() <-chan struct{} {
+	return c.pipe.done
+}
+
+func (c pipeConn) Close() error {
+	return c.pipe.downstream.Close()
+}
+
+func (c pipeConn) UpstreamIdentity() UpstreamIdentity {
+	u := c.pipe.upstream
+	algs, key := u.transport.agreed()
+
+	id := UpstreamIdentity{
+		HostKey:       key,
+		ServerVersion: string(u.ServerVersion()),
+	}
+
+	if algs != nil {
+		id.Algorithms = algs.exported()
+	}
+
+	return id
 }
 
 func (piper *SSHPiper) Serve(conn net.Conn) error {
 
+	piper.enterPhase(conn, PhaseHandshake)
+	defer piper.enterPhase(conn, PhaseClosed)
+
+	// no deadline if zero
+	var deadline time.Time
+	if piper.LoginGraceTime > 0 {
+		deadline = time.Now().Add(piper.LoginGraceTime)
+	}
+
+	kex := piper.stage("downstream kex", piper.Timeouts.DownstreamKex, deadline)
+	conn.SetDeadline(kex.deadline)
+
 	d, err := newDownstream(conn, &piper.DownstreamConfig)
 	if err != nil {
+		if he, ok := err.(*HandshakeError); ok {
+			he.Err = kex.wrap(he.Err)
+		}
 		return err
 	}
 
 	defer d.Close()
 
+	piper.observeRekeys(d, d.transport, false)
+	if piper.AnomalyHook != nil {
+		d.anomaly = func(a Anomaly) error {
+			return piper.AnomalyHook(d, a)
+		}
+	}
+	piper.enterPhase(conn, PhaseAuth)
+
+	firstAuth := piper.stage("first auth", piper.Timeouts.FirstAuth, deadline)
+	conn.SetDeadline(firstAuth.deadline)
+
 	userAuthReq, err := d.nextAuthMsg()
 	if err != nil {
-		return err
+		return firstAuth.wrap(err)
 	}
 
+	conn.SetDeadline(deadline)
+
 	d.user = userAuthReq.User
 
-	// need additional challenge
-	if piper.AdditionalChallenge != nil {
+	if piper.Banner != "" {
+		if err := d.transport.writePacket(Marshal(&userAuthBannerMsg{Message: piper.Banner})); err != nil {
+			return err
+		}
+	}
+
+	// an upstream dropped before auth completes is redialed once, either
+	// here or during auth
+	redialed := false
+
+	upc := make(chan upstreamResult, 1)
+	dial := func() {
+		dialed := make(chan struct{})
+		d.dialed = dialed
+
+		go func() {
+			u, dropped, err := piper.connectUpstream(d, deadline)
+			if dropped {
+				redialed = true
+				u, _, err = piper.connectUpstream(d, deadline)
+			}
+
+			d.dialErr = err
+			close(dialed)
+
+			upc <- upstreamResult{u, err}
+		}()
+	}
+
+	if piper.DialAfterAuth {
+		// the signed msg is relayed as the first one, challenged after
+		if userAuthReq, err = piper.verifyDownstream(d, userAuthReq); err != nil {
+			piper.reportError(d, err)
+			return err
+		}
+		d.verified = true
+	} else {
+		// dial upstream while the additional challenge is going on
+		dial()
+	}
+
+	if piper.AdditionalChallenge != nil && (piper.ChallengeNeeded == nil || piper.ChallengeNeeded(d)) {
+		challenge := piper.stage("challenge", piper.Timeouts.Challenge, deadline)
+		conn.SetDeadline(challenge.deadline)
+
+		err := piper.additionalChallenge(d)
+		if err != nil {
+			err = challenge.wrap(err)
+			if !piper.DialAfterAuth {
+				go discardUpstream(upc)
+			}
+			piper.reportError(d, err)
+			return err
+		}
+
+		conn.SetDeadline(deadline)
+	}
+
+	if piper.DialAfterAuth {
+		dial()
+	}
+
+	r := <-upc
+	if r.err != nil {
+		piper.reportError(d, r.err)
+		return r.err
+	}
+
+	p := &pipedConn{
+		upstream:   r.u,
+		downstream: d,
+		onUpstream: func(u *upstream) {
+			piper.observeRekeys(d, u.transport, true)
+		},
+	}
+	p.onUpstream(r.u)
+
+	if piper.AuthMethods != nil {
+		p.authMethods = func(methods []string) []string {
+			return piper.AuthMethods(d, methods)
+		}
+	}
+	defer func() { p.upstream.Close() }()
+
+	var authOrder []string
+	if piper.UpstreamAuth != nil {
+		authOrder = piper.UpstreamAuth(d)
+	}
+
+	if authOrder != nil {
+		authMethods := p.authMethods
+		p.authMethods = func(methods []string) []string {
+			if authMethods != nil {
+				methods = authMethods(methods)
+			}
+
+			var relayed []string
+			for _, m := range methods {
+				if relaysMethod(authOrder, m) {
+					relayed = append(relayed, m)
+				}
+			}
+			return relayed
+		}
+	}
+
+	if _, ok := piper.Observer.(AuthObserver); ok || piper.DownstreamConfig.AuthLogCallback != nil {
+		p.authLog = func(method string, err error) {
+			piper.logAuth(d, method, err)
+		}
+	}
+
+	if piper.PasswordPrompt != nil {
+		p.passwordPrompt = piper.PasswordPrompt(d)
+	}
+
+	if piper.AuthStateHook != nil {
+		p.authState = func(state AuthState, msgType byte) {
+			piper.AuthStateHook(d, state, msgType)
+		}
+	}
+
+	if piper.VerifyPassword != nil {
+		authMethods := p.authMethods
+		p.verifiesPassword = true
+		p.authMethods = func(methods []string) []string {
+			if authMethods != nil {
+				methods = authMethods(methods)
+			}
+
+			return withPassword(methods)
+		}
+	}
+
+	if p.passwordPrompt != "" {
+		authMethods := p.authMethods
+		p.authMethods = func(methods []string) []string {
+			if authMethods != nil {
+				methods = authMethods(methods)
+			}
+
+			return withKeyboardInteractive(methods)
+		}
+	}
+
+	if !redialed {
+		p.redial = func() (*upstream, error) {
+			u, _, err := piper.connectUpstream(d, deadline)
+			return u, err
+		}
+	}
+
+	p.processAuthMsg = func(msg *userAuthRequestMsg) (*userAuthRequestMsg, error) {
+
+		order := authOrder
+		if order == nil {
+			order = []string{"certificate", "publickey"}
+		}
+
+		if msg.Method == "password" && piper.VerifyPassword != nil {
+			signer, ok := d.passwordSigner, true
+			d.passwordSigner = nil
+			if signer == nil {
+				signer, ok = piper.verifyPassword(d, msg)
+			}
+
+			if !ok {
+				return noneAuthMsg(msg.User), nil
+			}
+
+			// verified, logs in with the key
+			if signer != nil {
+				signer, err := p.pickSigner(upstreamSigners(signer, order))
+				if err != nil || signer == nil {
+					return noneAuthMsg(msg.User), err
+				}
+
+				return p.signAgain(msg, signer, nil)
+			}
+		}
+
+		if authOrder != nil && !relaysMethod(authOrder, msg.Method) {
+			return noneAuthMsg(msg.User), nil
+		}
+
+		if msg.Method == "hostbased" && piper.MapHostbased != nil {
+			return p.relayHostbased(msg, func(hostKey PublicKey, clientHost, clientUser string) (Signer, string, error) {
+				return piper.MapHostbased(d, hostKey, clientHost, clientUser)
+			})
+		}
+
+		// only public msg need
+		if msg.Method != "publickey" {
+			return msg, nil
+		}
+
+		user := msg.User
+		// pubKey MAP
+		downKey, isQuery, sig, err := parsePublicKeyMsg(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := piper.MapPublicKey(d, downKey)
+
+		// no mapped user change it to none or error occur
+		if err != nil || signer == nil {
+			return noneAuthMsg(user), nil
+		}
+
+		signer, err = p.pickSigner(upstreamSigners(signer, order))
+		if err != nil {
+			return nil, err
+		}
+
+		if signer == nil {
+			return noneAuthMsg(user), nil
+		}
+
+		upKey := signer.PublicKey()
+
+		if isQuery {
+			// reply for query msg
+			msg, err = p.validAndAck(upKey, downKey)
+		} else {
+
+			ok, err := p.downstream.checkPublicKey(msg, downKey, sig)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if !ok {
+				return noneAuthMsg(user), nil
+			}
+
+			msg, err = p.signAgain(msg, signer, downKey)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return msg, nil
+	}
 
-		for {
-			err := d.transport.writePacket(Marshal(&userAuthFailureMsg{
-				Methods: []string{"keyboard-interactive"},
-			}))
+	auth := piper.stage("upstream auth", piper.Timeouts.UpstreamAuth, deadline)
+	conn.SetDeadline(auth.deadline)
+	p.upstream.sshConn.conn.SetDeadline(auth.deadline)
+
+	err = p.pipeAuth(userAuthReq)
+	if err != nil {
+		err = auth.wrap(err)
+		piper.reportError(d, err)
+		return err
+	}
+
+	// authed, no deadline from now on
+	d.sshConn.conn.SetDeadline(time.Time{})
+	p.upstream.sshConn.conn.SetDeadline(time.Time{})
+
+	p.done = make(chan struct{})
+
+	if piper.PacketFilter != nil {
+		p.filter = piper.PacketFilter(pipeConn{d, p})
+	}
+
+	if piper.RateLimit != nil {
+		p.rateLimit = piper.RateLimit(d)
+	}
+
+	if o, ok := piper.Observer.(PacketObserver); ok {
+		p.piped = func(fromUpstream bool, msgType byte, size int) {
+			o.PacketPiped(d, fromUpstream, msgType, size)
+		}
+	}
+
+	p.upstreamClosed = func(err error) {
+		piper.reportError(d, err)
+	}
+
+	piper.enterPhase(conn, PhasePiping)
+
+	// block until connection closed or errors occur
+	return p.loop()
+}
+
+type upstreamResult struct {
+	u   *upstream
+	err error
+}
+
+// connectUpstream dials and handshakes upstream. dropped is true if the
+// connection was dialed but closed by a network error during handshake.
+func (piper *SSHPiper) connectUpstream(d *downstream, deadline time.Time) (u *upstream, dropped bool, err error) {
+	upconn, upconfig, err := piper.findUpstream(d, deadline)
+	if err != nil {
+		return nil, false, err
+	}
+
+	kex := piper.stage("upstream kex", piper.Timeouts.UpstreamKex, deadline)
+	upconn.SetDeadline(kex.deadline)
+
+	addr := upconn.RemoteAddr().String()
+
+	u, err = newUpstream(upconn, addr, upconfig, d.transport.budget)
+	if err != nil {
+		return nil, isDropped(err), &UpstreamError{kex.wrap(err)}
+	}
+
+	upconn.SetDeadline(deadline)
+
+	// upstream user is the same as downstream unless mapped by FindUpstream
+	u.user = upconfig.User
+	if u.user == "" {
+		u.user = d.User()
+	}
+
+	return u, false, nil
+}
+
+// findUpstream calls FindUpstream bounded by its stage, FindUpstream cannot
+// be canceled, a conn it returns too late is closed
+func (piper *SSHPiper) findUpstream(d *downstream, deadline time.Time) (net.Conn, *ClientConfig, error) {
+	s := piper.stage("find upstream", piper.Timeouts.FindUpstream, deadline)
+	if s.deadline.IsZero() {
+		return piper.FindUpstream(d)
+	}
+
+	type found struct {
+		conn   net.Conn
+		config *ClientConfig
+		err    error
+	}
+
+	c := make(chan found, 1)
+	go func() {
+		conn, config, err := piper.FindUpstream(d)
+		c <- found{conn, config, err}
+	}()
+
+	timer := time.NewTimer(time.Until(s.deadline))
+	defer timer.Stop()
+
+	select {
+	case f := <-c:
+		return f.conn, f.config, f.err
+	case <-timer.C:
+		go func() {
+			if f := <-c; f.err == nil {
+				f.conn.Close()
+			}
+		}()
+		return nil, nil, s.wrap(os.ErrDeadlineExceeded)
+	}
+}
+
+// isDropped reports whether err is a connection closed or reset by the
+// network, timeouts are not, they are deadlines expiring
+func isDropped(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	ne, ok := err.(net.Error)
+	return ok && !ne.Timeout()
+}
+
+// reportError tells downstream why it is disconnected, if ErrorMessage has
+// a message for err
+func (piper *SSHPiper) reportError(d *downstream, err error) {
+	if piper.ErrorMessage == nil {
+		return
+	}
+
+	if msg := piper.ErrorMessage(d, err); msg != "" {
+		d.transport.writePacket(Marshal(&disconnectMsg{
+			Reason:  11, // SSH_DISCONNECT_BY_APPLICATION
+			Message: msg,
+		}))
+	}
+}
+
+// discardUpstream closes the upstream once dialed, used when the downstream
+// is gone before the upstream is needed
+func discardUpstream(upc <-chan upstreamResult) {
+	if r := <-upc; r.u != nil {
+		r.u.Close()
+	}
+}
+
+func (piper *SSHPiper) additionalChallenge(d *downstream) error {
+	for {
+		// the verified request is answered by this, RFC 4252 section 5.1
+		err := d.transport.writePacket(Marshal(&userAuthFailureMsg{
+			Methods:        []string{"keyboard-interactive"},
+			PartialSuccess: d.verified,
+		}))
+
+		if err != nil {
+			return err
+		}
+
+		userAuthReq, err := d.nextAuthMsg()
+
+		if err != nil {
+			return err
+		}
+
+		if userAuthReq.Method == "keyboard-interactive" {
+			break
+		}
+	}
+
+	prompter := &sshClientKeyboardInteractive{d.connection}
+	ok, err := piper.AdditionalChallenge(d, prompter.Challenge)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrAdditionalChallengeFailed
+	}
+
+	return nil
+}
+
+// verifyDownstream answers auth msgs from msg on until downstream signs
+// with a key MapPublicKey maps, or sends a password VerifyPassword returns a
+// signer for, that msg is returned. Queries of mapped keys are accepted,
+// anything else fails listing publickey, and password with VerifyPassword.
+func (piper *SSHPiper) verifyDownstream(d *downstream, msg *userAuthRequestMsg) (*userAuthRequestMsg, error) {
+	methods := []string{"publickey"}
+	if piper.VerifyPassword != nil {
+		methods = append(methods, "password")
+	}
+
+	for {
+		var reply interface{} = &userAuthFailureMsg{
+			Methods: methods,
+		}
 
-			if err != nil {
-				return err
+		if msg.Method == "password" && piper.VerifyPassword != nil {
+			if signer, ok := piper.verifyPassword(d, msg); ok && signer != nil {
+				d.passwordSigner = signer
+				return msg, nil
 			}
+		}
 
-			userAuthReq, err := d.nextAuthMsg()
-
+		if msg.Method == "publickey" {
+			key, isQuery, sig, err := parsePublicKeyMsg(msg)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
-			if userAuthReq.Method == "keyboard-interactive" {
-				break
+			signer, err := piper.MapPublicKey(d, key)
+			switch {
+			case err != nil || signer == nil:
+			case isQuery:
+				reply = &userAuthPubKeyOkMsg{
+					Algo:   key.Type(),
+					PubKey: key.Marshal(),
+				}
+			default:
+				ok, err := d.checkPublicKey(msg, key, sig)
+				if err != nil {
+					return nil, err
+				}
+
+				if ok {
+					return msg, nil
+				}
 			}
 		}
 
-		prompter := &sshClientKeyboardInteractive{d.connection}
-		ok, err := piper.AdditionalChallenge(d, prompter.Challenge)
-
-		if err != nil {
-			return err
+		if _, failed := reply.(*userAuthFailureMsg); failed {
+			piper.logAuth(d, msg.Method, errNotVerified)
 		}
 
-		if !ok {
-			return fmt.Errorf("additional challenge failed")
+		if err := d.transport.writePacket(Marshal(reply)); err != nil {
+			return nil, err
 		}
-	}
 
-	upconn, upconfig, err := piper.FindUpstream(d)
-	if err != nil {
-		return err
+		var err error
+		if msg, err = d.nextAuthMsg(); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	addr := upconn.RemoteAddr().String()
-
-	u, err := newUpstream(upconn, addr, upconfig)
-	if err != nil {
-		return err
+// relaysMethod tells whether method is relayed to upstream in order
+func relaysMethod(order []string, method string) bool {
+	for _, m := range order {
+		if m == method || (m == "certificate" && method == "publickey") {
+			return true
+		}
 	}
-	defer u.Close()
+	return false
+}
 
-	p := &pipedConn{
-		upstream:   u,
-		downstream: d,
+// upstreamSigners returns the signers tried for signer in order, the
+// certificate and the key it certifies are tried apart
+func upstreamSigners(signer Signer, order []string) []Signer {
+	cert, isCert := signer.(*openSSHCertSigner)
+
+	var signers []Signer
+	for _, m := range order {
+		switch {
+		case m == "certificate" && isCert:
+			signers = append(signers, signer)
+		case m == "publickey" && isCert:
+			signers = append(signers, cert.signer)
+		case m == "publickey":
+			signers = append(signers, signer)
+		}
 	}
 
-	p.processAuthMsg = func(msg *userAuthRequestMsg) (*userAuthRequestMsg, error) {
+	return signers
+}
 
-		// only public msg need
-		if msg.Method != "publickey" {
-			return msg, nil
+// pickSigner returns the first of signers upstream accepts, asked with
+// queries without signatures, nil if none is accepted. A single signer is
+// returned without asking.
+func (pipe *pipedConn) pickSigner(signers []Signer) (Signer, error) {
+	if len(signers) < 2 {
+		if len(signers) == 0 {
+			return nil, nil
 		}
+		return signers[0], nil
+	}
 
-		user := msg.User
-		// pubKey MAP
-		downKey, isQuery, sig, err := parsePublicKeyMsg(msg)
+	for _, signer := range signers {
+		ok, err := pipe.queries.validate(signer.PublicKey(), pipe.upstream.User(), pipe.upstream.transport)
 		if err != nil {
 			return nil, err
 		}
 
-		signer, err := piper.MapPublicKey(d, downKey)
-
-		// no mapped user change it to none or error occur
-		if err != nil || signer == nil {
-			return noneAuthMsg(user), nil
+		if ok {
+			return signer, nil
 		}
+	}
 
-		upKey := signer.PublicKey()
-
-		if isQuery {
-			// reply for query msg
-			msg, err = p.validAndAck(upKey, downKey)
-		} else {
-
-			ok, err := p.checkPublicKey(msg, downKey, sig)
-
-			if err != nil {
-				return nil, err
-			}
-
-			if !ok {
-				return noneAuthMsg(user), nil
-			}
-
-			msg, err = p.signAgain(msg, signer, downKey)
-		}
+	return nil, nil
+}
 
-		if err != nil {
-			return nil, err
-		}
+// keyQueries caches whether upstream accepts a key for a user, so clients
+// probing many keys, mapped to few upstream keys, cost one round trip to
+// upstream per upstream key. It lives as long as the auth exchange.
+type keyQueries map[string]bool
 
-		return msg, nil
+// validate asks upstream over c whether it accepts key for user, once
+func (q *keyQueries) validate(key PublicKey, user string, c packetConn) (bool, error) {
+	id := user + "\x00" + string(key.Marshal())
+	if ok, cached := (*q)[id]; cached {
+		return ok, nil
 	}
 
-	err = p.pipeAuth(userAuthReq)
+	ok, err := validateKey(key, user, c)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	// block until connection closed or errors occur
-	return p.loop()
+	if *q == nil {
+		*q = make(keyQueries)
+	}
+	(*q)[id] = ok
+
+	return ok, nil
 }
 
 func (pipe *pipedConn) validAndAck(upKey, downKey PublicKey) (*userAuthRequestMsg, error) {
 
-	user := pipe.downstream.User()
-	ok, err := validateKey(upKey, user, pipe.upstream.transport)
+	user := pipe.upstream.User()
+	ok, err := pipe.queries.validate(upKey, user, pipe.upstream.transport)
 
 	if ok {
 		okMsg := userAuthPubKeyOkMsg{
@@ -171,12 +1155,12 @@ func (pipe *pipedConn) validAndAck(upKey, downKey PublicKey) (*userAuthRequestMs
 	return noneAuthMsg(user), nil
 }
 
-func (pipe *pipedConn) checkPublicKey(msg *userAuthRequestMsg, pubkey PublicKey, sig *Signature) (bool, error) {
+func (d *downstream) checkPublicKey(msg *userAuthRequestMsg, pubkey PublicKey, sig *Signature) (bool, error) {
 
 	if !isAcceptableAlgo(sig.Format) {
 		return false, nil
 	}
-	signedData := buildDataSignedForAuth(pipe.downstream.transport.getSessionID(), *msg, []byte(pubkey.Type()), pubkey.Marshal())
+	signedData := buildDataSignedForAuth(d.transport.getSessionID(), *msg, []byte(pubkey.Type()), pubkey.Marshal())
 
 	if err := pubkey.Verify(signedData, sig); err != nil {
 		return false, nil
@@ -187,7 +1171,7 @@ func (pipe *pipedConn) checkPublicKey(msg *userAuthRequestMsg, pubkey PublicKey,
 
 func (pipe *pipedConn) signAgain(msg *userAuthRequestMsg, signer Signer, downKey PublicKey) (*userAuthRequestMsg, error) {
 
-	user := pipe.downstream.User()
+	user := pipe.upstream.User()
 
 	rand := pipe.upstream.transport.config.Rand
 	session := pipe.upstream.transport.getSessionID()
@@ -224,6 +1208,161 @@ func (pipe *pipedConn) signAgain(msg *userAuthRequestMsg, signer Signer, downKey
 	return msg, nil
 }
 
+// userAuthBannerMsg is sent before auth completes, RFC 4252 section 5.4
+type userAuthBannerMsg struct {
+	Message  string `sshtype:"53"`
+	Language string
+}
+
+// hostbasedAuthMsg is the payload of a hostbased auth request, RFC 4252
+// section 9
+type hostbasedAuthMsg struct {
+	Algo       string
+	HostKey    []byte
+	ClientHost string
+	ClientUser string
+	Sig        []byte
+}
+
+func buildDataSignedForHostbased(sessionId []byte, user, service string, m *hostbasedAuthMsg) []byte {
+	data := struct {
+		Session    []byte
+		Type       byte
+		User       string
+		Service    string
+		Method     string
+		Algo       string
+		HostKey    []byte
+		ClientHost string
+		ClientUser string
+	}{
+		sessionId,
+		msgUserAuthRequest,
+		user,
+		service,
+		"hostbased",
+		m.Algo,
+		m.HostKey,
+		m.ClientHost,
+		m.ClientUser,
+	}
+	return Marshal(data)
+}
+
+// hostbasedSigFormat is the signature format and key type hostbased algo
+// algo asks for, empty if not accepted
+func hostbasedSigFormat(algo string) (format, keyType string) {
+	switch {
+	case algo == SigAlgoRSASHA2256, algo == SigAlgoRSASHA2512:
+		return algo, KeyAlgoRSA
+	case !isAcceptableAlgo(algo):
+		return "", ""
+	}
+
+	// certificates are signed with their key
+	for key, cert := range certAlgoNames {
+		if cert == algo {
+			return key, algo
+		}
+	}
+
+	return algo, algo
+}
+
+// verifyHostbased checks the signature of a hostbased auth request from
+// downstream, it returns the host key signed with
+func verifyHostbased(sessionId []byte, msg *userAuthRequestMsg) (*hostbasedAuthMsg, PublicKey, error) {
+	var m hostbasedAuthMsg
+	if err := Unmarshal(msg.Payload, &m); err != nil {
+		return nil, nil, err
+	}
+
+	format, keyType := hostbasedSigFormat(m.Algo)
+	if format == "" {
+		return nil, nil, fmt.Errorf("ssh: algorithm %q not accepted", m.Algo)
+	}
+
+	hostKey, err := ParsePublicKey(m.HostKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hostKey.Type() != keyType {
+		return nil, nil, fmt.Errorf("ssh: algorithm %q for host key type %q", m.Algo, hostKey.Type())
+	}
+
+	// the algo is signed too, a signature of another format must not pass
+	// for it
+	sig, rest, ok := parseSignatureBody(m.Sig)
+	if !ok || len(rest) > 0 || sig.Format != format {
+		return nil, nil, parseError(msgUserAuthRequest)
+	}
+
+	if err := hostKey.Verify(buildDataSignedForHostbased(sessionId, msg.User, msg.Service, &m), sig); err != nil {
+		return nil, nil, err
+	}
+
+	return &m, hostKey, nil
+}
+
+// signHostbased builds a hostbased auth request for upstream, rsa keys sign
+// with rsa-sha2-256, OpenSSH 8.8 on refuses ssh-rsa
+func signHostbased(sessionId []byte, user string, signer Signer, clientHost, clientUser string, rand io.Reader) (*userAuthRequestMsg, error) {
+	hostKey := signer.PublicKey()
+
+	m := &hostbasedAuthMsg{
+		Algo:       hostKey.Type(),
+		HostKey:    hostKey.Marshal(),
+		ClientHost: clientHost,
+		ClientUser: clientUser,
+	}
+
+	algoSigner, ok := signer.(AlgorithmSigner)
+	if ok && hostKey.Type() == KeyAlgoRSA {
+		m.Algo = SigAlgoRSASHA2256
+	}
+
+	data := buildDataSignedForHostbased(sessionId, user, serviceSSH, m)
+
+	var sig *Signature
+	var err error
+	if m.Algo != hostKey.Type() {
+		sig, err = algoSigner.SignWithAlgorithm(rand, data, m.Algo)
+	} else {
+		sig, err = signer.Sign(rand, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.Sig = Marshal(sig)
+
+	return &userAuthRequestMsg{
+		User:    user,
+		Service: serviceSSH,
+		Method:  "hostbased",
+		Payload: Marshal(m),
+	}, nil
+}
+
+// relayHostbased verifies a hostbased request from downstream and signs it
+// again with the host credential mapHostbased returns
+func (pipe *pipedConn) relayHostbased(msg *userAuthRequestMsg, mapHostbased func(hostKey PublicKey, clientHost, clientUser string) (Signer, string, error)) (*userAuthRequestMsg, error) {
+	user := pipe.upstream.User()
+
+	m, hostKey, err := verifyHostbased(pipe.downstream.transport.getSessionID(), msg)
+	if err != nil {
+		return noneAuthMsg(user), nil
+	}
+
+	signer, clientHost, err := mapHostbased(hostKey, m.ClientHost, m.ClientUser)
+	if err != nil || signer == nil {
+		return noneAuthMsg(user), nil
+	}
+
+	return signHostbased(pipe.upstream.transport.getSessionID(), user, signer, clientHost, m.ClientUser, pipe.upstream.transport.config.Rand)
+}
+
 func parsePublicKeyMsg(userAuthReq *userAuthRequestMsg) (PublicKey, bool, *Signature, error) {
 	if userAuthReq.Method != "publickey" {
 		return nil, false, nil, fmt.Errorf("not a publickey auth msg")
@@ -265,7 +1404,9 @@ func parsePublicKeyMsg(userAuthReq *userAuthRequestMsg) (PublicKey, bool, *Signa
 	return pubKey, isQuery, sig, nil
 }
 
-func piping(dst, src packetConn) error {
+// piping copies packets from src to dst through filter, held back by
+// limiter if not nil until done is closed
+func piping(dst, src packetConn, filter func(p []byte) ([]byte, error), limiter *rateLimiter, observe func(msgType byte, size int), done <-chan struct{}) error {
 	for {
 		p, err := src.readPacket()
 
@@ -273,7 +1414,33 @@ func piping(dst, src packetConn) error {
 			return err
 		}
 
-		err = dst.writePacket(p)
+		// each leg rekeys on its own, the transport marks a finished
+		// key exchange with this
+		if len(p) > 0 && p[0] == msgNewKeys {
+			putPacketBuffer(p)
+			continue
+		}
+
+		out := p
+		if filter != nil {
+			out, err = filter(p)
+			if err != nil {
+				return err
+			}
+		}
+
+		if out != nil {
+			if limiter != nil {
+				limiter.wait(len(out), done)
+			}
+			if observe != nil && len(out) > 0 {
+				observe(out[0], len(out))
+			}
+			err = dst.writePacket(out)
+		}
+
+		// p is consumed by writePacket and never referenced after
+		putPacketBuffer(p)
 
 		if err != nil {
 			return err
@@ -281,73 +1448,318 @@ func piping(dst, src packetConn) error {
 	}
 }
 
+// pipeReader notes how a side ended the pipe
+type pipeReader struct {
+	packetConn
+
+	// the side sent a disconnect msg, read by the other side's goroutine
+	disconnected int32
+	// reading failed with
+	err error
+
+	// the side is upstream
+	upstream bool
+	// anomaly, if not nil, is told of oversized packets the side sent
+	anomaly func(a Anomaly) error
+}
+
+func (r *pipeReader) readPacket() ([]byte, error) {
+	p, err := r.packetConn.readPacket()
+	if err != nil {
+		r.err = err
+		return nil, err
+	}
+
+	if len(p) > maxSanePayload && r.anomaly != nil {
+		if err := r.anomaly(Anomaly{Kind: AnomalyOversizedPacket, Upstream: r.upstream, MsgType: p[0], Size: len(p)}); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(p) > 0 && p[0] == msgDisconnect {
+		atomic.StoreInt32(&r.disconnected, 1)
+	}
+
+	return p, nil
+}
+
+func (r *pipeReader) hasDisconnected() bool {
+	return atomic.LoadInt32(&r.disconnected) != 0
+}
+
 func (pipe *pipedConn) loop() error {
-	c := make(chan error)
+	// the side closing second is not waited for
+	c := make(chan error, 2)
+
+	var fromDown, fromUp func(p []byte) ([]byte, error)
+	if pipe.filter != nil {
+		fromDown, fromUp = pipe.filter.FromDownstream, pipe.filter.FromUpstream
+	}
+
+	var toUp, toDown func(msgType byte, size int)
+	if pipe.piped != nil {
+		toUp = func(msgType byte, size int) { pipe.piped(false, msgType, size) }
+		toDown = func(msgType byte, size int) { pipe.piped(true, msgType, size) }
+	}
+
+	down := &pipeReader{packetConn: pipe.downstream.mux.conn, anomaly: pipe.downstream.anomaly}
+	up := &pipeReader{packetConn: pipe.upstream.mux.conn, upstream: true, anomaly: pipe.downstream.anomaly}
 
 	go func() {
-		c <- piping(pipe.upstream.mux.conn, pipe.downstream.mux.conn)
+		c <- piping(pipe.upstream.mux.conn, down, fromDown, newRateLimiter(pipe.rateLimit), toUp, pipe.done)
 	}()
 
 	go func() {
-		c <- piping(pipe.downstream.mux.conn, pipe.upstream.mux.conn)
+		err := piping(pipe.downstream.mux.conn, up, fromUp, newRateLimiter(pipe.rateLimit), toDown, pipe.done)
+
+		// upstream may close before downstream's read ends once downstream
+		// disconnected
+		if up.err != nil && !up.hasDisconnected() && !down.hasDisconnected() {
+			err = &UpstreamClosedError{Addr: pipe.upstream.RemoteAddr().String(), Err: up.err}
+		}
+
+		c <- err
 	}()
 
 	defer pipe.Close()
 
 	// wait until either connection closed
-	return <-c
+	err := <-c
+
+	// downstream is still there, tell it why
+	if _, ok := err.(*UpstreamClosedError); ok && pipe.upstreamClosed != nil {
+		pipe.upstreamClosed(err)
+	}
+
+	return err
 }
 
 func (pipe *pipedConn) Close() {
+	if pipe.done != nil {
+		close(pipe.done)
+	}
 	pipe.upstream.mux.conn.Close()
 	pipe.downstream.mux.conn.Close()
 }
 
-func (pipe *pipedConn) pipeAuth(initUserAuthMsg *userAuthRequestMsg) error {
-	err := pipe.upstream.sendAuthReq()
+// errRejectedByUpstream is passed to AuthLogCallback for auth failed upstream
+var errRejectedByUpstream = errors.New("ssh: rejected by upstream")
+
+// errNotVerified is passed to AuthLogCallback for auth failed before upstream
+// is dialed, see DialAfterAuth
+var errNotVerified = errors.New("ssh: not verified before dial")
+
+// verifyPassword calls VerifyPassword with the password in msg, ok is false
+// if it failed, msg is malformed or changes the password
+func (piper *SSHPiper) verifyPassword(d *downstream, msg *userAuthRequestMsg) (signer Signer, ok bool) {
+	// no change of password, see RFC 4252 section 8
+	if len(msg.Payload) == 0 || msg.Payload[0] != 0 {
+		return nil, false
+	}
+
+	password, _, ok := parseString(msg.Payload[1:])
+	if !ok {
+		return nil, false
+	}
+
+	signer, err := piper.VerifyPassword(d, password)
 	if err != nil {
-		return err
+		return nil, false
 	}
 
-	userAuthMsg := initUserAuthMsg
+	return signer, true
+}
 
-	for {
-		// hook msg
-		userAuthMsg, err = pipe.processAuthMsg(userAuthMsg)
+// SSH_MSG_USERAUTH_PASSWD_CHANGEREQ, upstream's reply to password auth
+// when the password expired
+const msgUserAuthPasswdChangeReq = 60
 
-		if err != nil {
-			return err
+// keyboardInteractivePassword asks downstream for the password with the
+// prompt and returns the password auth msg relaying the answer
+func (pipe *pipedConn) keyboardInteractivePassword(msg *userAuthRequestMsg) (*userAuthRequestMsg, error) {
+	prompter := &sshClientKeyboardInteractive{pipe.downstream.connection}
+	answers, err := prompter.Challenge(msg.User, "", []string{pipe.passwordPrompt}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+
+	// no change of password, see RFC 4252 section 8
+	payload := appendString([]byte{0}, answers[0])
+
+	return &userAuthRequestMsg{
+		User:    msg.User,
+		Service: msg.Service,
+		Method:  "password",
+		Payload: payload,
+	}, nil
+}
+
+// relayFailure rewrites the methods of upstream's auth failure with
+// authMethods. Only methods upstream lists are kept, keyboard-interactive
+// too if bridged to password, so downstream is told exactly which methods
+// may still succeed and falls back to the next one it has. Partial success
+// is relayed as is.
+func (pipe *pipedConn) relayFailure(packet []byte) ([]byte, error) {
+	var failure userAuthFailureMsg
+	if err := Unmarshal(packet, &failure); err != nil {
+		return nil, err
+	}
+
+	// hooks may reuse the slice
+	listed := append([]string(nil), failure.Methods...)
+	failure.Methods = remainingMethods(listed, pipe.authMethods(failure.Methods), pipe.passwordPrompt != "", pipe.verifiesPassword)
+
+	return Marshal(&failure), nil
+}
+
+// remainingMethods returns methods which upstream lists, each once, in the
+// order given. password counts as listed with publickey if verified by the
+// piper, keyboard-interactive with password if bridged.
+func remainingMethods(upstreamMethods, methods []string, bridged, verified bool) []string {
+	listed := make(map[string]bool)
+	for _, m := range upstreamMethods {
+		listed[m] = true
+	}
+
+	if verified && listed["publickey"] {
+		listed["password"] = true
+	}
+
+	if bridged && listed["password"] {
+		listed["keyboard-interactive"] = true
+	}
+
+	var remaining []string
+	for _, m := range methods {
+		if listed[m] {
+			remaining = append(remaining, m)
+			// once
+			listed[m] = false
 		}
+	}
 
-		// nil for ignore
-		if userAuthMsg != nil {
-			err = pipe.upstream.transport.writePacket(Marshal(userAuthMsg))
-			if err != nil {
-				return err
-			}
+	return remaining
+}
+
+// withPassword lists password after publickey if methods has publickey and
+// no password
+func withPassword(methods []string) []string {
+	at := -1
+	for i, m := range methods {
+		switch m {
+		case "password":
+			return methods
+		case "publickey":
+			at = i
+		}
+	}
+
+	if at < 0 {
+		return methods
+	}
+
+	with := append([]string(nil), methods[:at+1]...)
+	with = append(with, "password")
+	return append(with, methods[at+1:]...)
+}
+
+// withKeyboardInteractive lists keyboard-interactive after password if
+// methods has password only
+func withKeyboardInteractive(methods []string) []string {
+	hasPassword := false
+	for _, m := range methods {
+		switch m {
+		case "keyboard-interactive":
+			return methods
+		case "password":
+			hasPassword = true
+		}
+	}
+
+	if !hasPassword {
+		return methods
+	}
+
+	return append(methods, "keyboard-interactive")
+}
+
+// relayAuthMsg hooks msg and sends it upstream, returns upstream's reply, nil
+// if the hook ignores msg. msg is untouched, so it can be relayed again to a
+// redialed upstream.
+func (pipe *pipedConn) relayAuthMsg(msg *userAuthRequestMsg) ([]byte, error) {
+	m := *msg
+
+	userAuthMsg, err := pipe.processAuthMsg(&m)
+	if err != nil || userAuthMsg == nil {
+		return nil, err
+	}
+
+	userAuthMsg.User = pipe.upstream.User()
+
+	if err = pipe.upstream.transport.writePacket(Marshal(userAuthMsg)); err != nil {
+		return nil, err
+	}
+
+	return pipe.readAuthReply()
+}
+
+// relayPrompts relays banners of upstream to downstream, and with prompts
+// keyboard-interactive prompts as they are, prompt texts and echo flags
+// untouched, and the answers back, until upstream replies otherwise. next is
+// the auth request downstream sent instead of answers, which aborts the
+// prompts, RFC 4256 section 3.4. Prompts share their message number with
+// password change requests, which password auth relays as replies.
+func (pipe *pipedConn) relayPrompts(packet []byte, prompts bool) (reply []byte, next *userAuthRequestMsg, err error) {
+	for packet != nil && (packet[0] == msgUserAuthBanner || prompts && packet[0] == msgUserAuthInfoRequest) {
+		// writePacket consumes packet
+		msgType := packet[0]
+		if err := pipe.downstream.transport.writePacket(packet); err != nil {
+			return nil, nil, err
+		}
 
-			packet, err := pipe.upstream.transport.readPacket()
+		if msgType == msgUserAuthInfoRequest {
+			answers, err := pipe.downstream.readAuthPacket(msgUserAuthInfoResponse)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 
-			success := packet[0] == msgUserAuthSuccess
-
-			if err = pipe.downstream.transport.writePacket(packet); err != nil {
-				return err
+			if answers[0] != msgUserAuthInfoResponse {
+				next, err := pipe.downstream.parseAuthMsg(answers)
+				return nil, next, err
 			}
 
-			if success {
-				return nil
+			if err := pipe.upstream.transport.writePacket(answers); err != nil {
+				return nil, nil, err
 			}
 		}
 
-		userAuthMsg, err = pipe.downstream.nextAuthMsg()
-		if err != nil {
-			return err
+		if packet, err = pipe.readAuthReply(); err != nil {
+			return nil, nil, err
 		}
+	}
+
+	return packet, nil, nil
+}
+
+// reconnect replaces the upstream with a redialed one
+func (pipe *pipedConn) reconnect() error {
+	redial := pipe.redial
+	pipe.redial = nil
+
+	u, err := redial()
+	if err != nil {
+		return err
+	}
 
+	pipe.upstream.Close()
+	pipe.upstream = u
+	pipe.queries = nil
+
+	if pipe.onUpstream != nil {
+		pipe.onUpstream(u)
 	}
+
+	return u.sendAuthReq()
 }
 
 func (u *upstream) sendAuthReq() error {
@@ -378,15 +1790,18 @@ func newDownstream(c net.Conn, config *ServerConfig) (*downstream, error) {
 	_, err := s.serverHandshake(&fullConf)
 	if err != nil {
 		c.Close()
-		return nil, err
+		return nil, &HandshakeError{s.clientVersion, err}
 	}
 
-	return &downstream{s}, nil
+	return &downstream{connection: s}, nil
 }
 
-func newUpstream(c net.Conn, addr string, config *ClientConfig) (*upstream, error) {
+// newUpstream dials upstream, its packets waiting to be piped count against
+// budget of downstream
+func newUpstream(c net.Conn, addr string, config *ClientConfig, budget *bufferBudget) (*upstream, error) {
 	fullConf := *config
 	fullConf.SetDefaults()
+	fullConf.budget = budget
 
 	conn := &connection{
 		sshConn: sshConn{conn: c},
@@ -402,11 +1817,17 @@ func newUpstream(c net.Conn, addr string, config *ClientConfig) (*upstream, erro
 }
 
 func (d *downstream) nextAuthMsg() (*userAuthRequestMsg, error) {
-	var userAuthReq userAuthRequestMsg
-
-	if packet, err := d.transport.readPacket(); err != nil {
+	packet, err := d.readAuthPacket()
+	if err != nil {
 		return nil, err
-	} else if err = Unmarshal(packet, &userAuthReq); err != nil {
+	}
+
+	return d.parseAuthMsg(packet)
+}
+
+func (d *downstream) parseAuthMsg(packet []byte) (*userAuthRequestMsg, error) {
+	var userAuthReq userAuthRequestMsg
+	if err := Unmarshal(packet, &userAuthReq); err != nil {
 		return nil, err
 	}
 
@@ -414,6 +1835,13 @@ func (d *downstream) nextAuthMsg() (*userAuthRequestMsg, error) {
 		return nil, errors.New("ssh: client attempted to negotiate for unknown service: " + userAuthReq.Service)
 	}
 
+	// malformed msgs fail where they are handled
+	if userAuthReq.Method == "publickey" {
+		if key, isQuery, _, err := parsePublicKeyMsg(&userAuthReq); err == nil {
+			d.offerKey(key, !isQuery)
+		}
+	}
+
 	return &userAuthReq, nil
 }
 
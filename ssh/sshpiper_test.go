@@ -0,0 +1,213 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"reflect"
+	"testing"
+)
+
+func TestHostbasedRelay(t *testing.T) {
+	session := []byte("downstream session")
+	signer := testSigners["ecdsa"]
+
+	msg, err := signHostbased(session, "alice", signer, "client.example.", "bob", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, hostKey, err := verifyHostbased(session, msg)
+	if err != nil {
+		t.Fatalf("verifyHostbased: %v", err)
+	}
+
+	if string(hostKey.Marshal()) != string(signer.PublicKey().Marshal()) {
+		t.Errorf("got another host key")
+	}
+
+	if m.ClientHost != "client.example." || m.ClientUser != "bob" {
+		t.Errorf("got client %v@%v", m.ClientUser, m.ClientHost)
+	}
+
+	// signed for another session
+	if _, _, err := verifyHostbased([]byte("upstream session"), msg); err == nil {
+		t.Errorf("signature of another session verified")
+	}
+
+	// claims another user
+	msg.User = "root"
+	if _, _, err := verifyHostbased(session, msg); err == nil {
+		t.Errorf("signature for another user verified")
+	}
+}
+
+func TestHostbasedAlgo(t *testing.T) {
+	session := []byte("downstream session")
+	signer := testSigners["rsa"]
+
+	msg, err := signHostbased(session, "alice", signer, "client.example.", "bob", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m hostbasedAuthMsg
+	if err := Unmarshal(msg.Payload, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Algo != SigAlgoRSASHA2256 {
+		t.Errorf("rsa host key signed with %v, want %v", m.Algo, SigAlgoRSASHA2256)
+	}
+
+	if _, _, err := verifyHostbased(session, msg); err != nil {
+		t.Fatalf("verifyHostbased: %v", err)
+	}
+
+	// a signature of another format than the algo claimed
+	sig, err := signer.Sign(rand.Reader, buildDataSignedForHostbased(session, "alice", serviceSSH, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Sig = Marshal(sig)
+	msg.Payload = Marshal(&m)
+	if _, _, err := verifyHostbased(session, msg); err == nil {
+		t.Errorf("ssh-rsa signature verified as %v", m.Algo)
+	}
+
+	// an algo of another key type
+	m.Algo = KeyAlgoECDSA256
+	msg.Payload = Marshal(&m)
+	if _, _, err := verifyHostbased(session, msg); err == nil {
+		t.Errorf("rsa key verified as %v", m.Algo)
+	}
+}
+
+func TestUpstreamSigners(t *testing.T) {
+	cert, plain := testSigners["cert"], testSigners["rsa"]
+	key := cert.(*openSSHCertSigner).signer
+
+	for _, tt := range []struct {
+		signer Signer
+		order  []string
+		want   []Signer
+	}{
+		{cert, []string{"certificate", "publickey"}, []Signer{cert, key}},
+		{cert, []string{"publickey", "certificate"}, []Signer{key, cert}},
+		{cert, []string{"certificate", "password"}, []Signer{cert}},
+		{plain, []string{"certificate", "publickey"}, []Signer{plain}},
+		{plain, []string{"certificate"}, nil},
+	} {
+		got := upstreamSigners(tt.signer, tt.order)
+		if len(got) != len(tt.want) {
+			t.Errorf("%v: got %d signers, want %d", tt.order, len(got), len(tt.want))
+			continue
+		}
+
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%v: signer %d is another", tt.order, i)
+			}
+		}
+	}
+
+	if !relaysMethod([]string{"certificate"}, "publickey") || relaysMethod([]string{"publickey"}, "password") {
+		t.Errorf("relaysMethod relays other methods")
+	}
+}
+
+func TestRemainingMethods(t *testing.T) {
+	for _, tt := range []struct {
+		upstream, methods []string
+		bridged, verified bool
+		want              []string
+	}{
+		{[]string{"publickey", "password"}, []string{"password", "publickey"}, false, false, []string{"password", "publickey"}},
+		{[]string{"publickey"}, []string{"publickey", "password", "publickey"}, false, false, []string{"publickey"}},
+		{[]string{"password"}, []string{"password", "keyboard-interactive"}, false, false, []string{"password"}},
+		{[]string{"password"}, []string{"password", "keyboard-interactive"}, true, false, []string{"password", "keyboard-interactive"}},
+		{[]string{"publickey"}, []string{"keyboard-interactive"}, true, false, nil},
+		{[]string{"publickey"}, []string{"publickey", "password"}, false, true, []string{"publickey", "password"}},
+		{[]string{"publickey"}, []string{"password", "keyboard-interactive"}, true, true, []string{"password", "keyboard-interactive"}},
+		{[]string{"hostbased"}, []string{"password"}, false, true, nil},
+	} {
+		got := remainingMethods(tt.upstream, tt.methods, tt.bridged, tt.verified)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v %v: got %v, want %v", tt.upstream, tt.methods, got, tt.want)
+		}
+	}
+}
+
+func TestWithPassword(t *testing.T) {
+	for _, tt := range []struct {
+		methods, want []string
+	}{
+		{[]string{"publickey"}, []string{"publickey", "password"}},
+		{[]string{"publickey", "keyboard-interactive"}, []string{"publickey", "password", "keyboard-interactive"}},
+		{[]string{"password", "publickey"}, []string{"password", "publickey"}},
+		{[]string{"keyboard-interactive"}, []string{"keyboard-interactive"}},
+	} {
+		if got := withPassword(tt.methods); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.methods, got, tt.want)
+		}
+	}
+}
+
+func TestKeyQueries(t *testing.T) {
+	accepted, rejected := testSigners["ecdsa"].PublicKey(), testSigners["rsa"].PublicKey()
+
+	down, up := memPipe()
+	defer down.Close()
+
+	// upstream accepts accepted only, counting queries
+	queries := make(chan int, 1)
+	go func() {
+		n := 0
+		defer func() { queries <- n }()
+
+		for {
+			packet, err := up.readPacket()
+			if err != nil {
+				return
+			}
+			n++
+
+			var msg publickeyAuthMsg
+			if err := Unmarshal(packet, &msg); err != nil {
+				return
+			}
+
+			var reply interface{} = &userAuthFailureMsg{Methods: []string{"publickey"}}
+			if string(msg.PubKey) == string(accepted.Marshal()) {
+				reply = &userAuthPubKeyOkMsg{Algo: msg.Algoname, PubKey: msg.PubKey}
+			}
+			if err := up.writePacket(Marshal(reply)); err != nil {
+				return
+			}
+		}
+	}()
+
+	var q keyQueries
+	for _, tt := range []struct {
+		key  PublicKey
+		user string
+		want bool
+	}{
+		{accepted, "alice", true},
+		{rejected, "alice", false},
+		{accepted, "alice", true},
+		{rejected, "alice", false},
+		// asked again for another user
+		{accepted, "bob", true},
+	} {
+		ok, err := q.validate(tt.key, tt.user, down)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want {
+			t.Errorf("%v key of %v accepted %v, want %v", tt.key.Type(), tt.user, ok, tt.want)
+		}
+	}
+
+	down.Close()
+	if n := <-queries; n != 3 {
+		t.Errorf("upstream asked %d times, want 3", n)
+	}
+}
@@ -124,7 +124,7 @@ func (s *connectionState) readPacket(r *bufio.Reader) ([]byte, error) {
 
 	// The packet may point to an internal buffer, so copy the
 	// packet out here.
-	fresh := make([]byte, len(packet))
+	fresh := getPacketBuffer(len(packet))
 	copy(fresh, packet)
 
 	return fresh, err
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/sshpiperd/piperd"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// startAdmin serves the admin api of d, the token is read from tokenFile to
+// keep it out of the command line
+func startAdmin(d *piperd.Daemon, addr, tokenFile string) error {
+	if tokenFile == "" {
+		return fmt.Errorf("admin api needs -admin-token-file")
+	}
+
+	if err := upstream.CheckPerm(tokenFile); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("admin token file %v is empty", tokenFile)
+	}
+
+	l, err := sockets.listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go http.Serve(l, d.AdminHandler(token))
+	return nil
+}
@@ -0,0 +1,110 @@
+// Package audit is the API for sshpiperd audit sinks.
+//
+// sshpiperd passes connection, auth and session events to one Sink, which
+// records or forwards them, e.g. to a file, a webhook or a SIEM. Sinks
+// register themselves in init, the same way as upstream providers, and are
+// picked with sshpiperd -audit name:target.
+package audit
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Event types
+const (
+	// a downstream connection accepted or closed
+	TypeConnection = "connection"
+	// an auth attempt of downstream, relayed or answered by sshpiperd
+	TypeAuth = "auth"
+	// a pipe authed on both legs, established or closed
+	TypeSession = "session"
+)
+
+// Event actions
+const (
+	ActionAccepted    = "accepted"
+	ActionClosed      = "closed"
+	ActionSuccess     = "success"
+	ActionFailure     = "failure"
+	ActionEstablished = "established"
+	// a pipe upstream ended without disconnecting, e.g. its host died
+	ActionUpstreamClosed = "upstream_closed"
+)
+
+// Event is one audit record, fields not known for the event are empty
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Action string    `json:"action"`
+
+	User       string `json:"user,omitempty"`
+	Downstream string `json:"downstream,omitempty"`
+	Upstream   string `json:"upstream,omitempty"`
+
+	// auth method downstream tried, auth events only
+	Method string `json:"method,omitempty"`
+
+	// SHA256 fingerprint of the key tried in publickey auth events, of the
+	// key auth passed with in session events
+	Key string `json:"key,omitempty"`
+
+	// labels of the pipe set by the provider, session events only
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// SHA256 fingerprint of the upstream's host key and its version,
+	// session events only
+	UpstreamHostKey string `json:"upstream_host_key,omitempty"`
+	UpstreamVersion string `json:"upstream_version,omitempty"`
+
+	// bytes read from and written to downstream and time since accepted,
+	// closed sessions only
+	BytesIn  int64  `json:"bytes_in,omitempty"`
+	BytesOut int64  `json:"bytes_out,omitempty"`
+	Duration string `json:"duration,omitempty"`
+
+	// why auth failed or the connection closed
+	Error string `json:"error,omitempty"`
+}
+
+// Sink records events. Audit is called from the goroutine of the
+// connection the event is about, it must be safe for concurrent use and
+// should not block for long.
+type Sink interface {
+	Audit(e Event) error
+	Close() error
+}
+
+// Opener opens a sink writing to target, e.g. a file name or an url
+type Opener func(target string) (Sink, error)
+
+var sinks = make(map[string]Opener)
+
+func Register(name string, open Opener) {
+	if open == nil {
+		panic("audit sink opener is nil")
+	}
+	if _, dup := sinks[name]; dup {
+		panic("Register twice for audit sink " + name)
+	}
+	sinks[name] = open
+}
+
+func Sinks() []string {
+	var list []string
+	for name := range sinks {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Open opens the sink registered as name with target
+func Open(name, target string) (Sink, error) {
+	open, ok := sinks[name]
+	if !ok {
+		return nil, fmt.Errorf("no such audit sink: %v", name)
+	}
+	return open(target)
+}
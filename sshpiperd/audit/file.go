@@ -0,0 +1,49 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+func init() {
+	Register("file", OpenFile)
+}
+
+// fileSink appends events to a file, one json object per line
+type fileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenFile opens a sink appending events to file as newline delimited json,
+// the file is created 600 if missing
+func OpenFile(file string) (Sink, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{f: f}, nil
+}
+
+func (s *fileSink) Audit(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// one write per line, lines of concurrent events do not interleave
+	_, err = s.f.Write(append(data, '\n'))
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
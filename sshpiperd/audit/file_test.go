@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "audit.json")
+
+	events := []Event{
+		{Time: time.Unix(1, 0).UTC(), Type: TypeConnection, Action: ActionAccepted, Downstream: "10.0.0.1:5000"},
+		{Time: time.Unix(2, 0).UTC(), Type: TypeAuth, Action: ActionFailure, User: "alice", Method: "password", Error: "rejected by upstream"},
+	}
+
+	// appended to, not truncated, when opened again
+	for _, e := range events {
+		s, err := Open("file", file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Audit(e); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if fi, _ := f.Stat(); fi.Mode().Perm() != 0600 {
+		t.Errorf("got perm %o", fi.Mode().Perm())
+	}
+
+	var got []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		got = append(got, e)
+	}
+
+	if len(got) != len(events) {
+		t.Fatalf("got %d events, want %d", len(got), len(events))
+	}
+
+	for i := range got {
+		if got[i].Time != events[i].Time || got[i].Action != events[i].Action || got[i].Method != events[i].Method || got[i].Error != events[i].Error {
+			t.Errorf("got %+v, want %+v", got[i], events[i])
+		}
+	}
+
+	if _, err := Open("kafka", "localhost:9092"); err == nil {
+		t.Errorf("opened unregistered sink")
+	}
+}
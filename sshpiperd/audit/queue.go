@@ -0,0 +1,346 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueueFull is returned by Queue.Audit for events dropped as max events
+// are waiting already
+var ErrQueueFull = errors.New("audit queue full")
+
+// backoff between retries of a failing sink, vars for tests
+var (
+	minRetry = time.Second
+	maxRetry = time.Minute
+)
+
+// compactAt is the offset past which sent events are cut from the spool
+// while others wait, a var for tests
+var compactAt int64 = 1 << 20
+
+// Queue is a Sink spooling events to a file and passing them to its sink in
+// order from a goroutine of its own, retried with backoff while the sink
+// fails. An outage of the sink never blocks or fails connections, and events
+// spooled when closed are sent once a queue is opened on the dir again.
+type Queue struct {
+	sink Sink
+	max  int
+
+	// events dropped as the queue was full, atomic
+	dropped int64
+	// times the sink failed, atomic
+	retries int64
+
+	mu        sync.Mutex
+	spool     *os.File
+	spoolFile string
+	offFile   string
+	// of the first event not sent yet
+	offset  int64
+	pending int
+	closed  bool
+
+	wake chan struct{}
+	done chan struct{}
+	exit chan struct{}
+}
+
+// NewQueue queues events to sink in dir, at most max of them wait, others
+// are dropped
+func NewQueue(sink Sink, dir string, max int) (*Queue, error) {
+	if max <= 0 {
+		return nil, errors.New("audit queue size must be positive")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	spoolFile := filepath.Join(dir, "queue.json")
+	spool, err := os.OpenFile(spoolFile, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		sink:      sink,
+		max:       max,
+		spool:     spool,
+		spoolFile: spoolFile,
+		offFile:   filepath.Join(dir, "queue.offset"),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		exit:      make(chan struct{}),
+	}
+
+	if data, err := ioutil.ReadFile(q.offFile); err == nil {
+		q.offset, _ = strconv.ParseInt(string(data), 10, 64)
+	}
+
+	// events left by the last run
+	if err := q.load(); err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	go q.loop()
+
+	return q, nil
+}
+
+// load counts events spooled from offset on. A last line cut short, e.g.
+// by a crash while writing it, is truncated, events appended would join it.
+func (q *Queue) load() error {
+	fi, err := q.spool.Stat()
+	if err != nil {
+		return err
+	}
+
+	// emptied but the offset not saved
+	if q.offset > fi.Size() {
+		q.offset = 0
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(q.spool, q.offset, fi.Size()-q.offset))
+	end := q.offset
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		end += int64(len(line))
+		q.pending++
+	}
+
+	if end < fi.Size() {
+		return q.spool.Truncate(end)
+	}
+
+	return nil
+}
+
+func (q *Queue) Audit(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errors.New("audit queue closed")
+	}
+
+	if q.pending >= q.max {
+		atomic.AddInt64(&q.dropped, 1)
+		return ErrQueueFull
+	}
+
+	if _, err := q.spool.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	q.pending++
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Pending returns events waiting for the sink
+func (q *Queue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+// Dropped returns events dropped as the queue was full
+func (q *Queue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// Retries returns how often the sink failed
+func (q *Queue) Retries() int64 {
+	return atomic.LoadInt64(&q.retries)
+}
+
+// Close stops sending, events not sent stay spooled, and closes the sink
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mu.Unlock()
+
+	close(q.done)
+	<-q.exit
+
+	q.mu.Lock()
+	err := q.saveOffset()
+	q.spool.Close()
+	q.mu.Unlock()
+
+	if serr := q.sink.Close(); err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+func (q *Queue) loop() {
+	defer close(q.exit)
+
+	retry := minRetry
+	for {
+		e, next, ok := q.next()
+		if !ok {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+
+		if err := q.sink.Audit(e); err != nil {
+			atomic.AddInt64(&q.retries, 1)
+
+			select {
+			case <-time.After(retry):
+			case <-q.done:
+				return
+			}
+
+			if retry *= 2; retry > maxRetry {
+				retry = maxRetry
+			}
+			continue
+		}
+
+		retry = minRetry
+		q.sent(next)
+	}
+}
+
+// next reads the first event not sent and the offset after it. Lines which
+// are not events are skipped.
+func (q *Queue) next() (e Event, next int64, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.pending > 0 {
+		r := bufio.NewReader(io.NewSectionReader(q.spool, q.offset, 1<<62))
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return e, 0, false
+		}
+
+		next = q.offset + int64(len(line))
+		if err := json.Unmarshal(line, &e); err != nil {
+			atomic.AddInt64(&q.dropped, 1)
+			q.advance(next)
+			continue
+		}
+
+		return e, next, true
+	}
+
+	return e, 0, false
+}
+
+func (q *Queue) sent(next int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.advance(next)
+	q.saveOffset()
+}
+
+// advance marks the event before next sent, the spool is emptied once all
+// are, or compacted once past compactAt while the sink lags. q.mu must be
+// held.
+func (q *Queue) advance(next int64) {
+	q.offset = next
+	q.pending--
+
+	switch {
+	case q.pending == 0:
+		if err := q.spool.Truncate(0); err == nil {
+			q.offset = 0
+		}
+	case q.offset >= compactAt:
+		// tried again on the next event if failed
+		q.compact()
+	}
+}
+
+// compact replaces the spool with the events not sent. The offset is reset
+// before the rename, a crash between sends events again rather than losing
+// them. q.mu must be held.
+func (q *Queue) compact() error {
+	tmp, err := os.OpenFile(q.spoolFile+".tmp", os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if _, err := io.Copy(tmp, io.NewSectionReader(q.spool, q.offset, 1<<62)); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+
+	offset := q.offset
+	q.offset = 0
+	if err := q.saveOffset(); err != nil {
+		q.offset = offset
+		return fail(err)
+	}
+
+	if err := os.Rename(tmp.Name(), q.spoolFile); err != nil {
+		q.offset = offset
+		q.saveOffset()
+		return fail(err)
+	}
+
+	q.spool.Close()
+	q.spool = tmp
+	return nil
+}
+
+// saveOffset keeps the offset for the next run, events sent since the last
+// save are sent again. It is replaced by rename, a crash never leaves it
+// half written. q.mu must be held.
+func (q *Queue) saveOffset() error {
+	tmp := q.offFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(q.offset, 10)), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, q.offFile)
+}
@@ -0,0 +1,213 @@
+package audit
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakySink fails while down
+type flakySink struct {
+	mu     sync.Mutex
+	down   bool
+	events []Event
+}
+
+func (s *flakySink) Audit(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.down {
+		return errors.New("sink down")
+	}
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *flakySink) Close() error {
+	return nil
+}
+
+func (s *flakySink) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *flakySink) users() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []string
+	for _, e := range s.events {
+		users = append(users, e.User)
+	}
+	return users
+}
+
+func waitPending(t *testing.T, q *Queue, n int) {
+	for i := 0; i < 200 && q.Pending() != n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := q.Pending(); got != n {
+		t.Fatalf("got %d events pending, want %d", got, n)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	minRetry, maxRetry = 10*time.Millisecond, 20*time.Millisecond
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &flakySink{down: true}
+	q, err := NewQueue(sink, dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if err := q.Audit(Event{Type: TypeAuth, User: user}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.Audit(Event{User: "dave"}); err != ErrQueueFull || q.Dropped() != 1 {
+		t.Errorf("got %v, %d dropped, want the full queue to drop", err, q.Dropped())
+	}
+
+	// closed during the outage, the events wait on disk
+	q.Close()
+
+	sink = &flakySink{down: true}
+	if q, err = NewQueue(sink, dir, 3); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if q.Pending() != 3 {
+		t.Fatalf("got %d events pending after reopen, want 3", q.Pending())
+	}
+
+	// fails a few times more
+	time.Sleep(50 * time.Millisecond)
+	sink.setDown(false)
+	waitPending(t, q, 0)
+
+	if users := sink.users(); len(users) != 3 || users[0] != "alice" || users[2] != "carol" {
+		t.Errorf("got events of %v, want alice, bob and carol in order", users)
+	}
+
+	if q.Retries() == 0 {
+		t.Errorf("no retries counted")
+	}
+
+	if err := q.Audit(Event{User: "erin"}); err != nil {
+		t.Fatal(err)
+	}
+	waitPending(t, q, 0)
+}
+
+func TestQueuePartialLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// cut short by a crash
+	spool := `{"user":"alice"}` + "\n" + `{"user":"bo`
+	if err := ioutil.WriteFile(filepath.Join(dir, "queue.json"), []byte(spool), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &flakySink{}
+	q, err := NewQueue(sink, dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if err := q.Audit(Event{User: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	waitPending(t, q, 0)
+
+	if users := sink.users(); len(users) != 2 || users[0] != "alice" || users[1] != "carol" {
+		t.Errorf("got events of %v, want alice and carol", users)
+	}
+	if q.Dropped() != 0 {
+		t.Errorf("%d events dropped, carol joined the cut line", q.Dropped())
+	}
+}
+
+// sizeSink notes the size of the spool when each event is sent
+type sizeSink struct {
+	flakySink
+	spool string
+	sizes []int64
+}
+
+func (s *sizeSink) Audit(e Event) error {
+	if err := s.flakySink.Audit(e); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(s.spool)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.sizes = append(s.sizes, fi.Size())
+	s.mu.Unlock()
+	return nil
+}
+
+func TestQueueCompact(t *testing.T) {
+	minRetry, maxRetry = 10*time.Millisecond, 20*time.Millisecond
+	compactAt = 1
+	defer func() { compactAt = 1 << 20 }()
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &sizeSink{spool: filepath.Join(dir, "queue.json")}
+	sink.setDown(true)
+	q, err := NewQueue(sink, dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if err := q.Audit(Event{User: user}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each event sent is cut while others wait
+	sink.setDown(false)
+	waitPending(t, q, 0)
+
+	if users := sink.users(); len(users) != 3 || users[0] != "alice" || users[2] != "carol" {
+		t.Errorf("got events of %v, want alice, bob and carol in order", users)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.sizes) != 3 || sink.sizes[0] <= sink.sizes[1] || sink.sizes[1] <= sink.sizes[2] {
+		t.Errorf("spool sizes %v while sending, want them shrinking", sink.sizes)
+	}
+}
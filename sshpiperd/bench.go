@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	subCommands["bench"] = runBench
+}
+
+// bench runs a piper, a dummy upstream and synthetic clients all in process,
+// so only the piper code path is measured.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	concurrent := fs.Int("c", 10, "Concurrent synthetic clients")
+	total := fs.Int("n", 100, "Total logins")
+	size := fs.Int64("s", 1<<20, "Bytes piped to upstream after each login, 0 for login only")
+	fs.Parse(args)
+
+	if *concurrent < 1 || *total < 1 {
+		return fmt.Errorf("-c and -n must be positive")
+	}
+
+	key, err := benchHostKey()
+	if err != nil {
+		return err
+	}
+
+	upl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer upl.Close()
+	go benchUpstream(upl, key)
+
+	piper := &ssh.SSHPiper{
+		FindUpstream: func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+			c, err := net.Dial("tcp", upl.Addr().String())
+			if err != nil {
+				return nil, nil, err
+			}
+			return c, &ssh.ClientConfig{}, nil
+		},
+	}
+	piper.DownstreamConfig.AddHostKey(key)
+
+	downl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer downl.Close()
+	go func() {
+		for {
+			c, err := downl.Accept()
+			if err != nil {
+				return
+			}
+			go piper.Serve(c)
+		}
+	}()
+
+	fmt.Printf("bench: %d logins, %d concurrent clients, %d bytes per login\n", *total, *concurrent, *size)
+
+	var (
+		mu        sync.Mutex
+		logins    []time.Duration
+		transfers []time.Duration
+		failed    int
+		lastErr   error
+		wg        sync.WaitGroup
+	)
+
+	jobs := make(chan struct{}, *total)
+	for i := 0; i < *total; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	start := time.Now()
+	for i := 0; i < *concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				login, transfer, err := benchLogin(downl.Addr().String(), *size)
+
+				mu.Lock()
+				if err != nil {
+					failed++
+					lastErr = err
+				} else {
+					logins = append(logins, login)
+					transfers = append(transfers, transfer)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("logins:     %d ok, %d failed in %v (%.1f logins/sec)\n", len(logins), failed, elapsed, float64(len(logins))/elapsed.Seconds())
+	if lastErr != nil {
+		fmt.Printf("last error: %v\n", lastErr)
+	}
+
+	if len(logins) == 0 {
+		return fmt.Errorf("all logins failed")
+	}
+
+	fmt.Printf("login time: %s\n", percentiles(logins))
+
+	if *size > 0 {
+		piped := float64(*size) * float64(len(transfers)) / (1 << 20)
+		fmt.Printf("throughput: %.1f MiB in %v (%.1f MiB/s)\n", piped, elapsed, piped/elapsed.Seconds())
+		fmt.Printf("transfer:   %s\n", percentiles(transfers))
+	}
+
+	return nil
+}
+
+func percentiles(d []time.Duration) string {
+	sort.Sort(durations(d))
+
+	at := func(p float64) time.Duration {
+		return d[int(float64(len(d)-1)*p)]
+	}
+
+	return fmt.Sprintf("p50 %v p90 %v p99 %v max %v", at(0.5), at(0.9), at(0.99), d[len(d)-1])
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func benchHostKey() (ssh.Signer, error) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewSignerFromKey(k)
+}
+
+// benchLogin logs in through the piper and, if size > 0, pipes size bytes to
+// the dummy upstream. It returns the time used by each step.
+func benchLogin(addr string, size int64) (login, transfer time.Duration, err error) {
+	start := time.Now()
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "bench",
+		Auth: []ssh.AuthMethod{ssh.Password("bench")},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer client.Close()
+
+	login = time.Since(start)
+
+	if size == 0 {
+		return login, 0, nil
+	}
+
+	start = time.Now()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer session.Close()
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err = session.Start("discard"); err != nil {
+		return 0, 0, err
+	}
+
+	if _, err = io.CopyN(w, zeros{}, size); err != nil {
+		return 0, 0, err
+	}
+	w.Close()
+
+	if err = session.Wait(); err != nil {
+		return 0, 0, err
+	}
+
+	return login, time.Since(start), nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// benchUpstream accepts any password and discards everything sent to an exec
+// session until EOF.
+func benchUpstream(l net.Listener, key ssh.Signer) {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(key)
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			conn, chans, reqs, err := ssh.NewServerConn(c, config)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			go ssh.DiscardRequests(reqs)
+
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "session only")
+					continue
+				}
+
+				ch, reqs, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+
+				go func() {
+					for req := range reqs {
+						req.Reply(req.Type == "exec", nil)
+
+						if req.Type != "exec" {
+							continue
+						}
+
+						go func() {
+							io.Copy(ioutil.Discard, ch)
+							ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+							ch.Close()
+						}()
+					}
+				}()
+			}
+		}()
+	}
+}
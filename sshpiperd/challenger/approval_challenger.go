@@ -0,0 +1,275 @@
+package challenger
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// headers of signed webhook calls, see approval.newRequest
+const (
+	headerTimestamp = "X-Sshpiper-Timestamp"
+	headerNonce     = "X-Sshpiper-Nonce"
+	headerSignature = "X-Sshpiper-Signature"
+)
+
+// answers of the webhook are small, more is not read
+const maxDecisionSize = 64 << 10
+
+// settings of the approval challenger, set by sshpiperd from its flags
+var (
+	// ApprovalURL is the webhook requests are filed at
+	ApprovalURL string
+	// ApprovalToken is sent as bearer token if not empty
+	ApprovalToken string
+	// ApprovalSecret signs requests and verifies answers if not empty
+	ApprovalSecret string
+	// ApprovalTimeout is how long a request may stay pending
+	ApprovalTimeout = 5 * time.Minute
+)
+
+// approval files a request at a webhook and polls it for a decision, the
+// user only sees a waiting message
+type approval struct {
+	url   string
+	token string
+	// signs requests and verifies answers if not empty
+	secret   string
+	interval time.Duration
+	timeout  time.Duration
+	client   *http.Client
+}
+
+type approvalRequest struct {
+	ID            string `json:"id"`
+	User          string `json:"user"`
+	RemoteAddr    string `json:"remote_addr"`
+	ClientVersion string `json:"client_version"`
+}
+
+type approvalDecision struct {
+	// "allow", "deny" or "pending"
+	Status string `json:"status"`
+}
+
+func newApproval() *approval {
+	a := &approval{
+		url:      ApprovalURL,
+		token:    ApprovalToken,
+		secret:   ApprovalSecret,
+		interval: 2 * time.Second,
+		timeout:  ApprovalTimeout,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	return a
+}
+
+func (a *approval) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(a.secret))
+	for i, p := range parts {
+		if i > 0 {
+			mac.Write([]byte("\n"))
+		}
+		mac.Write([]byte(p))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newRequest builds a call of the webhook. With a secret it is signed,
+// hmac-sha256 of method, request uri, timestamp, nonce and body joined by
+// newlines, so the webhook can refuse forged calls and replays of old
+// nonces. It returns the nonce the answer must be signed with.
+func (a *approval) newRequest(method, url string, data []byte) (*http.Request, string, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	if a.secret == "" {
+		return req, "", nil
+	}
+
+	n := make([]byte, 16)
+	if _, err := rand.Read(n); err != nil {
+		return nil, "", err
+	}
+
+	nonce := hex.EncodeToString(n)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerNonce, nonce)
+	req.Header.Set(headerSignature, a.sign(method, req.URL.RequestURI(), timestamp, nonce, string(data)))
+
+	return req, nonce, nil
+}
+
+func (a *approval) do(method, url string, body interface{}) (string, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return "", err
+		}
+	}
+
+	req, nonce, err := a.newRequest(method, url, data)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("approval webhook returned %v", resp.Status)
+	}
+
+	answer, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDecisionSize))
+	if err != nil {
+		return "", err
+	}
+
+	// the answer is signed with the nonce of this call, an answer to
+	// another call cannot be replayed
+	if a.secret != "" {
+		want := a.sign(nonce, string(answer))
+		if !hmac.Equal([]byte(resp.Header.Get(headerSignature)), []byte(want)) {
+			return "", fmt.Errorf("approval webhook answer has a bad signature")
+		}
+	}
+
+	var d approvalDecision
+	if err := json.Unmarshal(answer, &d); err != nil {
+		return "", err
+	}
+
+	return d.Status, nil
+}
+
+func (a *approval) challenge(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+	// anyone knowing a user name could page approvers otherwise, and they
+	// could not tell whether the requester holds the user's key
+	if !Verified(conn) {
+		return false, fmt.Errorf("approval: login of %v is not verified, approval needs dial after auth", conn.User())
+	}
+
+	// approvers are not asked about logins which cannot pass
+	if denial := DenialOf(conn); denial != nil {
+		return false, denial.Err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return false, err
+	}
+
+	req := approvalRequest{
+		ID:            hex.EncodeToString(id),
+		User:          conn.User(),
+		RemoteAddr:    conn.RemoteAddr().String(),
+		ClientVersion: string(conn.ClientVersion()),
+	}
+
+	status, err := a.do("POST", a.url, req)
+	if err != nil {
+		return false, err
+	}
+
+	if status == "pending" {
+		if _, err := client(req.User, fmt.Sprintf("waiting for approval of request %v ...", req.ID), nil, nil); err != nil {
+			return false, err
+		}
+	}
+
+	deadline := time.Now().Add(a.timeout)
+
+	for status == "pending" {
+		if time.Now().After(deadline) {
+			return false, fmt.Errorf("approval request %v timed out", req.ID)
+		}
+
+		time.Sleep(a.interval)
+
+		if status, err = a.do("GET", a.url+"/"+req.ID, nil); err != nil {
+			return false, err
+		}
+	}
+
+	switch status {
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("approval request %v got unknown status %q", req.ID, status)
+}
+
+// defaultApproval is the approval challenger of the settings
+func defaultApproval() (*approval, error) {
+	a := newApproval()
+	if a.url == "" {
+		return nil, fmt.Errorf("approval: no webhook url, see -approval-url")
+	}
+
+	return a, nil
+}
+
+func init() {
+	Register("approval", func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+		a, err := defaultApproval()
+		if err != nil {
+			return false, err
+		}
+		return a.challenge(conn, client)
+	})
+
+	RegisterCheck("approval", func() error {
+		a, err := defaultApproval()
+		if err != nil {
+			return err
+		}
+		return a.check()
+	})
+}
+
+// check tells whether the webhook answers, any status but a server error
+// will do, the webhook need not serve GET on its url
+func (a *approval) check() error {
+	req, _, err := a.newRequest(http.MethodGet, a.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 == 5 {
+		return fmt.Errorf("approval webhook returned %v", resp.Status)
+	}
+
+	return nil
+}
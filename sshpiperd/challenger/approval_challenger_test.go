@@ -0,0 +1,226 @@
+package challenger
+
+import (
+	"encoding/json"
+	"github.com/tg123/sshpiper/ssh"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testConnMeta struct {
+	ssh.ConnMetadata
+}
+
+func (testConnMeta) User() string {
+	return "alice"
+}
+
+func (testConnMeta) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+}
+
+func (testConnMeta) ClientVersion() []byte {
+	return []byte("SSH-2.0-test")
+}
+
+// approvalServer keeps requests pending for polls polls, then decides
+func approvalServer(t *testing.T, polls int, decision string) *httptest.Server {
+	var mu sync.Mutex
+	ids := make(map[string]int)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		var id string
+		if r.Method == "POST" {
+			var req approvalRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.User != "alice" {
+				t.Errorf("approval request %+v: %v", req, err)
+			}
+			id = req.ID
+		} else {
+			id = strings.TrimPrefix(r.URL.Path, "/")
+			ids[id]++
+		}
+
+		status := "pending"
+		if ids[id] >= polls {
+			status = decision
+		}
+
+		json.NewEncoder(w).Encode(approvalDecision{Status: status})
+	}))
+}
+
+func TestApprovalChallenger(t *testing.T) {
+	for _, c := range []struct {
+		polls    int
+		decision string
+		ok       bool
+	}{
+		{0, "allow", true},
+		{2, "allow", true},
+		{2, "deny", false},
+	} {
+		s := approvalServer(t, c.polls, c.decision)
+
+		a := &approval{url: s.URL, token: "secret", interval: time.Millisecond, timeout: time.Second, client: http.DefaultClient}
+
+		var shown []string
+		ok, err := a.challenge(verifiedConnMeta{}, func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			shown = append(shown, instruction)
+			return nil, nil
+		})
+
+		if ok != c.ok || err != nil {
+			t.Errorf("%d polls then %v: got %v, %v", c.polls, c.decision, ok, err)
+		}
+
+		if waited := len(shown) > 0; waited != (c.polls > 0) {
+			t.Errorf("%d polls then %v: shown %q", c.polls, c.decision, shown)
+		}
+
+		s.Close()
+	}
+}
+
+func TestApprovalNotVerified(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("approval requested for a login not verified")
+	}))
+	defer s.Close()
+
+	a := &approval{url: s.URL, interval: time.Millisecond, timeout: time.Second, client: http.DefaultClient}
+
+	ok, err := a.challenge(testConnMeta{}, func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return nil, nil
+	})
+
+	if ok || err == nil {
+		t.Errorf("login not verified got %v, %v", ok, err)
+	}
+}
+
+func TestApprovalTimeout(t *testing.T) {
+	s := approvalServer(t, 1<<30, "allow")
+	defer s.Close()
+
+	a := &approval{url: s.URL, token: "secret", interval: time.Millisecond, timeout: 20 * time.Millisecond, client: http.DefaultClient}
+
+	ok, err := a.challenge(verifiedConnMeta{}, func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return nil, nil
+	})
+
+	if ok || err == nil {
+		t.Errorf("never decided request got %v, %v", ok, err)
+	}
+}
+
+func TestApprovalCheck(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		http.Error(w, "post only", http.StatusMethodNotAllowed)
+	}))
+
+	a := newApproval()
+	a.url = s.URL
+	if err := a.check(); err != nil {
+		t.Errorf("check: %v", err)
+	}
+
+	a.url = s.URL + "/broken"
+	if err := a.check(); err == nil {
+		t.Errorf("check of a failing webhook passed")
+	}
+
+	if err := Check("approval"); err == nil {
+		t.Errorf("check without -approval-url passed")
+	}
+
+	ApprovalURL = s.URL
+	defer func() { ApprovalURL = "" }()
+	if err := Check("approval"); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+
+	s.Close()
+	a.url = s.URL
+	if err := a.check(); err == nil {
+		t.Errorf("check of a closed webhook passed")
+	}
+}
+
+func TestApprovalSigned(t *testing.T) {
+	signer := &approval{secret: "hmac key"}
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+
+	// answers to the first call it saw, e.g. an attacker replaying it
+	var replay []byte
+	var replayNonce string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		nonce := r.Header.Get(headerNonce)
+
+		want := signer.sign(r.Method, r.URL.RequestURI(), r.Header.Get(headerTimestamp), nonce, string(body))
+		if r.Header.Get(headerSignature) != want {
+			t.Errorf("request signature %q, want %q", r.Header.Get(headerSignature), want)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if seen[nonce] {
+			t.Errorf("nonce %v used twice", nonce)
+		}
+		seen[nonce] = true
+
+		answer := []byte(`{"status": "allow"}`)
+		if r.URL.Path == "/forged" {
+			w.Header().Set(headerSignature, (&approval{secret: "other"}).sign(nonce, string(answer)))
+		} else if replay != nil {
+			w.Header().Set(headerSignature, signer.sign(replayNonce, string(replay)))
+		} else {
+			replay, replayNonce = answer, nonce
+			w.Header().Set(headerSignature, signer.sign(nonce, string(answer)))
+		}
+		w.Write(answer)
+	}))
+	defer s.Close()
+
+	a := &approval{url: s.URL, secret: "hmac key", interval: time.Millisecond, timeout: time.Second, client: http.DefaultClient}
+
+	noPrompt := func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return nil, nil
+	}
+
+	if ok, err := a.challenge(verifiedConnMeta{}, noPrompt); !ok || err != nil {
+		t.Errorf("signed call got %v, %v", ok, err)
+	}
+
+	if ok, err := a.challenge(verifiedConnMeta{}, noPrompt); ok || err == nil {
+		t.Errorf("replayed answer got %v, %v", ok, err)
+	}
+
+	a.url = s.URL + "/forged"
+	if ok, err := a.challenge(verifiedConnMeta{}, noPrompt); ok || err == nil {
+		t.Errorf("answer signed with another key got %v, %v", ok, err)
+	}
+}
@@ -10,6 +10,9 @@ type Challenger func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChalle
 
 var challengers = make(map[string]Challenger)
 
+// self checks of challengers, run by sshpiperd check
+var checks = make(map[string]func() error)
+
 // copied from database/sql
 
 func Register(name string, challenger Challenger) {
@@ -38,3 +41,55 @@ func GetChallenger(name string) (Challenger, error) {
 	}
 	return challenger, nil
 }
+
+// RegisterCheck registers a self check of challenger name, e.g. whether its
+// backend is reachable
+func RegisterCheck(name string, check func() error) {
+	checks[name] = check
+}
+
+// Check runs the self check of challenger name, nil if it has none
+func Check(name string) error {
+	if _, err := GetChallenger(name); err != nil {
+		return err
+	}
+
+	if check, ok := checks[name]; ok {
+		return check()
+	}
+
+	return nil
+}
+
+// Denial is why a login cannot pass whatever the challenge answers, e.g. no
+// pipe for the user, so a challenger may tell the user what to do instead,
+// such as where to enroll
+type Denial struct {
+	// Reason is the key of the message sshpiperd sends for Err, e.g.
+	// no-pipe, lockdown or upstream-unreachable, "denied" if it has none
+	Reason string
+	Err    error
+}
+
+// Denier is implemented by the conn challengers get from sshpiperd
+type Denier interface {
+	// Denial waits for what runs along the challenge, finding and dialing
+	// upstream, and returns why it denied the login, nil if it did not
+	Denial() *Denial
+}
+
+// DenialOf is Denial of conn, nil if conn does not implement Denier
+func DenialOf(conn ssh.ConnMetadata) *Denial {
+	if d, ok := conn.(Denier); ok {
+		return d.Denial()
+	}
+	return nil
+}
+
+// Verified tells whether sshpiperd verified the primary credential of conn
+// before the challenge, see ssh.VerifiedConn. Only then does the user name
+// belong to whoever answers.
+func Verified(conn ssh.ConnMetadata) bool {
+	v, ok := conn.(ssh.VerifiedConn)
+	return ok && v.Verified()
+}
@@ -67,4 +67,12 @@ func init() {
 	}
 
 	Register("pam", pamChallenger)
+	RegisterCheck("pam", func() error {
+		// pam reads it as root, unreadable would fail every login
+		f, err := os.Open(SSHPIPER_PAM_SERVICE_FILE)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	})
 }
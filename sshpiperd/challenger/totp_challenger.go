@@ -0,0 +1,210 @@
+package challenger
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rfc 6238 defaults every authenticator app supports, 6 digits each 30s
+const totpPeriod = 30
+
+// TOTPSecretFile returns the file with the base32 totp secret of user, set
+// by sshpiperd to the user's dir in working dir
+var TOTPSecretFile func(user string) string
+
+// settings of the totp challenger, set by sshpiperd from its flags
+var (
+	// TOTPEnroll lets the first login of a user without a secret enroll one
+	TOTPEnroll bool
+	// TOTPIssuer is the issuer authenticator apps show for secrets enrolled
+	// on login
+	TOTPIssuer = "sshpiper"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random base32 secret of 160 bits
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURL is the otpauth url authenticator apps import secret from, most
+// scan it as a qr code
+func TOTPURL(issuer, user, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("period", fmt.Sprint(totpPeriod))
+	v.Set("digits", "6")
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+user) + "?" + v.Encode()
+}
+
+// WriteTOTPSecret stores secret of user 400, it fails if one is there
+func WriteTOTPSecret(user, secret string) error {
+	if TOTPSecretFile == nil {
+		return fmt.Errorf("totp: no secret file for %v", user)
+	}
+
+	f, err := os.OpenFile(TOTPSecretFile(user), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(secret + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func totpCode(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// totp checks codes, one period off either way for clock skew, and
+// refuses a code used before
+type totp struct {
+	now func() time.Time
+
+	mu sync.Mutex
+	// counter of the last code accepted by user
+	used map[string]uint64
+}
+
+func newTOTP() *totp {
+	return &totp{
+		now:  time.Now,
+		used: make(map[string]uint64),
+	}
+}
+
+// verify tells whether code is valid for key of user now
+func (t *totp) verify(user string, key []byte, code string) bool {
+	code = strings.TrimSpace(code)
+	now := uint64(t.now().Unix() / totpPeriod)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, counter := range []uint64{now - 1, now, now + 1} {
+		if !hmac.Equal([]byte(totpCode(key, counter)), []byte(code)) {
+			continue
+		}
+
+		if counter <= t.used[user] {
+			return false
+		}
+
+		t.used[user] = counter
+		return true
+	}
+
+	return false
+}
+
+func (t *totp) ask(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge, instruction string, key []byte) (bool, error) {
+	ans, err := client(conn.User(), instruction, []string{"Verification code: "}, []bool{true})
+	if err != nil {
+		return false, err
+	}
+
+	if len(ans) != 1 {
+		return false, nil
+	}
+
+	return t.verify(conn.User(), key, ans[0]), nil
+}
+
+func (t *totp) challenge(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+	if TOTPSecretFile == nil {
+		return false, fmt.Errorf("totp: no secret file for %v", conn.User())
+	}
+
+	file := TOTPSecretFile(conn.User())
+
+	err := upstream.CheckPerm(file)
+	if os.IsNotExist(err) && TOTPEnroll {
+		// whoever enrolls holds the second factor, so the primary
+		// credential must be checked before, see -dial-after-auth
+		if !Verified(conn) {
+			return false, fmt.Errorf("totp: %v has no secret, enrolling on login needs dial after auth", conn.User())
+		}
+
+		// no secret is stored for logins which cannot pass, e.g. no pipe
+		if denial := DenialOf(conn); denial != nil {
+			return false, denial.Err
+		}
+		return t.enrollOnLogin(conn, client)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(string(data))))
+	if err != nil {
+		return false, fmt.Errorf("totp: bad secret in %v: %v", file, err)
+	}
+
+	return t.ask(conn, client, "", key)
+}
+
+// enrollOnLogin shows a new secret and stores it once the user answered a
+// code of it, so nobody is locked out by a secret never imported
+func (t *totp) enrollOnLogin(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return false, err
+	}
+
+	key, _ := totpEncoding.DecodeString(secret)
+
+	instruction := fmt.Sprintf("Add this key to your authenticator app, secret %v\n%v\n", secret, TOTPURL(TOTPIssuer, conn.User(), secret))
+
+	ok, err := t.ask(conn, client, instruction, key)
+	if !ok || err != nil {
+		return ok, err
+	}
+
+	if err := WriteTOTPSecret(conn.User(), secret); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func init() {
+	Register("totp", newTOTP().challenge)
+}
@@ -0,0 +1,156 @@
+package challenger
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// rfc 6238 appendix b, sha1 at 59s, last 6 digits
+	if code := totpCode([]byte("12345678901234567890"), 59/totpPeriod); code != "287082" {
+		t.Errorf("got %v, want 287082", code)
+	}
+}
+
+func TestTOTPChallenge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	TOTPSecretFile = func(user string) string {
+		return filepath.Join(dir, user)
+	}
+	defer func() { TOTPSecretFile = nil }()
+
+	now := time.Unix(1e9, 0)
+	tp := newTOTP()
+	tp.now = func() time.Time { return now }
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+
+	answer := func(code string) ssh.KeyboardInteractiveChallenge {
+		return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			return []string{code}, nil
+		}
+	}
+
+	if _, err := tp.challenge(testConnMeta{}, answer("000000")); !os.IsNotExist(err) {
+		t.Errorf("got %v without a secret, want not exist", err)
+	}
+
+	if err := WriteTOTPSecret("alice", secret); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteTOTPSecret("alice", secret); err == nil {
+		t.Errorf("secret overwritten")
+	}
+
+	code := totpCode(key, uint64(now.Unix()/totpPeriod))
+
+	if ok, err := tp.challenge(testConnMeta{}, answer(code)); !ok || err != nil {
+		t.Errorf("valid code: %v %v", ok, err)
+	}
+
+	if ok, _ := tp.challenge(testConnMeta{}, answer(code)); ok {
+		t.Errorf("code replayed")
+	}
+
+	now = now.Add(totpPeriod * time.Second)
+
+	// one period behind, a slow clock
+	late := totpCode(key, uint64(now.Unix()/totpPeriod)-1)
+	if ok, _ := tp.challenge(testConnMeta{}, answer(late)); ok {
+		t.Errorf("code of a period used before accepted")
+	}
+
+	if ok, _ := tp.challenge(testConnMeta{}, answer(totpCode(key, uint64(now.Unix()/totpPeriod)+1))); !ok {
+		t.Errorf("code one period ahead rejected")
+	}
+
+	if ok, _ := tp.challenge(testConnMeta{}, answer(totpCode(key, uint64(now.Unix()/totpPeriod)+5))); ok {
+		t.Errorf("code far ahead accepted")
+	}
+}
+
+// verifiedConnMeta is testConnMeta with its primary credential verified
+type verifiedConnMeta struct {
+	testConnMeta
+}
+
+func (verifiedConnMeta) Verified() bool {
+	return true
+}
+
+func TestTOTPEnrollOnLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	TOTPSecretFile = func(user string) string {
+		return filepath.Join(dir, user)
+	}
+	defer func() { TOTPSecretFile = nil }()
+
+	tp := newTOTP()
+	TOTPEnroll = true
+	defer func() { TOTPEnroll = false }()
+
+	secretRe := regexp.MustCompile(`secret=([A-Z2-7]+)`)
+
+	// a client imports the secret shown, or mistypes the code
+	enroll := func(typo bool) ssh.KeyboardInteractiveChallenge {
+		return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			m := secretRe.FindStringSubmatch(instruction)
+			if m == nil {
+				t.Fatalf("no otpauth url in %q", instruction)
+			}
+
+			key, _ := totpEncoding.DecodeString(m[1])
+			code := totpCode(key, uint64(time.Now().Unix()/totpPeriod))
+			if typo {
+				code = "x" + code
+			}
+			return []string{code}, nil
+		}
+	}
+
+	// anyone may send the user name before it is verified
+	if ok, err := tp.challenge(testConnMeta{}, enroll(false)); ok || err == nil {
+		t.Errorf("enrolled before the primary credential was verified")
+	}
+
+	if ok, _ := tp.challenge(verifiedConnMeta{}, enroll(true)); ok {
+		t.Errorf("enrolled with a wrong code")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "alice")); !os.IsNotExist(err) {
+		t.Errorf("secret stored though enrollment failed")
+	}
+
+	if ok, err := tp.challenge(verifiedConnMeta{}, enroll(false)); !ok || err != nil {
+		t.Fatalf("enroll: %v %v", ok, err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode().Perm() != 0400 {
+		t.Errorf("secret stored %o, want 400", fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+func init() {
+	subCommands["check"] = runCheck
+}
+
+// check fails on what dumpconfig warns about, and on the self checks of the
+// provider and challenger, so a deploy can run it before restarting
+func runCheck(args []string) error {
+	problems := configWarnings()
+
+	if p, err := getProvider(); err == nil {
+		if c, ok := p.(upstream.Checker); ok {
+			if err := c.Check(); err != nil {
+				problems = append(problems, fmt.Sprintf("provider %v: %v", Provider, err))
+			}
+		}
+	}
+
+	// unknown ones are in the warnings already
+	if _, err := challenger.GetChallenger(Challenger); err == nil {
+		if err := challenger.Check(Challenger); err != nil {
+			problems = append(problems, fmt.Sprintf("challenger %v: %v", Challenger, err))
+		}
+	}
+
+	for _, p := range problems {
+		fmt.Printf("problem: %v\n", p)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems", len(problems))
+	}
+
+	fmt.Println("ok")
+	return nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// upstreamDialer resolves upstream host names and caches the result as long
+// as the dns ttl allows, capped at maxTTL.
+type upstreamDialer struct {
+	// dns server, host:port, empty for system default
+	server string
+	maxTTL time.Duration
+
+	// local ip or interface upstream dials are bound to, empty for any
+	bind string
+
+	// bounds each address dialed, 0 for the system's
+	timeout time.Duration
+
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	cache map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs  []net.IPAddr
+	expire time.Time
+}
+
+type ttlKey struct{}
+
+// ttlRecorder collects the smallest ttl seen in dns responses of one lookup
+type ttlRecorder struct {
+	mu  sync.Mutex
+	ttl uint32
+	ok  bool
+}
+
+func (r *ttlRecorder) observe(ttl uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.ok || ttl < r.ttl {
+		r.ttl = ttl
+		r.ok = true
+	}
+}
+
+func newUpstreamDialer(server string, maxTTL time.Duration, bind string, timeout time.Duration) *upstreamDialer {
+	d := &upstreamDialer{
+		server:  server,
+		maxTTL:  maxTTL,
+		bind:    bind,
+		timeout: timeout,
+		cache:   make(map[string]dnsEntry),
+	}
+
+	d.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial:     d.dialDNS,
+	}
+
+	return d
+}
+
+// dialDNS is used by the go resolver to reach the dns server, it redirects to
+// the configured server and watches udp responses for their ttl.
+func (d *upstreamDialer) dialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.server != "" {
+		address = d.server
+	}
+
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// tcp responses may be split across reads, only look into udp ones
+	rec, ok := ctx.Value(ttlKey{}).(*ttlRecorder)
+	if !ok {
+		return c, nil
+	}
+
+	udp, ok := c.(*net.UDPConn)
+	if !ok {
+		return c, nil
+	}
+
+	return &ttlConn{udp, rec}, nil
+}
+
+// ttlConn must stay a net.PacketConn, the go resolver uses it to tell udp
+// from tcp framing
+type ttlConn struct {
+	*net.UDPConn
+	rec *ttlRecorder
+}
+
+func (c *ttlConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if ttl, ok := minAnswerTTL(b[:n]); ok {
+		c.rec.observe(ttl)
+	}
+	return n, err
+}
+
+func (d *upstreamDialer) lookup(host string) ([]net.IPAddr, error) {
+	now := time.Now()
+
+	d.mu.Lock()
+	e, ok := d.cache[host]
+	d.mu.Unlock()
+
+	if ok && now.Before(e.expire) {
+		return e.addrs, nil
+	}
+
+	rec := &ttlRecorder{}
+	ctx := context.WithValue(context.Background(), ttlKey{}, rec)
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := d.maxTTL
+	if rec.ok && time.Duration(rec.ttl)*time.Second < ttl {
+		ttl = time.Duration(rec.ttl) * time.Second
+	}
+
+	if ttl > 0 {
+		d.mu.Lock()
+		d.cache[host] = dnsEntry{addrs: addrs, expire: now.Add(ttl)}
+		d.mu.Unlock()
+	}
+
+	return addrs, nil
+}
+
+// Dial connects to addr, trying each address host resolves to
+func (d *upstreamDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialBind(network, addr, "")
+}
+
+// DialBind is Dial with the local end bound to bind, an ip or interface
+// name, instead of the dialer's default
+func (d *upstreamDialer) DialBind(network, addr, bind string) (net.Conn, error) {
+	if bind == "" {
+		bind = d.bind
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else if addrs, err = d.lookup(host); err != nil {
+		return nil, err
+	}
+
+	// spread load on round robin records
+	start := rand.Intn(len(addrs))
+
+	for i := range addrs {
+		ip := addrs[(start+i)%len(addrs)]
+
+		var local *net.TCPAddr
+		local, err = bindAddr(bind, ip.IP)
+		if err != nil {
+			continue
+		}
+
+		var c net.Conn
+		c, err = (&net.Dialer{LocalAddr: local, Timeout: d.timeout}).Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return c, nil
+		}
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && d.timeout > 0 {
+		return nil, dialTimeoutError{ne, d.timeout}
+	}
+
+	return nil, err
+}
+
+// dialTimeoutError names the stage as ssh.TimeoutError does, it is still a
+// net.Error, so the client is told upstream is unreachable
+type dialTimeoutError struct {
+	err   net.Error
+	after time.Duration
+}
+
+func (e dialTimeoutError) Error() string {
+	return fmt.Sprintf("upstream dial timed out after %v: %v", e.after, e.err)
+}
+
+func (e dialTimeoutError) Timeout() bool   { return true }
+func (e dialTimeoutError) Temporary() bool { return e.err.Temporary() }
+
+// bindAddr returns the local address to dial remote from, nil for any. bind
+// is an ip, or an interface whose first address of remote's family is used.
+func bindAddr(bind string, remote net.IP) (*net.TCPAddr, error) {
+	if bind == "" {
+		return nil, nil
+	}
+
+	v4 := remote.To4() != nil
+
+	if ip := net.ParseIP(bind); ip != nil {
+		if (ip.To4() != nil) != v4 {
+			return nil, fmt.Errorf("bind address %v cannot reach %v", ip, remote)
+		}
+		return &net.TCPAddr{IP: ip}, nil
+	}
+
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && (n.IP.To4() != nil) == v4 {
+			return &net.TCPAddr{IP: n.IP}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("interface %v has no address to reach %v", bind, remote)
+}
+
+// minAnswerTTL returns the smallest ttl of the answer records in a dns
+// message, false if there are none or the message is malformed.
+func minAnswerTTL(msg []byte) (uint32, bool) {
+	if len(msg) < 12 {
+		return 0, false
+	}
+
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < questions && off >= 0; i++ {
+		off = skipDNSName(msg, off)
+		if off >= 0 {
+			off += 4
+		}
+	}
+
+	var ttl uint32
+	found := false
+
+	for i := 0; i < answers; i++ {
+		off = skipDNSName(msg, off)
+		if off < 0 || off+10 > len(msg) {
+			return 0, false
+		}
+
+		t := binary.BigEndian.Uint32(msg[off+4:])
+		if !found || t < ttl {
+			ttl = t
+			found = true
+		}
+
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+
+	return ttl, found
+}
+
+// skipDNSName returns the offset after the name starting at off, -1 on error
+func skipDNSName(msg []byte, off int) int {
+	for off >= 0 && off < len(msg) {
+		l := int(msg[off])
+
+		switch {
+		case l == 0:
+			return off + 1
+		case l&0xC0 == 0xC0:
+			// compression pointer ends the name
+			return off + 2
+		}
+
+		off += 1 + l
+	}
+
+	return -1
+}
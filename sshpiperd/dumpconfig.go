@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/piperd"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+func init() {
+	subCommands["dumpconfig"] = runDumpConfig
+}
+
+// dumpconfig prints every setting with where it came from, then the
+// problems sshpiperd would run into with them
+func runDumpConfig(args []string) error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	flag.VisitAll(func(f *flag.Flag) {
+		source := "default"
+		if set[f.Name] {
+			source = "flag"
+		}
+
+		fmt.Printf("%-17s %-25q %s\n", f.Name, f.Value.String(), source)
+	})
+
+	warnings := configWarnings()
+
+	fmt.Println()
+	for _, w := range warnings {
+		fmt.Printf("warning: %v\n", w)
+	}
+	fmt.Printf("%d warnings\n", len(warnings))
+
+	return nil
+}
+
+func configWarnings() []string {
+	var warnings []string
+	warn := func(format string, a ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, a...))
+	}
+
+	if fi, err := os.Stat(PiperKeyFile); err != nil {
+		warn("host key: %v", err)
+	} else {
+		if fi.Mode().Perm()&0077 != 0 {
+			warn("host key %v is readable by others, perm %o", PiperKeyFile, fi.Mode().Perm())
+		}
+
+		if data, err := ioutil.ReadFile(PiperKeyFile); err != nil {
+			warn("host key: %v", err)
+		} else if _, err := ssh.ParsePrivateKey(data); err != nil {
+			warn("host key %v: %v", PiperKeyFile, err)
+		}
+	}
+
+	if _, err := getProvider(); err != nil {
+		warn("%v", err)
+	}
+
+	if Challenger != "" {
+		if _, err := challenger.GetChallenger(Challenger); err != nil {
+			warn("%v, available: %v", err, challenger.Challengers())
+		}
+	}
+
+	if AuditSink != "" {
+		if _, _, err := getAuditSink(); err != nil {
+			warn("%v", err)
+		}
+	}
+
+	if MessagesFile != "" {
+		if _, err := piperd.LoadMessages(MessagesFile); err != nil {
+			warn("messages: %v", err)
+		}
+	}
+
+	if PassthroughFile != "" {
+		if _, err := piperd.LoadPassthroughRules(PassthroughFile); err != nil {
+			warn("passthrough: %v", err)
+		}
+	}
+
+	if ListenersFile != "" {
+		if _, err := piperd.LoadListeners(ListenersFile); err != nil {
+			warn("listeners: %v", err)
+		}
+	}
+
+	if _, err := getTenants(); err != nil {
+		warn("tenants: %v", err)
+	}
+
+	if HostbasedKnownHosts != "" {
+		if data, err := ioutil.ReadFile(HostbasedKnownHosts); err != nil {
+			warn("hostbased known hosts: %v", err)
+		} else if _, err := upstream.ParseKnownHosts(data); err != nil {
+			warn("hostbased known hosts %v: %v", HostbasedKnownHosts, err)
+		}
+
+		if HostbasedKeyFile != "" {
+			if data, err := ioutil.ReadFile(HostbasedKeyFile); err != nil {
+				warn("hostbased key: %v", err)
+			} else if _, err := ssh.ParsePrivateKey(data); err != nil {
+				warn("hostbased key %v: %v", HostbasedKeyFile, err)
+			}
+		}
+	}
+
+	if LocalShellUser != "" {
+		if data, err := ioutil.ReadFile(LocalShellKeys); err != nil {
+			warn("local shell keys: %v", err)
+		} else if _, err := upstream.ParseAuthorizedKeys(data); err != nil {
+			warn("local shell keys %v: %v", LocalShellKeys, err)
+		}
+	}
+
+	for _, file := range []string{BannerFile, MOTDFile} {
+		if file == "" {
+			continue
+		}
+
+		if _, err := ioutil.ReadFile(file); err != nil {
+			warn("%v", err)
+		}
+	}
+
+	if AdminAddr != "" {
+		if AdminTokenFile == "" {
+			warn("admin api needs -admin-token-file")
+		} else if err := upstream.CheckPerm(AdminTokenFile); err != nil {
+			warn("admin token: %v", err)
+		}
+	}
+
+	if MaxConn == 0 {
+		warn("max-conn must be positive")
+	}
+
+	switch DuplicateSessions {
+	case upstream.DuplicateAllow, upstream.DuplicateDeny, upstream.DuplicateTakeover:
+	default:
+		warn("duplicate-sessions must be allow, deny or takeover")
+	}
+
+	if UpstreamBind != "" && net.ParseIP(UpstreamBind) == nil {
+		if _, err := net.InterfaceByName(UpstreamBind); err != nil {
+			warn("upstream-bind %v is neither an ip nor an interface: %v", UpstreamBind, err)
+		}
+	}
+
+	for _, w := range workingDirs() {
+		users, err := w.users()
+		if err != nil {
+			warn("working dir %v: %v", w.root, err)
+			continue
+		}
+
+		for _, user := range users {
+			if _, err := os.Stat(w.file(UserUpstreamFile, user)); err != nil {
+				warn("user %v: %v", user, err)
+				continue
+			}
+
+			for _, file := range []userFile{UserUpstreamFile, UserAuthorizedKeysFile, UserKeyFile, UserKnownHostsFile} {
+				if _, err := os.Stat(w.file(file, user)); os.IsNotExist(err) && file != UserUpstreamFile {
+					continue
+				}
+
+				if err := w.checkPerm(file, user); err != nil {
+					warn("user %v: %v", user, err)
+				}
+			}
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/sshpiperd/piperd"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// execConnHook runs OnConnect or OnClose with sh in background, details of
+// the connection are passed in SSHPIPER_* env
+func execConnHook(event piperd.ConnEvent) {
+	command := OnConnect
+	if event.Type == piperd.ConnClosed {
+		command = OnClose
+	}
+
+	if command == "" {
+		return
+	}
+
+	addr := func(a interface{ String() string }) string {
+		if a == nil {
+			return ""
+		}
+		return a.String()
+	}
+
+	env := []string{
+		"SSHPIPER_EVENT=" + event.Type,
+		"SSHPIPER_USER=" + event.User,
+		"SSHPIPER_DOWNSTREAM=" + addr(event.Downstream),
+		"SSHPIPER_UPSTREAM=" + addr(event.Upstream),
+		fmt.Sprintf("SSHPIPER_BYTES_IN=%d", event.BytesIn),
+		fmt.Sprintf("SSHPIPER_BYTES_OUT=%d", event.BytesOut),
+		fmt.Sprintf("SSHPIPER_DURATION=%.3f", event.Duration.Seconds()),
+	}
+
+	var offered []string
+	for _, k := range event.OfferedKeys {
+		offered = append(offered, fingerprint(k.Key))
+		if k.Accepted {
+			env = append(env, "SSHPIPER_KEY="+fingerprint(k.Key))
+		}
+	}
+	env = append(env, "SSHPIPER_OFFERED_KEYS="+strings.Join(offered, ","))
+
+	// SSHPIPER_LABEL_TEAM for label team
+	for k, v := range event.Labels {
+		env = append(env, "SSHPIPER_LABEL_"+labelEnvName(k)+"="+v)
+	}
+
+	if id := event.UpstreamIdentity; id != nil {
+		if id.HostKey != nil {
+			env = append(env, "SSHPIPER_UPSTREAM_HOST_KEY="+fingerprint(id.HostKey))
+		}
+		env = append(env,
+			"SSHPIPER_UPSTREAM_VERSION="+id.ServerVersion,
+			"SSHPIPER_UPSTREAM_KEX="+id.Algorithms.Kex,
+			"SSHPIPER_UPSTREAM_CIPHER="+id.Algorithms.Write.Cipher,
+		)
+	}
+
+	if event.Err != nil {
+		env = append(env, "SSHPIPER_CLOSE_REASON="+event.Err.Error())
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		logger.Printf("%v hook failed: %v", event.Type, err)
+		return
+	}
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			logger.Printf("%v hook for [%v] failed: %v", event.Type, event.User, err)
+		}
+	}()
+}
+
+// labelEnvName upper cases k, characters not valid in env names become _
+func labelEnvName(k string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, k)
+}
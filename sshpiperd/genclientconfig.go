@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func init() {
+	subCommands["genclientconfig"] = runGenClientConfig
+}
+
+// genclientconfig prints a ~/.ssh/config stanza for user to log in through
+// the piper, and writes a PuTTY session with -putty
+func runGenClientConfig(args []string) error {
+	fs := flag.NewFlagSet("genclientconfig", flag.ExitOnError)
+	host := fs.String("host", "", "Host name users reach sshpiperd by, empty for this host's name")
+	port := fs.Uint("port", Port, "Port users reach sshpiperd on, differs from -p behind a balancer")
+	alias := fs.String("alias", "", "Host alias in the stanza, empty for the name of the user's first upstream")
+	identity := fs.String("identity", "", "Private key file on the user's machine, empty to leave it to the client")
+	putty := fs.String("putty", "", "Also write a PuTTY session .reg file here, empty for none")
+
+	user, err := pipeUser(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *host == "" {
+		if *host, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	target := ""
+	if Provider == "workingdir" {
+		targets, err := readUpstreamTargets(userWorkingDir(user), user)
+		if err != nil {
+			return fmt.Errorf("%v has no pipe: %v", user, err)
+		}
+		target = targets[0].name
+	}
+
+	if *alias == "" {
+		*alias = target
+	}
+	if *alias == "" {
+		*alias = user
+	}
+	// ssh_config patterns split on spaces
+	*alias = strings.Join(strings.Fields(*alias), "-")
+
+	fmt.Print(clientConfig(user, target, *alias, *host, *port, *identity))
+
+	if *putty != "" {
+		if err := ioutil.WriteFile(*putty, puttySession(user, *alias, *host, *port, *identity), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func clientConfig(user, target, alias, host string, port uint, identity string) string {
+	var b bytes.Buffer
+
+	if target != "" {
+		fmt.Fprintf(&b, "# %v to %v through sshpiperd\n", user, target)
+	} else {
+		fmt.Fprintf(&b, "# %v through sshpiperd\n", user)
+	}
+
+	if line := piperKnownHost(host, port); line != "" {
+		fmt.Fprintf(&b, "# host key, add to ~/.ssh/known_hosts:\n# %v\n", line)
+	}
+
+	fmt.Fprintf(&b, "Host %v\n", alias)
+	fmt.Fprintf(&b, "    HostName %v\n", host)
+	fmt.Fprintf(&b, "    Port %d\n", port)
+	fmt.Fprintf(&b, "    User %v\n", user)
+	if identity != "" {
+		fmt.Fprintf(&b, "    IdentityFile %v\n", identity)
+		fmt.Fprintf(&b, "    IdentitiesOnly yes\n")
+	}
+
+	return b.String()
+}
+
+// piperKnownHost is the known_hosts line of the piper's host key, empty if
+// -i cannot be read, e.g. not run as the daemon's user
+func piperKnownHost(host string, port uint) string {
+	data, err := ioutil.ReadFile(PiperKeyFile)
+	if err != nil {
+		return ""
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return ""
+	}
+
+	if port != 22 {
+		host = fmt.Sprintf("[%v]:%d", host, port)
+	}
+
+	return host + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+// puttySession is a .reg file adding a saved session to PuTTY. PuTTY wants
+// identity in its own .ppk format.
+func puttySession(user, alias, host string, port uint, identity string) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("Windows Registry Editor Version 5.00\r\n\r\n")
+	fmt.Fprintf(&b, "[HKEY_CURRENT_USER\\Software\\SimonTatham\\PuTTY\\Sessions\\%v]\r\n", puttyEscape(alias))
+	fmt.Fprintf(&b, "\"HostName\"=\"%v\"\r\n", regString(host))
+	fmt.Fprintf(&b, "\"PortNumber\"=dword:%08x\r\n", port)
+	fmt.Fprintf(&b, "\"UserName\"=\"%v\"\r\n", regString(user))
+	b.WriteString("\"Protocol\"=\"ssh\"\r\n")
+	if identity != "" {
+		fmt.Fprintf(&b, "\"PublicKeyFile\"=\"%v\"\r\n", regString(identity))
+	}
+
+	return b.Bytes()
+}
+
+// puttyEscape escapes a session name like PuTTY does in registry keys
+func puttyEscape(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-_.@+", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func regString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
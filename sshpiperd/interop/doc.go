@@ -0,0 +1,14 @@
+// Package interop holds tests driving real OpenSSH clients and servers
+// through the piper.
+//
+// Each ssh client is run against each upstream, an in-process Go server and
+// every sshd found, checking publickey mapping, banners, keepalives and bulk
+// transfer. Binaries are taken from $PATH, or from comma separated lists in
+// SSHPIPER_INTEROP_SSH and SSHPIPER_INTEROP_SSHD to test several OpenSSH
+// versions at once, e.g.
+//
+//	SSHPIPER_INTEROP_SSHD=/opt/openssh-7.4/sbin/sshd,/opt/openssh-9.6/sbin/sshd \
+//	go test ./sshpiperd/interop
+//
+// The tests are skipped with -short or when no ssh client is found.
+package interop
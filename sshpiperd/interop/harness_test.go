@@ -0,0 +1,395 @@
+package interop
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/piperd"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// testKey is a key with its private half in PEM, as OpenSSH reads it
+type testKey struct {
+	ssh.Signer
+	pem []byte
+}
+
+func newTestKey(t *testing.T) testKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testKey{s, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})}
+}
+
+// write saves the private key to file, OpenSSH refuses keys others can read
+func (k testKey) write(t *testing.T, file string) string {
+	if err := ioutil.WriteFile(file, k.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// binaries returns the comma separated list in env, or name in $PATH
+func binaries(env, name string) []string {
+	if list := os.Getenv(env); list != "" {
+		return strings.Split(list, ",")
+	}
+
+	if bin, err := exec.LookPath(name); err == nil {
+		return []string{bin}
+	}
+
+	// sshd is often outside a user's $PATH
+	for _, bin := range []string{"/usr/sbin/" + name, "/usr/local/sbin/" + name} {
+		if _, err := os.Stat(bin); err == nil {
+			return []string{bin}
+		}
+	}
+
+	return nil
+}
+
+// version returns the OpenSSH version of bin from -V, sshd prints it with
+// its usage
+func version(bin string) string {
+	out, _ := exec.Command(bin, "-V").CombinedOutput()
+	for _, f := range strings.FieldsFunc(string(out), func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+		if strings.HasPrefix(f, "OpenSSH") {
+			return f
+		}
+	}
+	return filepath.Base(bin)
+}
+
+func currentUser(t *testing.T) string {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Username
+}
+
+// testUpstream is a server the piper connects to
+type testUpstream struct {
+	name string
+	addr string
+	// user to log in as
+	user  string
+	close func()
+}
+
+// startGoUpstream serves commands run by the tests in process, it is always
+// there to tell a broken client from a broken sshd
+func startGoUpstream(t *testing.T, authorized ssh.PublicKey) *testUpstream {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(newTestKey(t))
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				conn, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				go ssh.DiscardRequests(reqs)
+				for newCh := range chans {
+					if newCh.ChannelType() != "session" {
+						newCh.Reject(ssh.UnknownChannelType, "session only")
+						continue
+					}
+
+					ch, reqs, err := newCh.Accept()
+					if err != nil {
+						continue
+					}
+					go serveSession(ch, reqs)
+				}
+			}()
+		}
+	}()
+
+	return &testUpstream{
+		name:  "go",
+		addr:  l.Addr().String(),
+		user:  "interop",
+		close: func() { l.Close() },
+	}
+}
+
+// serveSession runs the commands the tests send: echo, sleep and sha256sum
+// of stdin
+func serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			// env, pty-req and the like
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+
+		status := runCommand(ch, payload.Command)
+		ch.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+func runCommand(ch ssh.Channel, command string) uint32 {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return 127
+	}
+
+	switch args[0] {
+	case "echo":
+		fmt.Fprintln(ch, strings.Join(args[1:], " "))
+	case "sleep":
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return 1
+		}
+		time.Sleep(time.Duration(n) * time.Second)
+	case "sha256sum":
+		h := sha256.New()
+		if _, err := io.Copy(h, ch); err != nil {
+			return 1
+		}
+		fmt.Fprintf(ch, "%x  -\n", h.Sum(nil))
+	default:
+		fmt.Fprintf(ch.Stderr(), "%v: command not found\n", args[0])
+		return 127
+	}
+
+	return 0
+}
+
+var sshdConfig = template.Must(template.New("sshd_config").Parse(`
+ListenAddress {{.Addr}}
+HostKey {{.Dir}}/host_key
+PidFile {{.Dir}}/sshd.pid
+AuthorizedKeysFile {{.Dir}}/authorized_keys
+StrictModes no
+PubkeyAuthentication yes
+PasswordAuthentication no
+ChallengeResponseAuthentication no
+UsePAM no
+LogLevel DEBUG2
+`))
+
+// startSSHD runs bin as upstream allowing authorized to log in as the
+// current user
+func startSSHD(t *testing.T, bin string, authorized ssh.PublicKey) *testUpstream {
+	dir, err := ioutil.TempDir("", "sshpiper-interop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a free port, sshd cannot take a listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	newTestKey(t).write(t, filepath.Join(dir, "host_key"))
+	if err := ioutil.WriteFile(filepath.Join(dir, "authorized_keys"), ssh.MarshalAuthorizedKey(authorized), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(dir, "sshd_config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sshdConfig.Execute(f, map[string]string{"Addr": addr, "Dir": dir})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	cmd := exec.Command(bin, "-D", "-e", "-f", filepath.Join(dir, "sshd_config"))
+	cmd.Stdout = &log
+	cmd.Stderr = &log
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("start %v: %v", bin, err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	stop := func() {
+		cmd.Process.Kill()
+		<-exited
+		os.RemoveAll(dir)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+
+		select {
+		case <-exited:
+			os.RemoveAll(dir)
+			t.Fatalf("%v exited: %s", bin, log.String())
+		default:
+		}
+
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatalf("%v not listening on %v: %s", bin, addr, log.String())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return &testUpstream{
+		name:  version(bin),
+		addr:  addr,
+		user:  currentUser(t),
+		close: stop,
+	}
+}
+
+// startPiper runs a daemon in front of up, mapping client to upstreamKey
+func startPiper(t *testing.T, up *testUpstream, client ssh.PublicKey, upstreamKey ssh.Signer, opts ...piperd.Option) (addr string, stop func()) {
+	provider := &upstream.Fake{
+		Addr:           up.addr,
+		User:           up.user,
+		AuthorizedKeys: []ssh.PublicKey{client},
+		Signer:         upstreamKey,
+	}
+
+	d, err := piperd.New(append([]piperd.Option{
+		piperd.WithProvider(provider),
+		piperd.WithHostKey(newTestKey(t)),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	return l.Addr().String(), func() { d.Close() }
+}
+
+// sshClient runs a real ssh client through the piper
+type sshClient struct {
+	bin     string
+	keyFile string
+	addr    string
+}
+
+// run runs command with stdin and returns its stdout and stderr
+func (c sshClient) run(stdin io.Reader, command string, opts ...string) (stdout, stderr []byte, err error) {
+	host, port, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args := []string{
+		"-F", "/dev/null",
+		"-p", port,
+		"-i", c.keyFile,
+		"-o", "IdentitiesOnly=yes",
+		"-o", "BatchMode=yes",
+		"-o", "PasswordAuthentication=no",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "ConnectTimeout=10",
+	}
+	for _, o := range opts {
+		args = append(args, "-o", o)
+	}
+	args = append(args, "interop@"+host, command)
+
+	var out, errOut bytes.Buffer
+	cmd := exec.Command(c.bin, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+
+	done := make(chan error, 1)
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-time.After(time.Minute):
+		cmd.Process.Kill()
+		err = fmt.Errorf("%v timed out", c.bin)
+		<-done
+	}
+
+	return out.Bytes(), errOut.Bytes(), err
+}
@@ -0,0 +1,114 @@
+package interop
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"github.com/tg123/sshpiper/sshpiperd/piperd"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBanner = "sshpiper interop banner\n"
+
+func TestInterop(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping interop tests in short mode")
+	}
+
+	clients := binaries("SSHPIPER_INTEROP_SSH", "ssh")
+	if len(clients) == 0 {
+		t.Skip("no ssh client found")
+	}
+
+	dir, err := ioutil.TempDir("", "sshpiper-interop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientKey := newTestKey(t)
+	keyFile := clientKey.write(t, filepath.Join(dir, "id_ecdsa"))
+	upstreamKey := newTestKey(t)
+
+	upstreams := []func(t *testing.T) *testUpstream{
+		func(t *testing.T) *testUpstream { return startGoUpstream(t, upstreamKey.PublicKey()) },
+	}
+	for _, bin := range binaries("SSHPIPER_INTEROP_SSHD", "sshd") {
+		bin := bin
+		upstreams = append(upstreams, func(t *testing.T) *testUpstream { return startSSHD(t, bin, upstreamKey.PublicKey()) })
+	}
+
+	for _, start := range upstreams {
+		up := start(t)
+
+		addr, stop := startPiper(t, up, clientKey.PublicKey(), upstreamKey,
+			piperd.WithBanner(testBanner),
+			piperd.WithClientAlive(time.Second, 3),
+		)
+
+		for _, bin := range clients {
+			c := sshClient{bin: bin, keyFile: keyFile, addr: addr}
+			t.Run(fmt.Sprintf("%v/%v", version(bin), up.name), func(t *testing.T) {
+				testInterop(t, c)
+			})
+		}
+
+		stop()
+		up.close()
+	}
+}
+
+func testInterop(t *testing.T, c sshClient) {
+	t.Run("publickey", func(t *testing.T) {
+		out, errOut, err := c.run(nil, "echo interop")
+		if err != nil {
+			t.Fatalf("%v: %s", err, errOut)
+		}
+
+		if string(out) != "interop\n" {
+			t.Errorf("output %q, want %q", out, "interop\n")
+		}
+	})
+
+	t.Run("banner", func(t *testing.T) {
+		_, errOut, err := c.run(nil, "echo interop", "LogLevel=INFO")
+		if err != nil {
+			t.Fatalf("%v: %s", err, errOut)
+		}
+
+		if !strings.Contains(string(errOut), strings.TrimSpace(testBanner)) {
+			t.Errorf("banner not shown: %q", errOut)
+		}
+	})
+
+	t.Run("keepalive", func(t *testing.T) {
+		// both sides probe each second while the command is idle
+		_, errOut, err := c.run(nil, "sleep 4", "ServerAliveInterval=1", "ServerAliveCountMax=2")
+		if err != nil {
+			t.Fatalf("%v: %s", err, errOut)
+		}
+	})
+
+	t.Run("bulk", func(t *testing.T) {
+		data := make([]byte, 16<<20)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+
+		out, errOut, err := c.run(bytes.NewReader(data), "sha256sum")
+		if err != nil {
+			t.Fatalf("%v: %s", err, errOut)
+		}
+
+		want := fmt.Sprintf("%x", sha256.Sum256(data))
+		if got := strings.Fields(string(out)); len(got) == 0 || got[0] != want {
+			t.Errorf("sha256 %q, want %v", out, want)
+		}
+	})
+}
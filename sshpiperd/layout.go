@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// layoutToken matches %d, %u, %u[i:j] and %{domain} in -w-layout
+var layoutToken = regexp.MustCompile(`%d|%u\[(\d*):(\d*)\]|%u|%\{domain\}`)
+
+// checkWorkingDirLayout tells whether layout expands to one dir per user,
+// its last element must be %u so users can be listed back from dirs
+func checkWorkingDirLayout(layout string) error {
+	rest := layoutToken.ReplaceAllString(layout, "")
+	if strings.Contains(rest, "%") {
+		return fmt.Errorf("working dir layout %v: unknown %% token, want %%d, %%u, %%u[i:j] or %%{domain}", layout)
+	}
+
+	if !strings.HasSuffix(layout, "/%u") && layout != "%u" {
+		return fmt.Errorf("working dir layout %v: must end with /%%u", layout)
+	}
+
+	for _, m := range layoutToken.FindAllStringSubmatch(layout, -1) {
+		if m[1] == "" || m[2] == "" {
+			continue
+		}
+
+		if atoi(m[1]) > atoi(m[2]) {
+			return fmt.Errorf("working dir layout %v: bad range %v", layout, m[0])
+		}
+	}
+
+	return nil
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
+
+// workingDir is a root of user dirs laid out by layout, -w and -w-layout or
+// one of -tenants
+type workingDir struct {
+	root   string
+	layout string
+}
+
+func defaultWorkingDir() workingDir {
+	return workingDir{WorkingDir, WorkingDirLayout}
+}
+
+// userDir expands the layout of user's working dir for user
+func userDir(user string) string {
+	return userWorkingDir(user).userDir(user)
+}
+
+// userDir expands the layout for user, empty if the layout has %{domain}
+// and user has none, or if user could lead out of its dir
+func (w workingDir) userDir(user string) string {
+	if unsafeUser(user) {
+		return ""
+	}
+
+	domain := ""
+	if i := strings.LastIndex(user, "@"); i >= 0 {
+		domain = user[i+1:]
+	}
+
+	missing := false
+	dir := layoutToken.ReplaceAllStringFunc(w.layout, func(token string) string {
+		switch token {
+		case "%d":
+			return w.root
+		case "%u":
+			return user
+		case "%{domain}":
+			if domain == "" {
+				missing = true
+			}
+			return domain
+		}
+
+		// %u[i:j], out of range bounds are clamped, so short names still map
+		m := layoutToken.FindStringSubmatch(token)
+		r := []rune(user)
+		i, j := 0, len(r)
+		if m[1] != "" {
+			i = atoi(m[1])
+		}
+		if m[2] != "" {
+			j = atoi(m[2])
+		}
+		if j > len(r) {
+			j = len(r)
+		}
+		if i > j {
+			i = j
+		}
+		return string(r[i:j])
+	})
+
+	if missing {
+		return ""
+	}
+
+	return filepath.Clean(dir)
+}
+
+// unsafeUser tells whether user, or its domain which is part of it, would
+// expand to a path out of its dir, e.g. ../bob or alice@../../etc
+func unsafeUser(user string) bool {
+	return user == "" || user == "." || strings.Contains(user, "..") || strings.ContainsAny(user, "/\\\x00")
+}
+
+// users lists users with a dir in the layout, in path order
+func (w workingDir) users() ([]string, error) {
+	if _, err := os.Stat(w.root); err != nil {
+		return nil, err
+	}
+
+	pattern := layoutToken.ReplaceAllStringFunc(w.layout, func(token string) string {
+		if token == "%d" {
+			return w.root
+		}
+		return "*"
+	})
+
+	dirs, err := filepath.Glob(filepath.Clean(pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	var users []string
+	for _, dir := range dirs {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+
+		// e.g. alice misplaced in the shard of bob
+		user := filepath.Base(dir)
+		if w.userDir(user) != dir {
+			continue
+		}
+
+		users = append(users, user)
+	}
+
+	return users, nil
+}
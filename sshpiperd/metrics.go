@@ -0,0 +1,140 @@
+package main
+
+import (
+	"expvar"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/audit"
+	"github.com/tg123/sshpiper/sshpiperd/piperd"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// metrics are exported by expvar at http://[MetricsAddr]/debug/vars
+var (
+	phaseConns = expvar.NewMap("phase_connections")
+
+	// connections failed before key exchange, by kind
+	probes = expvar.NewMap("probes")
+
+	// established connections by label, key=value
+	labelConns = expvar.NewMap("label_connections")
+
+	labelValuesMu sync.Mutex
+	labelValues   = make(map[string]map[string]bool)
+
+	connPhasesMu sync.Mutex
+	connPhases   = make(map[net.Conn]ssh.PipePhase)
+)
+
+func init() {
+	for _, phase := range []ssh.PipePhase{ssh.PhaseHandshake, ssh.PhaseAuth, ssh.PhasePiping} {
+		phaseConns.Add(phase.String(), 0)
+	}
+}
+
+// trackPhase counts connections in each phase, used as piper.PhaseHook
+func trackPhase(conn net.Conn, phase ssh.PipePhase) {
+	connPhasesMu.Lock()
+	defer connPhasesMu.Unlock()
+
+	if last, ok := connPhases[conn]; ok {
+		phaseConns.Add(last.String(), -1)
+	}
+
+	if phase == ssh.PhaseClosed {
+		delete(connPhases, conn)
+		return
+	}
+
+	connPhases[conn] = phase
+	phaseConns.Add(phase.String(), 1)
+}
+
+// countProbe counts probes by kind, used as probe hook
+func countProbe(remote net.Addr, kind string) {
+	probes.Add(kind, 1)
+}
+
+// label sets are bounded, so a provider labelling e.g. by ticket id does not
+// grow metrics without limit. Keys beyond maxLabelKeys are not counted,
+// values beyond maxLabelValues of a key are counted as key=other.
+const (
+	maxLabelKeys   = 16
+	maxLabelValues = 64
+)
+
+// countLabels counts established connections by label, used as conn hook
+func countLabels(event piperd.ConnEvent) {
+	delta := int64(1)
+	if event.Type == piperd.ConnClosed {
+		delta = -1
+	}
+
+	for k, v := range event.Labels {
+		if name, ok := labelMetric(k, v); ok {
+			labelConns.Add(name, delta)
+		}
+	}
+}
+
+func labelMetric(k, v string) (string, bool) {
+	labelValuesMu.Lock()
+	defer labelValuesMu.Unlock()
+
+	values, ok := labelValues[k]
+	if !ok {
+		if len(labelValues) >= maxLabelKeys {
+			return "", false
+		}
+
+		values = make(map[string]bool)
+		labelValues[k] = values
+	}
+
+	if !values[v] {
+		if len(values) >= maxLabelValues {
+			return k + "=other", true
+		}
+
+		values[v] = true
+	}
+
+	return k + "=" + v, true
+}
+
+// publishUpstreams exports bytes and sessions of each upstream as upstreams
+func publishUpstreams(d *piperd.Daemon) {
+	expvar.Publish("upstreams", expvar.Func(func() interface{} {
+		return d.UpstreamStats()
+	}))
+}
+
+// publishCredentials exports pipes by upstream key version as credentials
+func publishCredentials(d *piperd.Daemon) {
+	expvar.Publish("credentials", expvar.Func(func() interface{} {
+		return d.CredentialStats()
+	}))
+}
+
+// publishAuditQueue exports events waiting in the audit queue, dropped as it
+// was full and failed sends to the sink as audit_queue
+func publishAuditQueue(q *audit.Queue) {
+	expvar.Publish("audit_queue", expvar.Func(func() interface{} {
+		return map[string]int64{
+			"pending": int64(q.Pending()),
+			"dropped": q.Dropped(),
+			"retries": q.Retries(),
+		}
+	}))
+}
+
+func startMetrics(addr string) error {
+	l, err := sockets.listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go http.Serve(l, nil)
+	return nil
+}
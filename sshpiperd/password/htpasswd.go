@@ -0,0 +1,295 @@
+package password
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"hash"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// hashes checks a password against a hash by the prefix of the hash,
+// bcrypt is added when built with -tags bcrypt
+var hashes = map[string]func(hash, password string) bool{
+	"{SHA}":  checkSHA1,
+	"$apr1$": checkMD5Crypt,
+	"$1$":    checkMD5Crypt,
+	"$5$":    checkSHACrypt,
+	"$6$":    checkSHACrypt,
+}
+
+// Htpasswd verifies passwords against file, lines of user:hash as htpasswd
+// writes them. Apache MD5, SHA-1, and crypt MD5, SHA-256 and SHA-512 hashes
+// are understood. file is read on each login, so edits apply at once.
+func Htpasswd(file string) Verifier {
+	return func(conn ssh.ConnMetadata, password string) (bool, error) {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+
+		hash, ok := htpasswdHash(data, conn.User())
+		if !ok {
+			return false, nil
+		}
+
+		for prefix, check := range hashes {
+			if strings.HasPrefix(hash, prefix) {
+				return check(hash, password), nil
+			}
+		}
+
+		return false, fmt.Errorf("%v: unsupported hash of user %v", file, conn.User())
+	}
+}
+
+// htpasswdHash returns the hash of user in an htpasswd file
+func htpasswdHash(data []byte, user string) (string, bool) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && kv[0] == user {
+			return kv[1], true
+		}
+	}
+
+	return "", false
+}
+
+func checkSHA1(hash, password string) bool {
+	sum := sha1.Sum([]byte(password))
+	return equal(strings.TrimPrefix(hash, "{SHA}"), base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// alphabet of crypt(3) base64
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// cryptEncode encodes sum in groups of 3 bytes picked by order, low 6 bits
+// first, as crypt(3) does. The last group is short if order is.
+func cryptEncode(sum []byte, order [][]int) string {
+	var b strings.Builder
+	for _, g := range order {
+		v, n := 0, len(g)+1
+		for _, i := range g {
+			v = v<<8 | int(sum[i])
+		}
+		for ; n > 0; n-- {
+			b.WriteByte(cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	return b.String()
+}
+
+// splitCrypt splits $id$salt$sum into its prefix, salt and sum, the salt
+// may start with rounds=<n>$
+func splitCrypt(hash string) (prefix, salt, sum string, ok bool) {
+	i := strings.LastIndexByte(hash, '$')
+	j := strings.IndexByte(hash[1:], '$') + 2
+	if i < j {
+		return "", "", "", false
+	}
+	return hash[:j], hash[j:i], hash[i+1:], true
+}
+
+var md5CryptOrder = [][]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}, {11}}
+
+// checkMD5Crypt checks $1$ of crypt(3) and $apr1$ of apache, the same but
+// for the prefix
+func checkMD5Crypt(hash, password string) bool {
+	prefix, salt, sum, ok := splitCrypt(hash)
+	if !ok {
+		return false
+	}
+
+	return equal(md5Crypt(password, prefix, salt), sum)
+}
+
+func md5Crypt(password, prefix, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	h := md5.New()
+	h.Write([]byte(password + prefix + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write([]byte(password[:1]))
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write([]byte(password))
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write([]byte(password))
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write([]byte(password))
+		}
+		final = h.Sum(nil)
+	}
+
+	return cryptEncode(final, md5CryptOrder)
+}
+
+var (
+	sha256CryptOrder = [][]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+		{31, 30},
+	}
+	sha512CryptOrder = [][]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41}, {63},
+	}
+)
+
+// checkSHACrypt checks $5$ and $6$ of crypt(3), SHA-256 and SHA-512
+func checkSHACrypt(hash, password string) bool {
+	prefix, salt, sum, ok := splitCrypt(hash)
+	if !ok {
+		return false
+	}
+
+	rounds := 5000
+	if strings.HasPrefix(salt, "rounds=") {
+		kv := strings.SplitN(strings.TrimPrefix(salt, "rounds="), "$", 2)
+		if len(kv) != 2 {
+			return false
+		}
+
+		n, err := strconv.Atoi(kv[0])
+		if err != nil {
+			return false
+		}
+
+		rounds, salt = n, kv[1]
+		if rounds < 1000 {
+			rounds = 1000
+		}
+		if rounds > 999999999 {
+			rounds = 999999999
+		}
+	}
+
+	if prefix == "$5$" {
+		return equal(shaCrypt(sha256.New, sha256CryptOrder, password, salt, rounds), sum)
+	}
+	return equal(shaCrypt(sha512.New, sha512CryptOrder, password, salt, rounds), sum)
+}
+
+func shaCrypt(newHash func() hash.Hash, order [][]int, password, salt string, rounds int) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	h := newHash()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+
+	h = newHash()
+	h.Write(p)
+	h.Write(s)
+	h.Write(repeatTo(b, len(p)))
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h = newHash()
+	for range p {
+		h.Write(p)
+	}
+	dp := h.Sum(nil)
+
+	h = newHash()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(s)
+	}
+	ds := h.Sum(nil)
+
+	pBytes, sBytes := repeatTo(dp, len(p)), repeatTo(ds, len(s))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h := newHash()
+		if i&1 != 0 {
+			h.Write(pBytes)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sBytes)
+		}
+		if i%7 != 0 {
+			h.Write(pBytes)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pBytes)
+		}
+		c = h.Sum(nil)
+	}
+
+	return cryptEncode(c, order)
+}
+
+// repeatTo repeats sum up to n bytes
+func repeatTo(sum []byte, n int) []byte {
+	var b []byte
+	for len(b) < n {
+		b = append(b, sum...)
+	}
+	return b[:n]
+}
@@ -0,0 +1,18 @@
+//go:build bcrypt
+// +build bcrypt
+
+package password
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		hashes[prefix] = checkBcrypt
+	}
+}
+
+func checkBcrypt(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
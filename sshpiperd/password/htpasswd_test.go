@@ -0,0 +1,71 @@
+package password
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testConnMeta struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c testConnMeta) User() string {
+	return c.user
+}
+
+func TestHashes(t *testing.T) {
+	for _, tt := range []struct {
+		hash string
+	}{
+		// openssl passwd -apr1, -1, -5, -6
+		{"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/"},
+		{"$1$abcdefgh$cHJi5PXp/ki/ktXzqlk6I1"},
+		{"$5$saltsalt$0IyaXrmV7.sGNS6tirgqHLqX/G.FBvgkYA.lpPdS5sA"},
+		{"$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1"},
+		// htpasswd -s
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="},
+	} {
+		dir, err := ioutil.TempDir("", "htpasswd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		file := filepath.Join(dir, "htpasswd")
+		if err := ioutil.WriteFile(file, []byte("# users\nbob:{SHA}x\nalice:"+tt.hash+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		verify := Htpasswd(file)
+
+		if ok, err := verify(testConnMeta{user: "alice"}, "secret"); !ok || err != nil {
+			t.Errorf("%v: secret not verified: %v", tt.hash, err)
+		}
+
+		if ok, _ := verify(testConnMeta{user: "alice"}, "secreT"); ok {
+			t.Errorf("%v: wrong password verified", tt.hash)
+		}
+
+		if ok, _ := verify(testConnMeta{user: "carol"}, "secret"); ok {
+			t.Errorf("%v: user not in file verified", tt.hash)
+		}
+	}
+}
+
+func TestSHACryptRounds(t *testing.T) {
+	// the spec of Ulrich Drepper, test vectors
+	for _, tt := range []struct {
+		password, hash string
+	}{
+		{"Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{"Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+	} {
+		if !checkSHACrypt(tt.hash, tt.password) {
+			t.Errorf("%v not verified", tt.hash)
+		}
+	}
+}
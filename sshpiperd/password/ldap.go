@@ -0,0 +1,281 @@
+package password
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// LDAPTimeout bounds dialing and binding to the LDAP server
+var LDAPTimeout = 10 * time.Second
+
+// LDAPPlaintext lets ParseLDAP take ldap:// urls, whose binds send passwords
+// in cleartext
+var LDAPPlaintext = false
+
+// maxLDAPValue caps the dn and password of a bind, longer ones are refused
+// unsent
+const maxLDAPValue = 1024
+
+// LDAP result codes, RFC 4511 section 4.1.9
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// ldapServer binds as users to check their passwords
+type ldapServer struct {
+	addr string
+	tls  bool
+	// %s is replaced with the escaped user
+	bindDN string
+}
+
+// ParseLDAP returns a verifier binding to the server of u, ldaps://, or
+// ldap:// if LDAPPlaintext, as the dn in its path with %s replaced with the
+// user, e.g. ldaps://ldap.example.com/uid=%s,ou=people,dc=example,dc=com
+func ParseLDAP(u string) (Verifier, error) {
+	s := &ldapServer{tls: strings.HasPrefix(u, "ldaps://")}
+
+	if !s.tls && !LDAPPlaintext {
+		return nil, fmt.Errorf("ldap: %v sends passwords in cleartext, use ldaps:// or allow plaintext", u)
+	}
+
+	// not a url, %s is no escape
+	rest := strings.TrimPrefix(strings.TrimPrefix(u, "ldap://"), "ldaps://")
+	kv := strings.SplitN(rest, "/", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return nil, fmt.Errorf("ldap: want ldap[s]://<host>/<bind dn>, got %v", u)
+	}
+	s.addr, s.bindDN = kv[0], kv[1]
+
+	if _, _, err := net.SplitHostPort(s.addr); err != nil {
+		port := "389"
+		if s.tls {
+			port = "636"
+		}
+		s.addr = net.JoinHostPort(strings.Trim(s.addr, "[]"), port)
+	}
+
+	if strings.Count(s.bindDN, "%s") != 1 {
+		return nil, fmt.Errorf("ldap: bind dn %q must have one %%s for the user", s.bindDN)
+	}
+
+	return s.verify, nil
+}
+
+func (s *ldapServer) verify(conn ssh.ConnMetadata, password string) (bool, error) {
+	// an empty password is an unauthenticated bind, which succeeds
+	if password == "" {
+		return false, nil
+	}
+
+	dn := strings.Replace(s.bindDN, "%s", escapeDN(conn.User()), 1)
+	if len(dn) > maxLDAPValue || len(password) > maxLDAPValue {
+		return false, fmt.Errorf("ldap: dn or password longer than %d bytes", maxLDAPValue)
+	}
+
+	dialer := &net.Dialer{Timeout: LDAPTimeout}
+
+	var c net.Conn
+	var err error
+	if s.tls {
+		host, _, _ := net.SplitHostPort(s.addr)
+		c, err = tls.DialWithDialer(dialer, "tcp", s.addr, &tls.Config{ServerName: host})
+	} else {
+		c, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(LDAPTimeout))
+
+	if _, err := c.Write(ldapBindRequest(1, dn, password)); err != nil {
+		return false, err
+	}
+
+	code, diag, err := readLDAPBindResponse(bufio.NewReader(c))
+	if err != nil {
+		return false, err
+	}
+
+	// unbind, the server closes
+	c.Write(berTLV(0x30, append(berInt(2), 0x42, 0)))
+
+	switch code {
+	case ldapSuccess:
+		return true, nil
+	case ldapInvalidCredentials:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("ldap: bind as %v: result %d %v", dn, code, diag)
+}
+
+// escapeDN escapes user as a dn attribute value, RFC 4514 section 2.4
+func escapeDN(user string) string {
+	var b strings.Builder
+	for i := 0; i < len(user); i++ {
+		c := user[i]
+		switch {
+		case strings.IndexByte(`"+,;<>\=`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(user)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapBindRequest is a simple bind LDAPMessage, RFC 4511 section 4.2
+func ldapBindRequest(id int, dn, password string) []byte {
+	var bind []byte
+	bind = append(bind, berInt(3)...)
+	bind = append(bind, berTLV(0x04, []byte(dn))...)
+	bind = append(bind, berTLV(0x80, []byte(password))...)
+
+	msg := append(berInt(id), berTLV(0x60, bind)...)
+	return berTLV(0x30, msg)
+}
+
+// berInt encodes small non-negative ints, all an LDAPMessage needs here
+func berInt(v int) []byte {
+	return berTLV(0x02, []byte{byte(v)})
+}
+
+func berTLV(tag byte, value []byte) []byte {
+	b := []byte{tag}
+
+	n := len(value)
+	if n < 0x80 {
+		b = append(b, byte(n))
+		return append(b, value...)
+	}
+
+	// long form, the count of big endian length bytes first
+	var l []byte
+	for ; n > 0; n >>= 8 {
+		l = append([]byte{byte(n)}, l...)
+	}
+	b = append(b, 0x80|byte(len(l)))
+	b = append(b, l...)
+
+	return append(b, value...)
+}
+
+var errBadLDAPResponse = errors.New("ldap: malformed bind response")
+
+// readLDAPBindResponse reads the result code and diagnostic message of a
+// BindResponse
+func readLDAPBindResponse(r *bufio.Reader) (code int, diag string, err error) {
+	tag, msg, err := readBER(r)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != 0x30 {
+		return 0, "", errBadLDAPResponse
+	}
+
+	// message id
+	_, _, rest, err := splitBER(msg)
+	if err != nil {
+		return 0, "", err
+	}
+
+	tag, resp, _, err := splitBER(rest)
+	if err != nil || tag != 0x61 {
+		return 0, "", errBadLDAPResponse
+	}
+
+	// resultCode, matchedDN, diagnosticMessage
+	var fields [][]byte
+	for i := 0; i < 3; i++ {
+		var v []byte
+		if _, v, resp, err = splitBER(resp); err != nil {
+			return 0, "", err
+		}
+		fields = append(fields, v)
+	}
+
+	if len(fields[0]) != 1 {
+		return 0, "", errBadLDAPResponse
+	}
+
+	return int(fields[0][0]), string(fields[2]), nil
+}
+
+// readBER reads one element from r
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := int(n)
+	if n&0x80 != 0 {
+		if n&0x7f > 3 {
+			return 0, nil, errBadLDAPResponse
+		}
+
+		length = 0
+		for i := 0; i < int(n&0x7f); i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+
+	return tag, value, nil
+}
+
+// splitBER splits the first element of b from the rest
+func splitBER(b []byte) (tag byte, value, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errBadLDAPResponse
+	}
+
+	tag, length, b := b[0], int(b[1]), b[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n > 3 || len(b) < n {
+			return 0, nil, nil, errBadLDAPResponse
+		}
+
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+
+	if len(b) < length {
+		return 0, nil, nil, errBadLDAPResponse
+	}
+
+	return tag, b[:length], b[length:], nil
+}
@@ -0,0 +1,107 @@
+package password
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBERLength(t *testing.T) {
+	for _, n := range []int{0, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000} {
+		tag, v, rest, err := splitBER(berTLV(0x04, make([]byte, n)))
+		if err != nil || tag != 0x04 || len(v) != n || len(rest) != 0 {
+			t.Errorf("length %d: got %d, %v", n, len(v), err)
+		}
+	}
+}
+
+// serveLDAP answers binds on l with success for password, invalid
+// credentials otherwise, and sends the dn bound as to dns
+func serveLDAP(t *testing.T, l net.Listener, password string, dns chan<- string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer c.Close()
+
+			tag, msg, err := readBER(bufio.NewReader(c))
+			if err != nil || tag != 0x30 {
+				return
+			}
+
+			_, _, rest, _ := splitBER(msg)
+			_, bind, _, _ := splitBER(rest)
+			_, _, bind, _ = splitBER(bind)
+			_, dn, bind, _ := splitBER(bind)
+			_, pw, _, _ := splitBER(bind)
+
+			dns <- string(dn)
+
+			code := byte(ldapInvalidCredentials)
+			if bytes.Equal(pw, []byte(password)) {
+				code = ldapSuccess
+			}
+
+			resp := append([]byte{0x0a, 1, code}, berTLV(0x04, nil)...)
+			resp = append(resp, berTLV(0x04, []byte("bye"))...)
+			c.Write(berTLV(0x30, append(berInt(1), berTLV(0x61, resp)...)))
+		}()
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dns := make(chan string, 10)
+	go serveLDAP(t, l, "secret", dns)
+
+	spec := "ldap://" + l.Addr().String() + "/uid=%s,ou=people,dc=example,dc=com"
+	if _, err := Parse(spec); err == nil {
+		t.Errorf("plaintext ldap parsed without LDAPPlaintext")
+	}
+
+	LDAPPlaintext = true
+	defer func() { LDAPPlaintext = false }()
+
+	verify, err := Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := verify(testConnMeta{user: "alice"}, "secret"); !ok || err != nil {
+		t.Errorf("secret not verified: %v", err)
+	}
+	if dn := <-dns; dn != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Errorf("bound as %v", dn)
+	}
+
+	if ok, err := verify(testConnMeta{user: "bob,ou=admins"}, "wrong"); ok || err != nil {
+		t.Errorf("wrong password: got %v, %v", ok, err)
+	}
+	if dn := <-dns; dn != `uid=bob\,ou\=admins,ou=people,dc=example,dc=com` {
+		t.Errorf("user not escaped in %v", dn)
+	}
+
+	// unauthenticated binds succeed, never sent
+	if ok, _ := verify(testConnMeta{user: "alice"}, ""); ok {
+		t.Errorf("empty password verified")
+	}
+
+	// refused before dialing
+	if ok, err := verify(testConnMeta{user: "alice"}, strings.Repeat("x", maxLDAPValue+1)); ok || err == nil {
+		t.Errorf("oversized password: got %v, %v", ok, err)
+	}
+
+	if _, err := Parse("ldap://" + l.Addr().String() + "/ou=people"); err == nil {
+		t.Errorf("bind dn without %%s parsed")
+	}
+}
@@ -0,0 +1,36 @@
+//go:build pam
+// +build pam
+
+package password
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	pam "github.com/vvanpo/golang-pam"
+)
+
+func init() {
+	PAM = pamVerifier
+}
+
+// pamVerifier answers every password prompt of the sshpiperd service with
+// password, informational messages are dropped
+func pamVerifier(conn ssh.ConnMetadata, password string) (bool, error) {
+	t, status := pam.Start("sshpiperd", conn.User(), pam.ResponseFunc(func(style int, msg string) (string, bool) {
+		switch style {
+		case pam.PROMPT_ECHO_OFF:
+			return password, true
+		case pam.ERROR_MSG, pam.TEXT_INFO:
+			return "", true
+		}
+		return "", false
+	}))
+
+	if status != pam.SUCCESS {
+		return false, fmt.Errorf("pam.Start() failed: %s", t.Error(status))
+	}
+	defer func() { t.End(status) }()
+
+	status = t.Authenticate(0)
+	return status == pam.SUCCESS, nil
+}
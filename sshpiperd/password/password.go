@@ -0,0 +1,43 @@
+// Package password checks passwords of downstream users in sshpiperd, so a
+// user may log in by password while the pipe logs in upstream with a key.
+//
+// Verifiers are picked with sshpiperd -password-verifier:
+//
+//	htpasswd:/etc/sshpiperd/htpasswd
+//	ldaps://ldap.example.com/uid=%s,ou=people,dc=example,dc=com
+//	pam
+package password
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"strings"
+)
+
+// Verifier tells whether password is the one of the user of conn, an error
+// if it cannot tell, e.g. its backend is down
+type Verifier func(conn ssh.ConnMetadata, password string) (bool, error)
+
+// PAM verifies passwords with the sshpiperd pam service, nil unless built
+// with -tags pam
+var PAM Verifier
+
+// htpasswdPrefix marks an htpasswd file in Parse
+const htpasswdPrefix = "htpasswd:"
+
+// Parse returns the verifier spec names, see the package doc
+func Parse(spec string) (Verifier, error) {
+	switch {
+	case spec == "pam":
+		if PAM == nil {
+			return nil, fmt.Errorf("pam: sshpiperd is built without -tags pam")
+		}
+		return PAM, nil
+	case strings.HasPrefix(spec, htpasswdPrefix):
+		return Htpasswd(strings.TrimPrefix(spec, htpasswdPrefix)), nil
+	case strings.HasPrefix(spec, "ldap://"), strings.HasPrefix(spec, "ldaps://"):
+		return ParseLDAP(spec)
+	}
+
+	return nil, fmt.Errorf("unknown password verifier %v, want htpasswd:<file>, ldap[s]://<host>/<bind dn> or pam", spec)
+}
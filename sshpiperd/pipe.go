@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func init() {
+	subCommands["pipe"] = runPipe
+}
+
+const pipeUsage = "usage: sshpiperd pipe add|list|remove <user> [-upstream host:port] [-map-user u] [-key path] [-bind ip]"
+
+// pipe manages user dirs in working dir, so files get the perms sshpiperd
+// requires
+func runPipe(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(pipeUsage)
+	}
+
+	switch args[0] {
+	case "add":
+		return pipeAdd(args[1:])
+	case "list":
+		return pipeList()
+	case "remove":
+		return pipeRemove(args[1:])
+	}
+
+	return fmt.Errorf(pipeUsage)
+}
+
+// pipeUser splits <user> from flags, user may be given before or after them
+func pipeUser(fs *flag.FlagSet, args []string) (string, error) {
+	var user string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		user, args = args[0], args[1:]
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+
+	if user == "" {
+		user = fs.Arg(0)
+	}
+
+	if user == "" || strings.ContainsAny(user, "/\\") || user == "." || user == ".." {
+		return "", fmt.Errorf("bad user name %q", user)
+	}
+
+	return user, nil
+}
+
+func pipeAdd(args []string) error {
+	fs := flag.NewFlagSet("pipe add", flag.ExitOnError)
+	upstream := fs.String("upstream", "", "Upstream address, e.g. host:port, unix:/path/to/sock or ws://host/path")
+	mapUser := fs.String("map-user", "", "Login upstream as this user, empty for the same user")
+	bind := fs.String("bind", "", "Local ip or interface to dial upstream from, empty for -upstream-bind")
+	key := fs.String("key", "", "Private key used to login upstream, copied as "+string(UserKeyFile))
+
+	user, err := pipeUser(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *upstream == "" {
+		return fmt.Errorf("-upstream is required")
+	}
+
+	if _, err := parseUpstreamAddr(*upstream); err != nil {
+		return fmt.Errorf("-upstream: %v", err)
+	}
+
+	dir := userDir(user)
+	if dir == "" {
+		return fmt.Errorf("no dir for %v in working dir layout %v", user, userWorkingDir(user).layout)
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("pipe for %v already exists at %v", user, dir)
+	}
+
+	// read key before creating anything, nothing left behind on bad path
+	var keyData []byte
+	if *key != "" {
+		keyData, err = ioutil.ReadFile(*key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	target := *upstream
+	if *mapUser != "" {
+		target = *mapUser + "@" + target
+	}
+
+	line := target
+	if *bind != "" {
+		line += " bind=" + *bind
+	}
+
+	if err := ioutil.WriteFile(UserUpstreamFile.realPath(user), []byte(line+"\n"), 0400); err != nil {
+		return err
+	}
+
+	if keyData != nil {
+		if err := ioutil.WriteFile(UserKeyFile.realPath(user), keyData, 0400); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("added pipe %v -> %v\n", user, target)
+	return nil
+}
+
+func pipeList() error {
+	for _, w := range workingDirs() {
+		users, err := w.users()
+		if err != nil {
+			return fmt.Errorf("working dir %v: %v", w.root, err)
+		}
+
+		for _, user := range users {
+			listPipe(w, user)
+		}
+	}
+
+	return nil
+}
+
+// listPipe prints user's upstream and the files in its dir in w
+func listPipe(w workingDir, user string) {
+	data, err := w.read(UserUpstreamFile, user)
+	if err != nil {
+		return
+	}
+
+	var addrs []string
+	for _, t := range parseUpstreamFile(string(data)) {
+		if t.bind != "" {
+			addrs = append(addrs, t.String()+" from "+t.bind)
+		} else {
+			addrs = append(addrs, t.String())
+		}
+	}
+	addr := strings.Join(addrs, ",")
+
+	var notes []string
+	for _, file := range []userFile{UserUpstreamFile, UserAuthorizedKeysFile, UserKeyFile, UserKnownHostsFile, UserTOTPFile} {
+		if _, err := os.Stat(w.file(file, user)); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := w.checkPerm(file, user); err != nil {
+			notes = append(notes, err.Error())
+		}
+	}
+
+	if _, err := os.Stat(w.file(UserKeyFile, user)); err == nil {
+		notes = append(notes, "mapped key")
+	}
+
+	if _, err := os.Stat(w.file(UserCertFile, user)); err == nil {
+		notes = append(notes, "certificate")
+	}
+
+	if _, err := os.Stat(w.file(UserKnownHostsFile, user)); err == nil {
+		notes = append(notes, "known hosts")
+	}
+
+	if _, err := os.Stat(w.file(UserTOTPFile, user)); err == nil {
+		notes = append(notes, "totp")
+	}
+
+	fmt.Printf("%v\t%v\t%v\n", user, addr, strings.Join(notes, ", "))
+}
+
+func pipeRemove(args []string) error {
+	fs := flag.NewFlagSet("pipe remove", flag.ExitOnError)
+
+	user, err := pipeUser(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// only remove dirs looking like a pipe
+	if _, err := os.Stat(UserUpstreamFile.realPath(user)); err != nil {
+		return fmt.Errorf("no pipe for %v: %v", user, err)
+	}
+
+	if err := os.RemoveAll(userDir(user)); err != nil {
+		return err
+	}
+
+	fmt.Printf("removed pipe %v\n", user)
+	return nil
+}
@@ -0,0 +1,345 @@
+package piperd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// pipeRequest is the body of POST /pipes, ttl in time.ParseDuration format
+type pipeRequest struct {
+	User           string `json:"user"`
+	Upstream       string `json:"upstream"`
+	AuthorizedKeys string `json:"authorized_keys"`
+	KeyFile        string `json:"key_file"`
+	TTL            string `json:"ttl"`
+
+	Labels map[string]string `json:"labels"`
+}
+
+// AdminHandler serves the admin api, every request must carry
+// Authorization: Bearer token.
+//
+//	GET    /pipes         list temporary pipes
+//	POST   /pipes         add a temporary pipe, body {"user", "upstream", "authorized_keys", "key_file", "ttl", "labels"}
+//	DELETE /pipes/[user]  remove a temporary pipe
+//	GET    /sessions      list piped sessions, see WithObservers
+//	GET    /sessions/[id]/observe  stream the output of a session read-only
+//	GET    /upstreams     utilization of upstreams, see UpstreamStats
+//	GET    /drains        drained upstreams
+//	POST   /drains        drain an upstream, body {"upstream", "grace", "terminate"}, see DrainUpstream
+//	DELETE /drains/[addr] let an upstream take new pipes again
+//	GET    /credentials   pipes by upstream key version, see CredentialStats
+//	GET    /provider      name of the provider
+//	PUT    /provider      swap in a registered provider, body {"name"}
+//	GET    /lockdown      whether new logins are refused
+//	PUT    /lockdown      lock down or lift it, body {"enabled"}
+func (d *Daemon) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/provider", d.serveProvider)
+	mux.HandleFunc("/upstreams", d.serveUpstreams)
+	mux.HandleFunc("/drains", d.serveDrains)
+	mux.HandleFunc("/drains/", d.serveDrain)
+	mux.HandleFunc("/credentials", d.serveCredentials)
+	mux.HandleFunc("/lockdown", d.serveLockdown)
+	mux.HandleFunc("/pipes", d.servePipes)
+	mux.HandleFunc("/pipes/", d.servePipe)
+	mux.HandleFunc("/sessions", d.serveSessions)
+	mux.HandleFunc("/sessions/", d.serveObserve)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (d *Daemon) servePipes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		pipes := d.Pipes()
+		if pipes == nil {
+			pipes = []Pipe{}
+		}
+		writeJSON(w, http.StatusOK, pipes)
+
+	case http.MethodPost:
+		var req pipeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			http.Error(w, "ttl: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p := Pipe{
+			User:           req.User,
+			Upstream:       req.Upstream,
+			AuthorizedKeys: req.AuthorizedKeys,
+			KeyFile:        req.KeyFile,
+			Expires:        time.Now().Add(ttl),
+			Labels:         req.Labels,
+		}
+
+		if err := d.AddPipe(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, p)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *Daemon) servePipe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := strings.TrimPrefix(r.URL.Path, "/pipes/")
+	if !d.RemovePipe(user) {
+		http.Error(w, "no temporary pipe of "+user, http.StatusNotFound)
+		return
+	}
+
+	d.logger.Printf("temporary pipe [%v] removed", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) serveSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessions := d.Sessions()
+	if sessions == nil {
+		sessions = []Session{}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// serveObserve streams session output until the session ends or the
+// observer goes away
+func (d *Daemon) serveObserve(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if !strings.HasSuffix(path, "/observe") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	output, detach, err := d.Observe(strings.TrimSuffix(path, "/observe"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer detach()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case data, ok := <-output:
+			if !ok {
+				return
+			}
+
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (d *Daemon) serveUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := d.UpstreamStats()
+	if stats == nil {
+		stats = []UpstreamStats{}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// drainRequest is the body of POST /drains, grace in time.ParseDuration
+// format, needed if terminate
+type drainRequest struct {
+	Upstream  string `json:"upstream"`
+	Grace     string `json:"grace"`
+	Terminate bool   `json:"terminate"`
+}
+
+func (d *Daemon) serveDrains(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		drains := d.Drains()
+		if drains == nil {
+			drains = []Drain{}
+		}
+		writeJSON(w, http.StatusOK, drains)
+
+	case http.MethodPost:
+		var req drainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var grace time.Duration
+		if req.Terminate {
+			var err error
+			if grace, err = time.ParseDuration(req.Grace); err != nil {
+				http.Error(w, "grace: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := d.DrainUpstream(req.Upstream, grace, req.Terminate); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, req)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *Daemon) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addr := strings.TrimPrefix(r.URL.Path, "/drains/")
+	if !d.UndrainUpstream(addr) {
+		http.Error(w, "upstream "+addr+" is not drained", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) serveCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := d.CredentialStats()
+	if stats == nil {
+		stats = []CredentialStats{}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// providerRequest is the body of PUT /provider
+type providerRequest struct {
+	Name string `json:"name"`
+}
+
+func (d *Daemon) serveProvider(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, providerRequest{d.ProviderName()})
+
+	case http.MethodPut:
+		var req providerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p, err := upstream.GetProvider(req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err := d.SetProvider(req.Name, p); err != nil {
+			http.Error(w, "provider "+req.Name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, req)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// lockdownRequest is the body of PUT /lockdown
+type lockdownRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (d *Daemon) serveLockdown(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, lockdownRequest{d.Lockdown()})
+
+	case http.MethodPut:
+		var req lockdownRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		d.SetLockdown(req.Enabled)
+		writeJSON(w, http.StatusOK, req)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,79 @@
+package piperd
+
+import (
+	"encoding/json"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	d, err := New(WithProvider(&upstream.Fake{}), WithHostKey(newTestSigner(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(d.AdminHandler("secret"))
+	defer s.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := do("GET", "/pipes", "wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong token got %v", resp.Status)
+	}
+
+	if resp := do("POST", "/pipes", "secret", `{"user": "alice", "upstream": "127.0.0.1:22"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST without ttl got %v", resp.Status)
+	}
+
+	resp := do("POST", "/pipes", "secret", `{"user": "alice", "upstream": "bob@127.0.0.1:22", "ttl": "30m"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST got %v", resp.Status)
+	}
+
+	resp = do("GET", "/pipes", "secret", "")
+
+	var pipes []Pipe
+	if err := json.NewDecoder(resp.Body).Decode(&pipes); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(pipes) != 1 || pipes[0].User != "alice" || pipes[0].Upstream != "bob@127.0.0.1:22" {
+		t.Errorf("GET got %+v", pipes)
+	}
+
+	if resp := do("DELETE", "/pipes/alice", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE got %v", resp.Status)
+	}
+
+	if resp := do("DELETE", "/pipes/alice", "secret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE again got %v", resp.Status)
+	}
+
+	if resp := do("POST", "/drains", "secret", `{"upstream": "127.0.0.1:22", "terminate": true}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /drains terminating without grace got %v", resp.Status)
+	}
+
+	if resp := do("POST", "/drains", "secret", `{"upstream": "127.0.0.1:22"}`); resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST /drains got %v", resp.Status)
+	}
+
+	if resp := do("DELETE", "/drains/127.0.0.1:22", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE /drains got %v", resp.Status)
+	}
+}
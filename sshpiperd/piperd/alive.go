@@ -0,0 +1,227 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"sync"
+	"time"
+)
+
+// global request messages, see RFC 4254 section 4
+const (
+	msgGlobalRequest  = 80
+	msgRequestSuccess = 81
+	msgRequestFailure = 82
+)
+
+type globalRequestMsg struct {
+	Type      string `sshtype:"80"`
+	WantReply bool
+	Data      []byte `ssh:"rest"`
+}
+
+// WithClientAlive probes downstream with a keepalive request after interval
+// passed without a packet from it, like ClientAliveInterval of OpenSSH.
+// Downstream is disconnected after countMax probes went unanswered, with 0
+// it is probed but never disconnected. Clients answer probes on their own,
+// so silent sessions of live clients are kept.
+func WithClientAlive(interval time.Duration, countMax int) Option {
+	return func(d *Daemon) {
+		d.aliveInterval = interval
+		d.aliveCountMax = countMax
+	}
+}
+
+// WithUpstreamKeepalive sends upstream a keepalive request after interval
+// passed without a packet from it, whatever downstream does, so firewalls
+// in between keep the connection. Providers may set it per pipe with
+// upstream.Conn.
+func WithUpstreamKeepalive(interval time.Duration) Option {
+	return func(d *Daemon) {
+		d.keepalive = interval
+	}
+}
+
+// withAlive adds the keepalive filter to piper, last, as it writes global
+// requests itself. The upstream keepalive is taken from the conn the
+// provider returns.
+func (d *Daemon) withAlive(piper *ssh.SSHPiper) {
+	keepalive := d.keepalive
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if uc, ok := c.(*upstream.Conn); ok && uc.KeepaliveInterval != 0 {
+			keepalive = uc.KeepaliveInterval
+		}
+		return c, config, err
+	}
+
+	appendFilter(piper, func(conn ssh.PipeConn) ssh.PacketFilter {
+		return d.newAliveFilter(conn, keepalive)
+	})
+}
+
+// aliveLeg probes one leg of a pipe and takes replies to its probes. Global
+// requests are answered in order, so requests toward the leg wanting a reply
+// are written by the leg too, under mu, to know whose reply comes next.
+type aliveLeg struct {
+	write    func(p []byte) error
+	countMax int
+
+	mu sync.Mutex
+	// replies the peer owes in order, true for probes
+	pending []bool
+	// a packet came from the peer since the last tick
+	seen   bool
+	missed int
+}
+
+// aliveFilter has a leg for each side probed, nil if not
+type aliveFilter struct {
+	down *aliveLeg
+	up   *aliveLeg
+}
+
+func (d *Daemon) newAliveFilter(conn ssh.PipeConn, upstreamKeepalive time.Duration) ssh.PacketFilter {
+	f := &aliveFilter{}
+
+	if d.aliveInterval > 0 {
+		f.down = &aliveLeg{write: conn.WriteDownstream, countMax: d.aliveCountMax}
+		go f.down.loop(d.aliveInterval, conn, func() {
+			d.logger.Printf("client [%v] not responding after %d keepalive probes, disconnecting", conn.RemoteAddr(), d.aliveCountMax)
+			conn.Close()
+		})
+	}
+
+	if upstreamKeepalive > 0 {
+		f.up = &aliveLeg{write: conn.WriteUpstream}
+		go f.up.loop(upstreamKeepalive, conn, nil)
+	}
+
+	if f.down == nil && f.up == nil {
+		return nil
+	}
+
+	return f
+}
+
+func (l *aliveLeg) loop(interval time.Duration, conn ssh.PipeConn, dead func()) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-conn.Done():
+			return
+		}
+
+		alive, err := l.tick()
+		if err != nil {
+			return
+		}
+
+		if !alive {
+			dead()
+			return
+		}
+	}
+}
+
+// tick probes the peer if it was silent since the last tick, false when it
+// missed too many probes
+func (l *aliveLeg) tick() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen {
+		l.seen = false
+		return true, nil
+	}
+
+	if l.countMax > 0 && l.missed >= l.countMax {
+		return false, nil
+	}
+
+	l.missed++
+	l.pending = append(l.pending, true)
+
+	return true, l.write(ssh.Marshal(&globalRequestMsg{
+		Type:      "keepalive@openssh.com",
+		WantReply: true,
+	}))
+}
+
+// fromPeer notes p came from the peer, false if p is a reply to a probe.
+// Replies to probes do not count as traffic, the next tick probes again.
+func (l *aliveLeg) fromPeer(p []byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.missed = 0
+
+	if len(p) > 0 && (p[0] == msgRequestSuccess || p[0] == msgRequestFailure) && len(l.pending) > 0 {
+		probe := l.pending[0]
+		l.pending = l.pending[1:]
+
+		if probe {
+			return false
+		}
+	}
+
+	l.seen = true
+	return true
+}
+
+// toPeer writes p to the peer if it is a request wanting a reply, true if
+// written
+func (l *aliveLeg) toPeer(p []byte) (bool, error) {
+	if len(p) == 0 || p[0] != msgGlobalRequest {
+		return false, nil
+	}
+
+	var msg globalRequestMsg
+	if err := ssh.Unmarshal(p, &msg); err != nil {
+		return false, err
+	}
+
+	if !msg.WantReply {
+		return false, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pending = append(l.pending, false)
+	return true, l.write(p)
+}
+
+func (f *aliveFilter) FromUpstream(p []byte) ([]byte, error) {
+	if f.up != nil && !f.up.fromPeer(p) {
+		return nil, nil
+	}
+
+	if f.down != nil {
+		if written, err := f.down.toPeer(p); written || err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (f *aliveFilter) FromDownstream(p []byte) ([]byte, error) {
+	if f.down != nil && !f.down.fromPeer(p) {
+		return nil, nil
+	}
+
+	if f.up != nil {
+		if written, err := f.up.toPeer(p); written || err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,109 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"testing"
+)
+
+func TestAliveFilter(t *testing.T) {
+	conn := &testPipeConn{}
+	f := &aliveFilter{down: &aliveLeg{write: conn.WriteDownstream, countMax: 2}}
+
+	tick := func(want bool) {
+		alive, err := f.down.tick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alive != want {
+			t.Fatalf("tick got alive %v, want %v", alive, want)
+		}
+	}
+
+	tick(true)
+	if len(conn.down) != 1 {
+		t.Fatalf("got %d packets to downstream, want a probe", len(conn.down))
+	}
+
+	var probe globalRequestMsg
+	if err := ssh.Unmarshal(conn.down[0], &probe); err != nil {
+		t.Fatal(err)
+	}
+	if probe.Type != "keepalive@openssh.com" || !probe.WantReply {
+		t.Errorf("got probe %q want reply %v", probe.Type, probe.WantReply)
+	}
+
+	// upstream's request is written by the filter, after the probe
+	req := ssh.Marshal(&globalRequestMsg{Type: "hostkeys-00@openssh.com", WantReply: true})
+	if p, err := f.FromUpstream(req); p != nil || err != nil {
+		t.Fatalf("request from upstream got %v %v, want written by filter", p, err)
+	}
+	if len(conn.down) != 2 {
+		t.Fatalf("got %d packets to downstream, want 2", len(conn.down))
+	}
+
+	// no reply wanted, no need to track
+	if p, _ := f.FromUpstream(ssh.Marshal(&globalRequestMsg{Type: "x"})); p == nil {
+		t.Errorf("request without reply dropped")
+	}
+
+	// first reply answers the probe, second goes upstream
+	if p, _ := f.FromDownstream([]byte{msgRequestFailure}); p != nil {
+		t.Errorf("reply to probe not dropped")
+	}
+	if p, _ := f.FromDownstream([]byte{msgRequestSuccess}); p == nil {
+		t.Errorf("reply to upstream dropped")
+	}
+
+	// downstream was heard from, no probe
+	tick(true)
+	if len(conn.down) != 2 {
+		t.Errorf("probed a client which sent packets")
+	}
+
+	tick(true)
+	tick(true)
+	tick(false)
+	if len(conn.down) != 4 {
+		t.Errorf("got %d packets to downstream, want 2 more probes", len(conn.down))
+	}
+}
+
+func TestAliveFilterNoCountMax(t *testing.T) {
+	l := &aliveLeg{write: (&testPipeConn{}).WriteDownstream}
+
+	for i := 0; i < 10; i++ {
+		if alive, _ := l.tick(); !alive {
+			t.Fatalf("disconnected with countMax 0")
+		}
+	}
+}
+
+func TestUpstreamKeepalive(t *testing.T) {
+	conn := &testPipeConn{}
+	f := &aliveFilter{up: &aliveLeg{write: conn.WriteUpstream}}
+
+	// downstream's request first, then a probe
+	req := ssh.Marshal(&globalRequestMsg{Type: "tcpip-forward", WantReply: true})
+	if p, _ := f.FromDownstream(req); p != nil {
+		t.Fatalf("request from downstream not written by filter")
+	}
+
+	if _, err := f.up.tick(); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.up) != 2 {
+		t.Fatalf("got %d packets to upstream, want request and probe", len(conn.up))
+	}
+
+	if p, _ := f.FromUpstream([]byte{msgRequestSuccess}); p == nil {
+		t.Errorf("reply to downstream dropped")
+	}
+	if p, _ := f.FromUpstream([]byte{msgRequestFailure}); p != nil {
+		t.Errorf("reply to probe not dropped")
+	}
+
+	// downstream being silent does not matter, upstream was heard from
+	if _, err := f.up.tick(); err != nil || len(conn.up) != 2 {
+		t.Errorf("probed upstream which sent packets")
+	}
+}
@@ -0,0 +1,65 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"sync"
+)
+
+// anomaly policies, see WithAnomalyPolicy
+const (
+	// anomalies are logged and the connection goes on
+	AnomalyLog = "log"
+	// the connection is closed
+	AnomalyTerminate = "terminate"
+	// the connection is closed and its ip banned as for probing
+	AnomalyBan = "ban"
+)
+
+// anomalyError is returned by serve for connections closed for an anomaly
+type anomalyError struct {
+	ssh.Anomaly
+}
+
+func (e *anomalyError) Error() string {
+	return "protocol anomaly: " + e.Anomaly.String()
+}
+
+// WithAnomalyPolicy sets how peers straying from the protocol are handled,
+// see ssh.Anomaly: AnomalyLog, AnomalyTerminate, or AnomalyBan which needs
+// WithProbeBan and bans for its ban time. Empty, the default, checks
+// nothing.
+func WithAnomalyPolicy(policy string) Option {
+	return func(d *Daemon) {
+		d.anomalyPolicy = policy
+	}
+}
+
+// withAnomalies applies the anomaly policy, the first anomaly of each kind
+// of a connection is logged
+func (d *Daemon) withAnomalies(piper *ssh.SSHPiper) {
+	var mu sync.Mutex
+	logged := make(map[string]bool)
+
+	piper.AnomalyHook = func(conn ssh.ConnMetadata, a ssh.Anomaly) error {
+		// each leg is read by a goroutine of its own while piping
+		mu.Lock()
+		first := !logged[a.Kind]
+		logged[a.Kind] = true
+		mu.Unlock()
+
+		if first {
+			d.logger.Printf("protocol anomaly of [%v] from [%v]: %v", conn.User(), conn.RemoteAddr(), a)
+		}
+
+		switch d.anomalyPolicy {
+		case AnomalyLog:
+			return nil
+		case AnomalyBan:
+			ip := remoteIP(conn.RemoteAddr())
+			d.probes.ban(ip)
+			d.logger.Printf("anomaly: banning [%v] for %v", ip, d.probes.banTime)
+		}
+
+		return &anomalyError{a}
+	}
+}
@@ -0,0 +1,72 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAnomalyPolicy(t *testing.T) {
+	key := newTestSigner(t)
+
+	provider := &upstream.Fake{}
+	if _, err := New(WithProvider(provider), WithHostKey(key), WithAnomalyPolicy("strict")); err == nil {
+		t.Errorf("unknown anomaly policy accepted")
+	}
+	if _, err := New(WithProvider(provider), WithHostKey(key), WithAnomalyPolicy(AnomalyBan)); err == nil {
+		t.Errorf("anomaly policy ban without probe ban accepted")
+	}
+
+	up := testUpstream(t, key)
+	defer up.Close()
+	provider.Addr = up.Addr().String()
+
+	for _, tt := range []struct {
+		policy string
+		piped  bool
+		banned bool
+	}{
+		{AnomalyLog, true, false},
+		{AnomalyTerminate, false, false},
+		{AnomalyBan, false, true},
+	} {
+		d, err := New(WithProvider(provider), WithHostKey(key), WithAnomalyPolicy(tt.policy), WithProbeBan(10, time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go d.Serve(l)
+
+		config := &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("pw")},
+		}
+
+		client, err := ssh.Dial("tcp", l.Addr().String(), config)
+		if err != nil {
+			t.Fatalf("%v: Dial: %v", tt.policy, err)
+		}
+
+		// far beyond what any client sends in one packet
+		_, _, err = client.SendRequest("oversized@sshpiper", true, make([]byte, 64<<10))
+		if piped := err == nil; piped != tt.piped {
+			t.Errorf("%v: oversized packet piped %v, want %v", tt.policy, piped, tt.piped)
+		}
+		client.Close()
+
+		client, err = ssh.Dial("tcp", l.Addr().String(), config)
+		if err == nil {
+			client.Close()
+		}
+		if banned := err != nil; banned != tt.banned {
+			t.Errorf("%v: next login refused %v, want %v: %v", tt.policy, banned, tt.banned, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/audit"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"time"
+)
+
+// WithAuditSink passes connection, auth and session events to sink
+func WithAuditSink(sink audit.Sink) Option {
+	return func(d *Daemon) {
+		d.audit = sink
+	}
+}
+
+// initAudit hooks the auth and session events of every connection into
+// the sink, connection events are sent by serve
+func (d *Daemon) initAudit() {
+	d.piper.DownstreamConfig.AuthLogCallback = d.auditAuth
+
+	if challenge := d.piper.AdditionalChallenge; challenge != nil {
+		d.piper.AdditionalChallenge = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+			ok, err := challenge(conn, client)
+
+			failure := err
+			if !ok && err == nil {
+				failure = ssh.ErrAdditionalChallengeFailed
+			}
+			d.auditAuth(conn, "challenge", failure)
+
+			return ok, err
+		}
+	}
+
+	hook := d.connHook
+	d.connHook = func(event ConnEvent) {
+		if hook != nil {
+			hook(event)
+		}
+
+		e := audit.Event{
+			Type:       audit.TypeSession,
+			Action:     audit.ActionEstablished,
+			User:       event.User,
+			Downstream: event.Downstream.String(),
+			Labels:     event.Labels,
+		}
+
+		if event.Upstream != nil {
+			e.Upstream = event.Upstream.String()
+		}
+
+		for _, k := range event.OfferedKeys {
+			if k.Accepted {
+				e.Key = fingerprint(k.Key)
+			}
+		}
+
+		if id := event.UpstreamIdentity; id != nil {
+			if id.HostKey != nil {
+				e.UpstreamHostKey = fingerprint(id.HostKey)
+			}
+			e.UpstreamVersion = id.ServerVersion
+		}
+
+		if event.Type == ConnClosed {
+			e.Action = audit.ActionClosed
+			if _, ok := event.Err.(*ssh.UpstreamClosedError); ok {
+				e.Action = audit.ActionUpstreamClosed
+			}
+			e.BytesIn, e.BytesOut = event.BytesIn, event.BytesOut
+			e.Duration = event.Duration.String()
+			if event.Err != nil {
+				e.Error = event.Err.Error()
+			}
+		}
+
+		d.auditEvent(e)
+	}
+}
+
+func (d *Daemon) auditEvent(e audit.Event) {
+	e.Time = time.Now()
+	if err := d.audit.Audit(e); err != nil {
+		d.logger.Printf("audit: %v", err)
+	}
+}
+
+// auditAuth records an auth attempt, none is how clients start auth and
+// is not audited
+func (d *Daemon) auditAuth(conn ssh.ConnMetadata, method string, err error) {
+	if method == "none" {
+		return
+	}
+
+	e := audit.Event{
+		Type:       audit.TypeAuth,
+		Action:     audit.ActionSuccess,
+		User:       conn.User(),
+		Downstream: conn.RemoteAddr().String(),
+		Method:     method,
+	}
+
+	// the key of this attempt is the one offered last
+	if offers, ok := conn.(ssh.KeyOffers); ok && method == "publickey" {
+		if keys := offers.OfferedKeys(); len(keys) > 0 {
+			e.Key = fingerprint(keys[len(keys)-1].Key)
+		}
+	}
+
+	if err != nil {
+		e.Action = audit.ActionFailure
+		e.Error = err.Error()
+	}
+
+	d.auditEvent(e)
+}
+
+func (d *Daemon) auditConn(c net.Conn, action string, err error) {
+	e := audit.Event{
+		Type:       audit.TypeConnection,
+		Action:     action,
+		Downstream: c.RemoteAddr().String(),
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	d.auditEvent(e)
+}
+
+// fingerprint is key as ssh-keygen -l prints it
+func fingerprint(key ssh.PublicKey) string {
+	return upstream.KeyFingerprint(key)
+}
@@ -0,0 +1,110 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/audit"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memorySink struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (s *memorySink) Audit(e audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func (s *memorySink) actions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var actions []string
+	for _, e := range s.events {
+		a := e.Type + " " + e.Action
+		if e.Method != "" {
+			a += " " + e.Method
+		}
+		actions = append(actions, a)
+	}
+	return actions
+}
+
+func TestAuditSink(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	sink := &memorySink{}
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key), WithAuditSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	for _, pw := range []string{"wrong", "pw"} {
+		client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password(pw)},
+		})
+		if err == nil {
+			client.Close()
+		}
+
+		// the closed events of the first connection go first
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	want := []string{
+		"connection accepted",
+		"auth failure password",
+		"connection closed",
+		"connection accepted",
+		"auth success password",
+		"session established",
+		"session closed",
+		"connection closed",
+	}
+
+	var got []string
+	for i := 0; i < 100; i++ {
+		if got = sink.actions(); len(got) == len(want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got events %q, want %q", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	for _, e := range sink.events {
+		if e.Type != audit.TypeConnection && e.User != "alice" {
+			t.Errorf("%v %v of user %q", e.Type, e.Action, e.User)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+)
+
+// WithAuthMethods lists only methods to downstream in auth failures, in the
+// order given, and of them only those upstream lists too. Others would fail
+// anyway, clients need not try them.
+func WithAuthMethods(methods []string) Option {
+	return func(d *Daemon) {
+		d.authMethods = methods
+	}
+}
+
+func (d *Daemon) advertisedMethods(conn ssh.ConnMetadata, upstreamMethods []string) []string {
+	offered := make(map[string]bool)
+	for _, m := range upstreamMethods {
+		offered[m] = true
+	}
+
+	var methods []string
+	for _, m := range d.authMethods {
+		if offered[m] {
+			methods = append(methods, m)
+		}
+	}
+
+	return methods
+}
+
+// WithUpstreamAuth relays only methods to upstream, tried in the order
+// given, e.g. certificate before publickey and never password. Providers
+// override it per pipe with upstream.Conn, nil relays what downstream sends.
+func WithUpstreamAuth(methods []string) Option {
+	return func(d *Daemon) {
+		d.upstreamAuth = methods
+	}
+}
+
+// withUpstreamAuth takes the methods of the pipe FindUpstream dials
+func (d *Daemon) withUpstreamAuth(piper *ssh.SSHPiper) {
+	var methods []string
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if err != nil {
+			return c, config, err
+		}
+
+		methods = d.upstreamAuth
+		if uc, ok := c.(*upstream.Conn); ok && uc.UpstreamAuth != nil {
+			methods = uc.UpstreamAuth
+		}
+
+		return c, config, nil
+	}
+
+	piper.UpstreamAuth = func(conn ssh.ConnMetadata) []string {
+		return methods
+	}
+}
+
+// WithPasswordPrompt answers keyboard-interactive from downstream with
+// prompt and relays the answer to upstream as password, for clients which
+// prefer keyboard-interactive to upstreams taking password only
+func WithPasswordPrompt(prompt string) Option {
+	return func(d *Daemon) {
+		d.piper.PasswordPrompt = func(conn ssh.ConnMetadata) string {
+			return prompt
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdvertisedMethods(t *testing.T) {
+	d := &Daemon{}
+	WithAuthMethods([]string{"keyboard-interactive", "publickey", "password"})(d)
+
+	got := d.advertisedMethods(nil, []string{"publickey", "gssapi-with-mic", "keyboard-interactive"})
+	want := []string{"keyboard-interactive", "publickey"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUpstreamAuthNeverRelaysUnlisted(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key), WithUpstreamAuth([]string{"publickey"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	// upstream takes the password, but the piper must not send it
+	if _, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("pw")},
+	}); err == nil {
+		t.Errorf("password relayed to upstream")
+	}
+}
+
+func TestPasswordPrompt(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key), WithPasswordPrompt("Password for upstream: "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	for _, tt := range []struct {
+		answer string
+		ok     bool
+	}{
+		{"pw", true},
+		{"wrong", false},
+	} {
+		var prompts []string
+		client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				prompts = append(prompts, questions...)
+				return []string{tt.answer}, nil
+			})},
+		})
+
+		if (err == nil) != tt.ok {
+			t.Errorf("answer %v: got err %v", tt.answer, err)
+		}
+
+		if err == nil {
+			client.Close()
+		}
+
+		if !reflect.DeepEqual(prompts, []string{"Password for upstream: "}) {
+			t.Errorf("answer %v: got prompts %q", tt.answer, prompts)
+		}
+	}
+}
+
+func TestAuthStateHook(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var mu sync.Mutex
+	var states []string
+	d.piper.AuthStateHook = func(conn ssh.ConnMetadata, state ssh.AuthState, msgType byte) {
+		mu.Lock()
+		states = append(states, state.String())
+		mu.Unlock()
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("pw")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// none fails, password passes
+	want := []string{"request", "prompts", "reply", "next", "request", "prompts", "reply", "done"}
+
+	// done is entered once success is sent
+	var got []string
+	for i := 0; i < 50; i++ {
+		mu.Lock()
+		got = append([]string(nil), states...)
+		mu.Unlock()
+
+		if len(got) >= len(want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got states %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,34 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+)
+
+// names of the packets auth states are entered after, RFC 4252 and 4256
+var authMsgNames = map[byte]string{
+	0:  "none",
+	50: "userauth-request",
+	51: "userauth-failure",
+	52: "userauth-success",
+	53: "userauth-banner",
+	60: "userauth-info-request",
+	61: "userauth-info-response",
+}
+
+// WithAuthTrace logs every state upstream auth of a connection enters and
+// the packet which led there, to diagnose clients or servers which do not
+// interop. Verbose, every connection logs several lines.
+func WithAuthTrace(enabled bool) Option {
+	return func(d *Daemon) {
+		d.authTrace = enabled
+	}
+}
+
+func (d *Daemon) traceAuth(conn ssh.ConnMetadata, state ssh.AuthState, msgType byte) {
+	name, ok := authMsgNames[msgType]
+	if !ok {
+		name = "unknown"
+	}
+
+	d.logger.Printf("auth of [%v] from [%v]: %v after %d (%v)", conn.User(), conn.RemoteAddr(), state, msgType, name)
+}
@@ -0,0 +1,352 @@
+package piperd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+// critical options of user certificates the daemon enforces itself, see
+// PROTOCOL.certkeys of OpenSSH
+const (
+	certForceCommand  = "force-command"
+	certSourceAddress = "source-address"
+)
+
+// CertRule routes downstream user certificates with a principal matching
+// Principal, and the critical options in Options, to the pipe of Pipe,
+// logging in upstream as User. Empty Pipe keeps the downstream's own pipe,
+// empty User the one the pipe logs in as.
+type CertRule struct {
+	// pattern as of path.Match, e.g. role:dba or team:*
+	Principal string
+
+	// critical options the certificate must have, "*" for any value
+	Options map[string]string
+
+	Pipe string
+	User string
+}
+
+// CertRules routes downstream by their user certificates signed by CAs,
+// first rule matching wins
+type CertRules struct {
+	CAs   []ssh.PublicKey
+	Rules []CertRule
+}
+
+// LoadCertRules reads rules from file, one per line: the principal, the
+// pipe, - for the downstream's own, then user=<upstream user> and the
+// critical options the certificate must have as name=value
+//
+//	role:dba  dba  user=postgres
+//	role:ops  ops  force-command=*
+//	team:*    -    user=deploy
+func LoadCertRules(file string) ([]CertRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := parseCertRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v:%v", file, err)
+	}
+
+	return rules, nil
+}
+
+func parseCertRules(r io.Reader) ([]CertRule, error) {
+	var rules []CertRule
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%d: want <principal> <pipe> [user=<user>] [<option>=<value>]...", n)
+		}
+
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("%d: principal %v: %v", n, fields[0], err)
+		}
+
+		rule := CertRule{Principal: fields[0]}
+		if fields[1] != "-" {
+			rule.Pipe = fields[1]
+		}
+
+		for _, f := range fields[2:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("%d: want name=value, got %v", n, f)
+			}
+
+			if kv[0] == "user" {
+				rule.User = kv[1]
+				continue
+			}
+
+			if rule.Options == nil {
+				rule.Options = make(map[string]string)
+			}
+			rule.Options[kv[0]] = kv[1]
+		}
+
+		if rule.Pipe == "" && rule.User == "" {
+			return nil, fmt.Errorf("%d: rule of %v routes nowhere, give a pipe or user=", n, rule.Principal)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// WithCertRules routes downstream signing with user certificates of r.CAs
+// by r.Rules, e.g. a certificate of principal role:dba to the dba pipe, so
+// users need no pipe of their own. The pipe logs in upstream with the key
+// its provider maps for verified users, see upstream.PasswordMapper, or
+// maps the certificate as any key if none. Certificates no rule matches
+// are mapped as usual. Requires WithDialAfterAuth, as certificates route
+// before the dial.
+func WithCertRules(r CertRules) Option {
+	return func(d *Daemon) {
+		d.certRules = &r
+	}
+}
+
+var errCertRouted = errors.New("routed by certificate, other credentials are refused")
+
+// certRoute is where a certificate of downstream routes
+type certRoute struct {
+	cert      *ssh.Certificate
+	principal string
+	rule      CertRule
+}
+
+// match returns the route of cert, nil if no rule matches it
+func (r *CertRules) match(cert *ssh.Certificate) *certRoute {
+	for _, rule := range r.Rules {
+		if !certHasOptions(cert, rule.Options) {
+			continue
+		}
+
+		for _, p := range cert.ValidPrincipals {
+			if ok, _ := path.Match(rule.Principal, p); ok {
+				return &certRoute{cert: cert, principal: p, rule: rule}
+			}
+		}
+	}
+
+	return nil
+}
+
+func certHasOptions(cert *ssh.Certificate, options map[string]string) bool {
+	for name, want := range options {
+		v, ok := cert.CriticalOptions[name]
+		if !ok || (want != "*" && v != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// check verifies the certificate of route was signed by a CA, is valid
+// now, from addr, and has no critical options the daemon cannot enforce
+func (r *CertRules) check(route *certRoute, addr net.Addr) error {
+	cert := route.cert
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("certificate has type %d", cert.CertType)
+	}
+
+	// options a rule asks for are taken as understood
+	supported := []string{certForceCommand}
+	for name := range route.rule.Options {
+		supported = append(supported, name)
+	}
+
+	checker := &ssh.CertChecker{
+		IsAuthority: func(auth ssh.PublicKey) bool {
+			return upstream.ContainsKey(r.CAs, auth)
+		},
+		SupportedCriticalOptions: supported,
+	}
+
+	if err := checker.CheckCert(route.principal, cert); err != nil {
+		return err
+	}
+
+	if src, ok := cert.CriticalOptions[certSourceAddress]; ok {
+		return checkCertSource(addr, src)
+	}
+
+	return nil
+}
+
+// checkCertSource tells whether addr is in src, the comma separated
+// addresses and cidrs of a source-address option
+func checkCertSource(addr net.Addr, src string) error {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+
+	for _, s := range strings.Split(src, ",") {
+		if allowed := net.ParseIP(s); allowed != nil {
+			if allowed.Equal(ip) {
+				return nil
+			}
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("bad source-address %q: %v", src, err)
+		}
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%v is not in source-address %v", host, src)
+}
+
+// certConn is conn as the provider sees it for the pipe of a route
+type certConn struct {
+	ssh.ConnMetadata
+	pipe string
+}
+
+func (c certConn) User() string {
+	return c.pipe
+}
+
+func (route *certRoute) conn(conn ssh.ConnMetadata) ssh.ConnMetadata {
+	if route.rule.Pipe == "" {
+		return conn
+	}
+	return certConn{conn, route.rule.Pipe}
+}
+
+// withCertRules routes downstream by the certificate it signs with. The
+// route is picked by the last key mapped, which is the one signed once the
+// dial happens, and pinned then: no other credential is mapped into the
+// pipe after.
+func (d *Daemon) withCertRules(piper *ssh.SSHPiper, provider upstream.Provider) {
+	var route, pinned *certRoute
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		if route == nil {
+			return findUpstream(conn)
+		}
+		pinned = route
+
+		rule := route.rule
+		d.logger.Printf("certificate of [%v] from [%v] with principal [%v] routed to pipe [%v] as [%v]", conn.User(), conn.RemoteAddr(), route.principal, rule.Pipe, rule.User)
+
+		c, config, err := findUpstream(route.conn(conn))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if rule.User != "" {
+			config.User = rule.User
+		}
+
+		// enforced as if the pipe forced it, see withForceCommand
+		if command, ok := route.cert.CriticalOptions[certForceCommand]; ok {
+			uc, isConn := c.(*upstream.Conn)
+			if !isConn {
+				uc = &upstream.Conn{Conn: c}
+			}
+			uc.ForceCommand = command
+			c = uc
+		}
+
+		return c, config, nil
+	}
+
+	mapPublicKey := piper.MapPublicKey
+	piper.MapPublicKey = func(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
+		if pinned != nil {
+			if !bytes.Equal(key.Marshal(), pinned.cert.Marshal()) {
+				return nil, nil
+			}
+			return d.mapCertRoute(provider, conn, pinned, mapPublicKey)
+		}
+
+		route = nil
+
+		cert, ok := key.(*ssh.Certificate)
+		if !ok {
+			return mapPublicKey(conn, key)
+		}
+
+		r := d.certRules.match(cert)
+		if r == nil {
+			return mapPublicKey(conn, key)
+		}
+
+		if err := d.keyPolicy.Check(key); err != nil {
+			d.logger.Printf("public key of [%v] from [%v] rejected: %v", conn.User(), conn.RemoteAddr(), err)
+			return nil, nil
+		}
+
+		if err := d.certRules.check(r, conn.RemoteAddr()); err != nil {
+			d.logger.Printf("certificate of [%v] from [%v] rejected: %v", conn.User(), conn.RemoteAddr(), err)
+			return nil, nil
+		}
+
+		signer, err := d.mapCertRoute(provider, conn, r, mapPublicKey)
+		if err == nil && signer != nil {
+			route = r
+		}
+		return signer, err
+	}
+
+	if piper.VerifyPassword != nil {
+		verifyPassword := piper.VerifyPassword
+		piper.VerifyPassword = func(conn ssh.ConnMetadata, password []byte) (ssh.Signer, error) {
+			if pinned != nil {
+				return nil, errCertRouted
+			}
+
+			route = nil
+			return verifyPassword(conn, password)
+		}
+	}
+}
+
+// mapCertRoute returns the signer of the pipe of route
+func (d *Daemon) mapCertRoute(provider upstream.Provider, conn ssh.ConnMetadata, route *certRoute, mapPublicKey func(ssh.ConnMetadata, ssh.PublicKey) (ssh.Signer, error)) (ssh.Signer, error) {
+	conn = route.conn(conn)
+
+	if mapper, ok := provider.(upstream.PasswordMapper); ok {
+		signer, err := mapper.MapPassword(conn)
+		if err != nil || signer != nil {
+			return signer, err
+		}
+	}
+
+	return mapPublicKey(conn, route.cert)
+}
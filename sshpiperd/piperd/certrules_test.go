@@ -0,0 +1,162 @@
+package piperd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestCert(t *testing.T, ca ssh.Signer, options map[string]string, principals ...string) ssh.Signer {
+	key := newTestSigner(t)
+
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions:     ssh.Permissions{CriticalOptions: options},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// userUpstream takes key, sending the users logged in to users
+func userUpstream(t *testing.T, key ssh.Signer, authorized ssh.PublicKey, users chan<- string) net.Listener {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !upstream.ContainsKey([]ssh.PublicKey{authorized}, key) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+
+	return serveUpstream(t, key, config, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+		users <- conn.User()
+		rejectChannels(chans)
+	})
+}
+
+func TestCertRules(t *testing.T) {
+	key := newTestSigner(t)
+	ca, rogue := newTestSigner(t), newTestSigner(t)
+	mapped := newTestSigner(t)
+
+	users := make(chan string, 4)
+	up := userUpstream(t, key, mapped.PublicKey(), users)
+	defer up.Close()
+
+	// no authorized keys, certificates are the only way in
+	provider := &upstream.Fake{Addr: up.Addr().String(), Signer: mapped, PasswordSigner: true}
+
+	rules := CertRules{
+		CAs: []ssh.PublicKey{ca.PublicKey()},
+		Rules: []CertRule{
+			{Principal: "role:dba", Pipe: "dba", User: "postgres"},
+			{Principal: "team:*", Options: map[string]string{"force-command": "*"}, User: "deploy"},
+		},
+	}
+
+	if _, err := New(WithProvider(provider), WithHostKey(key), WithCertRules(rules)); err == nil {
+		t.Errorf("cert rules without dial after auth accepted")
+	}
+
+	d, err := New(WithProvider(provider), WithHostKey(key), WithCertRules(rules), WithDialAfterAuth(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	for _, tt := range []struct {
+		name   string
+		signer ssh.Signer
+		pipe   string
+		user   string
+	}{
+		{"dba", newTestCert(t, ca, nil, "alice", "role:dba"), "dba", "postgres"},
+		{"team with forced command", newTestCert(t, ca, map[string]string{"force-command": "/bin/deploy"}, "team:web"), "alice", "deploy"},
+		{"team without forced command", newTestCert(t, ca, nil, "team:web"), "", ""},
+		{"no rule", newTestCert(t, ca, nil, "role:dev"), "", ""},
+		{"rogue ca", newTestCert(t, rogue, nil, "role:dba"), "", ""},
+		{"unknown critical option", newTestCert(t, ca, map[string]string{"verify-required": ""}, "role:dba"), "", ""},
+		{"outside source-address", newTestCert(t, ca, map[string]string{"source-address": "10.0.0.0/8"}, "role:dba"), "", ""},
+		{"plain key", newTestSigner(t), "", ""},
+	} {
+		dialed := len(provider.Users())
+
+		c, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(tt.signer)},
+		})
+
+		if tt.pipe == "" {
+			if err == nil {
+				c.Close()
+				t.Errorf("%v: login passed", tt.name)
+			}
+			if len(provider.Users()) != dialed {
+				t.Errorf("%v: upstream dialed", tt.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		c.Close()
+
+		if got := provider.Users(); got[len(got)-1] != tt.pipe {
+			t.Errorf("%v: routed to pipe %v, want %v", tt.name, got[len(got)-1], tt.pipe)
+		}
+
+		if got := <-users; got != tt.user {
+			t.Errorf("%v: upstream logged in as %v, want %v", tt.name, got, tt.user)
+		}
+	}
+}
+
+func TestParseCertRules(t *testing.T) {
+	rules, err := parseCertRules(strings.NewReader(`
+# dbas share one upstream account
+role:dba  dba  user=postgres
+
+team:*    -    user=deploy force-command=*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []CertRule{
+		{Principal: "role:dba", Pipe: "dba", User: "postgres"},
+		{Principal: "team:*", User: "deploy", Options: map[string]string{"force-command": "*"}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("got %+v, want %+v", rules, want)
+	}
+
+	for _, bad := range []string{"role:dba\n", "role:dba -\n", "role:dba dba user\n", "[ dba\n"} {
+		if _, err := parseCertRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseCertRules(%q) succeeded", bad)
+		}
+	}
+}
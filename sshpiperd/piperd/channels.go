@@ -0,0 +1,219 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"strings"
+	"sync"
+)
+
+const msgChannelExtendedData = 95
+
+type channelExtendedDataMsg struct {
+	PeersId  uint32 `sshtype:"95"`
+	DataType uint32
+	Data     []byte
+}
+
+// stderr data type of extended data, RFC 4254 section 5.2
+const extendedDataStderr = 1
+
+type sessionChannel struct {
+	downID    uint32
+	window    uint32
+	maxPacket uint32
+	pty       bool
+	shell     bool
+
+	// bytes printed which upstream does not know about, taken from window
+	// adjusts downstream sends before they go upstream
+	owed uint32
+}
+
+// sessionChannels tracks session channels of a pipe, so a filter can print
+// to downstream. Channels are keyed by upstream's id, as requests from
+// downstream carry that one. Each filter has a tracker of its own, window
+// adjusts pass all of them in turn and each takes what it printed.
+type sessionChannels struct {
+	conn ssh.PipeConn
+
+	// onRequest, if not nil, is called with mu held for each channel
+	// request from downstream before it goes upstream
+	onRequest func(ch *sessionChannel, request string) error
+
+	mu       sync.Mutex
+	opening  map[uint32]channelOpenMsg
+	channels map[uint32]*sessionChannel
+}
+
+func newSessionChannels(conn ssh.PipeConn) *sessionChannels {
+	return &sessionChannels{
+		conn:     conn,
+		opening:  make(map[uint32]channelOpenMsg),
+		channels: make(map[uint32]*sessionChannel),
+	}
+}
+
+func (s *sessionChannels) FromUpstream(p []byte) ([]byte, error) {
+	if len(p) == 0 || p[0] != msgChannelOpenConfirm {
+		return p, nil
+	}
+
+	var msg channelOpenConfirmMsg
+	if err := ssh.Unmarshal(p, &msg); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if open, ok := s.opening[msg.PeersId]; ok {
+		delete(s.opening, msg.PeersId)
+		s.channels[msg.MyId] = &sessionChannel{
+			downID:    msg.PeersId,
+			window:    open.PeersWindow,
+			maxPacket: open.MaxPacketSize,
+		}
+	}
+
+	return p, nil
+}
+
+func (s *sessionChannels) FromDownstream(p []byte) ([]byte, error) {
+	if len(p) == 0 {
+		return p, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch p[0] {
+	case msgChannelOpen:
+		var msg channelOpenMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			return nil, err
+		}
+
+		if msg.ChanType == "session" {
+			s.opening[msg.PeersId] = msg
+		}
+
+	case msgChannelRequest:
+		var msg channelRequestMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			return nil, err
+		}
+
+		ch, ok := s.channels[msg.PeersId]
+		if !ok {
+			break
+		}
+
+		switch msg.Request {
+		case "pty-req":
+			ch.pty = true
+		case "shell", "exec", "subsystem":
+			ch.shell = true
+		}
+
+		if s.onRequest != nil {
+			if err := s.onRequest(ch, msg.Request); err != nil {
+				return nil, err
+			}
+		}
+
+	case msgChannelWindowAdjust:
+		var msg windowAdjustMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			return nil, err
+		}
+
+		ch, ok := s.channels[msg.PeersId]
+		if !ok || ch.owed == 0 {
+			break
+		}
+
+		take := ch.owed
+		if take > msg.AdditionalBytes {
+			take = msg.AdditionalBytes
+		}
+		ch.owed -= take
+		msg.AdditionalBytes -= take
+
+		if msg.AdditionalBytes == 0 {
+			return nil, nil
+		}
+
+		return ssh.Marshal(&msg), nil
+
+	case msgChannelClose:
+		var msg channelCloseMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			return nil, err
+		}
+
+		delete(s.channels, msg.PeersId)
+	}
+
+	return p, nil
+}
+
+// printAll prints text to every session channel running a shell or command
+func (s *sessionChannels) printAll(text string, stderr bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ch := range s.channels {
+		if !ch.shell {
+			continue
+		}
+
+		if err := s.print(ch, text, stderr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// print writes text to ch, cut to what the downstream window allows.
+// s.mu must be held.
+func (s *sessionChannels) print(ch *sessionChannel, text string, stderr bool) error {
+	if ch.pty {
+		text = strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	}
+
+	data := []byte(text)
+	if uint32(len(data)) > ch.window {
+		data = data[:ch.window]
+	}
+
+	// stay below the max packet downstream accepts
+	chunk := int(ch.maxPacket)
+	if chunk <= 0 || chunk > 16*1024 {
+		chunk = 16 * 1024
+	}
+
+	for len(data) > 0 {
+		n := chunk
+		if n > len(data) {
+			n = len(data)
+		}
+
+		var packet []byte
+		if stderr {
+			packet = ssh.Marshal(&channelExtendedDataMsg{PeersId: ch.downID, DataType: extendedDataStderr, Data: data[:n]})
+		} else {
+			packet = ssh.Marshal(&channelDataMsg{PeersId: ch.downID, Data: data[:n]})
+		}
+
+		if err := s.conn.WriteDownstream(packet); err != nil {
+			return err
+		}
+
+		ch.window -= uint32(n)
+		ch.owed += uint32(n)
+		data = data[n:]
+	}
+
+	return nil
+}
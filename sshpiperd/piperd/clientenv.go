@@ -0,0 +1,77 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"strconv"
+)
+
+// env vars WithClientEnv sends upstream
+const (
+	EnvClient = "SSHPIPER_CLIENT"
+	EnvConn   = "SSHPIPER_CONN"
+)
+
+// WithClientEnv sends upstream the address downstream connects from, e.g.
+// SSHPIPER_CLIENT=1.2.3.4:5555, and the id of the connection in events,
+// SSHPIPER_CONN, before each shell, command or subsystem, so upstream's audit
+// trail tells who is behind the piper. Upstream sets them if its AcceptEnv
+// allows, e.g. AcceptEnv SSHPIPER_*.
+func WithClientEnv(enabled bool) Option {
+	return func(d *Daemon) {
+		d.clientEnv = enabled
+	}
+}
+
+func (d *Daemon) withClientEnv(piper *ssh.SSHPiper, id uint64) {
+	appendFilter(piper, func(conn ssh.PipeConn) ssh.PacketFilter {
+		return &clientEnv{
+			conn: conn,
+			env: []envPayload{
+				{EnvClient, conn.RemoteAddr().String()},
+				{EnvConn, strconv.FormatUint(id, 10)},
+			},
+		}
+	})
+}
+
+// clientEnv sends env requests upstream ahead of the request starting a
+// session, on the same channel
+type clientEnv struct {
+	conn ssh.PipeConn
+	env  []envPayload
+}
+
+func (f *clientEnv) FromUpstream(p []byte) ([]byte, error) {
+	return p, nil
+}
+
+func (f *clientEnv) FromDownstream(p []byte) ([]byte, error) {
+	if len(p) == 0 || p[0] != msgChannelRequest {
+		return p, nil
+	}
+
+	var msg channelRequestMsg
+	if err := ssh.Unmarshal(p, &msg); err != nil {
+		return nil, err
+	}
+
+	switch msg.Request {
+	case "shell", "exec", "subsystem":
+	default:
+		return p, nil
+	}
+
+	for i := range f.env {
+		env := ssh.Marshal(&channelRequestMsg{
+			PeersId:             msg.PeersId,
+			Request:             "env",
+			RequestSpecificData: ssh.Marshal(&f.env[i]),
+		})
+
+		if err := f.conn.WriteUpstream(env); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
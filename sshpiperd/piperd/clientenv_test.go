@@ -0,0 +1,46 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"testing"
+)
+
+func TestClientEnv(t *testing.T) {
+	conn := &testPipeConn{}
+	f := &clientEnv{conn: conn, env: []envPayload{{EnvClient, "1.2.3.4:5555"}, {EnvConn, "42"}}}
+
+	pty := ssh.Marshal(&channelRequestMsg{PeersId: 7, Request: "pty-req"})
+	if _, err := f.FromDownstream(pty); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conn.up) != 0 {
+		t.Fatalf("env sent before pty-req")
+	}
+
+	shell := ssh.Marshal(&channelRequestMsg{PeersId: 7, Request: "shell", WantReply: true})
+	p, err := f.FromDownstream(shell)
+	if err != nil || p == nil || p[0] != msgChannelRequest {
+		t.Fatalf("shell request not passed: %v", err)
+	}
+
+	if len(conn.up) != 2 {
+		t.Fatalf("got %d packets upstream, want 2 env requests", len(conn.up))
+	}
+
+	for i, want := range f.env {
+		var msg channelRequestMsg
+		if err := ssh.Unmarshal(conn.up[i], &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		var env envPayload
+		if err := ssh.Unmarshal(msg.RequestSpecificData, &env); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.PeersId != 7 || msg.Request != "env" || env != want {
+			t.Errorf("got %v on %d %v, want env %v", msg.Request, msg.PeersId, env, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnEvent types
+const (
+	ConnEstablished = "established"
+	ConnClosed      = "closed"
+)
+
+// ConnEvent is passed to the hook set by WithConnHook
+type ConnEvent struct {
+	Type string
+
+	User       string
+	Downstream net.Addr
+	Upstream   net.Addr
+
+	// labels of the pipe set by the provider, nil for none
+	Labels map[string]string
+
+	// public keys downstream offered, see ssh.KeyOffers
+	OfferedKeys []ssh.OfferedKey
+
+	// who the pipe talks to, the upstream's host key, version and
+	// algorithms
+	UpstreamIdentity *ssh.UpstreamIdentity
+
+	// bytes read from and written to downstream, duration since accepted
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+
+	// reason of close, nil when established
+	Err error
+}
+
+// countingConn counts bytes read and written
+type countingConn struct {
+	net.Conn
+	in  int64
+	out int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.in, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.out, int64(n))
+	return n, err
+}
+
+// serveWithHook serves c with piper, a copy for c only, so user and upstream
+// of this connection are known to the hook
+func (d *Daemon) serveWithHook(piper *ssh.SSHPiper, c net.Conn, labels *connLabels, identity *upstreamIdentity) error {
+	start := time.Now()
+	cc := &countingConn{Conn: c}
+
+	event := ConnEvent{Downstream: c.RemoteAddr()}
+	established := false
+
+	var offers ssh.KeyOffers
+
+	fire := func(typ string, err error) {
+		event.Type = typ
+		event.BytesIn = atomic.LoadInt64(&cc.in)
+		event.BytesOut = atomic.LoadInt64(&cc.out)
+		event.Duration = time.Since(start)
+		event.Err = err
+		event.Labels = labels.get()
+		event.UpstreamIdentity = identity.get()
+		if offers != nil {
+			event.OfferedKeys = offers.OfferedKeys()
+		}
+		d.connHook(event)
+	}
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		event.User = conn.User()
+		offers, _ = conn.(ssh.KeyOffers)
+
+		u, config, err := findUpstream(conn)
+		if err == nil {
+			event.Upstream = u.RemoteAddr()
+		}
+		return u, config, err
+	}
+
+	phaseHook := piper.PhaseHook
+	piper.PhaseHook = func(conn net.Conn, phase ssh.PipePhase) {
+		if phaseHook != nil {
+			phaseHook(conn, phase)
+		}
+
+		if phase == ssh.PhasePiping {
+			established = true
+			fire(ConnEstablished, nil)
+		}
+	}
+
+	err := piper.Serve(cc)
+
+	if established {
+		fire(ConnClosed, err)
+	}
+
+	return err
+}
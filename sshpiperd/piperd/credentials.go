@@ -0,0 +1,108 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"sort"
+	"sync"
+)
+
+// CredentialStats counts pipes by the version of the upstream key they
+// logged in with, since the daemon started. A rotation is done once no pipe
+// is active on the old version.
+type CredentialStats struct {
+	Version string `json:"version"`
+
+	// pipes established and piped now
+	Sessions int64 `json:"sessions"`
+	Active   int64 `json:"active"`
+}
+
+type credentialRegistry struct {
+	mu       sync.Mutex
+	versions map[string]*CredentialStats
+}
+
+func (r *credentialRegistry) piped(version string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.versions == nil {
+		r.versions = make(map[string]*CredentialStats)
+	}
+
+	s, ok := r.versions[version]
+	if !ok {
+		s = &CredentialStats{Version: version}
+		r.versions[version] = s
+	}
+
+	if delta > 0 {
+		s.Sessions++
+	}
+	s.Active += delta
+}
+
+// CredentialStats returns pipes by upstream key version, sorted by version
+func (d *Daemon) CredentialStats() []CredentialStats {
+	d.credentials.mu.Lock()
+	defer d.credentials.mu.Unlock()
+
+	var stats []CredentialStats
+	for _, s := range d.credentials.versions {
+		stats = append(stats, *s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Version < stats[j].Version })
+	return stats
+}
+
+// credentialVersion is the version of the upstream key of one connection,
+// empty if no key was mapped, e.g. password auth
+type credentialVersion struct {
+	version string
+}
+
+func (c *credentialVersion) get() string {
+	if c == nil {
+		return ""
+	}
+	return c.version
+}
+
+// withCredentialVersion keeps the version of the last key mapped before the
+// pipe is up, the one upstream accepted, and counts the pipe by it. Providers
+// name versions with upstream.CredentialVersioner, fingerprints otherwise.
+func (d *Daemon) withCredentialVersion(piper *ssh.SSHPiper, provider upstream.Provider) *credentialVersion {
+	c := &credentialVersion{}
+
+	versioner, _ := provider.(upstream.CredentialVersioner)
+
+	onMapped(piper, func(conn ssh.ConnMetadata, signer ssh.Signer) {
+		c.version = ""
+		if versioner != nil {
+			c.version = versioner.CredentialVersion(signer)
+		}
+		if c.version == "" {
+			c.version = fingerprint(signer.PublicKey())
+		}
+	})
+
+	appendFilter(piper, func(conn ssh.PipeConn) ssh.PacketFilter {
+		if c.version == "" {
+			return nil
+		}
+
+		d.logger.Printf("pipe of [%v] from [%v] logged in upstream with key %v", conn.User(), conn.RemoteAddr(), c.version)
+		d.credentials.piped(c.version, 1)
+
+		go func() {
+			<-conn.Done()
+			d.credentials.piped(c.version, -1)
+		}()
+
+		return nil
+	})
+
+	return c
+}
@@ -0,0 +1,134 @@
+package piperd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// keyUpstream accepts keys in authorized and keeps conns open
+func keyUpstream(t *testing.T, key ssh.Signer, authorized ...ssh.PublicKey) net.Listener {
+	return serveUpstream(t, key, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range authorized {
+				if bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown key")
+		},
+	}, nil)
+}
+
+// keyringProvider maps alice's key to the key of the user in its keyring
+type keyringProvider struct {
+	upstream.Keyring
+	*upstream.Fake
+}
+
+func (p *keyringProvider) MapPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
+	if !upstream.ContainsKey(p.AuthorizedKeys, key) {
+		return nil, nil
+	}
+	return p.Get(conn.User()), nil
+}
+
+func TestCredentialRotation(t *testing.T) {
+	key := newTestSigner(t)
+	client := newTestSigner(t)
+	v1, v2 := newTestSigner(t), newTestSigner(t)
+
+	up := keyUpstream(t, key, v1.PublicKey(), v2.PublicKey())
+	defer up.Close()
+
+	provider := &keyringProvider{Fake: &upstream.Fake{Addr: up.Addr().String(), AuthorizedKeys: []ssh.PublicKey{client.PublicKey()}}}
+	provider.Set("alice", v1, "2026-01")
+
+	d, err := New(WithProvider(provider), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	events, cancel := d.Subscribe(16, EventPipeOpen)
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	dial := func() *ssh.Client {
+		c, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(client)},
+		})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		return c
+	}
+
+	nextVersion := func() string {
+		select {
+		case e := <-events:
+			return e.CredentialVersion
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no pipe-open event")
+		}
+		return ""
+	}
+
+	old := dial()
+	if v := nextVersion(); v != "2026-01" {
+		t.Errorf("first pipe logged in with %q, want 2026-01", v)
+	}
+
+	// rotated while the first pipe is up, a key without a version of its
+	// own is named by its fingerprint
+	provider.Set("alice", v2, "")
+
+	rotated := dial()
+	defer rotated.Close()
+	if v := nextVersion(); v != fingerprint(v2.PublicKey()) {
+		t.Errorf("pipe after rotation logged in with %q, want %v", v, fingerprint(v2.PublicKey()))
+	}
+
+	want := []CredentialStats{
+		{Version: "2026-01", Sessions: 1, Active: 1},
+		{Version: fingerprint(v2.PublicKey()), Sessions: 1, Active: 1},
+	}
+	if got := d.CredentialStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("CredentialStats() = %+v, want %+v", got, want)
+	}
+
+	// the old pipe was not touched by the rotation
+	if _, _, err := old.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("request on the old pipe: %v", err)
+	}
+
+	old.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		var active int64
+		for _, s := range d.CredentialStats() {
+			if s.Version == "2026-01" {
+				active = s.Active
+			}
+		}
+
+		if active == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("old version still active after its pipe closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,56 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+)
+
+// denialConn is the conn the challenger gets, see challenger.Denier
+type denialConn struct {
+	ssh.ConnMetadata
+}
+
+func (c denialConn) Denial() *challenger.Denial {
+	w, ok := c.ConnMetadata.(ssh.UpstreamWaiter)
+	if !ok {
+		return nil
+	}
+
+	err := w.WaitUpstream()
+	if err == nil {
+		return nil
+	}
+
+	reason := messageKey(err)
+	if reason == "" {
+		reason = "denied"
+	}
+
+	return &challenger.Denial{Reason: reason, Err: err}
+}
+
+// OfferedKeys keeps ssh.KeyOffers of the wrapped conn
+func (c denialConn) OfferedKeys() []ssh.OfferedKey {
+	if offers, ok := c.ConnMetadata.(ssh.KeyOffers); ok {
+		return offers.OfferedKeys()
+	}
+	return nil
+}
+
+// Verified keeps ssh.VerifiedConn of the wrapped conn
+func (c denialConn) Verified() bool {
+	return challenger.Verified(c.ConnMetadata)
+}
+
+// withDenials lets the challenger tell why the login is denied, see
+// challenger.DenialOf
+func (d *Daemon) withDenials(piper *ssh.SSHPiper) {
+	challenge := piper.AdditionalChallenge
+	if challenge == nil {
+		return
+	}
+
+	piper.AdditionalChallenge = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+		return challenge(denialConn{conn}, client)
+	}
+}
@@ -0,0 +1,61 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"testing"
+)
+
+func TestDenialToChallenger(t *testing.T) {
+	denials := make(chan *challenger.Denial, 1)
+
+	d, err := New(
+		WithProvider(&upstream.Fake{}),
+		WithHostKey(newTestSigner(t)),
+		WithChallenger(func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+			denial := challenger.DenialOf(conn)
+			denials <- denial
+
+			if denial != nil {
+				client(conn.User(), "enroll at https://example.com/enroll", nil, nil)
+				return false, nil
+			}
+			return true, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	var instruction string
+	_, err = ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{
+			ssh.KeyboardInteractive(func(user, inst string, questions []string, echos []bool) ([]string, error) {
+				instruction = inst
+				return nil, nil
+			}),
+		},
+	})
+	if err == nil {
+		t.Fatal("login passed without a pipe")
+	}
+
+	denial := <-denials
+	if denial == nil || denial.Reason != MsgNoPipe || denial.Err != upstream.ErrNoPipe {
+		t.Errorf("denial %+v, want %v", denial, MsgNoPipe)
+	}
+
+	if instruction != "enroll at https://example.com/enroll" {
+		t.Errorf("instruction %q, want the enroll url", instruction)
+	}
+}
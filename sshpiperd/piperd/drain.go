@@ -0,0 +1,227 @@
+package piperd
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// drainingError is returned by FindUpstream for an upstream drained for
+// maintenance
+type drainingError struct {
+	Addr string
+}
+
+func (e *drainingError) Error() string {
+	return fmt.Sprintf("upstream %v is drained", e.Addr)
+}
+
+// Drain is an upstream taking no new pipes, see DrainUpstream
+type Drain struct {
+	Addr  string    `json:"addr"`
+	Since time.Time `json:"since"`
+
+	// when pipes still up are closed, nil if they are left alone
+	CloseAt *time.Time `json:"close_at,omitempty"`
+}
+
+type drain struct {
+	Drain
+	cancel chan struct{}
+}
+
+// drainRegistry tracks drained upstreams and the pipes up to every upstream,
+// by address as dialed
+type drainRegistry struct {
+	mu     sync.Mutex
+	drains map[string]*drain
+	pipes  map[string]map[*sessionChannels]bool
+}
+
+// DrainUpstream refuses new pipes to upstream addr, ip:port as in
+// UpstreamStats, with MsgUpstreamDraining, e.g. before its maintenance. If
+// terminate, users of pipes up are told on stderr and the pipes closed
+// after grace, pipes are left alone otherwise. Draining an upstream again
+// replaces the drain before.
+func (d *Daemon) DrainUpstream(addr string, grace time.Duration, terminate bool) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return err
+	}
+
+	dr := &drain{
+		Drain:  Drain{Addr: addr, Since: time.Now()},
+		cancel: make(chan struct{}),
+	}
+
+	if terminate {
+		at := dr.Since.Add(grace)
+		dr.CloseAt = &at
+	}
+
+	d.drains.mu.Lock()
+	if d.drains.drains == nil {
+		d.drains.drains = make(map[string]*drain)
+	}
+	if old, ok := d.drains.drains[addr]; ok {
+		close(old.cancel)
+	}
+	d.drains.drains[addr] = dr
+	d.drains.mu.Unlock()
+
+	if !terminate {
+		d.logger.Printf("upstream [%v] drained, pipes up are left alone", addr)
+		return nil
+	}
+
+	d.logger.Printf("upstream [%v] drained, pipes up are closed in %v", addr, grace)
+	d.drains.each(addr, func(s *sessionChannels) {
+		s.printAll(fmt.Sprintf("\nsshpiper: upstream %v goes down for maintenance, this session is closed in %v\n", addr, grace), true)
+	})
+
+	go func() {
+		t := time.NewTimer(grace)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-dr.cancel:
+			return
+		}
+
+		d.drains.each(addr, func(s *sessionChannels) {
+			d.logger.Printf("pipe of [%v] from [%v] to drained upstream [%v] closed", s.conn.User(), s.conn.RemoteAddr(), addr)
+			s.conn.Close()
+		})
+	}()
+
+	return nil
+}
+
+// UndrainUpstream lets upstream addr take new pipes again, false if it is
+// not drained. Pipes waiting to be closed are left alone.
+func (d *Daemon) UndrainUpstream(addr string) bool {
+	d.drains.mu.Lock()
+	defer d.drains.mu.Unlock()
+
+	dr, ok := d.drains.drains[addr]
+	if !ok {
+		return false
+	}
+
+	close(dr.cancel)
+	delete(d.drains.drains, addr)
+
+	d.logger.Printf("upstream [%v] undrained", addr)
+	return true
+}
+
+// Drains returns drained upstreams, by address
+func (d *Daemon) Drains() []Drain {
+	d.drains.mu.Lock()
+	defer d.drains.mu.Unlock()
+
+	var addrs []string
+	for addr := range d.drains.drains {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var drains []Drain
+	for _, addr := range addrs {
+		drains = append(drains, d.drains.drains[addr].Drain)
+	}
+
+	return drains
+}
+
+func (r *drainRegistry) drained(addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.drains[addr]
+	return ok
+}
+
+// each calls f with the pipes up to addr, outside of mu
+func (r *drainRegistry) each(addr string, f func(s *sessionChannels)) {
+	r.mu.Lock()
+	var pipes []*sessionChannels
+	for s := range r.pipes[addr] {
+		pipes = append(pipes, s)
+	}
+	r.mu.Unlock()
+
+	for _, s := range pipes {
+		f(s)
+	}
+}
+
+func (r *drainRegistry) add(addr string, s *sessionChannels) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pipes == nil {
+		r.pipes = make(map[string]map[*sessionChannels]bool)
+	}
+	if r.pipes[addr] == nil {
+		r.pipes[addr] = make(map[*sessionChannels]bool)
+	}
+	r.pipes[addr][s] = true
+}
+
+func (r *drainRegistry) remove(addr string, s *sessionChannels) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.pipes[addr], s)
+	if len(r.pipes[addr]) == 0 {
+		delete(r.pipes, addr)
+	}
+}
+
+// withDrain refuses pipes to drained upstreams once dialed, as the
+// address is known then, and tracks the pipes up so a drain can close them
+func (d *Daemon) withDrain(piper *ssh.SSHPiper) {
+	var addr string
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if err != nil {
+			return c, config, err
+		}
+
+		// e.g. the local shell is not an upstream
+		if _, ok := c.RemoteAddr().(*net.TCPAddr); !ok {
+			return c, config, nil
+		}
+
+		addr = c.RemoteAddr().String()
+		if d.drains.drained(addr) {
+			c.Close()
+			d.logger.Printf("user [%v] from [%v] refused, upstream [%v] is drained", conn.User(), conn.RemoteAddr(), addr)
+			return nil, nil, &drainingError{addr}
+		}
+
+		return c, config, nil
+	}
+
+	appendFilter(piper, func(conn ssh.PipeConn) ssh.PacketFilter {
+		if addr == "" {
+			return nil
+		}
+
+		s := newSessionChannels(conn)
+		d.drains.add(addr, s)
+
+		go func() {
+			<-conn.Done()
+			d.drains.remove(addr, s)
+		}()
+
+		return s
+	})
+}
@@ -0,0 +1,84 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainUpstream(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	dial := func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("pw")},
+		})
+	}
+
+	piped, err := dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer piped.Close()
+
+	addr := up.Addr().String()
+	if err := d.DrainUpstream(addr, 100*time.Millisecond, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if drains := d.Drains(); len(drains) != 1 || drains[0].Addr != addr || drains[0].CloseAt == nil {
+		t.Errorf("Drains() = %+v", drains)
+	}
+
+	if _, err := dial(); err == nil || !strings.Contains(err.Error(), "upstream "+addr+" is down for maintenance") {
+		t.Errorf("Dial to drained upstream got %v, want the draining message", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- piped.Wait() }()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("pipe to drained upstream not closed after grace")
+	}
+
+	if !d.UndrainUpstream(addr) || d.UndrainUpstream(addr) {
+		t.Errorf("UndrainUpstream did not undrain once")
+	}
+
+	again, err := dial()
+	if err != nil {
+		t.Fatalf("Dial after undrain: %v", err)
+	}
+	defer again.Close()
+
+	// pipes are left alone without terminate
+	if err := d.DrainUpstream(addr, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, _, err := again.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("request on a pipe drained without terminate: %v", err)
+	}
+}
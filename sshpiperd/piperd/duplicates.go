@@ -0,0 +1,129 @@
+package piperd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"sync"
+)
+
+// errDuplicateSession is returned by FindUpstream when the user already has
+// a pipe to the upstream and duplicates are denied
+var errDuplicateSession = errors.New("duplicate session")
+
+// WithDuplicatePolicy sets what happens when a user opens a second pipe to
+// the same upstream, upstream.DuplicateAllow by default. Providers override
+// it per pipe with upstream.Conn.
+func WithDuplicatePolicy(policy string) Option {
+	return func(d *Daemon) {
+		d.duplicates.policy = policy
+	}
+}
+
+// duplicateRegistry tracks piped sessions by user and upstream
+type duplicateRegistry struct {
+	policy string
+
+	mu       sync.Mutex
+	sessions map[string][]*duplicateSession
+}
+
+type duplicateSession struct {
+	conn ssh.PipeConn
+
+	// tracked for sessions which may be taken over, to tell the user
+	channels *sessionChannels
+}
+
+func duplicateKey(user string, c net.Conn) string {
+	return user + " " + c.RemoteAddr().String()
+}
+
+func (r *duplicateRegistry) count(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions[key])
+}
+
+// withDuplicates applies the duplicate policy the provider or daemon sets
+func (d *Daemon) withDuplicates(piper *ssh.SSHPiper) {
+	var key, policy string
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if err != nil {
+			return c, config, err
+		}
+
+		key, policy = duplicateKey(conn.User(), c), d.duplicates.policy
+		if uc, ok := c.(*upstream.Conn); ok && uc.DuplicatePolicy != "" {
+			policy = uc.DuplicatePolicy
+		}
+
+		if policy == upstream.DuplicateDeny && d.duplicates.count(key) > 0 {
+			c.Close()
+			d.logger.Printf("user [%v] from [%v] denied, already has a session to [%v]", conn.User(), conn.RemoteAddr(), c.RemoteAddr())
+			return nil, nil, errDuplicateSession
+		}
+
+		return c, config, nil
+	}
+
+	appendFilter(piper, func(conn ssh.PipeConn) ssh.PacketFilter {
+		if key == "" {
+			return nil
+		}
+
+		s := &duplicateSession{conn: conn}
+		if policy == upstream.DuplicateTakeover {
+			s.channels = newSessionChannels(conn)
+		}
+
+		d.duplicates.mu.Lock()
+		if d.duplicates.sessions == nil {
+			d.duplicates.sessions = make(map[string][]*duplicateSession)
+		}
+
+		if policy == upstream.DuplicateTakeover {
+			for _, old := range d.duplicates.sessions[key] {
+				d.logger.Printf("session of [%v] from [%v] taken over by [%v]", old.conn.User(), old.conn.RemoteAddr(), conn.RemoteAddr())
+				if old.channels != nil {
+					old.channels.printAll(fmt.Sprintf("\nsshpiper: session taken over from %v\n", conn.RemoteAddr()), true)
+				}
+				old.conn.Close()
+			}
+			d.duplicates.sessions[key] = nil
+		}
+
+		d.duplicates.sessions[key] = append(d.duplicates.sessions[key], s)
+		d.duplicates.mu.Unlock()
+
+		go func() {
+			<-conn.Done()
+
+			d.duplicates.mu.Lock()
+			defer d.duplicates.mu.Unlock()
+
+			sessions := d.duplicates.sessions[key]
+			for i, other := range sessions {
+				if other == s {
+					d.duplicates.sessions[key] = append(sessions[:i:i], sessions[i+1:]...)
+					break
+				}
+			}
+
+			if len(d.duplicates.sessions[key]) == 0 {
+				delete(d.duplicates.sessions, key)
+			}
+		}()
+
+		if s.channels == nil {
+			return nil
+		}
+
+		return s.channels
+	})
+}
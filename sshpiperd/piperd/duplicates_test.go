@@ -0,0 +1,88 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDuplicatePolicy(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	serve := func(policy string) string {
+		d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key), WithDuplicatePolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go d.Serve(l)
+
+		return l.Addr().String()
+	}
+
+	dial := func(addr string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("pw")},
+		})
+	}
+
+	// deny
+	addr := serve(upstream.DuplicateDeny)
+
+	first, err := dial(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	if _, err := dial(addr); err == nil {
+		t.Errorf("second Dial with deny succeeded")
+	}
+
+	first.Close()
+
+	// the pipe is gone once the piper sees downstream closed
+	var again *ssh.Client
+	for i := 0; i < 50 && again == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		again, _ = dial(addr)
+	}
+
+	if again == nil {
+		t.Fatalf("Dial after the first session closed failed")
+	}
+	again.Close()
+
+	// takeover
+	addr = serve(upstream.DuplicateTakeover)
+
+	if first, err = dial(addr); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	second, err := dial(addr)
+	if err != nil {
+		t.Fatalf("second Dial with takeover: %v", err)
+	}
+	defer second.Close()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- first.Wait()
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("older session not closed by takeover")
+	}
+}
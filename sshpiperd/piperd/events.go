@@ -0,0 +1,221 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types, see Subscribe
+const (
+	// a connection accepted, passthroughs included, after its proxy header
+	EventAccept = "accept"
+	// an auth attempt of downstream, Err set if it failed
+	EventAuth = "auth"
+	// downstream authed and piped to Upstream
+	EventPipeOpen = "pipe-open"
+	// a channel opened by either side of a pipe
+	EventChannelOpen = "channel-open"
+	// a connection closed, Err the reason
+	EventClose = "close"
+)
+
+// Event is sent to subscribers, fields not known yet are empty
+type Event struct {
+	Type string
+	Time time.Time
+
+	// the same for every event of one connection
+	Conn uint64
+
+	User       string
+	Downstream net.Addr
+	Upstream   net.Addr
+
+	// who the pipe talks to, from EventPipeOpen on
+	UpstreamIdentity *ssh.UpstreamIdentity
+
+	// version of the upstream key the pipe logged in with, from
+	// EventPipeOpen on, empty if none was mapped
+	CredentialVersion string
+
+	// auth method of EventAuth
+	Method string
+
+	// channel type of EventChannelOpen, and whether upstream opened it,
+	// e.g. forwarded-tcpip
+	ChannelType string
+	ByUpstream  bool
+
+	Err error
+}
+
+// eventBus fans events out to subscribers
+type eventBus struct {
+	// connections served, ids of Event.Conn
+	conns uint64
+
+	mu   sync.RWMutex
+	subs map[*subscriber]bool
+}
+
+type subscriber struct {
+	ch    chan Event
+	types map[string]bool
+}
+
+// Subscribe returns a channel of events of types, every type if none. The
+// channel buffers size events, events which do not fit are dropped, so a
+// slow subscriber never holds connections up. cancel ends the subscription
+// and closes the channel.
+func (d *Daemon) Subscribe(size int, types ...string) (events <-chan Event, cancel func()) {
+	s := &subscriber{ch: make(chan Event, size)}
+	if len(types) > 0 {
+		s.types = make(map[string]bool)
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+
+	d.events.mu.Lock()
+	if d.events.subs == nil {
+		d.events.subs = make(map[*subscriber]bool)
+	}
+	d.events.subs[s] = true
+	d.events.mu.Unlock()
+
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			d.events.mu.Lock()
+			delete(d.events.subs, s)
+			d.events.mu.Unlock()
+			close(s.ch)
+		})
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.subs) == 0 {
+		return
+	}
+
+	e.Time = time.Now()
+	for s := range b.subs {
+		if s.types != nil && !s.types[e.Type] {
+			continue
+		}
+
+		select {
+		case s.ch <- e:
+		default:
+		}
+	}
+}
+
+// connEvents publishes the events of one connection
+type connEvents struct {
+	bus   *eventBus
+	event Event
+}
+
+func (d *Daemon) newConnEvents(c net.Conn) *connEvents {
+	return &connEvents{
+		bus: &d.events,
+		event: Event{
+			Conn:       atomic.AddUint64(&d.events.conns, 1),
+			Downstream: c.RemoteAddr(),
+		},
+	}
+}
+
+func (e *connEvents) publish(typ string, err error) {
+	event := e.event
+	event.Type, event.Err = typ, err
+	e.bus.publish(event)
+}
+
+// withEvents publishes auth, pipe-open and channel-open of the connection.
+// The upstream is the one every feature let through and channels are those
+// no filter dropped, so it goes last.
+func (e *connEvents) withEvents(piper *ssh.SSHPiper, identity *upstreamIdentity, credential *credentialVersion) {
+	authLog := piper.DownstreamConfig.AuthLogCallback
+	piper.DownstreamConfig.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		if authLog != nil {
+			authLog(conn, method, err)
+		}
+
+		if method == "none" {
+			return
+		}
+
+		e.event.User = conn.User()
+
+		event := e.event
+		event.Type, event.Method, event.Err = EventAuth, method, err
+		e.bus.publish(event)
+	}
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		e.event.User = conn.User()
+
+		c, config, err := findUpstream(conn)
+		if err == nil {
+			e.event.Upstream = c.RemoteAddr()
+		}
+		return c, config, err
+	}
+
+	phaseHook := piper.PhaseHook
+	piper.PhaseHook = func(conn net.Conn, phase ssh.PipePhase) {
+		if phaseHook != nil {
+			phaseHook(conn, phase)
+		}
+
+		if phase == ssh.PhasePiping {
+			e.event.UpstreamIdentity = identity.get()
+			e.event.CredentialVersion = credential.get()
+			e.publish(EventPipeOpen, nil)
+		}
+	}
+
+	appendFilter(piper, func(conn ssh.PipeConn) ssh.PacketFilter {
+		return channelOpenEvents{e}
+	})
+}
+
+// channelOpenEvents publishes channel opens of either side
+type channelOpenEvents struct {
+	events *connEvents
+}
+
+func (f channelOpenEvents) open(p []byte, byUpstream bool) {
+	if len(p) == 0 || p[0] != msgChannelOpen {
+		return
+	}
+
+	var msg channelOpenMsg
+	if err := ssh.Unmarshal(p, &msg); err != nil {
+		return
+	}
+
+	event := f.events.event
+	event.Type, event.ChannelType, event.ByUpstream = EventChannelOpen, msg.ChanType, byUpstream
+	f.events.bus.publish(event)
+}
+
+func (f channelOpenEvents) FromDownstream(p []byte) ([]byte, error) {
+	f.open(p, false)
+	return p, nil
+}
+
+func (f channelOpenEvents) FromUpstream(p []byte) ([]byte, error) {
+	f.open(p, true)
+	return p, nil
+}
@@ -0,0 +1,112 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	events, cancel := d.Subscribe(16)
+	closes, cancelCloses := d.Subscribe(16, EventClose)
+	defer cancelCloses()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	dial := func(password string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password(password)},
+		})
+	}
+
+	if _, err := dial("wrong"); err == nil {
+		t.Fatalf("Dial with a wrong password succeeded")
+	}
+
+	client, err := dial("pw")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	// upstream rejects channels, the open is published all the same
+	client.NewSession()
+	client.Close()
+
+	// connections close concurrently, events are in order per connection
+	want := [][]string{
+		{EventAccept, EventAuth, EventClose},
+		{EventAccept, EventAuth, EventPipeOpen, EventChannelOpen, EventClose},
+	}
+
+	var order []uint64
+	byConn := make(map[uint64][]Event)
+	for i := 0; i < len(want[0])+len(want[1]); i++ {
+		select {
+		case e := <-events:
+			if byConn[e.Conn] == nil {
+				order = append(order, e.Conn)
+			}
+			byConn[e.Conn] = append(byConn[e.Conn], e)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d events, want %d", i, len(want[0])+len(want[1]))
+		}
+	}
+
+	for i, conn := range order {
+		got := byConn[conn]
+		for j, typ := range want[i] {
+			if j >= len(got) || got[j].Type != typ {
+				t.Fatalf("connection %d got %+v, want %v", i, got, want[i])
+			}
+		}
+	}
+
+	if e := byConn[order[0]][1]; e.User != "alice" || e.Method != "password" || e.Err == nil {
+		t.Errorf("first auth got %+v, want a failed password of alice", e)
+	}
+
+	piped := byConn[order[1]]
+	if e := piped[1]; e.Err != nil {
+		t.Errorf("second auth failed: %v", e.Err)
+	}
+
+	if e := piped[2]; e.Upstream.String() != up.Addr().String() {
+		t.Errorf("pipe-open to %v, want %v", e.Upstream, up.Addr())
+	}
+
+	if e := piped[3]; e.ChannelType != "session" || e.ByUpstream {
+		t.Errorf("channel-open got %+v, want a session by downstream", e)
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Errorf("channel open after cancel")
+	}
+
+	select {
+	case e := <-closes:
+		if e.Type != EventClose {
+			t.Errorf("subscriber of close got %v", e.Type)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no close event for a subscriber of close only")
+	}
+}
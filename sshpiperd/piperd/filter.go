@@ -0,0 +1,115 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+)
+
+// channel messages filters look into, see RFC 4254
+const (
+	msgChannelOpen         = 90
+	msgChannelOpenConfirm  = 91
+	msgChannelWindowAdjust = 93
+	msgChannelData         = 94
+	msgChannelClose        = 97
+	msgChannelRequest      = 98
+)
+
+type channelOpenMsg struct {
+	ChanType         string `sshtype:"90"`
+	PeersId          uint32
+	PeersWindow      uint32
+	MaxPacketSize    uint32
+	TypeSpecificData []byte `ssh:"rest"`
+}
+
+type channelOpenConfirmMsg struct {
+	PeersId          uint32 `sshtype:"91"`
+	MyId             uint32
+	MyWindow         uint32
+	MaxPacketSize    uint32
+	TypeSpecificData []byte `ssh:"rest"`
+}
+
+type windowAdjustMsg struct {
+	PeersId         uint32 `sshtype:"93"`
+	AdditionalBytes uint32
+}
+
+type channelDataMsg struct {
+	PeersId uint32 `sshtype:"94"`
+	Data    []byte
+}
+
+type channelCloseMsg struct {
+	PeersId uint32 `sshtype:"97"`
+}
+
+type channelRequestMsg struct {
+	PeersId             uint32 `sshtype:"98"`
+	Request             string
+	WantReply           bool
+	RequestSpecificData []byte `ssh:"rest"`
+}
+
+// filterChain runs filters in order, a packet dropped by one is not seen by
+// the rest
+type filterChain []ssh.PacketFilter
+
+func (c filterChain) FromDownstream(p []byte) ([]byte, error) {
+	var err error
+	for _, f := range c {
+		if p, err = f.FromDownstream(p); p == nil || err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (c filterChain) FromUpstream(p []byte) ([]byte, error) {
+	var err error
+	for _, f := range c {
+		if p, err = f.FromUpstream(p); p == nil || err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// packetFilter builds the filters enabled by options for conn, nil if none
+func (d *Daemon) packetFilter(conn ssh.PipeConn) ssh.PacketFilter {
+	var chain filterChain
+	for _, newFilter := range d.filters {
+		if f := newFilter(conn); f != nil {
+			chain = append(chain, f)
+		}
+	}
+
+	if len(chain) == 0 {
+		return nil
+	}
+
+	return chain
+}
+
+// appendFilter runs the filter newFilter builds after those of piper
+func appendFilter(piper *ssh.SSHPiper, newFilter func(conn ssh.PipeConn) ssh.PacketFilter) {
+	packetFilter := piper.PacketFilter
+	piper.PacketFilter = func(conn ssh.PipeConn) ssh.PacketFilter {
+		var chain filterChain
+		if packetFilter != nil {
+			if f := packetFilter(conn); f != nil {
+				chain = append(chain, f)
+			}
+		}
+
+		if f := newFilter(conn); f != nil {
+			chain = append(chain, f)
+		}
+
+		if len(chain) == 0 {
+			return nil
+		}
+
+		return chain
+	}
+}
@@ -0,0 +1,103 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+)
+
+// payloads of session channel requests, RFC 4254 section 6
+type execPayload struct {
+	Command string
+}
+
+type subsystemPayload struct {
+	Name string
+}
+
+type envPayload struct {
+	Name  string
+	Value string
+}
+
+// withForceCommand takes the forced command of the pipe FindUpstream dials
+func (d *Daemon) withForceCommand(piper *ssh.SSHPiper) {
+	var command string
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if uc, ok := c.(*upstream.Conn); ok && err == nil {
+			command = uc.ForceCommand
+		}
+		return c, config, err
+	}
+
+	appendFilter(piper, func(conn ssh.PipeConn) ssh.PacketFilter {
+		if command == "" {
+			return nil
+		}
+
+		return &forceCommand{conn: conn, command: command}
+	})
+}
+
+// forceCommand rewrites shell, exec and subsystem requests from downstream
+// to exec command, like command= in authorized_keys. The command downstream
+// asked for is sent before as SSH_ORIGINAL_COMMAND, which upstream sets if
+// its AcceptEnv allows.
+type forceCommand struct {
+	conn    ssh.PipeConn
+	command string
+}
+
+func (f *forceCommand) FromUpstream(p []byte) ([]byte, error) {
+	return p, nil
+}
+
+func (f *forceCommand) FromDownstream(p []byte) ([]byte, error) {
+	if len(p) == 0 || p[0] != msgChannelRequest {
+		return p, nil
+	}
+
+	var msg channelRequestMsg
+	if err := ssh.Unmarshal(p, &msg); err != nil {
+		return nil, err
+	}
+
+	var original string
+	switch msg.Request {
+	case "shell":
+	case "exec":
+		var exec execPayload
+		if err := ssh.Unmarshal(msg.RequestSpecificData, &exec); err != nil {
+			return nil, err
+		}
+		original = exec.Command
+	case "subsystem":
+		var subsystem subsystemPayload
+		if err := ssh.Unmarshal(msg.RequestSpecificData, &subsystem); err != nil {
+			return nil, err
+		}
+		original = subsystem.Name
+	default:
+		return p, nil
+	}
+
+	if original != "" {
+		env := ssh.Marshal(&channelRequestMsg{
+			PeersId:             msg.PeersId,
+			Request:             "env",
+			RequestSpecificData: ssh.Marshal(&envPayload{"SSH_ORIGINAL_COMMAND", original}),
+		})
+
+		if err := f.conn.WriteUpstream(env); err != nil {
+			return nil, err
+		}
+	}
+
+	msg.Request = "exec"
+	msg.RequestSpecificData = ssh.Marshal(&execPayload{f.command})
+
+	return ssh.Marshal(&msg), nil
+}
@@ -0,0 +1,73 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"testing"
+)
+
+func TestForceCommand(t *testing.T) {
+	conn := &testPipeConn{}
+	f := &forceCommand{conn: conn, command: "/usr/bin/menu"}
+
+	for _, tt := range []struct {
+		request  string
+		payload  []byte
+		original string
+	}{
+		{"shell", nil, ""},
+		{"exec", ssh.Marshal(&execPayload{"rm -rf /"}), "rm -rf /"},
+		{"subsystem", ssh.Marshal(&subsystemPayload{"sftp"}), "sftp"},
+	} {
+		conn.up = nil
+
+		p, err := f.FromDownstream(ssh.Marshal(&channelRequestMsg{PeersId: 7, Request: tt.request, WantReply: true, RequestSpecificData: tt.payload}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg channelRequestMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		var exec execPayload
+		if err := ssh.Unmarshal(msg.RequestSpecificData, &exec); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.PeersId != 7 || msg.Request != "exec" || !msg.WantReply || exec.Command != "/usr/bin/menu" {
+			t.Errorf("%v: got %v %q, want exec of the forced command", tt.request, msg.Request, exec.Command)
+		}
+
+		if tt.original == "" {
+			if len(conn.up) != 0 {
+				t.Errorf("%v: got %d packets upstream, want none", tt.request, len(conn.up))
+			}
+			continue
+		}
+
+		if len(conn.up) != 1 {
+			t.Fatalf("%v: got %d packets upstream, want the env request", tt.request, len(conn.up))
+		}
+
+		var env channelRequestMsg
+		if err := ssh.Unmarshal(conn.up[0], &env); err != nil {
+			t.Fatal(err)
+		}
+
+		var kv envPayload
+		if err := ssh.Unmarshal(env.RequestSpecificData, &kv); err != nil {
+			t.Fatal(err)
+		}
+
+		if env.Request != "env" || env.WantReply || kv.Name != "SSH_ORIGINAL_COMMAND" || kv.Value != tt.original {
+			t.Errorf("%v: got %v %v=%q", tt.request, env.Request, kv.Name, kv.Value)
+		}
+	}
+
+	// other requests pass
+	pty := ssh.Marshal(&channelRequestMsg{PeersId: 7, Request: "pty-req"})
+	if p, err := f.FromDownstream(pty); err != nil || p == nil || p[0] != msgChannelRequest {
+		t.Errorf("pty-req not passed: %v", err)
+	}
+}
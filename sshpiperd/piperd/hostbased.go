@@ -0,0 +1,68 @@
+package piperd
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"strings"
+)
+
+// WithHostbased relays hostbased auth. Client hosts must be in trusted with
+// the host key they sign with and resolve to the address they connect from,
+// requests are signed again toward upstream with key as client host
+// hostname.
+func WithHostbased(trusted *upstream.KnownHosts, key ssh.Signer, hostname string) Option {
+	return func(d *Daemon) {
+		d.hostbased = &hostbasedRelay{trusted, key, hostname}
+	}
+}
+
+// lookupHost resolves client host names, a var for tests
+var lookupHost = net.LookupHost
+
+type hostbasedRelay struct {
+	trusted  *upstream.KnownHosts
+	key      ssh.Signer
+	hostname string
+}
+
+func (d *Daemon) mapHostbased(conn ssh.ConnMetadata, hostKey ssh.PublicKey, clientHost, clientUser string) (ssh.Signer, string, error) {
+	// clients send their fqdn with a trailing dot
+	host := strings.TrimSuffix(clientHost, ".")
+
+	err := d.keyPolicy.Check(hostKey)
+	if err == nil {
+		err = d.hostbased.trusted.Check(net.JoinHostPort(host, "22"), hostKey)
+	}
+
+	// the client host is only what downstream claims, a trusted host key
+	// stolen elsewhere must not pass for that host
+	if err == nil {
+		err = checkClientHost(host, remoteIP(conn.RemoteAddr()))
+	}
+
+	if err != nil {
+		d.logger.Printf("hostbased auth of [%v] from [%v] as %v@%v rejected: %v", conn.User(), conn.RemoteAddr(), clientUser, host, err)
+		return nil, "", nil
+	}
+
+	d.logger.Printf("hostbased auth of [%v] from [%v] as %v@%v relayed as %v", conn.User(), conn.RemoteAddr(), clientUser, host, d.hostbased.hostname)
+	return d.hostbased.key, d.hostbased.hostname, nil
+}
+
+// checkClientHost checks host resolves to ip
+func checkClientHost(host, ip string) error {
+	addrs, err := lookupHost(host)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		if a := net.ParseIP(addr); a != nil && a.Equal(net.ParseIP(ip)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%v does not resolve to %v", host, ip)
+}
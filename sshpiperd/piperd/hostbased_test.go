@@ -0,0 +1,64 @@
+package piperd
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+)
+
+type testConnMeta struct {
+	ssh.ConnMetadata
+}
+
+func (testConnMeta) User() string {
+	return "alice"
+}
+
+func (testConnMeta) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+}
+
+func TestMapHostbased(t *testing.T) {
+	client := newTestSigner(t)
+	piper := newTestSigner(t)
+
+	trusted, err := upstream.ParseKnownHosts([]byte("client.example,elsewhere.example " + string(ssh.MarshalAuthorizedKey(client.PublicKey()))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(f func(string) ([]string, error)) { lookupHost = f }(lookupHost)
+	lookupHost = func(host string) ([]string, error) {
+		switch host {
+		case "client.example":
+			return []string{"10.0.0.1", "127.0.0.1"}, nil
+		case "elsewhere.example":
+			return []string{"10.0.0.2"}, nil
+		}
+		return nil, fmt.Errorf("no such host %v", host)
+	}
+
+	d := &Daemon{logger: log.New(ioutil.Discard, "", 0)}
+	WithHostbased(trusted, piper, "piper.example")(d)
+
+	signer, host, err := d.mapHostbased(testConnMeta{}, client.PublicKey(), "client.example.", "bob")
+	if err != nil || signer != piper || host != "piper.example" {
+		t.Errorf("trusted host got %v %q %v", signer, host, err)
+	}
+
+	if signer, _, _ := d.mapHostbased(testConnMeta{}, client.PublicKey(), "other.example.", "bob"); signer != nil {
+		t.Errorf("untrusted host name relayed")
+	}
+
+	if signer, _, _ := d.mapHostbased(testConnMeta{}, newTestSigner(t).PublicKey(), "client.example.", "bob"); signer != nil {
+		t.Errorf("unknown host key relayed")
+	}
+
+	if signer, _, _ := d.mapHostbased(testConnMeta{}, client.PublicKey(), "elsewhere.example.", "bob"); signer != nil {
+		t.Errorf("host not resolving to the remote address relayed")
+	}
+}
@@ -0,0 +1,71 @@
+package piperd
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+)
+
+// upstreamIdentity is who the pipe of one connection talks to, nil until
+// piped
+type upstreamIdentity struct {
+	id *ssh.UpstreamIdentity
+}
+
+func (u *upstreamIdentity) get() *ssh.UpstreamIdentity {
+	if u == nil {
+		return nil
+	}
+	return u.id
+}
+
+// withUpstreamIdentity logs the host key, version and algorithms of the
+// upstream every pipe ends up with, and keeps them for hooks, events and
+// stats. It is known once filters are built, right before PhasePiping.
+func (d *Daemon) withUpstreamIdentity(piper *ssh.SSHPiper) *upstreamIdentity {
+	u := &upstreamIdentity{}
+
+	var addr net.Addr
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if err == nil {
+			addr = c.RemoteAddr()
+		}
+		return c, config, err
+	}
+
+	appendFilter(piper, func(conn ssh.PipeConn) ssh.PacketFilter {
+		id := conn.UpstreamIdentity()
+		u.id = &id
+
+		d.logger.Printf("upstream [%v] of [%v]: %v", addr, conn.User(), formatIdentity(id))
+		return nil
+	})
+
+	return u
+}
+
+// formatIdentity is the canonical one line form of id
+func formatIdentity(id ssh.UpstreamIdentity) string {
+	key := "none"
+	if id.HostKey != nil {
+		key = id.HostKey.Type() + " " + fingerprint(id.HostKey)
+	}
+
+	algs := id.Algorithms
+
+	// one name if both directions agree, toward upstream first if not
+	both := func(w, r string) string {
+		if w == r {
+			return w
+		}
+		return w + "/" + r
+	}
+
+	return fmt.Sprintf("host key %v, version %q, kex %v, cipher %v, mac %v",
+		key, id.ServerVersion, algs.Kex,
+		both(algs.Write.Cipher, algs.Read.Cipher),
+		both(algs.Write.MAC, algs.Read.MAC))
+}
@@ -0,0 +1,73 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamIdentity(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	events, cancel := d.Subscribe(4, EventPipeOpen)
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("pw")},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	var e Event
+	select {
+	case e = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no pipe-open event")
+	}
+
+	id := e.UpstreamIdentity
+	if id == nil {
+		t.Fatalf("pipe-open without upstream identity")
+	}
+
+	if id.HostKey == nil || fingerprint(id.HostKey) != fingerprint(key.PublicKey()) {
+		t.Errorf("got host key %v, want the upstream's", id.HostKey)
+	}
+
+	if !strings.HasPrefix(id.ServerVersion, "SSH-2.0-") {
+		t.Errorf("got server version %q", id.ServerVersion)
+	}
+
+	algs := id.Algorithms
+	if algs.Kex == "" || algs.HostKey != key.PublicKey().Type() || algs.Write.Cipher == "" || algs.Read.Cipher == "" {
+		t.Errorf("got algorithms %+v", algs)
+	}
+
+	line := formatIdentity(*id)
+	for _, want := range []string{fingerprint(key.PublicKey()), id.ServerVersion, "kex " + algs.Kex} {
+		if !strings.Contains(line, want) {
+			t.Errorf("%q does not contain %q", line, want)
+		}
+	}
+}
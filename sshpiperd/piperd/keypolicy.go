@@ -0,0 +1,66 @@
+package piperd
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"math/big"
+)
+
+// KeyPolicy rejects weak downstream public keys before they are mapped, so
+// they are never signed again for upstream
+type KeyPolicy struct {
+	// MinRSABits is the smallest rsa modulus accepted, 0 for any
+	MinRSABits int
+
+	// DenyTypes are key types never accepted, e.g. ssh-dss
+	DenyTypes []string
+}
+
+// WithKeyPolicy checks downstream public keys against p
+func WithKeyPolicy(p KeyPolicy) Option {
+	return func(d *Daemon) {
+		d.keyPolicy = p
+	}
+}
+
+// Check returns why key is rejected, nil if accepted. Certificates are
+// checked by the key they certify.
+func (p KeyPolicy) Check(key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	for _, t := range p.DenyTypes {
+		if key.Type() == t {
+			return fmt.Errorf("%v keys are not accepted", t)
+		}
+	}
+
+	if p.MinRSABits > 0 && key.Type() == ssh.KeyAlgoRSA {
+		var rsa struct {
+			Name string
+			E    *big.Int
+			N    *big.Int
+		}
+
+		if err := ssh.Unmarshal(key.Marshal(), &rsa); err != nil {
+			return err
+		}
+
+		if bits := rsa.N.BitLen(); bits < p.MinRSABits {
+			return fmt.Errorf("rsa key has %d bits, %d required", bits, p.MinRSABits)
+		}
+	}
+
+	return nil
+}
+
+func (d *Daemon) mapPublicKey(provider upstream.Provider, conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
+	if err := d.keyPolicy.Check(key); err != nil {
+		d.logger.Printf("public key of [%v] from [%v] rejected: %v", conn.User(), conn.RemoteAddr(), err)
+		return nil, nil
+	}
+
+	return provider.MapPublicKey(conn, key)
+}
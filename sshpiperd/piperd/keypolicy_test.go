@@ -0,0 +1,56 @@
+package piperd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/tg123/sshpiper/ssh"
+	"testing"
+)
+
+func newRSAKey(t *testing.T, bits int) ssh.PublicKey {
+	k, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := ssh.NewPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pub
+}
+
+// typedKey only has a type, enough for deny lists
+type typedKey struct {
+	ssh.PublicKey
+	typ string
+}
+
+func (k typedKey) Type() string {
+	return k.typ
+}
+
+func TestKeyPolicy(t *testing.T) {
+	p := KeyPolicy{MinRSABits: 2048, DenyTypes: []string{ssh.KeyAlgoDSA}}
+
+	if err := p.Check(newRSAKey(t, 1024)); err == nil {
+		t.Errorf("1024 bit rsa key accepted")
+	}
+
+	if err := p.Check(newRSAKey(t, 2048)); err != nil {
+		t.Errorf("2048 bit rsa key: %v", err)
+	}
+
+	if err := p.Check(typedKey{typ: ssh.KeyAlgoDSA}); err == nil {
+		t.Errorf("dsa key accepted")
+	}
+
+	if err := p.Check(newTestSigner(t).PublicKey()); err != nil {
+		t.Errorf("ecdsa key: %v", err)
+	}
+
+	if err := (KeyPolicy{}).Check(newRSAKey(t, 1024)); err != nil {
+		t.Errorf("empty policy: %v", err)
+	}
+}
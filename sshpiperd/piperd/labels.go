@@ -0,0 +1,54 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// connLabels are the labels of one connection, set when the provider
+// returns upstream.Conn with labels
+type connLabels struct {
+	mu     sync.Mutex
+	labels map[string]string
+}
+
+func (l *connLabels) get() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.labels
+}
+
+// withLabels takes labels from the conn FindUpstream returns and logs them
+func (d *Daemon) withLabels(piper *ssh.SSHPiper) *connLabels {
+	l := &connLabels{}
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if uc, ok := c.(*upstream.Conn); ok && len(uc.Labels) > 0 {
+			l.mu.Lock()
+			l.labels = uc.Labels
+			l.mu.Unlock()
+
+			d.logger.Printf("labels of [%v] from [%v]: %v", conn.User(), conn.RemoteAddr(), FormatLabels(uc.Labels))
+		}
+		return c, config, err
+	}
+
+	return l
+}
+
+// FormatLabels formats labels as key=value pairs sorted by key
+func FormatLabels(labels map[string]string) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, " ")
+}
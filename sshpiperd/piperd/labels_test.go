@@ -0,0 +1,55 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLabelsInConnEvent(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	events := make(chan ConnEvent, 10)
+
+	d, err := New(
+		WithProvider(&upstream.Fake{}),
+		WithHostKey(key),
+		WithConnHook(func(event ConnEvent) { events <- event }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	labels := map[string]string{"team": "infra", "ticket": "OPS-1"}
+	if err := d.AddPipe(Pipe{User: "alice", Upstream: up.Addr().String(), Expires: time.Now().Add(time.Hour), Labels: labels}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("pw")},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	client.Close()
+
+	for _, typ := range []string{ConnEstablished, ConnClosed} {
+		e := <-events
+		if e.Type != typ || FormatLabels(e.Labels) != "team=infra ticket=OPS-1" {
+			t.Errorf("got %v event with labels %v", e.Type, e.Labels)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package piperd
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// Listener is the downstream identity of one listener, so internal and
+// internet facing endpoints of a daemon may differ. Empty fields take the
+// daemon's.
+type Listener struct {
+	Addr string
+
+	HostKeys []ssh.Signer
+	Banner   string
+
+	Ciphers      []string
+	KeyExchanges []string
+	MACs         []string
+}
+
+// WithBanner sends banner to downstream when auth starts
+func WithBanner(banner string) Option {
+	return func(d *Daemon) {
+		d.piper.Banner = banner
+	}
+}
+
+// listenerConn is a conn accepted by a listener with its own config
+type listenerConn struct {
+	net.Conn
+	config *Listener
+}
+
+// apply sets the downstream side of piper to l, over the daemon's
+func (l *Listener) apply(piper *ssh.SSHPiper) {
+	if len(l.HostKeys) > 0 {
+		// host keys cannot be removed from a config, start a new one, the
+		// daemon's keys must not be overwritten in place
+		old := piper.DownstreamConfig
+		config := ssh.ServerConfig{
+			Config:                      old.Config,
+			NoClientAuth:                old.NoClientAuth,
+			PasswordCallback:            old.PasswordCallback,
+			PublicKeyCallback:           old.PublicKeyCallback,
+			KeyboardInteractiveCallback: old.KeyboardInteractiveCallback,
+			AuthLogCallback:             old.AuthLogCallback,
+		}
+		for _, key := range l.HostKeys {
+			config.AddHostKey(key)
+		}
+		piper.DownstreamConfig = config
+	}
+
+	if l.Banner != "" {
+		piper.Banner = l.Banner
+	}
+
+	if l.Ciphers != nil {
+		piper.DownstreamConfig.Ciphers = l.Ciphers
+	}
+
+	if l.KeyExchanges != nil {
+		piper.DownstreamConfig.KeyExchanges = l.KeyExchanges
+	}
+
+	if l.MACs != nil {
+		piper.DownstreamConfig.MACs = l.MACs
+	}
+}
+
+// LoadListeners reads listeners from file, one per line
+//
+//	# <addr> [key=file,...] [banner=file] [ciphers=...] [kex=...] [macs=...]
+//	0.0.0.0:22    key=/etc/sshpiper/public_key banner=/etc/sshpiper/public_banner ciphers=aes256-ctr
+//	10.0.0.1:2222 key=/etc/sshpiper/internal_key
+func LoadListeners(file string) ([]Listener, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var listeners []Listener
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		l := Listener{Addr: fields[0]}
+		if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", file, n, err)
+		}
+
+		for _, option := range fields[1:] {
+			kv := strings.SplitN(option, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("%v:%d: want <option>=<value>, got %v", file, n, option)
+			}
+
+			values := strings.Split(kv[1], ",")
+
+			switch kv[0] {
+			case "key":
+				for _, keyFile := range values {
+					key, err := readHostKey(keyFile)
+					if err != nil {
+						return nil, fmt.Errorf("%v:%d: %v", file, n, err)
+					}
+					l.HostKeys = append(l.HostKeys, key)
+				}
+			case "banner":
+				data, err := ioutil.ReadFile(kv[1])
+				if err != nil {
+					return nil, fmt.Errorf("%v:%d: %v", file, n, err)
+				}
+				l.Banner = string(data)
+			case "ciphers":
+				l.Ciphers = values
+			case "kex":
+				l.KeyExchanges = values
+			case "macs":
+				l.MACs = values
+			default:
+				return nil, fmt.Errorf("%v:%d: unknown option %v", file, n, kv[0])
+			}
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, scanner.Err()
+}
+
+func readHostKey(file string) (ssh.Signer, error) {
+	if err := upstream.CheckHostKeyPerm(file); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(data)
+}
+
+// ServeListener is Serve with the downstream identity of config, its Addr
+// is not used
+func (d *Daemon) ServeListener(l net.Listener, config Listener) error {
+	return d.serveListener(l, &config)
+}
@@ -0,0 +1,116 @@
+package piperd
+
+import (
+	"bytes"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeListenerHostKey(t *testing.T) {
+	key := newTestSigner(t)
+	listenerKey := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key), WithBanner("welcome\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	l := listen()
+	go d.Serve(l)
+
+	internal := listen()
+	go d.ServeListener(internal, Listener{HostKeys: []ssh.Signer{listenerKey}, Banner: "internal\n"})
+
+	dial := func(addr string) ssh.PublicKey {
+		var got ssh.PublicKey
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("pw")},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				got = key
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("Dial %v: %v", addr, err)
+		}
+		client.Close()
+		return got
+	}
+
+	if got := dial(internal.Addr().String()); !bytes.Equal(got.Marshal(), listenerKey.PublicKey().Marshal()) {
+		t.Errorf("listener offered a host key other than its own")
+	}
+
+	if got := dial(l.Addr().String()); !bytes.Equal(got.Marshal(), key.PublicKey().Marshal()) {
+		t.Errorf("daemon host key changed by listener")
+	}
+}
+
+func TestLoadListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listeners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	banner := filepath.Join(dir, "banner")
+	if err := ioutil.WriteFile(banner, []byte("authorized use only\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "listeners")
+	if err := ioutil.WriteFile(file, []byte(`
+# public
+0.0.0.0:22 banner=`+banner+` ciphers=aes256-ctr,aes128-ctr kex=curve25519-sha256@libssh.org
+
+10.0.0.1:2222 macs=hmac-sha2-256
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	listeners, err := LoadListeners(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listeners) != 2 {
+		t.Fatalf("got %d listeners, want 2", len(listeners))
+	}
+
+	l := listeners[0]
+	if l.Addr != "0.0.0.0:22" || l.Banner != "authorized use only\n" || len(l.Ciphers) != 2 || len(l.KeyExchanges) != 1 || l.MACs != nil {
+		t.Errorf("got %+v", l)
+	}
+
+	if l := listeners[1]; l.Addr != "10.0.0.1:2222" || len(l.MACs) != 1 || l.Ciphers != nil {
+		t.Errorf("got %+v", l)
+	}
+
+	for _, bad := range []string{"nohost\n", "0.0.0.0:22 key\n", "0.0.0.0:22 color=red\n", "0.0.0.0:22 key=" + filepath.Join(dir, "missing") + "\n"} {
+		if err := ioutil.WriteFile(file, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := LoadListeners(file); err == nil {
+			t.Errorf("LoadListeners(%q) succeeded", bad)
+		}
+	}
+}
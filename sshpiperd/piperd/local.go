@@ -0,0 +1,247 @@
+package piperd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// LocalShell pipes one downstream user to a command on the piper host, for
+// diagnostics when upstreams are down. The upstream is an ssh server inside
+// the daemon, nothing is dialed.
+type LocalShell struct {
+	// User is the downstream user piped to the local shell
+	User string
+
+	// AuthorizedKeys are the keys User may log in with, other auth methods
+	// are refused
+	AuthorizedKeys []ssh.PublicKey
+
+	// Command runs for shell and exec requests, with the requested command
+	// in SSH_ORIGINAL_COMMAND like ForceCommand of OpenSSH
+	Command []string
+}
+
+type localShell struct {
+	LocalShell
+
+	// the local server takes key from the piper only
+	key    ssh.Signer
+	config ssh.ServerConfig
+}
+
+// WithLocalShell pipes l.User to l.Command on the piper host instead of the
+// provider. The command runs as the daemon's user, so it should be
+// constrained, e.g. a fixed diagnostics script.
+func WithLocalShell(l LocalShell) Option {
+	return func(d *Daemon) {
+		d.localShell = &localShell{LocalShell: l}
+	}
+}
+
+func (l *localShell) init() error {
+	if l.User == "" || len(l.Command) == 0 {
+		return fmt.Errorf("local shell needs a user and a command")
+	}
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	if l.key, err = ssh.NewSignerFromKey(k); err != nil {
+		return err
+	}
+
+	l.config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if !bytes.Equal(key.Marshal(), l.key.PublicKey().Marshal()) {
+			return nil, fmt.Errorf("not the piper")
+		}
+		return nil, nil
+	}
+	l.config.AddHostKey(l.key)
+
+	return nil
+}
+
+// withLocalShell puts the local shell before what piper does for its user
+func (d *Daemon) withLocalShell(piper *ssh.SSHPiper) {
+	l := d.localShell
+	findUpstream := piper.FindUpstream
+	mapPublicKey := piper.MapPublicKey
+
+	own := func(conn ssh.ConnMetadata) bool {
+		return conn.User() == l.User
+	}
+	d.skipMenu(piper, own)
+	refusePasswords(piper, own)
+
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		if conn.User() != l.User {
+			return findUpstream(conn)
+		}
+
+		d.logger.Printf("mapping user [%s] from [%v] to local shell", conn.User(), conn.RemoteAddr())
+
+		// a socket pair, so both ends may write their version first
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		piperEnd, err := fileConn(fds[0])
+		if err != nil {
+			syscall.Close(fds[1])
+			return nil, nil, err
+		}
+
+		localEnd, err := fileConn(fds[1])
+		if err != nil {
+			piperEnd.Close()
+			return nil, nil, err
+		}
+
+		go l.serve(localEnd, conn)
+
+		return piperEnd, &ssh.ClientConfig{
+			User: conn.User(),
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				if !bytes.Equal(key.Marshal(), l.key.PublicKey().Marshal()) {
+					return fmt.Errorf("local shell host key mismatch")
+				}
+				return nil
+			},
+		}, nil
+	}
+
+	piper.MapPublicKey = func(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
+		if conn.User() != l.User {
+			return mapPublicKey(conn, key)
+		}
+
+		if err := d.keyPolicy.Check(key); err != nil {
+			d.logger.Printf("public key of [%v] from [%v] rejected: %v", conn.User(), conn.RemoteAddr(), err)
+			return nil, nil
+		}
+
+		if !upstream.ContainsKey(l.AuthorizedKeys, key) {
+			return nil, nil
+		}
+
+		return l.key, nil
+	}
+}
+
+func fileConn(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), "local shell")
+	defer f.Close()
+
+	return net.FileConn(f)
+}
+
+// serve is the ssh server behind the local shell, down is the downstream
+// the pipe belongs to
+func (l *localShell) serve(c net.Conn, down ssh.ConnMetadata) {
+	defer c.Close()
+
+	conn, chans, reqs, err := ssh.NewServerConn(c, &l.config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.Prohibited, "local shell has session channels only")
+			continue
+		}
+
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go l.session(ch, requests, down)
+	}
+}
+
+// session runs the command once for the first shell or exec request
+func (l *localShell) session(ch ssh.Channel, requests <-chan *ssh.Request, down ssh.ConnMetadata) {
+	started := false
+
+	for req := range requests {
+		if started || (req.Type != "shell" && req.Type != "exec") {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		var original string
+		if req.Type == "exec" {
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			original = payload.Command
+		}
+
+		cmd := exec.Command(l.Command[0], l.Command[1:]...)
+		cmd.Env = []string{
+			"PATH=/usr/bin:/bin",
+			"SSH_ORIGINAL_COMMAND=" + original,
+			"SSHPIPER_USER=" + down.User(),
+			"SSHPIPER_DOWNSTREAM=" + down.RemoteAddr().String(),
+		}
+		cmd.Stdout = ch
+		cmd.Stderr = ch.Stderr()
+
+		// copied by hand, Wait must not wait for downstream to close stdin
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+
+		if err != nil {
+			req.Reply(false, nil)
+			fmt.Fprintf(ch.Stderr(), "sshpiper: local shell: %v\n", err)
+			ch.Close()
+			return
+		}
+
+		started = true
+		req.Reply(true, nil)
+
+		go func() {
+			io.Copy(stdin, ch)
+			stdin.Close()
+		}()
+
+		go func() {
+			status := 0
+			if err := cmd.Wait(); err != nil {
+				status = 255
+				if e, ok := err.(*exec.ExitError); ok {
+					if ws, ok := e.Sys().(syscall.WaitStatus); ok {
+						status = ws.ExitStatus()
+					}
+				}
+			}
+
+			ch.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{uint32(status)}))
+			ch.Close()
+		}()
+	}
+}
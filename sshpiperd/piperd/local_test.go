@@ -0,0 +1,66 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"testing"
+)
+
+func TestLocalShell(t *testing.T) {
+	key := newTestSigner(t)
+	admin := newTestSigner(t)
+
+	provider := &upstream.Fake{Addr: "127.0.0.1:1"}
+
+	d, err := New(WithProvider(provider), WithHostKey(key), WithLocalShell(LocalShell{
+		User:           "breakglass",
+		AuthorizedKeys: []ssh.PublicKey{admin.PublicKey()},
+		Command:        []string{"/bin/sh", "-c", "echo local $SSHPIPER_USER $SSH_ORIGINAL_COMMAND; exit 3"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Serve(l)
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "breakglass",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(admin)},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := session.Output("uptime")
+	if e, ok := err.(*ssh.ExitError); !ok || e.ExitStatus() != 3 {
+		t.Errorf("exit got %v", err)
+	}
+
+	if string(out) != "local breakglass uptime\n" {
+		t.Errorf("got output %q", out)
+	}
+
+	if users := provider.Users(); len(users) != 0 {
+		t.Errorf("provider got users %v", users)
+	}
+
+	if _, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "breakglass",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(newTestSigner(t)), ssh.Password("pw")},
+	}); err == nil {
+		t.Errorf("Dial with an unknown key succeeded")
+	}
+}
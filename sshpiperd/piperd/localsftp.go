@@ -0,0 +1,183 @@
+package piperd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/sftpd"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// localSFTP is the ssh server inside the daemon of one pipe ending in a
+// local dir. It takes the key mapped for a key or password of downstream,
+// so the provider decides who logs in as for any upstream.
+type localSFTP struct {
+	dir  string
+	down ssh.ConnMetadata
+
+	mu     sync.Mutex
+	mapped ssh.PublicKey
+}
+
+func (l *localSFTP) setMapped(key ssh.PublicKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mapped = key
+}
+
+func (l *localSFTP) isMapped(key ssh.PublicKey) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.mapped != nil && bytes.Equal(l.mapped.Marshal(), key.Marshal())
+}
+
+// withLocalSFTP serves the sftp subsystem of pipes whose provider returns
+// upstream.Conn with LocalSFTP from that dir, nothing is dialed. It goes
+// first, every other feature sees the conn to the local server.
+func (d *Daemon) withLocalSFTP(piper *ssh.SSHPiper) {
+	var local *localSFTP
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if err != nil {
+			return c, config, err
+		}
+
+		uc, ok := c.(*upstream.Conn)
+		if !ok || uc.LocalSFTP == "" {
+			return c, config, nil
+		}
+
+		if uc.Conn != nil {
+			uc.Conn.Close()
+		}
+
+		d.logger.Printf("mapping user [%s] from [%v] to local sftp dir [%v]", conn.User(), conn.RemoteAddr(), uc.LocalSFTP)
+
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		hostKey, err := ssh.NewSignerFromKey(k)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// a socket pair, so both ends may write their version first
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		piperEnd, err := fileConn(fds[0])
+		if err != nil {
+			syscall.Close(fds[1])
+			return nil, nil, err
+		}
+
+		localEnd, err := fileConn(fds[1])
+		if err != nil {
+			piperEnd.Close()
+			return nil, nil, err
+		}
+
+		local = &localSFTP{dir: uc.LocalSFTP, down: conn}
+		go d.serveLocalSFTP(local, localEnd, hostKey)
+
+		uc.Conn = piperEnd
+		config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !bytes.Equal(key.Marshal(), hostKey.PublicKey().Marshal()) {
+				return fmt.Errorf("local sftp host key mismatch")
+			}
+			return nil
+		}
+
+		return uc, config, nil
+	}
+
+	onMapped(piper, func(conn ssh.ConnMetadata, signer ssh.Signer) {
+		if local != nil {
+			local.setMapped(signer.PublicKey())
+		}
+	})
+}
+
+func (d *Daemon) serveLocalSFTP(l *localSFTP, c net.Conn, hostKey ssh.Signer) {
+	defer c.Close()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !l.isMapped(key) {
+				return nil, fmt.Errorf("not the mapped key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.Prohibited, "local sftp has session channels only")
+			continue
+		}
+
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go d.localSFTPSession(l, ch, requests)
+	}
+}
+
+// localSFTPSession serves the first sftp subsystem request, shells and
+// commands are refused
+func (d *Daemon) localSFTPSession(l *localSFTP, ch ssh.Channel, requests <-chan *ssh.Request) {
+	for req := range requests {
+		if req.Type != "subsystem" {
+			if req.Type == "shell" || req.Type == "exec" {
+				fmt.Fprintf(ch.Stderr(), "sshpiper: only sftp is served here\n")
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		var payload subsystemPayload
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		go ssh.DiscardRequests(requests)
+
+		status := uint32(0)
+		server := &sftpd.Server{Root: l.dir}
+		if err := server.Serve(ch); err != nil {
+			d.logger.Printf("local sftp of [%v] from [%v] in [%v]: %v", l.down.User(), l.down.RemoteAddr(), l.dir, err)
+			status = 1
+		}
+
+		ch.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{status}))
+		ch.Close()
+		return
+	}
+}
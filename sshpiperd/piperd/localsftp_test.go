@@ -0,0 +1,139 @@
+package piperd
+
+import (
+	"encoding/binary"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// localSFTPProvider serves dir to every user
+type localSFTPProvider struct {
+	*upstream.Fake
+	dir string
+}
+
+func (p *localSFTPProvider) FindUpstream(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+	return &upstream.Conn{LocalSFTP: p.dir}, &ssh.ClientConfig{}, nil
+}
+
+// sftpCall sends an sftp packet and returns the reply
+func sftpCall(t *testing.T, rw io.ReadWriter, msg interface{}) []byte {
+	p := ssh.Marshal(msg)
+	packet := make([]byte, 4, 4+len(p))
+	binary.BigEndian.PutUint32(packet, uint32(len(p)))
+	if _, err := rw.Write(append(packet, p...)); err != nil {
+		t.Fatal(err)
+	}
+
+	var l [4]byte
+	if _, err := io.ReadFull(rw, l[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, binary.BigEndian.Uint32(l[:]))
+	if _, err := io.ReadFull(rw, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	return reply
+}
+
+func TestLocalSFTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localsftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := newTestSigner(t)
+	client, mapped := newTestSigner(t), newTestSigner(t)
+
+	provider := &localSFTPProvider{
+		Fake: &upstream.Fake{AuthorizedKeys: []ssh.PublicKey{client.PublicKey()}, Signer: mapped},
+		dir:  dir,
+	}
+
+	d, err := New(WithProvider(provider), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	c, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(client)},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+
+	// commands are refused
+	session, err := c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run("ls"); err == nil {
+		t.Errorf("command ran on local sftp")
+	}
+	session.Close()
+
+	session, err = c.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		t.Fatalf("sftp subsystem: %v", err)
+	}
+
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{stdout, stdin}
+
+	// init, version
+	if reply := sftpCall(t, rw, &struct {
+		Type    byte
+		Version uint32
+	}{1, 3}); reply[0] != 2 {
+		t.Fatalf("init answered with %d, want version", reply[0])
+	}
+
+	// mkdir, status ok
+	reply := sftpCall(t, rw, &struct {
+		Type  byte
+		ID    uint32
+		Path  string
+		Flags uint32
+	}{14, 1, "/drop", 0})
+	if reply[0] != 101 || binary.BigEndian.Uint32(reply[5:]) != 0 {
+		t.Fatalf("mkdir answered with %v", reply)
+	}
+
+	if fi, err := os.Stat(filepath.Join(dir, "drop")); err != nil || !fi.IsDir() {
+		t.Errorf("dir made over sftp not in local dir: %v", err)
+	}
+}
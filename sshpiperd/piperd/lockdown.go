@@ -0,0 +1,59 @@
+package piperd
+
+import (
+	"errors"
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+	"sync/atomic"
+)
+
+// errLockdown is returned by FindUpstream while the daemon is locked down
+var errLockdown = errors.New("locked down")
+
+// WithLockdown starts the daemon locked down, see SetLockdown
+func WithLockdown(enabled bool) Option {
+	return func(d *Daemon) {
+		if enabled {
+			d.lockdown = 1
+		}
+	}
+}
+
+// Lockdown tells whether new logins are refused
+func (d *Daemon) Lockdown() bool {
+	return atomic.LoadInt32(&d.lockdown) == 1
+}
+
+// SetLockdown refuses every new login while enabled, with MsgLockdown.
+// New passthrough connections are closed. Connections already piped are
+// left alone.
+func (d *Daemon) SetLockdown(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+
+	if atomic.SwapInt32(&d.lockdown, v) == v {
+		return
+	}
+
+	if enabled {
+		d.logger.Printf("lockdown: new logins are refused")
+	} else {
+		d.logger.Printf("lockdown: lifted")
+	}
+}
+
+// withLockdown refuses before any other feature or the provider is asked,
+// so it goes last
+func (d *Daemon) withLockdown(piper *ssh.SSHPiper) {
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		if d.Lockdown() {
+			d.logger.Printf("user [%v] from [%v] refused, locked down", conn.User(), conn.RemoteAddr())
+			return nil, nil, errLockdown
+		}
+
+		return findUpstream(conn)
+	}
+}
@@ -0,0 +1,111 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLockdown(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(
+		WithProvider(&upstream.Fake{Addr: up.Addr().String()}),
+		WithHostKey(key),
+		WithMessages(map[string]string{MsgLockdown: "incident, {user} try later"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	dial := func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("pw")},
+		})
+	}
+
+	piped, err := dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer piped.Close()
+
+	d.SetLockdown(true)
+	if !d.Lockdown() {
+		t.Fatalf("Lockdown() = false after SetLockdown(true)")
+	}
+
+	if _, err := dial(); err == nil || !strings.Contains(err.Error(), "incident, alice try later") {
+		t.Errorf("Dial while locked down got %v, want the lockdown message", err)
+	}
+
+	// the pipe from before goes on
+	if _, _, err := piped.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("request on the piped client: %v", err)
+	}
+
+	d.SetLockdown(false)
+
+	again, err := dial()
+	if err != nil {
+		t.Fatalf("Dial after lifting: %v", err)
+	}
+	again.Close()
+}
+
+func TestLockdownPassthrough(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(
+		WithProvider(&upstream.Fake{}),
+		WithHostKey(key),
+		WithPassthrough(PassthroughRules{{src: &net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}, upstream: up.Addr().String()}}),
+		WithLockdown(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	dial := func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("pw")},
+		})
+	}
+
+	if client, err := dial(); err == nil {
+		client.Close()
+		t.Errorf("passthrough spliced while locked down")
+	}
+
+	d.SetLockdown(false)
+
+	client, err := dial()
+	if err != nil {
+		t.Fatalf("Dial after lifting: %v", err)
+	}
+	client.Close()
+}
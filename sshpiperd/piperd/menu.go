@@ -0,0 +1,176 @@
+package piperd
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tries a user has to pick a target from the menu
+const menuTries = 3
+
+// targetMenu lets the user of one connection pick an upstream when the
+// provider offers more than one. The menu runs as additional challenge,
+// FindUpstream waits for the pick.
+type targetMenu struct {
+	provider upstream.TargetProvider
+
+	once    sync.Once
+	targets []string
+	err     error
+
+	picked chan string
+	target string
+}
+
+// withTargetMenu changes piper to show the menu, piper is a copy for a
+// single connection
+func (d *Daemon) withTargetMenu(piper *ssh.SSHPiper, provider upstream.TargetProvider) {
+	m := &targetMenu{
+		provider: provider,
+		picked:   make(chan string, 1),
+	}
+
+	challenge := piper.AdditionalChallenge
+	needed := piper.ChallengeNeeded
+	findUpstream := piper.FindUpstream
+
+	piper.ChallengeNeeded = func(conn ssh.ConnMetadata) bool {
+		if m.hasMenu(conn) {
+			return true
+		}
+
+		return challenge != nil && (needed == nil || needed(conn))
+	}
+
+	piper.AdditionalChallenge = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+		if m.hasMenu(conn) {
+			ok, err := m.pick(conn, client)
+			if !ok || err != nil {
+				return ok, err
+			}
+		}
+
+		if challenge != nil && (needed == nil || needed(conn)) {
+			return challenge(conn, client)
+		}
+
+		return true, nil
+	}
+
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		if err := d.checkQuota(conn); err != nil {
+			return nil, nil, err
+		}
+
+		if !m.hasMenu(conn) {
+			if m.err != nil {
+				return nil, nil, m.err
+			}
+
+			if len(m.targets) == 1 {
+				return provider.FindTarget(conn, m.targets[0])
+			}
+
+			return findUpstream(conn)
+		}
+
+		// closed without a pick if the menu failed
+		target, ok := <-m.picked
+		if !ok {
+			return nil, nil, ssh.ErrAdditionalChallengeFailed
+		}
+
+		d.logger.Printf("user [%v] picked upstream [%v]", conn.User(), target)
+		return provider.FindTarget(conn, target)
+	}
+}
+
+func (m *targetMenu) hasMenu(conn ssh.ConnMetadata) bool {
+	m.once.Do(func() {
+		m.targets, m.err = m.provider.Targets(conn)
+	})
+
+	return m.err == nil && len(m.targets) > 1
+}
+
+// pick asks for a target, by number or name
+func (m *targetMenu) pick(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+	picked := false
+	defer func() {
+		if !picked {
+			close(m.picked)
+		}
+	}()
+
+	var menu []string
+	for i, t := range m.targets {
+		menu = append(menu, fmt.Sprintf("%d) %s", i+1, t))
+	}
+
+	instruction := "Select host:\n" + strings.Join(menu, "\n")
+
+	for i := 0; i < menuTries; i++ {
+		answers, err := client(conn.User(), instruction, []string{"Host: "}, []bool{true})
+		if err != nil {
+			return false, err
+		}
+
+		if len(answers) != 1 {
+			continue
+		}
+
+		if target, ok := m.match(strings.TrimSpace(answers[0])); ok {
+			picked = true
+			m.picked <- target
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *targetMenu) match(answer string) (string, bool) {
+	if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(m.targets) {
+		return m.targets[n-1], true
+	}
+
+	for _, t := range m.targets {
+		if t == answer {
+			return t, true
+		}
+	}
+
+	return "", false
+}
+
+// skipMenu runs only the challenge of the daemon for conns skip picks, they
+// bypass the provider and so its menu
+func (d *Daemon) skipMenu(piper *ssh.SSHPiper, skip func(conn ssh.ConnMetadata) bool) {
+	needed := piper.ChallengeNeeded
+	challenge := piper.AdditionalChallenge
+
+	if challenge == nil {
+		return
+	}
+
+	piper.ChallengeNeeded = func(conn ssh.ConnMetadata) bool {
+		if skip(conn) {
+			return d.piper.AdditionalChallenge != nil && (d.piper.ChallengeNeeded == nil || d.piper.ChallengeNeeded(conn))
+		}
+
+		return needed == nil || needed(conn)
+	}
+
+	piper.AdditionalChallenge = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+		if skip(conn) {
+			return d.piper.AdditionalChallenge(conn, client)
+		}
+
+		return challenge(conn, client)
+	}
+}
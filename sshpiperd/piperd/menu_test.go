@@ -0,0 +1,86 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"strings"
+	"testing"
+)
+
+type targetFake struct {
+	*upstream.Fake
+	targets []string
+	found   chan string
+}
+
+func (f *targetFake) Targets(conn ssh.ConnMetadata) ([]string, error) {
+	return f.targets, nil
+}
+
+func (f *targetFake) FindTarget(conn ssh.ConnMetadata, target string) (net.Conn, *ssh.ClientConfig, error) {
+	f.found <- target
+	return f.Fake.FindUpstream(conn)
+}
+
+func TestTargetMenu(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	for _, tc := range []struct {
+		answer  string
+		targets []string
+		want    string
+		menu    bool
+	}{
+		{"2", []string{"web01", "db01"}, "db01", true},
+		{"web01", []string{"web01", "db01"}, "web01", true},
+		{"", []string{"only"}, "only", false},
+	} {
+		provider := &targetFake{
+			Fake:    &upstream.Fake{Addr: up.Addr().String()},
+			targets: tc.targets,
+			found:   make(chan string, 1),
+		}
+
+		d, err := New(WithProvider(provider), WithHostKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go d.Serve(l)
+
+		menu := false
+		client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{
+				ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+					menu = strings.Contains(instruction, "1) "+tc.targets[0])
+					return []string{tc.answer}, nil
+				}),
+				ssh.Password("pw"),
+			},
+		})
+		if err != nil {
+			t.Errorf("answer %q: Dial: %v", tc.answer, err)
+		} else {
+			client.Close()
+		}
+
+		if menu != tc.menu {
+			t.Errorf("answer %q: menu shown %v, want %v", tc.answer, menu, tc.menu)
+		}
+
+		if got := <-provider.found; got != tc.want {
+			t.Errorf("answer %q: got target %v, want %v", tc.answer, got, tc.want)
+		}
+
+		d.Close()
+	}
+}
@@ -0,0 +1,140 @@
+package piperd
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"os"
+	"strings"
+)
+
+// keys of messages sent to downstream when it is disconnected during auth,
+// or when upstream closed the pipe
+const (
+	MsgNoPipe              = "no-pipe"
+	MsgChallengeFailed     = "challenge-failed"
+	MsgUpstreamUnreachable = "upstream-unreachable"
+	MsgBanned              = "banned"
+	MsgQuotaExceeded       = "quota-exceeded"
+	MsgDuplicateSession    = "duplicate-session"
+	MsgLockdown            = "lockdown"
+	MsgUserRateLimited     = "user-rate-limited"
+	MsgTimeout             = "timeout"
+	MsgUpstreamClosed      = "upstream-closed"
+	MsgUpstreamDraining    = "upstream-draining"
+)
+
+// DefaultMessages is used for keys WithMessages does not set, {user} is
+// replaced by the downstream user, {upstream} by the upstream address
+var DefaultMessages = map[string]string{
+	MsgNoPipe:              "no pipe for user {user}",
+	MsgChallengeFailed:     "additional challenge failed",
+	MsgUpstreamUnreachable: "upstream for {user} is unreachable, try again later",
+	MsgBanned:              "access denied",
+	MsgQuotaExceeded:       "transfer quota of {user} is used up",
+	MsgDuplicateSession:    "{user} already has a session to this upstream",
+	MsgLockdown:            "new logins are refused for now, try again later",
+	MsgUserRateLimited:     "too many logins of {user}, try again later",
+	MsgTimeout:             "login of {user} took too long",
+	MsgUpstreamClosed:      "upstream {upstream} closed the connection",
+	MsgUpstreamDraining:    "upstream {upstream} is down for maintenance, try again later",
+}
+
+// WithMessages overrides DefaultMessages, empty text disconnects without
+// a message
+func WithMessages(messages map[string]string) Option {
+	return func(d *Daemon) {
+		for k, v := range messages {
+			d.messages[k] = v
+		}
+	}
+}
+
+// LoadMessages reads messages from file, one per line
+//
+//	# key = text, \n for a new line
+//	no-pipe = no such user, see https://helpdesk.example.com/ssh
+//	banned  =
+func LoadMessages(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	messages := make(map[string]string)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%v:%d: want <key> = <text>", file, n)
+		}
+
+		key := strings.TrimSpace(line[:i])
+		if _, ok := DefaultMessages[key]; !ok {
+			return nil, fmt.Errorf("%v:%d: unknown message %v", file, n, key)
+		}
+
+		messages[key] = strings.Replace(strings.TrimSpace(line[i+1:]), `\n`, "\n", -1)
+	}
+
+	return messages, scanner.Err()
+}
+
+// messageKey tells which message explains err to downstream, empty if none
+func messageKey(err error) string {
+	switch err {
+	case upstream.ErrNoPipe:
+		return MsgNoPipe
+	case upstream.ErrBanned:
+		return MsgBanned
+	case ssh.ErrAdditionalChallengeFailed:
+		return MsgChallengeFailed
+	case errQuotaExceeded:
+		return MsgQuotaExceeded
+	case errDuplicateSession:
+		return MsgDuplicateSession
+	case errLockdown:
+		return MsgLockdown
+	case errUserRateLimited:
+		return MsgUserRateLimited
+	}
+
+	switch err.(type) {
+	case *ssh.UpstreamClosedError:
+		return MsgUpstreamClosed
+	case *drainingError:
+		return MsgUpstreamDraining
+	case *ssh.TimeoutError:
+		return MsgTimeout
+	case *ssh.UpstreamError, net.Error:
+		return MsgUpstreamUnreachable
+	}
+
+	return ""
+}
+
+func (d *Daemon) errorMessage(conn ssh.ConnMetadata, err error) string {
+	key := messageKey(err)
+	if key == "" {
+		return ""
+	}
+
+	addr := ""
+	switch e := err.(type) {
+	case *ssh.UpstreamClosedError:
+		addr = e.Addr
+	case *drainingError:
+		addr = e.Addr
+	}
+
+	return strings.NewReplacer("{user}", conn.User(), "{upstream}", addr).Replace(d.messages[key])
+}
@@ -0,0 +1,154 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/audit"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMessages(t *testing.T) {
+	f, err := ioutil.TempFile("", "messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("# comment\nno-pipe = see\\nhelpdesk\nbanned =\n")
+	f.Close()
+
+	messages, err := LoadMessages(f.Name())
+	if err != nil {
+		t.Fatalf("LoadMessages: %v", err)
+	}
+
+	if m := messages[MsgNoPipe]; m != "see\nhelpdesk" {
+		t.Errorf("got no-pipe %q", m)
+	}
+
+	if m, ok := messages[MsgBanned]; !ok || m != "" {
+		t.Errorf("got banned %q %v, want empty", m, ok)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("nosuch = x\n"), 0600)
+	if _, err := LoadMessages(f.Name()); err == nil {
+		t.Errorf("LoadMessages accepted unknown key")
+	}
+}
+
+func TestMessageKey(t *testing.T) {
+	for err, key := range map[error]string{
+		upstream.ErrNoPipe:               MsgNoPipe,
+		upstream.ErrBanned:               MsgBanned,
+		ssh.ErrAdditionalChallengeFailed: MsgChallengeFailed,
+		&ssh.UpstreamError{Err: ssh.ErrAdditionalChallengeFailed}: MsgUpstreamUnreachable,
+		&net.OpError{Op: "dial", Err: os.ErrNotExist}:             MsgUpstreamUnreachable,
+		os.ErrNotExist: "",
+	} {
+		if k := messageKey(err); k != key {
+			t.Errorf("messageKey(%v) = %q, want %q", err, k, key)
+		}
+	}
+}
+
+func TestNoPipeMessage(t *testing.T) {
+	d, err := New(
+		WithProvider(&upstream.Fake{}),
+		WithHostKey(newTestSigner(t)),
+		WithMessages(map[string]string{MsgNoPipe: "ask helpdesk about {user}"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	_, err = ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("pw")},
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "ask helpdesk about alice") {
+		t.Errorf("got %v, want the no-pipe message", err)
+	}
+}
+
+func TestUpstreamClosedMessage(t *testing.T) {
+	key := newTestSigner(t)
+
+	// upstream dies once a session is opened
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+
+	go func() {
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(key)
+
+		for {
+			c, err := up.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+
+				<-chans
+				c.Close()
+			}()
+		}
+	}()
+
+	sink := &memorySink{}
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key), WithAuditSink(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{User: "alice"})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	client.NewSession()
+
+	want := "upstream " + up.Addr().String() + " closed the connection"
+	if err := client.Wait(); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want %q", err, want)
+	}
+
+	for i := 0; i < 100; i++ {
+		for _, a := range sink.actions() {
+			if a == "session "+audit.ActionUpstreamClosed {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("no upstream closed event in %q", sink.actions())
+}
@@ -0,0 +1,46 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// WithMOTD prints motd to downstream when a shell is requested, before
+// anything upstream prints. Providers implementing upstream.MOTDProvider
+// override it per connection.
+func WithMOTD(motd string) Option {
+	return func(d *Daemon) {
+		d.motd = motd
+	}
+}
+
+func (d *Daemon) newMOTDFilter(conn ssh.PipeConn) ssh.PacketFilter {
+	motd := d.motd
+
+	if p, ok := d.Provider().(upstream.MOTDProvider); ok {
+		m, err := p.MOTD(conn)
+		if err != nil {
+			d.logger.Printf("motd for [%v]: %v", conn.User(), err)
+		} else if m != "" {
+			motd = m
+		}
+	}
+
+	if motd == "" {
+		return nil
+	}
+
+	channels := newSessionChannels(conn)
+
+	printed := make(map[*sessionChannel]bool)
+	channels.onRequest = func(ch *sessionChannel, request string) error {
+		if request != "shell" || printed[ch] {
+			return nil
+		}
+
+		printed[ch] = true
+		return channels.print(ch, motd, false)
+	}
+
+	return channels
+}
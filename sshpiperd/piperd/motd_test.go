@@ -0,0 +1,102 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"testing"
+)
+
+type testPipeConn struct {
+	ssh.ConnMetadata
+	down   [][]byte
+	up     [][]byte
+	closed bool
+
+	identity ssh.UpstreamIdentity
+}
+
+func (c *testPipeConn) WriteDownstream(p []byte) error {
+	c.down = append(c.down, p)
+	return nil
+}
+
+func (c *testPipeConn) WriteUpstream(p []byte) error {
+	c.up = append(c.up, p)
+	return nil
+}
+
+func (c *testPipeConn) Done() <-chan struct{} {
+	return nil
+}
+
+func (c *testPipeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *testPipeConn) UpstreamIdentity() ssh.UpstreamIdentity {
+	return c.identity
+}
+
+func TestMOTDFilter(t *testing.T) {
+	conn := &testPipeConn{}
+	d := &Daemon{motd: "hello\nworld\n"}
+
+	f := d.newMOTDFilter(conn)
+
+	mustPass := func(p []byte, err error) []byte {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// downstream channel 3 is upstream channel 7
+	mustPass(f.FromDownstream(ssh.Marshal(&channelOpenMsg{ChanType: "session", PeersId: 3, PeersWindow: 1 << 20, MaxPacketSize: 1 << 15})))
+	mustPass(f.FromUpstream(ssh.Marshal(&channelOpenConfirmMsg{PeersId: 3, MyId: 7, MyWindow: 1 << 20, MaxPacketSize: 1 << 15})))
+	mustPass(f.FromDownstream(ssh.Marshal(&channelRequestMsg{PeersId: 7, Request: "pty-req"})))
+
+	if len(conn.down) != 0 {
+		t.Fatalf("motd printed before shell")
+	}
+
+	shell := ssh.Marshal(&channelRequestMsg{PeersId: 7, Request: "shell", WantReply: true})
+	if p := mustPass(f.FromDownstream(shell)); p == nil {
+		t.Fatalf("shell request dropped")
+	}
+
+	if len(conn.down) != 1 {
+		t.Fatalf("got %d packets to downstream, want 1", len(conn.down))
+	}
+
+	var data channelDataMsg
+	if err := ssh.Unmarshal(conn.down[0], &data); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "hello\r\nworld\r\n"
+	if data.PeersId != 3 || string(data.Data) != want {
+		t.Errorf("got data %d %q, want 3 %q", data.PeersId, data.Data, want)
+	}
+
+	// a second shell request does not print again
+	mustPass(f.FromDownstream(shell))
+	if len(conn.down) != 1 {
+		t.Errorf("motd printed twice")
+	}
+
+	// window adjusts for the motd bytes must not reach upstream
+	if p := mustPass(f.FromDownstream(ssh.Marshal(&windowAdjustMsg{PeersId: 7, AdditionalBytes: 10}))); p != nil {
+		t.Errorf("window adjust within motd bytes not dropped")
+	}
+
+	p := mustPass(f.FromDownstream(ssh.Marshal(&windowAdjustMsg{PeersId: 7, AdditionalBytes: 100})))
+
+	var adjust windowAdjustMsg
+	if err := ssh.Unmarshal(p, &adjust); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := uint32(100 - (len(want) - 10)); adjust.AdditionalBytes != n {
+		t.Errorf("got window adjust %d, want %d", adjust.AdditionalBytes, n)
+	}
+}
@@ -0,0 +1,145 @@
+package piperd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PassthroughRule routes a connection to upstream without terminating ssh,
+// matched either by the local port it came in or by its source address.
+type PassthroughRule struct {
+	port     int
+	src      *net.IPNet
+	upstream string
+}
+
+type PassthroughRules []PassthroughRule
+
+// LoadPassthroughRules reads rules from file, one per line
+//
+//	:2223          10.0.0.5:22   # connections to local port 2223
+//	192.168.1.0/24 10.0.0.6:22   # connections from 192.168.1.0/24
+func LoadPassthroughRules(file string) (PassthroughRules, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules PassthroughRules
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%d: want <match> <upstream>", file, n)
+		}
+
+		rule := PassthroughRule{upstream: fields[1]}
+
+		match := fields[0]
+		switch {
+		case strings.HasPrefix(match, ":"):
+			rule.port, err = strconv.Atoi(match[1:])
+		case strings.Contains(match, "/"):
+			_, rule.src, err = net.ParseCIDR(match)
+		default:
+			ip := net.ParseIP(match)
+			if ip == nil {
+				err = fmt.Errorf("bad ip %v", match)
+				break
+			}
+			rule.src = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", file, n, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// ports returns the local ports that need a listener of their own
+func (rules PassthroughRules) ports() []int {
+	var ports []int
+	for _, r := range rules {
+		if r.port != 0 {
+			ports = append(ports, r.port)
+		}
+	}
+	return ports
+}
+
+// match returns the upstream for c, empty if c should be piped as usual
+func (rules PassthroughRules) match(c net.Conn) string {
+	local, _ := c.LocalAddr().(*net.TCPAddr)
+	remote, _ := c.RemoteAddr().(*net.TCPAddr)
+
+	for _, r := range rules {
+		if r.port != 0 && local != nil && local.Port == r.port {
+			return r.upstream
+		}
+
+		if r.src != nil && remote != nil && r.src.Contains(remote.IP) {
+			return r.upstream
+		}
+	}
+
+	return ""
+}
+
+// splice copies raw bytes between c and upstream until either side closes.
+// when both are tcp conns the kernel splice is used by io.Copy.
+func splice(c net.Conn, upstream string) error {
+	defer c.Close()
+
+	u, err := net.Dial("tcp", upstream)
+	if err != nil {
+		return err
+	}
+	defer u.Close()
+
+	// bytes read while parsing proxy protocol header go first
+	if pc, ok := c.(*proxyConn); ok {
+		var buffered []byte
+		c, buffered, err = pc.raw()
+		if err != nil {
+			return err
+		}
+
+		if _, err = u.Write(buffered); err != nil {
+			return err
+		}
+	}
+
+	errc := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(u, c)
+		errc <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(c, u)
+		errc <- err
+	}()
+
+	return <-errc
+}
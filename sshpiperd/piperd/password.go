@@ -0,0 +1,88 @@
+package piperd
+
+import (
+	"errors"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/password"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+var errPasswordRejected = errors.New("password rejected")
+
+// WithPasswordVerifier checks passwords of downstream with v in the daemon
+// for pipes whose provider maps passwords to a key, see
+// upstream.PasswordMapper. Upstream is logged in with the key and never
+// sees the password, other pipes are relayed the password as is.
+func WithPasswordVerifier(v password.Verifier) Option {
+	return func(d *Daemon) {
+		d.passwords = v
+	}
+}
+
+func (d *Daemon) verifyPassword(provider upstream.Provider, conn ssh.ConnMetadata, pw []byte) (ssh.Signer, error) {
+	mapper, ok := provider.(upstream.PasswordMapper)
+	if !ok {
+		return nil, nil
+	}
+
+	signer, err := mapper.MapPassword(conn)
+	if err != nil || signer == nil {
+		return nil, err
+	}
+
+	ok, err = d.passwords(conn, string(pw))
+	if err != nil {
+		d.logger.Printf("password of [%v] from [%v] not verified: %v", conn.User(), conn.RemoteAddr(), err)
+		return nil, err
+	}
+
+	if !ok {
+		d.logger.Printf("password of [%v] from [%v] rejected", conn.User(), conn.RemoteAddr())
+		return nil, errPasswordRejected
+	}
+
+	d.logger.Printf("password of [%v] from [%v] verified, logging in upstream with the mapped key", conn.User(), conn.RemoteAddr())
+	return signer, nil
+}
+
+// onMapped calls f with each signer mapped to log in upstream, for a key or
+// a verified password, before the pipe is up
+func onMapped(piper *ssh.SSHPiper, f func(conn ssh.ConnMetadata, signer ssh.Signer)) {
+	mapPublicKey := piper.MapPublicKey
+	piper.MapPublicKey = func(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
+		signer, err := mapPublicKey(conn, key)
+		if err == nil && signer != nil {
+			f(conn, signer)
+		}
+		return signer, err
+	}
+
+	if piper.VerifyPassword == nil {
+		return
+	}
+
+	verifyPassword := piper.VerifyPassword
+	piper.VerifyPassword = func(conn ssh.ConnMetadata, password []byte) (ssh.Signer, error) {
+		signer, err := verifyPassword(conn, password)
+		if err == nil && signer != nil {
+			f(conn, signer)
+		}
+		return signer, err
+	}
+}
+
+// refusePasswords fails password auth of users own returns true for, their
+// pipes log in with keys of their own
+func refusePasswords(piper *ssh.SSHPiper, own func(conn ssh.ConnMetadata) bool) {
+	if piper.VerifyPassword == nil {
+		return
+	}
+
+	verifyPassword := piper.VerifyPassword
+	piper.VerifyPassword = func(conn ssh.ConnMetadata, password []byte) (ssh.Signer, error) {
+		if own(conn) {
+			return nil, errPasswordRejected
+		}
+		return verifyPassword(conn, password)
+	}
+}
@@ -0,0 +1,105 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"testing"
+	"time"
+)
+
+// testPassword verifies letmein as alice's password
+func testPassword(conn ssh.ConnMetadata, password string) (bool, error) {
+	return conn.User() == "alice" && password == "letmein", nil
+}
+
+func TestPasswordVerifier(t *testing.T) {
+	key := newTestSigner(t)
+	mapped := newTestSigner(t)
+
+	// takes the mapped key only, never a password
+	up := keyUpstream(t, key, mapped.PublicKey())
+	defer up.Close()
+
+	provider := &upstream.Fake{Addr: up.Addr().String(), Signer: mapped, PasswordSigner: true}
+
+	for _, dialAfterAuth := range []bool{false, true} {
+		d, err := New(WithProvider(provider), WithHostKey(key), WithPasswordVerifier(testPassword), WithDialAfterAuth(dialAfterAuth))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events, cancel := d.Subscribe(16, EventPipeOpen)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go d.Serve(l)
+
+		dialed := len(provider.Users())
+
+		if _, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("wrong")},
+		}); err == nil {
+			t.Errorf("dial after auth %v: wrong password passed", dialAfterAuth)
+		}
+
+		if dialAfterAuth && len(provider.Users()) != dialed {
+			t.Errorf("upstream dialed for a wrong password")
+		}
+
+		c, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("letmein")},
+		})
+		if err != nil {
+			t.Fatalf("dial after auth %v: verified password: %v", dialAfterAuth, err)
+		}
+		c.Close()
+
+		select {
+		case e := <-events:
+			if e.CredentialVersion != fingerprint(mapped.PublicKey()) {
+				t.Errorf("pipe logged in with %v, want the mapped key", e.CredentialVersion)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("no pipe-open event")
+		}
+
+		cancel()
+		d.Close()
+	}
+}
+
+func TestPasswordRelayedWithoutMappedKey(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	// no key mapped for passwords, upstream checks them
+	provider := &upstream.Fake{Addr: up.Addr().String()}
+
+	d, err := New(WithProvider(provider), WithHostKey(key), WithPasswordVerifier(testPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	c, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("pw")},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c.Close()
+}
@@ -0,0 +1,612 @@
+// Package piperd is the sshpiperd daemon as a library: it accepts
+// connections, hands them to a fixed number of workers and pipes each with an
+// ssh.SSHPiper using an upstream.Provider.
+//
+//	d, err := piperd.New(
+//		piperd.WithHostKey(key),
+//		piperd.WithProvider(provider),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	return d.ListenAndServe("0.0.0.0:2222")
+package piperd
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/audit"
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/password"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Daemon accepts and pipes ssh connections, create it with New
+type Daemon struct {
+	piper    ssh.SSHPiper
+	hostKeys int
+
+	// swapped by SetProvider, connections keep the one they started with
+	providerMu   sync.RWMutex
+	provider     upstream.Provider
+	providerName string
+
+	logger        *log.Logger
+	maxConn       uint
+	backlog       uint
+	maxBuffer     int
+	proxyProtocol bool
+	passthroughs  PassthroughRules
+	connHook      func(event ConnEvent)
+	audit         audit.Sink
+	motd          string
+	messages      map[string]string
+	quota         *quotaStore
+	aliveInterval time.Duration
+	aliveCountMax int
+	keepalive     time.Duration
+	keyPolicy     KeyPolicy
+	hostbased     *hostbasedRelay
+	authMethods   []string
+	upstreamAuth  []string
+	clientEnv     bool
+	authTrace     bool
+	filters       []func(conn ssh.PipeConn) ssh.PacketFilter
+	dial          func(network, addr string) (net.Conn, error)
+	listen        func(network, addr string) (net.Listener, error)
+	listening     func()
+	pipes         pipeRegistry
+	observe       bool
+	sessions      sessionRegistry
+	localShell    *localShell
+	duplicates    duplicateRegistry
+	probes        probeGuard
+	userLimit     userLimiter
+	shadowPercent int
+	upstreams     upstreamRegistry
+	credentials   credentialRegistry
+	events        eventBus
+	passwords     password.Verifier
+	rateLimit     ssh.RateLimit
+	certRules     *CertRules
+	drains        drainRegistry
+	anomalyPolicy string
+
+	// 1 while locked down, atomic
+	lockdown int32
+
+	startOnce sync.Once
+	queue     chan net.Conn
+	// connections accepted and not closed yet, queued ones too, atomic
+	active int64
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	closed    bool
+	done      chan struct{}
+}
+
+// Option configures a Daemon
+type Option func(d *Daemon)
+
+// WithProvider sets the provider finding upstreams, required
+func WithProvider(provider upstream.Provider) Option {
+	return func(d *Daemon) {
+		d.provider = provider
+	}
+}
+
+// WithHostKey adds a host key shown to downstream, at least one is required
+func WithHostKey(key ssh.Signer) Option {
+	return func(d *Daemon) {
+		d.piper.DownstreamConfig.AddHostKey(key)
+		d.hostKeys++
+	}
+}
+
+// WithChallenger runs c before dialing upstream
+func WithChallenger(c challenger.Challenger) Option {
+	return func(d *Daemon) {
+		d.piper.AdditionalChallenge = c
+	}
+}
+
+// WithLogger sets the logger, default discards
+func WithLogger(logger *log.Logger) Option {
+	return func(d *Daemon) {
+		d.logger = logger
+	}
+}
+
+// WithMaxConn sets connections served at the same time, default 1024
+func WithMaxConn(n uint) Option {
+	return func(d *Daemon) {
+		d.maxConn = n
+	}
+}
+
+// WithBacklog sets accepted connections waiting for a free worker,
+// connections beyond are refused, default 128
+func WithBacklog(n uint) Option {
+	return func(d *Daemon) {
+		d.backlog = n
+	}
+}
+
+// WithMaxBuffer sets bytes buffered for both legs of a pipe together,
+// default 1MiB
+func WithMaxBuffer(n int) Option {
+	return func(d *Daemon) {
+		d.maxBuffer = n
+	}
+}
+
+// WithLoginGraceTime sets time allowed for handshakes and auth, 0 for no limit
+func WithLoginGraceTime(t time.Duration) Option {
+	return func(d *Daemon) {
+		d.piper.LoginGraceTime = t
+	}
+}
+
+// WithDialAfterAuth dials upstream only once downstream signed with a key
+// the provider maps and passed the additional challenge, so scanners never
+// make the daemon connect to upstreams. Password users cannot login.
+func WithDialAfterAuth(enabled bool) Option {
+	return func(d *Daemon) {
+		d.piper.DialAfterAuth = enabled
+	}
+}
+
+// WithPhaseHook is called when a connection enters a phase
+func WithPhaseHook(hook func(conn net.Conn, phase ssh.PipePhase)) Option {
+	return func(d *Daemon) {
+		d.piper.PhaseHook = hook
+	}
+}
+
+// WithProxyProtocol reads PROXY protocol v1 header from every connection
+func WithProxyProtocol(enabled bool) Option {
+	return func(d *Daemon) {
+		d.proxyProtocol = enabled
+	}
+}
+
+// WithPassthrough splices connections matching rules to their upstream
+func WithPassthrough(rules PassthroughRules) Option {
+	return func(d *Daemon) {
+		d.passthroughs = rules
+	}
+}
+
+// WithConnHook calls hook when a connection is established, after auth on
+// both legs, and when an established connection is closed. hook blocks the
+// connection, long running work should be done in background.
+func WithConnHook(hook func(event ConnEvent)) Option {
+	return func(d *Daemon) {
+		d.connHook = hook
+	}
+}
+
+// WithTimeouts bounds stages of login on their own, see ssh.Timeouts
+func WithTimeouts(t ssh.Timeouts) Option {
+	return func(d *Daemon) {
+		d.piper.Timeouts = t
+	}
+}
+
+// WithDialer dials upstreams of temporary pipes, net.Dial by default
+func WithDialer(dial func(network, addr string) (net.Conn, error)) Option {
+	return func(d *Daemon) {
+		d.dial = dial
+	}
+}
+
+// WithListen opens the listeners of ListenAndServe, net.Listen by default.
+// sshpiperd hands its listening sockets over to an upgraded binary this way.
+func WithListen(listen func(network, addr string) (net.Listener, error)) Option {
+	return func(d *Daemon) {
+		d.listen = listen
+	}
+}
+
+// WithListening calls f once ListenAndServe listens on all its addrs
+func WithListening(f func()) Option {
+	return func(d *Daemon) {
+		d.listening = f
+	}
+}
+
+// New creates a Daemon, it does not listen until Serve or ListenAndServe
+func New(opts ...Option) (*Daemon, error) {
+	d := &Daemon{
+		logger:    log.New(ioutil.Discard, "", 0),
+		maxConn:   1024,
+		backlog:   128,
+		maxBuffer: 1 << 20,
+		messages:  make(map[string]string),
+		dial:      net.Dial,
+		listen:    net.Listen,
+		done:      make(chan struct{}),
+	}
+
+	for k, v := range DefaultMessages {
+		d.messages[k] = v
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if d.provider == nil {
+		return nil, fmt.Errorf("no upstream provider")
+	}
+
+	if d.maxConn == 0 {
+		return nil, fmt.Errorf("max-conn must be positive")
+	}
+
+	d.piper.ErrorMessage = d.errorMessage
+	if d.hostbased != nil {
+		d.piper.MapHostbased = d.mapHostbased
+	}
+
+	if d.audit != nil {
+		d.initAudit()
+	}
+
+	if len(d.authMethods) > 0 {
+		d.piper.AuthMethods = d.advertisedMethods
+	}
+
+	if d.authTrace {
+		d.piper.AuthStateHook = d.traceAuth
+	}
+	d.piper.DownstreamConfig.MaxBufferedBytes = d.maxBuffer
+
+	// a provider swapped in may have a motd
+	d.filters = append(d.filters, d.newMOTDFilter)
+
+	if d.quota != nil {
+		if err := d.quota.load(); err != nil {
+			return nil, err
+		}
+
+		d.filters = append(d.filters, d.newQuotaFilter)
+		go d.quota.saveLoop(d.done, d.logger)
+	}
+
+	switch d.duplicates.policy {
+	case "", upstream.DuplicateAllow, upstream.DuplicateDeny, upstream.DuplicateTakeover:
+	default:
+		return nil, fmt.Errorf("unknown duplicate policy %v", d.duplicates.policy)
+	}
+
+	switch d.anomalyPolicy {
+	case "", AnomalyLog, AnomalyTerminate:
+	case AnomalyBan:
+		if d.probes.banAfter <= 0 {
+			return nil, fmt.Errorf("anomaly policy ban needs probe ban")
+		}
+	default:
+		return nil, fmt.Errorf("unknown anomaly policy %v", d.anomalyPolicy)
+	}
+
+	if d.localShell != nil {
+		if err := d.localShell.init(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(d.filters) > 0 {
+		d.piper.PacketFilter = d.packetFilter
+	}
+
+	if d.hostKeys == 0 {
+		return nil, fmt.Errorf("no host key")
+	}
+
+	if d.certRules != nil && !d.piper.DialAfterAuth {
+		return nil, fmt.Errorf("cert rules route before the dial, they need dial after auth")
+	}
+
+	return d, nil
+}
+
+// findUpstream checks the quota before asking provider
+func (d *Daemon) findUpstream(provider upstream.Provider, conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+	if err := d.checkQuota(conn); err != nil {
+		return nil, nil, err
+	}
+
+	return provider.FindUpstream(conn)
+}
+
+// a fixed number of workers serve connections, accepted ones wait in
+// queue and are refused when it is full
+func (d *Daemon) start() {
+	d.startOnce.Do(func() {
+		d.queue = make(chan net.Conn, d.backlog)
+
+		for i := uint(0); i < d.maxConn; i++ {
+			go func() {
+				for c := range d.queue {
+					// probes are logged on their own, see checkProbe
+					if err := d.serve(c); err != errProbe && err != errBannedProbe {
+						d.logger.Printf("connection %v closed reason: %v", c.RemoteAddr(), err)
+					}
+					atomic.AddInt64(&d.active, -1)
+				}
+			}()
+		}
+	})
+}
+
+// ListenAndServe listens on addr, and on the same host for each port a
+// passthrough rule matches, then serves all of them until Close
+func (d *Daemon) ListenAndServe(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	listener, err := d.listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	d.logger.Printf("listening at %s", addr)
+
+	for _, port := range d.passthroughs.ports() {
+		paddr := net.JoinHostPort(host, strconv.Itoa(port))
+
+		l, err := d.listen("tcp", paddr)
+		if err != nil {
+			listener.Close()
+			d.Close()
+			return err
+		}
+
+		d.logger.Printf("listening at %s for passthrough", paddr)
+		go d.Serve(l)
+	}
+
+	if d.listening != nil {
+		d.listening()
+	}
+
+	return d.Serve(listener)
+}
+
+// Serve accepts connections from l until Close, l is closed by Close
+func (d *Daemon) Serve(l net.Listener) error {
+	return d.serveListener(l, nil)
+}
+
+func (d *Daemon) serveListener(l net.Listener, config *Listener) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		l.Close()
+		return fmt.Errorf("daemon closed")
+	}
+	d.listeners = append(d.listeners, l)
+	d.mu.Unlock()
+
+	d.start()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if d.isClosed() {
+				return nil
+			}
+
+			d.logger.Printf("failed to accept connection: %v", err)
+			continue
+		}
+
+		// without proxy protocol banned ips are known before taking a slot
+		if !d.proxyProtocol && d.refuseBanned(c) {
+			continue
+		}
+
+		if config != nil {
+			c = &listenerConn{c, config}
+		}
+
+		atomic.AddInt64(&d.active, 1)
+
+		select {
+		case d.queue <- c:
+			d.logger.Printf("connection accepted: %v", c.RemoteAddr())
+		default:
+			atomic.AddInt64(&d.active, -1)
+			d.logger.Printf("connection refused: %v, %d connections served and %d waiting", c.RemoteAddr(), d.maxConn, d.backlog)
+			c.Close()
+		}
+	}
+}
+
+func (d *Daemon) isClosed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closed
+}
+
+// Close stops all listeners, connections already accepted are still served
+func (d *Daemon) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.closed {
+		d.closed = true
+		close(d.done)
+
+		if d.quota != nil {
+			if err := d.quota.save(); err != nil {
+				d.logger.Printf("failed to save quota: %v", err)
+			}
+		}
+	}
+
+	var err error
+	for _, l := range d.listeners {
+		if e := l.Close(); e != nil {
+			err = e
+		}
+	}
+	d.listeners = nil
+
+	return err
+}
+
+// Active is the number of connections accepted and not closed yet
+func (d *Daemon) Active() int {
+	return int(atomic.LoadInt64(&d.active))
+}
+
+// Drain waits after Close until connections accepted before are all closed,
+// at most timeout if positive. It tells whether they were, the ones left are
+// not closed by Drain.
+func (d *Daemon) Drain(timeout time.Duration) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	for d.Active() > 0 {
+		select {
+		case <-tick.C:
+		case <-deadline:
+			return false
+		}
+	}
+
+	return true
+}
+
+// serve pipes c, or splices it to upstream if a passthrough rule matches
+func (d *Daemon) serve(c net.Conn) (err error) {
+	var config *Listener
+	if lc, ok := c.(*listenerConn); ok {
+		c, config = lc.Conn, lc.config
+	}
+
+	if d.proxyProtocol {
+		pc, err := readProxyHeader(c)
+		if err != nil {
+			c.Close()
+			return err
+		}
+
+		c = pc
+	}
+
+	if d.proxyProtocol && d.refuseBanned(c) {
+		return errBannedProbe
+	}
+
+	if d.audit != nil {
+		d.auditConn(c, audit.ActionAccepted, nil)
+		defer func() {
+			d.auditConn(c, audit.ActionClosed, err)
+		}()
+	}
+
+	events := d.newConnEvents(c)
+	events.publish(EventAccept, nil)
+	defer func() {
+		events.publish(EventClose, err)
+	}()
+
+	if upstream := d.passthroughs.match(c); upstream != "" {
+		// no ssh to refuse with, the connection is just closed
+		if d.Lockdown() {
+			d.logger.Printf("passthrough [%v] to [%s] refused, locked down", c.RemoteAddr(), upstream)
+			c.Close()
+			return errLockdown
+		}
+
+		d.logger.Printf("passthrough [%v] to [%s]", c.RemoteAddr(), upstream)
+		return splice(c, upstream)
+	}
+
+	// a copy for this connection, features below hook into it
+	piper := d.piper
+	if config != nil {
+		config.apply(&piper)
+	}
+
+	provider := d.Provider()
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		return d.findUpstream(provider, conn)
+	}
+	piper.MapPublicKey = func(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
+		return d.mapPublicKey(provider, conn, key)
+	}
+	if d.passwords != nil {
+		piper.VerifyPassword = func(conn ssh.ConnMetadata, pw []byte) (ssh.Signer, error) {
+			return d.verifyPassword(provider, conn, pw)
+		}
+	}
+	if d.certRules != nil {
+		d.withCertRules(&piper, provider)
+	}
+
+	d.withDenials(&piper)
+	if p, ok := provider.(upstream.TargetProvider); ok {
+		d.withTargetMenu(&piper, p)
+	}
+	d.withLocalSFTP(&piper)
+
+	d.withPipes(&piper)
+	d.withUpstreamAuth(&piper)
+	d.withForceCommand(&piper)
+	d.withTCPOptions(&piper)
+	d.withRateLimit(&piper)
+	if d.anomalyPolicy != "" {
+		d.withAnomalies(&piper)
+	}
+	if d.localShell != nil {
+		d.withLocalShell(&piper)
+	}
+
+	labels := d.withLabels(&piper)
+	d.withDuplicates(&piper)
+	d.withDrain(&piper)
+	d.withShadow(&piper)
+	if d.observe {
+		appendFilter(&piper, func(conn ssh.PipeConn) ssh.PacketFilter {
+			return d.newObservedSession(conn, labels)
+		})
+	}
+
+	d.withAlive(&piper)
+	identity := d.withUpstreamIdentity(&piper)
+	d.withUpstreamStats(&piper, identity)
+	credential := d.withCredentialVersion(&piper, provider)
+	d.withUserLimit(&piper, c)
+	d.withLockdown(&piper)
+	if d.clientEnv {
+		d.withClientEnv(&piper, events.event.Conn)
+	}
+	events.withEvents(&piper, identity, credential)
+
+	if d.connHook != nil {
+		return d.checkProbe(c, d.serveWithHook(&piper, c, labels, identity))
+	}
+
+	return d.checkProbe(c, piper.Serve(c))
+}
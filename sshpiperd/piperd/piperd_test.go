@@ -0,0 +1,675 @@
+package piperd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// testUpstream accepts password pw and closes each conn after auth
+func testUpstream(t *testing.T, key ssh.Signer) net.Listener {
+	return serveUpstream(t, key, &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "pw" {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		},
+	}, nil)
+}
+
+// serveUpstream serves config with host key on a listener, passing each conn
+// logged in and its channels to handle, every channel is rejected if nil.
+// Global requests are discarded.
+func serveUpstream(t *testing.T, key ssh.Signer, config *ssh.ServerConfig, handle func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.AddHostKey(key)
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				conn, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				go ssh.DiscardRequests(reqs)
+				if handle == nil {
+					rejectChannels(chans)
+					return
+				}
+				handle(conn, chans)
+			}()
+		}
+	}()
+
+	return l
+}
+
+func rejectChannels(chans <-chan ssh.NewChannel) {
+	for ch := range chans {
+		ch.Reject(ssh.Prohibited, "no channels")
+	}
+}
+
+func TestNewRequiresProviderAndHostKey(t *testing.T) {
+	key := newTestSigner(t)
+
+	if _, err := New(WithHostKey(key)); err == nil {
+		t.Errorf("New without provider succeeded")
+	}
+
+	if _, err := New(WithProvider(&upstream.Fake{})); err == nil {
+		t.Errorf("New without host key succeeded")
+	}
+
+	if _, err := New(WithProvider(&upstream.Fake{}), WithHostKey(key), WithMaxConn(0)); err == nil {
+		t.Errorf("New with max conn 0 succeeded")
+	}
+
+	if _, err := New(WithProvider(&upstream.Fake{}), WithHostKey(key)); err != nil {
+		t.Errorf("New: %v", err)
+	}
+}
+
+func TestDaemonPipesToProvider(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	provider := &upstream.Fake{Addr: up.Addr().String()}
+
+	d, err := New(WithProvider(provider), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- d.Serve(l)
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("pw")},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	client.Close()
+
+	if users := provider.Users(); len(users) != 1 || users[0] != "alice" {
+		t.Errorf("provider got users %v", users)
+	}
+
+	if _, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("wrong")},
+	}); err == nil {
+		t.Errorf("Dial with wrong password succeeded")
+	}
+
+	d.Close()
+
+	if err := <-served; err != nil {
+		t.Errorf("Serve after Close: %v", err)
+	}
+}
+
+func TestConnHook(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	events := make(chan ConnEvent, 10)
+
+	d, err := New(
+		WithProvider(&upstream.Fake{Addr: up.Addr().String(), User: "bob"}),
+		WithHostKey(key),
+		WithConnHook(func(event ConnEvent) { events <- event }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	// failed logins are never established
+	if _, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("wrong")},
+	}); err == nil {
+		t.Fatalf("Dial with wrong password succeeded")
+	}
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("pw")},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	e := <-events
+	if e.Type != ConnEstablished || e.User != "alice" || e.Upstream.String() != up.Addr().String() || e.Err != nil {
+		t.Errorf("got established event %+v", e)
+	}
+
+	client.Close()
+
+	e = <-events
+	if e.Type != ConnClosed || e.BytesIn == 0 || e.BytesOut == 0 || e.Duration == 0 {
+		t.Errorf("got closed event %+v", e)
+	}
+}
+
+// dropConn closes itself on the nth write, like a flaky network
+type dropConn struct {
+	net.Conn
+	n int
+}
+
+func (c *dropConn) Write(b []byte) (int, error) {
+	if c.n--; c.n == 0 {
+		c.Conn.Close()
+	}
+	return c.Conn.Write(b)
+}
+
+// flakyProvider drops the first upstream connection on its nth write
+type flakyProvider struct {
+	*upstream.Fake
+	n int
+}
+
+func (p *flakyProvider) FindUpstream(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+	c, config, err := p.Fake.FindUpstream(conn)
+	if err == nil && len(p.Users()) == 1 {
+		c = &dropConn{Conn: c, n: p.n}
+	}
+	return c, config, err
+}
+
+func TestRedialDroppedUpstream(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	// 2nd write is kex init, 6th the first auth request
+	for _, n := range []int{2, 6} {
+		provider := &flakyProvider{&upstream.Fake{Addr: up.Addr().String()}, n}
+
+		d, err := New(WithProvider(provider), WithHostKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go d.Serve(l)
+
+		client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("pw")},
+		})
+		if err != nil {
+			t.Errorf("drop on write %d: Dial: %v", n, err)
+		} else {
+			client.Close()
+		}
+
+		if users := provider.Users(); len(users) != 2 {
+			t.Errorf("drop on write %d: got %d upstream dials, want 2", n, len(users))
+		}
+
+		d.Close()
+	}
+}
+
+func TestDialAfterAuth(t *testing.T) {
+	key := newTestSigner(t)
+	allowed, other := newTestSigner(t), newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	provider := &upstream.Fake{Addr: up.Addr().String(), AuthorizedKeys: []ssh.PublicKey{allowed.PublicKey()}, Signer: key}
+	d, err := New(WithProvider(provider), WithHostKey(key), WithDialAfterAuth(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	for _, tt := range []struct {
+		auth   ssh.AuthMethod
+		dialed int
+	}{
+		{ssh.Password("pw"), 0},
+		{ssh.PublicKeys(other), 0},
+		// upstream takes password only, but it is dialed
+		{ssh.PublicKeys(allowed), 1},
+	} {
+		if _, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{tt.auth},
+		}); err == nil {
+			t.Errorf("login passed")
+		}
+
+		if got := len(provider.Users()); got != tt.dialed {
+			t.Errorf("upstream dialed %d times, want %d", got, tt.dialed)
+		}
+	}
+}
+
+func TestChallengeAfterVerified(t *testing.T) {
+	key := newTestSigner(t)
+	allowed, other, mapped := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+
+	users := make(chan string, 1)
+	up := userUpstream(t, key, mapped.PublicKey(), users)
+	defer up.Close()
+
+	challenged := make(chan bool, 2)
+	provider := &upstream.Fake{Addr: up.Addr().String(), AuthorizedKeys: []ssh.PublicKey{allowed.PublicKey()}, Signer: mapped}
+	d, err := New(
+		WithProvider(provider),
+		WithHostKey(key),
+		WithDialAfterAuth(true),
+		WithChallenger(func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (bool, error) {
+			challenged <- challenger.Verified(conn)
+			return true, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	answer := ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return make([]string, len(questions)), nil
+	})
+
+	// never challenged with a key which is not mapped
+	if _, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(other), answer},
+	}); err == nil {
+		t.Errorf("login passed with a key not mapped")
+	}
+
+	c, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(allowed), answer},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c.Close()
+
+	if len(challenged) != 1 || !<-challenged {
+		t.Errorf("challenger not called once for the verified login only")
+	}
+}
+
+// offersProvider records the keys offered before FindUpstream
+type offersProvider struct {
+	*upstream.Fake
+	offered chan []ssh.OfferedKey
+}
+
+func (p *offersProvider) FindUpstream(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+	p.offered <- conn.(ssh.KeyOffers).OfferedKeys()
+	return p.Fake.FindUpstream(conn)
+}
+
+func TestOfferedKeys(t *testing.T) {
+	key := newTestSigner(t)
+	allowed, other := newTestSigner(t), newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	provider := &offersProvider{
+		Fake:    &upstream.Fake{Addr: up.Addr().String(), AuthorizedKeys: []ssh.PublicKey{allowed.PublicKey()}, Signer: key},
+		offered: make(chan []ssh.OfferedKey, 1),
+	}
+	d, err := New(WithProvider(provider), WithHostKey(key), WithDialAfterAuth(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(other, allowed)},
+	})
+
+	// both asked about, then signed with the one accepted
+	want := []struct {
+		key    ssh.Signer
+		signed bool
+	}{
+		{other, false},
+		{allowed, false},
+		{allowed, true},
+	}
+
+	offered := <-provider.offered
+	if len(offered) != len(want) {
+		t.Fatalf("got %d keys offered, want %d", len(offered), len(want))
+	}
+
+	for i, w := range want {
+		k := offered[i]
+		if fingerprint(k.Key) != fingerprint(w.key.PublicKey()) || k.Signed != w.signed {
+			t.Errorf("offer %d: got %v signed %v, want %v signed %v", i, fingerprint(k.Key), k.Signed, fingerprint(w.key.PublicKey()), w.signed)
+		}
+	}
+}
+
+// mfaUpstream asks a password hidden and a token echoed, then an otp in a
+// second round, as pam stacks of mfa do
+func mfaUpstream(t *testing.T, key ssh.Signer) net.Listener {
+	return serveUpstream(t, key, &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			ans, err := client(conn.User(), "Welcome to up", []string{"Password: ", "Token serial: "}, []bool{false, true})
+			if err != nil {
+				return nil, err
+			}
+
+			if !reflect.DeepEqual(ans, []string{"pw", "1234"}) {
+				return nil, fmt.Errorf("wrong answers %q", ans)
+			}
+
+			ans, err = client(conn.User(), "", []string{"OTP: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+
+			if len(ans) != 1 || ans[0] != "000000" {
+				return nil, fmt.Errorf("wrong otp %q", ans)
+			}
+
+			return nil, nil
+		},
+	}, nil)
+}
+
+func TestKeyboardInteractiveRelay(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := mfaUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	type round struct {
+		instruction string
+		questions   []string
+		echos       []bool
+	}
+
+	var rounds []round
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			rounds = append(rounds, round{instruction, questions, echos})
+			if len(questions) == 2 {
+				return []string{"pw", "1234"}, nil
+			}
+			return []string{"000000"}, nil
+		})},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	client.Close()
+
+	want := []round{
+		{"Welcome to up", []string{"Password: ", "Token serial: "}, []bool{false, true}},
+		{"", []string{"OTP: "}, []bool{false}},
+	}
+	if !reflect.DeepEqual(rounds, want) {
+		t.Errorf("got rounds %+v, want %+v", rounds, want)
+	}
+}
+
+// syncBuffer is a log the daemon writes while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTimeouts(t *testing.T) {
+	key := newTestSigner(t)
+
+	// accepts and never speaks
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	// probes are logged, not returned
+	var logs syncBuffer
+
+	d, err := New(
+		WithProvider(&upstream.Fake{Addr: silent.Addr().String()}),
+		WithHostKey(key),
+		WithLogger(log.New(&logs, "", 0)),
+		WithLoginGraceTime(time.Minute),
+		WithTimeouts(ssh.Timeouts{DownstreamKex: 100 * time.Millisecond, UpstreamKex: 100 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	closes, cancel := d.Subscribe(4, EventClose)
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	closed := func() error {
+		select {
+		case e := <-closes:
+			return e.Err
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection not closed")
+		}
+		return nil
+	}
+
+	// a client which never starts its handshake
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	closed()
+	if !strings.Contains(logs.String(), "downstream kex timed out after 100ms") {
+		t.Errorf("got log %q", logs.String())
+	}
+
+	if _, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("pw")},
+	}); err == nil {
+		t.Fatalf("Dial to a silent upstream succeeded")
+	}
+
+	err = closed()
+	ue, ok := err.(*ssh.UpstreamError)
+	if !ok {
+		t.Fatalf("got %v, want an upstream error", err)
+	}
+
+	if te, ok := ue.Err.(*ssh.TimeoutError); !ok || te.Stage != "upstream kex" {
+		t.Errorf("got %#v, want upstream kex timed out", ue.Err)
+	}
+
+	if !strings.Contains(err.Error(), "upstream kex timed out after 100ms") {
+		t.Errorf("got %q", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listening := make(chan struct{})
+
+	// the listener handed over by the binary upgraded
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key),
+		WithListen(func(network, addr string) (net.Listener, error) {
+			return l, nil
+		}),
+		WithListening(func() { close(listening) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.ListenAndServe("127.0.0.1:0")
+	<-listening
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "alice",
+		Auth: []ssh.AuthMethod{ssh.Password("pw")},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	d.Close()
+
+	if d.Active() != 1 {
+		t.Errorf("got %d active, want 1", d.Active())
+	}
+
+	if d.Drain(200 * time.Millisecond) {
+		t.Errorf("drained with a pipe up")
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !d.Drain(5 * time.Second) {
+		t.Errorf("not drained after the pipe closed, %d active", d.Active())
+	}
+}
@@ -0,0 +1,197 @@
+package piperd
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pipe is a temporary pipe, it goes before the provider for its user until
+// it expires. Pipes live in memory only.
+type Pipe struct {
+	User string `json:"user"`
+
+	// [user@]host:port, user defaults to the downstream's
+	Upstream string `json:"upstream"`
+
+	// downstream keys in authorized_keys format mapped to KeyFile, optional
+	AuthorizedKeys string `json:"authorized_keys,omitempty"`
+
+	// private key logging in upstream, the file must be 400
+	KeyFile string `json:"key_file,omitempty"`
+
+	Expires time.Time `json:"expires"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type tempPipe struct {
+	Pipe
+
+	user   string
+	addr   string
+	keys   []ssh.PublicKey
+	signer ssh.Signer
+}
+
+type pipeRegistry struct {
+	mu    sync.Mutex
+	pipes map[string]*tempPipe
+}
+
+// AddPipe adds or replaces the temporary pipe of p.User
+func (d *Daemon) AddPipe(p Pipe) error {
+	if p.User == "" || p.Upstream == "" {
+		return fmt.Errorf("user and upstream are required")
+	}
+
+	if !p.Expires.After(time.Now()) {
+		return fmt.Errorf("pipe of %v expires in the past", p.User)
+	}
+
+	t := &tempPipe{Pipe: p, addr: p.Upstream}
+	if i := strings.LastIndex(p.Upstream, "@"); i >= 0 {
+		t.user, t.addr = p.Upstream[:i], p.Upstream[i+1:]
+	}
+
+	if _, _, err := net.SplitHostPort(t.addr); err != nil {
+		return err
+	}
+
+	var err error
+	if t.keys, err = upstream.ParseAuthorizedKeys([]byte(p.AuthorizedKeys)); err != nil {
+		return err
+	}
+
+	if p.KeyFile != "" {
+		if t.signer, err = upstream.ReadPrivateKeyFile(p.KeyFile); err != nil {
+			return err
+		}
+	}
+
+	d.pipes.mu.Lock()
+	defer d.pipes.mu.Unlock()
+
+	if d.pipes.pipes == nil {
+		d.pipes.pipes = make(map[string]*tempPipe)
+	}
+	d.pipes.pipes[p.User] = t
+
+	d.logger.Printf("temporary pipe [%v] to [%v] until %v", p.User, p.Upstream, p.Expires.Format(time.RFC3339))
+	return nil
+}
+
+// RemovePipe removes the temporary pipe of user, false if there is none
+func (d *Daemon) RemovePipe(user string) bool {
+	d.pipes.mu.Lock()
+	defer d.pipes.mu.Unlock()
+
+	if _, ok := d.pipes.pipes[user]; !ok {
+		return false
+	}
+
+	delete(d.pipes.pipes, user)
+	return true
+}
+
+// Pipes returns temporary pipes not expired, by user
+func (d *Daemon) Pipes() []Pipe {
+	d.pipes.mu.Lock()
+	defer d.pipes.mu.Unlock()
+
+	var users []string
+	for user := range d.pipes.pipes {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	var pipes []Pipe
+	for _, user := range users {
+		if t := d.pipes.get(user); t != nil {
+			pipes = append(pipes, t.Pipe)
+		}
+	}
+
+	return pipes
+}
+
+// get returns the pipe of user, expired ones are removed. mu must be held.
+func (r *pipeRegistry) get(user string) *tempPipe {
+	t, ok := r.pipes[user]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(t.Expires) {
+		delete(r.pipes, user)
+		return nil
+	}
+
+	return t
+}
+
+func (r *pipeRegistry) lookup(user string) *tempPipe {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.get(user)
+}
+
+// withPipes puts temporary pipes before what piper does for their users
+func (d *Daemon) withPipes(piper *ssh.SSHPiper) {
+	findUpstream := piper.FindUpstream
+	mapPublicKey := piper.MapPublicKey
+
+	own := func(conn ssh.ConnMetadata) bool {
+		return d.pipes.lookup(conn.User()) != nil
+	}
+	d.skipMenu(piper, own)
+	refusePasswords(piper, own)
+
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		t := d.pipes.lookup(conn.User())
+		if t == nil {
+			return findUpstream(conn)
+		}
+
+		if err := d.checkQuota(conn); err != nil {
+			return nil, nil, err
+		}
+
+		d.logger.Printf("mapping user [%s] to temporary pipe [%s]", conn.User(), t.Upstream)
+
+		c, err := d.dial("tcp", t.addr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(t.Labels) > 0 {
+			c = &upstream.Conn{Conn: c, Labels: t.Labels}
+		}
+
+		return c, &ssh.ClientConfig{User: t.user}, nil
+	}
+
+	piper.MapPublicKey = func(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
+		t := d.pipes.lookup(conn.User())
+		if t == nil {
+			return mapPublicKey(conn, key)
+		}
+
+		if err := d.keyPolicy.Check(key); err != nil {
+			d.logger.Printf("public key of [%v] from [%v] rejected: %v", conn.User(), conn.RemoteAddr(), err)
+			return nil, nil
+		}
+
+		if t.signer == nil || !upstream.ContainsKey(t.keys, key) {
+			return nil, nil
+		}
+
+		return t.signer, nil
+	}
+}
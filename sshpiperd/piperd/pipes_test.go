@@ -0,0 +1,96 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTemporaryPipe(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	// nothing listens where the provider points
+	provider := &upstream.Fake{Addr: "127.0.0.1:1"}
+
+	d, err := New(WithProvider(provider), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.AddPipe(Pipe{User: "alice", Upstream: up.Addr().String(), Expires: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go d.Serve(l)
+
+	dial := func() error {
+		client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("pw")},
+		})
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}
+
+	if err := dial(); err != nil {
+		t.Fatalf("Dial through temporary pipe: %v", err)
+	}
+
+	if users := provider.Users(); len(users) != 0 {
+		t.Errorf("provider got users %v", users)
+	}
+
+	if !d.RemovePipe("alice") {
+		t.Fatalf("RemovePipe found no pipe")
+	}
+
+	if err := dial(); err == nil {
+		t.Errorf("Dial after RemovePipe succeeded")
+	}
+
+	if users := provider.Users(); len(users) != 1 {
+		t.Errorf("provider got users %v after RemovePipe", users)
+	}
+}
+
+func TestPipeExpires(t *testing.T) {
+	d, err := New(WithProvider(&upstream.Fake{}), WithHostKey(newTestSigner(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.AddPipe(Pipe{User: "alice", Upstream: "127.0.0.1:22", Expires: time.Now().Add(-time.Second)}); err == nil {
+		t.Errorf("AddPipe expired in the past succeeded")
+	}
+
+	if err := d.AddPipe(Pipe{User: "alice", Upstream: "127.0.0.1"}); err == nil {
+		t.Errorf("AddPipe without port succeeded")
+	}
+
+	if err := d.AddPipe(Pipe{User: "alice", Upstream: "bob@127.0.0.1:22", Expires: time.Now().Add(50 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := d.pipes.lookup("alice"); p == nil || p.user != "bob" || p.addr != "127.0.0.1:22" {
+		t.Fatalf("lookup got %+v", p)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if pipes := d.Pipes(); len(pipes) != 0 {
+		t.Errorf("expired pipes listed: %v", pipes)
+	}
+}
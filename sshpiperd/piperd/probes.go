@@ -0,0 +1,223 @@
+package piperd
+
+import (
+	"errors"
+	"github.com/tg123/sshpiper/ssh"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errProbe is returned by serve for connections failed before key exchange,
+// they are logged as probes, not as closed connections
+var errProbe = errors.New("probe")
+
+// errBannedProbe is returned by serve for connections from ips banned for
+// probing
+var errBannedProbe = errors.New("banned for probing")
+
+// probe kinds, passed to the probe hook
+const (
+	// closed or timed out before sending an identification string
+	ProbeNoIdent = "no-identification"
+	// sent something other than SSH-2.0-
+	ProbeInvalidIdent = "invalid-identification"
+	// identified as ssh but failed key exchange
+	ProbeKexFailed = "kex-failed"
+	// refused, the ip is banned for probing
+	ProbeBanned = "banned"
+)
+
+// at most one probe is logged in detail per interval, others are counted
+const probeLogInterval = 10 * time.Second
+
+// WithProbeHook calls hook for every connection failed before key exchange
+// or refused for probing, with the kind of the probe
+func WithProbeHook(hook func(remote net.Addr, kind string)) Option {
+	return func(d *Daemon) {
+		d.probes.hook = hook
+	}
+}
+
+// WithProbeBan bans an ip for banTime once it probed after times within
+// banTime, 0 to never ban. Connections from banned ips are closed before
+// the handshake.
+func WithProbeBan(after int, banTime time.Duration) Option {
+	return func(d *Daemon) {
+		d.probes.banAfter = after
+		d.probes.banTime = banTime
+	}
+}
+
+// probeGuard tracks probes by ip
+type probeGuard struct {
+	hook     func(remote net.Addr, kind string)
+	banAfter int
+	banTime  time.Duration
+
+	mu         sync.Mutex
+	lastLog    time.Time
+	suppressed int
+	ips        map[string]*probeRecord
+}
+
+type probeRecord struct {
+	// probes since first
+	count int
+	first time.Time
+
+	// zero if not banned
+	bannedUntil time.Time
+}
+
+func probeKind(err *ssh.HandshakeError) string {
+	if err.ClientVersion == nil {
+		if _, ok := err.Err.(net.Error); ok || err.Err == io.EOF {
+			return ProbeNoIdent
+		}
+		return ProbeInvalidIdent
+	}
+
+	v := string(err.ClientVersion)
+	if !strings.HasPrefix(v, "SSH-2.0-") && !strings.HasPrefix(v, "SSH-1.99-") {
+		return ProbeInvalidIdent
+	}
+
+	return ProbeKexFailed
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// banned tells whether ip is banned for probing
+func (g *probeGuard) banned(ip string) bool {
+	if g.banAfter <= 0 {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	r := g.ips[ip]
+	if r == nil || r.bannedUntil.IsZero() {
+		return false
+	}
+
+	if time.Now().After(r.bannedUntil) {
+		delete(g.ips, ip)
+		return false
+	}
+
+	return true
+}
+
+// record counts a probe from ip, it returns whether ip is banned by it and
+// whether the probe should be logged, with the number of probes not logged
+// since the last one
+func (g *probeGuard) record(ip string) (ban, log bool, suppressed int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(g.lastLog) >= probeLogInterval {
+		log, suppressed = true, g.suppressed
+		g.lastLog, g.suppressed = now, 0
+	} else {
+		g.suppressed++
+	}
+
+	if g.banAfter <= 0 {
+		return false, log, suppressed
+	}
+
+	if g.ips == nil {
+		g.ips = make(map[string]*probeRecord)
+	}
+
+	// old records would pile up from scans of many ips
+	for k, r := range g.ips {
+		if r.bannedUntil.IsZero() && now.Sub(r.first) > g.banTime {
+			delete(g.ips, k)
+		}
+	}
+
+	r := g.ips[ip]
+	if r == nil {
+		r = &probeRecord{first: now}
+		g.ips[ip] = r
+	}
+
+	r.count++
+	if r.count >= g.banAfter && r.bannedUntil.IsZero() {
+		r.bannedUntil = now.Add(g.banTime)
+		return true, log, suppressed
+	}
+
+	return false, log, suppressed
+}
+
+// ban bans ip for banTime right away, whatever it probed
+func (g *probeGuard) ban(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.ips == nil {
+		g.ips = make(map[string]*probeRecord)
+	}
+
+	now := time.Now()
+	g.ips[ip] = &probeRecord{count: g.banAfter, first: now, bannedUntil: now.Add(g.banTime)}
+}
+
+// refuseBanned closes c if its ip is banned for probing
+func (d *Daemon) refuseBanned(c net.Conn) bool {
+	if !d.probes.banned(remoteIP(c.RemoteAddr())) {
+		return false
+	}
+
+	c.Close()
+	if d.probes.hook != nil {
+		d.probes.hook(c.RemoteAddr(), ProbeBanned)
+	}
+
+	return true
+}
+
+// checkProbe logs a connection failed before key exchange as a probe and
+// returns errProbe, other errors are returned as is
+func (d *Daemon) checkProbe(c net.Conn, err error) error {
+	he, ok := err.(*ssh.HandshakeError)
+	if !ok {
+		return err
+	}
+
+	kind := probeKind(he)
+	ip := remoteIP(c.RemoteAddr())
+
+	ban, log, suppressed := d.probes.record(ip)
+	if log {
+		if suppressed > 0 {
+			d.logger.Printf("probe from [%v]: %v %q: %v, %d more probes since the last one logged", c.RemoteAddr(), kind, he.ClientVersion, he.Err, suppressed)
+		} else {
+			d.logger.Printf("probe from [%v]: %v %q: %v", c.RemoteAddr(), kind, he.ClientVersion, he.Err)
+		}
+	}
+
+	if ban {
+		d.logger.Printf("probe: banning [%v] for %v after %d probes", ip, d.probes.banTime, d.probes.banAfter)
+	}
+
+	if d.probes.hook != nil {
+		d.probes.hook(c.RemoteAddr(), kind)
+	}
+
+	return errProbe
+}
@@ -0,0 +1,76 @@
+package piperd
+
+import (
+	"errors"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbeKind(t *testing.T) {
+	for _, tt := range []struct {
+		err  ssh.HandshakeError
+		want string
+	}{
+		{ssh.HandshakeError{Err: io.EOF}, ProbeNoIdent},
+		{ssh.HandshakeError{Err: errors.New("ssh: overflow reading version string")}, ProbeInvalidIdent},
+		{ssh.HandshakeError{ClientVersion: []byte("GET / HTTP/1.1"), Err: io.EOF}, ProbeInvalidIdent},
+		{ssh.HandshakeError{ClientVersion: []byte("SSH-2.0-masscan"), Err: io.EOF}, ProbeKexFailed},
+	} {
+		if got := probeKind(&tt.err); got != tt.want {
+			t.Errorf("probeKind(%q, %v) = %v, want %v", tt.err.ClientVersion, tt.err.Err, got, tt.want)
+		}
+	}
+}
+
+func TestProbeBan(t *testing.T) {
+	key := newTestSigner(t)
+
+	kinds := make(chan string, 10)
+	d, err := New(
+		WithProvider(&upstream.Fake{}),
+		WithHostKey(key),
+		WithProbeHook(func(remote net.Addr, kind string) { kinds <- kind }),
+		WithProbeBan(2, time.Minute),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	probe := func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+		c.(*net.TCPConn).CloseWrite()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		ioutil.ReadAll(c)
+	}
+
+	for _, want := range []string{ProbeInvalidIdent, ProbeInvalidIdent, ProbeBanned} {
+		probe()
+
+		select {
+		case got := <-kinds:
+			if got != want {
+				t.Errorf("got probe %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no probe %v", want)
+		}
+	}
+}
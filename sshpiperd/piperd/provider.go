@@ -0,0 +1,46 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+)
+
+// WithProviderName names the provider of WithProvider, as the admin api
+// shows it
+func WithProviderName(name string) Option {
+	return func(d *Daemon) {
+		d.providerName = name
+	}
+}
+
+// Provider returns the provider new connections are piped by
+func (d *Daemon) Provider() upstream.Provider {
+	d.providerMu.RLock()
+	defer d.providerMu.RUnlock()
+	return d.provider
+}
+
+// ProviderName returns the name of Provider, empty if not named
+func (d *Daemon) ProviderName() string {
+	d.providerMu.RLock()
+	defer d.providerMu.RUnlock()
+	return d.providerName
+}
+
+// SetProvider swaps in p for new connections once its Check, if it is an
+// upstream.Checker, passes. Connections piped or authing keep the provider
+// they started with.
+func (d *Daemon) SetProvider(name string, p upstream.Provider) error {
+	if c, ok := p.(upstream.Checker); ok {
+		if err := c.Check(); err != nil {
+			return err
+		}
+	}
+
+	d.providerMu.Lock()
+	old := d.providerName
+	d.provider, d.providerName = p, name
+	d.providerMu.Unlock()
+
+	d.logger.Printf("provider [%v] swapped for [%v]", old, name)
+	return nil
+}
@@ -0,0 +1,118 @@
+package piperd
+
+import (
+	"errors"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type failingProvider struct {
+	upstream.Fake
+}
+
+func (*failingProvider) Check() error {
+	return errors.New("database unreachable")
+}
+
+func TestSetProvider(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	before := &upstream.Fake{Addr: up.Addr().String()}
+	after := &upstream.Fake{Addr: up.Addr().String()}
+
+	d, err := New(WithProvider(before), WithProviderName("before"), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	dial := func() *ssh.Client {
+		client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("pw")},
+		})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		return client
+	}
+
+	piped := dial()
+	defer piped.Close()
+
+	if err := d.SetProvider("broken", &failingProvider{}); err == nil {
+		t.Errorf("provider failing its check swapped in")
+	}
+
+	if err := d.SetProvider("after", after); err != nil {
+		t.Fatal(err)
+	}
+
+	dial().Close()
+
+	if len(before.Users()) != 1 || len(after.Users()) != 1 {
+		t.Errorf("before got %v, after got %v", before.Users(), after.Users())
+	}
+
+	// the pipe of the old provider is still up
+	if _, _, err := piped.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("pipe dropped by swap: %v", err)
+	}
+
+	if d.ProviderName() != "after" {
+		t.Errorf("provider name %v", d.ProviderName())
+	}
+}
+
+func TestAdminProvider(t *testing.T) {
+	upstream.Register("test-admin-provider", &upstream.Fake{})
+
+	d, err := New(WithProvider(&upstream.Fake{}), WithHostKey(newTestSigner(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(d.AdminHandler("secret"))
+	defer s.Close()
+
+	put := func(body string) int {
+		req, err := http.NewRequest("PUT", s.URL+"/provider", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := put(`{"name": "no-such-provider"}`); code != http.StatusNotFound {
+		t.Errorf("unknown provider got %v", code)
+	}
+
+	if code := put(`{"name": "test-admin-provider"}`); code != http.StatusOK {
+		t.Errorf("swap got %v", code)
+	}
+
+	if d.ProviderName() != "test-admin-provider" {
+		t.Errorf("provider name %v", d.ProviderName())
+	}
+}
@@ -0,0 +1,95 @@
+package piperd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// max length of a PROXY protocol v1 header including CRLF
+const proxyHeaderMaxLen = 107
+
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyConn is a net.Conn after the PROXY protocol header has been read,
+// RemoteAddr returns the client address from the header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// raw returns the underlying conn and bytes already read from it but not
+// consumed yet, so the conn can be spliced directly.
+func (c *proxyConn) raw() (net.Conn, []byte, error) {
+	buffered, err := c.r.Peek(c.r.Buffered())
+	return c.Conn, buffered, err
+}
+
+// readProxyHeader reads a PROXY protocol v1 header from c
+// see http://www.haproxy.org/download/1.5/doc/proxy-protocol.txt
+func readProxyHeader(c net.Conn) (*proxyConn, error) {
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(c)
+
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		}
+
+		if len(line) >= proxyHeaderMaxLen {
+			return nil, fmt.Errorf("proxy protocol header too long")
+		}
+	}
+
+	header := strings.TrimSuffix(string(line), "\r\n")
+	fields := strings.Split(header, " ")
+
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("bad proxy protocol header %q", header)
+	}
+
+	pc := &proxyConn{Conn: c, r: r, remote: c.RemoteAddr()}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		// keep the real remote address
+		return pc, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("bad proxy protocol header %q", header)
+		}
+
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.Atoi(fields[4])
+		if ip == nil || err != nil {
+			return nil, fmt.Errorf("bad proxy protocol source in header %q", header)
+		}
+
+		pc.remote = &net.TCPAddr{IP: ip, Port: port}
+		return pc, nil
+	}
+
+	return nil, fmt.Errorf("unsupported proxy protocol %v", fields[1])
+}
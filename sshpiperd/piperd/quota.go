@@ -0,0 +1,244 @@
+package piperd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// errQuotaExceeded is returned by FindUpstream for users over their quota
+var errQuotaExceeded = errors.New("transfer quota exceeded")
+
+// share of a quota used before the user is warned
+const quotaWarnAt = 0.9
+
+// how often usage is written to the quota file while pipes are open
+const quotaSaveInterval = time.Minute
+
+// WithQuota limits bytes each user transfers per day and per month, 0 for
+// no limit. Usage is kept in file across restarts, empty file for memory
+// only. Users are warned on stderr at 90% and disconnected when a quota is
+// used up.
+func WithQuota(file string, daily, monthly int64) Option {
+	return func(d *Daemon) {
+		d.quota = &quotaStore{
+			file:    file,
+			daily:   daily,
+			monthly: monthly,
+			users:   make(map[string]*quotaUsage),
+		}
+	}
+}
+
+type quotaUsage struct {
+	Day        string
+	DayBytes   int64
+	Month      string
+	MonthBytes int64
+}
+
+type quotaStore struct {
+	file    string
+	daily   int64
+	monthly int64
+
+	mu    sync.Mutex
+	users map[string]*quotaUsage
+	dirty bool
+}
+
+func (q *quotaStore) load() error {
+	if q.file == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(q.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return json.Unmarshal(data, &q.users)
+}
+
+func (q *quotaStore) save() error {
+	if q.file == "" {
+		return nil
+	}
+
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(q.users)
+	q.dirty = false
+	q.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// rename, so a crash never leaves a half written file
+	tmp := q.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, q.file)
+}
+
+// saveLoop saves usage until done is closed
+func (q *quotaStore) saveLoop(done <-chan struct{}, logger *log.Logger) {
+	t := time.NewTicker(quotaSaveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+
+		if err := q.save(); err != nil {
+			logger.Printf("failed to save quota: %v", err)
+		}
+	}
+}
+
+// usage returns usage of user in the current day and month, zero for users
+// who never piped, without adding them, as any user name is looked up
+// before auth. q.mu must be held.
+func (q *quotaStore) usage(user string, now time.Time) quotaUsage {
+	var u quotaUsage
+	if p, ok := q.users[user]; ok {
+		u = *p
+	}
+
+	u.rollover(now)
+	return u
+}
+
+// rollover starts the day and month of now if u is in earlier ones
+func (u *quotaUsage) rollover(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+// used returns the larger share of the daily and monthly quota user used
+func (q *quotaStore) used(user string) float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.usage(user, time.Now())
+	return q.share(&u)
+}
+
+// add counts n bytes for user and returns the share used after
+func (q *quotaStore) add(user string, n int64) float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.users[user]
+	if !ok {
+		u = &quotaUsage{}
+		q.users[user] = u
+	}
+
+	u.rollover(time.Now())
+	u.DayBytes += n
+	u.MonthBytes += n
+	q.dirty = true
+
+	return q.share(u)
+}
+
+func (q *quotaStore) share(u *quotaUsage) float64 {
+	var used float64
+	if q.daily > 0 {
+		used = float64(u.DayBytes) / float64(q.daily)
+	}
+
+	if q.monthly > 0 {
+		if m := float64(u.MonthBytes) / float64(q.monthly); m > used {
+			used = m
+		}
+	}
+
+	return used
+}
+
+// checkQuota fails for users who used up a quota, before dialing upstream
+func (d *Daemon) checkQuota(conn ssh.ConnMetadata) error {
+	if d.quota != nil && d.quota.used(conn.User()) >= 1 {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// quotaFilter counts every byte piped for user
+type quotaFilter struct {
+	*sessionChannels
+
+	quota *quotaStore
+	user  string
+	warn  sync.Once
+}
+
+func (d *Daemon) newQuotaFilter(conn ssh.PipeConn) ssh.PacketFilter {
+	return &quotaFilter{
+		sessionChannels: newSessionChannels(conn),
+		quota:           d.quota,
+		user:            conn.User(),
+	}
+}
+
+func (f *quotaFilter) FromDownstream(p []byte) ([]byte, error) {
+	if err := f.count(len(p)); err != nil {
+		return nil, err
+	}
+
+	return f.sessionChannels.FromDownstream(p)
+}
+
+func (f *quotaFilter) FromUpstream(p []byte) ([]byte, error) {
+	if err := f.count(len(p)); err != nil {
+		return nil, err
+	}
+
+	return f.sessionChannels.FromUpstream(p)
+}
+
+func (f *quotaFilter) count(n int) error {
+	used := f.quota.add(f.user, int64(n))
+
+	if used >= 1 {
+		f.printAll("\nsshpiper: transfer quota exceeded, disconnecting\n", true)
+		return errQuotaExceeded
+	}
+
+	if used >= quotaWarnAt {
+		f.warn.Do(func() {
+			f.printAll(fmt.Sprintf("\nsshpiper: %d%% of transfer quota used\n", int(used*100)), true)
+		})
+	}
+
+	return nil
+}
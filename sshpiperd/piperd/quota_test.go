@@ -0,0 +1,58 @@
+package piperd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotaStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "quota.json")
+
+	q := &quotaStore{file: file, daily: 100, monthly: 1000, users: make(map[string]*quotaUsage)}
+
+	if used := q.add("alice", 50); used != 0.5 {
+		t.Errorf("got used %v, want 0.5", used)
+	}
+
+	if used := q.used("bob"); used != 0 {
+		t.Errorf("got used %v for bob, want 0", used)
+	}
+
+	// user names looked up before auth are not kept
+	if _, ok := q.users["bob"]; ok {
+		t.Errorf("bob added by a lookup")
+	}
+
+	if err := q.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// usage survives a restart
+	q = &quotaStore{file: file, daily: 100, monthly: 60, users: make(map[string]*quotaUsage)}
+	if err := q.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// monthly is the larger share now
+	if used := q.add("alice", 10); used != 1 {
+		t.Errorf("got used %v, want 1", used)
+	}
+
+	// a new day resets the daily bytes only
+	q.mu.Lock()
+	u := q.usage("alice", time.Now().AddDate(0, 0, 1))
+	q.mu.Unlock()
+
+	if u.DayBytes != 0 {
+		t.Errorf("got %d bytes on next day, want 0", u.DayBytes)
+	}
+}
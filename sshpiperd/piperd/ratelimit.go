@@ -0,0 +1,38 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+)
+
+// WithRateLimit bounds the bandwidth of each pipe, each way, packets beyond
+// are held back. Providers set it per pipe with upstream.Conn, e.g. so
+// premium and best effort tenants sharing the daemon get different
+// throughput.
+func WithRateLimit(l ssh.RateLimit) Option {
+	return func(d *Daemon) {
+		d.rateLimit = l
+	}
+}
+
+// withRateLimit takes the limit of the pipe FindUpstream dials
+func (d *Daemon) withRateLimit(piper *ssh.SSHPiper) {
+	limit := d.rateLimit
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if uc, ok := c.(*upstream.Conn); ok && uc.RateLimit.Rate != 0 {
+			limit = uc.RateLimit
+		}
+		return c, config, err
+	}
+
+	piper.RateLimit = func(conn ssh.ConnMetadata) ssh.RateLimit {
+		if limit.Rate > 0 {
+			d.logger.Printf("pipe of [%v] from [%v] limited to %d bytes/s, burst %d", conn.User(), conn.RemoteAddr(), limit.Rate, limit.Burst)
+		}
+		return limit
+	}
+}
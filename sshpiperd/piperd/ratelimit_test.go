@@ -0,0 +1,83 @@
+package piperd
+
+import (
+	"bytes"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"testing"
+	"time"
+)
+
+// rateProvider lifts the limit of premium
+type rateProvider struct {
+	*upstream.Fake
+}
+
+func (p *rateProvider) FindUpstream(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+	c, config, err := p.Fake.FindUpstream(conn)
+	if err != nil || conn.User() != "premium" {
+		return c, config, err
+	}
+
+	return &upstream.Conn{Conn: c, RateLimit: ssh.RateLimit{Rate: -1}}, config, nil
+}
+
+func TestRateLimit(t *testing.T) {
+	key := newTestSigner(t)
+	client, mapped := newTestSigner(t), newTestSigner(t)
+
+	output := bytes.Repeat([]byte("x"), 96<<10)
+	got := make(chan string, 2)
+	up := execUpstream(t, key, string(output), got, mapped.PublicKey())
+	defer up.Close()
+
+	provider := &rateProvider{&upstream.Fake{Addr: up.Addr().String(), AuthorizedKeys: []ssh.PublicKey{client.PublicKey()}, Signer: mapped}}
+
+	d, err := New(WithProvider(provider), WithHostKey(key), WithRateLimit(ssh.RateLimit{Rate: 64 << 10, Burst: 32 << 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	run := func(user string) time.Duration {
+		c, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: user,
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(client)},
+		})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer c.Close()
+
+		s, err := c.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		start := time.Now()
+		out, err := s.Output("cat")
+		if err != nil || len(out) != len(output) {
+			t.Fatalf("got %d bytes, %v", len(out), err)
+		}
+		<-got
+
+		return time.Since(start)
+	}
+
+	// 64k beyond the burst at 64k/s
+	if took := run("alice"); took < 800*time.Millisecond {
+		t.Errorf("limited pipe took %v", took)
+	}
+
+	if took := run("premium"); took > 500*time.Millisecond {
+		t.Errorf("pipe without limit took %v", took)
+	}
+}
@@ -0,0 +1,209 @@
+package piperd
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// output chunks buffered for each observer, more are dropped so a slow
+// observer never holds up the session
+const observeBuffer = 256
+
+// WithObservers tracks piped sessions, so the admin api lists them and lets
+// auditors attach read-only to their output. Users are told when an
+// observer attaches.
+func WithObservers(enabled bool) Option {
+	return func(d *Daemon) {
+		d.observe = enabled
+	}
+}
+
+// Session is a piped connection
+type Session struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	Started    time.Time `json:"started"`
+	Observers  int       `json:"observers"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type observedSession struct {
+	*sessionChannels
+
+	id      string
+	started time.Time
+	labels  *connLabels
+
+	// mu of sessionChannels guards observers too
+	observers map[chan []byte]bool
+}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	next     uint64
+	sessions map[string]*observedSession
+}
+
+func (d *Daemon) newObservedSession(conn ssh.PipeConn, labels *connLabels) ssh.PacketFilter {
+	s := &observedSession{
+		sessionChannels: newSessionChannels(conn),
+		started:         time.Now(),
+		labels:          labels,
+		observers:       make(map[chan []byte]bool),
+	}
+
+	d.sessions.mu.Lock()
+	d.sessions.next++
+	s.id = strconv.FormatUint(d.sessions.next, 10)
+	if d.sessions.sessions == nil {
+		d.sessions.sessions = make(map[string]*observedSession)
+	}
+	d.sessions.sessions[s.id] = s
+	d.sessions.mu.Unlock()
+
+	go func() {
+		<-conn.Done()
+
+		d.sessions.mu.Lock()
+		delete(d.sessions.sessions, s.id)
+		d.sessions.mu.Unlock()
+	}()
+
+	return s
+}
+
+// FromUpstream copies session output, stdout and stderr, to observers
+func (s *observedSession) FromUpstream(p []byte) ([]byte, error) {
+	var data []byte
+
+	switch {
+	case len(p) > 0 && p[0] == msgChannelData:
+		var msg channelDataMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			return nil, err
+		}
+		data = msg.Data
+
+	case len(p) > 0 && p[0] == msgChannelExtendedData:
+		var msg channelExtendedDataMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			return nil, err
+		}
+		data = msg.Data
+	}
+
+	if len(data) > 0 {
+		// data points into p, which the pipe reuses
+		data = append([]byte(nil), data...)
+
+		s.mu.Lock()
+		for o := range s.observers {
+			select {
+			case o <- data:
+			default:
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	return s.sessionChannels.FromUpstream(p)
+}
+
+// Sessions returns piped sessions by id, empty unless WithObservers
+func (d *Daemon) Sessions() []Session {
+	d.sessions.mu.Lock()
+	defer d.sessions.mu.Unlock()
+
+	var sessions []Session
+	for _, s := range d.sessions.sessions {
+		s.mu.Lock()
+		sessions = append(sessions, Session{
+			ID:         s.id,
+			User:       s.conn.User(),
+			RemoteAddr: s.conn.RemoteAddr().String(),
+			Started:    s.started,
+			Observers:  len(s.observers),
+			Labels:     s.labels.get(),
+		})
+		s.mu.Unlock()
+	}
+
+	sort.Sort(sessionsByID(sessions))
+	return sessions
+}
+
+type sessionsByID []Session
+
+func (s sessionsByID) Len() int { return len(s) }
+
+func (s sessionsByID) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+func (s sessionsByID) Less(i, j int) bool {
+	a, _ := strconv.ParseUint(s[i].ID, 10, 64)
+	b, _ := strconv.ParseUint(s[j].ID, 10, 64)
+	return a < b
+}
+
+// Observe attaches to the output of session id, the output channel is
+// closed when the session ends. Call detach when done watching.
+func (d *Daemon) Observe(id string) (output <-chan []byte, detach func(), err error) {
+	d.sessions.mu.Lock()
+	s, ok := d.sessions.sessions[id]
+	d.sessions.mu.Unlock()
+
+	if !ok {
+		return nil, nil, fmt.Errorf("no session %v", id)
+	}
+
+	in := make(chan []byte, observeBuffer)
+	out := make(chan []byte)
+	stop := make(chan struct{})
+
+	s.mu.Lock()
+	s.observers[in] = true
+	s.mu.Unlock()
+
+	d.logger.Printf("observer attached to session %v of [%v] from [%v]", id, s.conn.User(), s.conn.RemoteAddr())
+	s.printAll("\nsshpiper: this session is being observed\n", true)
+
+	go func() {
+		defer close(out)
+
+		for {
+			select {
+			case data := <-in:
+				select {
+				case out <- data:
+				case <-stop:
+					return
+				case <-s.conn.Done():
+					return
+				}
+			case <-stop:
+				return
+			case <-s.conn.Done():
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	detach = func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.observers, in)
+			s.mu.Unlock()
+
+			close(stop)
+			d.logger.Printf("observer detached from session %v", id)
+		})
+	}
+
+	return out, detach, nil
+}
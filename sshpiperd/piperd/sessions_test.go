@@ -0,0 +1,72 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestObserveSession(t *testing.T) {
+	conn := &testPipeConn{ConnMetadata: testConnMeta{}}
+	d := &Daemon{logger: log.New(ioutil.Discard, "", 0)}
+
+	f := d.newObservedSession(conn, &connLabels{labels: map[string]string{"team": "infra"}})
+
+	mustPass := func(p []byte, err error) []byte {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	mustPass(f.FromDownstream(ssh.Marshal(&channelOpenMsg{ChanType: "session", PeersId: 3, PeersWindow: 1 << 20, MaxPacketSize: 1 << 15})))
+	mustPass(f.FromUpstream(ssh.Marshal(&channelOpenConfirmMsg{PeersId: 3, MyId: 7, MyWindow: 1 << 20, MaxPacketSize: 1 << 15})))
+	mustPass(f.FromDownstream(ssh.Marshal(&channelRequestMsg{PeersId: 7, Request: "shell"})))
+
+	sessions := d.Sessions()
+	if len(sessions) != 1 || sessions[0].User != "alice" || sessions[0].Labels["team"] != "infra" {
+		t.Fatalf("got sessions %+v", sessions)
+	}
+
+	if _, _, err := d.Observe("nope"); err == nil {
+		t.Errorf("Observe of unknown session succeeded")
+	}
+
+	output, detach, err := d.Observe(sessions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the user is told
+	if len(conn.down) != 1 {
+		t.Errorf("got %d packets to downstream on attach, want 1", len(conn.down))
+	}
+
+	out := ssh.Marshal(&channelDataMsg{PeersId: 3, Data: []byte("$ ls\r\n")})
+	if p := mustPass(f.FromUpstream(out)); p == nil {
+		t.Fatalf("output dropped")
+	}
+	mustPass(f.FromUpstream(ssh.Marshal(&channelExtendedDataMsg{PeersId: 3, DataType: extendedDataStderr, Data: []byte("oops")})))
+
+	// input is not mirrored
+	mustPass(f.FromDownstream(ssh.Marshal(&channelDataMsg{PeersId: 7, Data: []byte("secret")})))
+
+	if got := string(<-output) + string(<-output); got != "$ ls\r\noops" {
+		t.Errorf("observed %q", got)
+	}
+
+	if n := d.Sessions()[0].Observers; n != 1 {
+		t.Errorf("got %d observers, want 1", n)
+	}
+
+	detach()
+
+	if _, ok := <-output; ok {
+		t.Errorf("output open after detach")
+	}
+
+	if n := d.Sessions()[0].Observers; n != 0 {
+		t.Errorf("got %d observers after detach", n)
+	}
+}
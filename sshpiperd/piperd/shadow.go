@@ -0,0 +1,331 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const msgChannelEOF = 96
+
+type channelEOFMsg struct {
+	PeersId uint32 `sshtype:"96"`
+}
+
+// packets waiting for a shadow, a shadow falling further behind is dropped
+// so it never holds up the pipe
+const shadowBuffer = 1024
+
+// a shadow replays what was queued when the pipe ended for this long at most
+const shadowLinger = 30 * time.Second
+
+// WithShadowPercent mirrors downstream input of percent of the pipes whose
+// provider names a shadow upstream in upstream.Conn, 0 for none. Experimental.
+func WithShadowPercent(percent int) Option {
+	return func(d *Daemon) {
+		d.shadowPercent = percent
+	}
+}
+
+// shadowPacket is a packet of the pipe the shadow replays
+type shadowPacket struct {
+	p            []byte
+	fromUpstream bool
+}
+
+// shadow replays what downstream sends in session channels to a second
+// upstream, logged in with the same mapped key. Its output is discarded and
+// downstream never knows it is there.
+type shadow struct {
+	d      *Daemon
+	conn   ssh.PipeConn
+	addr   string
+	config *ssh.ClientConfig
+
+	packets chan shadowPacket
+
+	mu sync.Mutex
+	// packets are closed and no longer queued once ended
+	ended bool
+	// dropped before the pipe ended
+	dropped bool
+	// closed when dropped, so a write blocked on the shadow returns
+	client *ssh.Client
+}
+
+// withShadow picks pipes to shadow once they are up. Only pipes logged in
+// with a mapped key can be, the key logs in to the shadow too, and only to
+// a shadow whose host key the provider checks.
+func (d *Daemon) withShadow(piper *ssh.SSHPiper) {
+	if d.shadowPercent <= 0 {
+		return
+	}
+
+	var (
+		addr    string
+		user    string
+		hostKey func(hostname string, remote net.Addr, key ssh.PublicKey) error
+		signer  ssh.Signer
+	)
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if err != nil {
+			return c, config, err
+		}
+
+		if uc, ok := c.(*upstream.Conn); ok && uc.Shadow != "" {
+			addr, user, hostKey = uc.Shadow, config.User, uc.ShadowHostKeyCallback
+			if user == "" {
+				user = conn.User()
+			}
+		}
+
+		return c, config, nil
+	}
+
+	onMapped(piper, func(conn ssh.ConnMetadata, s ssh.Signer) {
+		signer = s
+	})
+
+	appendFilter(piper, func(conn ssh.PipeConn) ssh.PacketFilter {
+		if addr == "" || rand.Intn(100) >= d.shadowPercent {
+			return nil
+		}
+
+		if signer == nil {
+			d.logger.Printf("pipe of [%v] from [%v] not shadowed, no mapped key logs in to [%v]", conn.User(), conn.RemoteAddr(), addr)
+			return nil
+		}
+
+		// a nil callback takes any host key, the user's input must not go
+		// to whoever answers at addr
+		if hostKey == nil {
+			d.logger.Printf("pipe of [%v] from [%v] not shadowed, the host key of [%v] cannot be checked", conn.User(), conn.RemoteAddr(), addr)
+			return nil
+		}
+
+		s := &shadow{
+			d:    d,
+			conn: conn,
+			addr: addr,
+			config: &ssh.ClientConfig{
+				User:            user,
+				Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+				HostKeyCallback: hostKey,
+			},
+			packets: make(chan shadowPacket, shadowBuffer),
+		}
+
+		go s.run()
+		return s
+	})
+}
+
+func (s *shadow) FromDownstream(p []byte) ([]byte, error) {
+	if len(p) > 0 {
+		switch p[0] {
+		case msgChannelOpen, msgChannelData, msgChannelEOF, msgChannelClose, msgChannelRequest:
+			s.queue(p, false)
+		}
+	}
+	return p, nil
+}
+
+func (s *shadow) FromUpstream(p []byte) ([]byte, error) {
+	if len(p) > 0 && p[0] == msgChannelOpenConfirm {
+		s.queue(p, true)
+	}
+	return p, nil
+}
+
+// queue copies p for the shadow, p is reused by the pipe
+func (s *shadow) queue(p []byte, fromUpstream bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended {
+		return
+	}
+
+	select {
+	case s.packets <- shadowPacket{append([]byte(nil), p...), fromUpstream}:
+	default:
+		s.drop("it fell behind")
+	}
+}
+
+// end stops queueing, what is queued is still replayed. s.mu must be held.
+func (s *shadow) end() {
+	if !s.ended {
+		s.ended = true
+		close(s.packets)
+	}
+}
+
+// drop ends the shadow at once, logged unless reason is empty. s.mu must be
+// held.
+func (s *shadow) drop(reason string) {
+	s.end()
+	if s.client != nil {
+		s.client.Close()
+	}
+
+	if !s.dropped && reason != "" {
+		s.d.logger.Printf("shadow [%v] of [%v] from [%v] dropped, %v", s.addr, s.conn.User(), s.conn.RemoteAddr(), reason)
+	}
+	s.dropped = true
+}
+
+func (s *shadow) stop(reason string) {
+	s.mu.Lock()
+	s.drop(reason)
+	s.mu.Unlock()
+}
+
+func (s *shadow) run() {
+	// the pipe ends the shadow too, once it replayed the rest
+	go func() {
+		<-s.conn.Done()
+
+		s.mu.Lock()
+		s.end()
+		s.mu.Unlock()
+
+		time.AfterFunc(shadowLinger, func() { s.stop("") })
+	}()
+
+	// queued packets are let go whatever happens
+	defer func() {
+		for range s.packets {
+		}
+	}()
+
+	c, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		s.stop(err.Error())
+		return
+	}
+
+	c.SetDeadline(time.Now().Add(shadowLinger))
+	sc, chans, reqs, err := ssh.NewClientConn(c, s.addr, s.config)
+	if err != nil {
+		c.Close()
+		s.stop(err.Error())
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sc, chans, reqs)
+	defer client.Close()
+
+	s.mu.Lock()
+	if s.dropped {
+		s.mu.Unlock()
+		return
+	}
+	s.client = client
+	s.mu.Unlock()
+
+	s.d.logger.Printf("pipe of [%v] from [%v] shadowed to [%v]", s.conn.User(), s.conn.RemoteAddr(), s.addr)
+
+	// by downstream's id until upstream confirms, then by upstream's, the
+	// id downstream sends with
+	opening := make(map[uint32]ssh.Channel)
+	channels := make(map[uint32]ssh.Channel)
+
+	for packet := range s.packets {
+		if packet.fromUpstream {
+			var msg channelOpenConfirmMsg
+			if ssh.Unmarshal(packet.p, &msg) != nil {
+				continue
+			}
+
+			if ch, ok := opening[msg.PeersId]; ok {
+				delete(opening, msg.PeersId)
+				channels[msg.MyId] = ch
+			}
+			continue
+		}
+
+		if err := s.replay(client, packet.p, opening, channels); err != nil {
+			s.stop(err.Error())
+			return
+		}
+	}
+}
+
+// replay sends what downstream sent to the shadow, channels other than
+// sessions are left out
+func (s *shadow) replay(client *ssh.Client, p []byte, opening, channels map[uint32]ssh.Channel) error {
+	switch p[0] {
+	case msgChannelOpen:
+		var msg channelOpenMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil || msg.ChanType != "session" {
+			return nil
+		}
+
+		ch, reqs, err := client.OpenChannel("session", nil)
+		if err != nil {
+			return err
+		}
+
+		go ssh.DiscardRequests(reqs)
+		go io.Copy(ioutil.Discard, ch)
+		go io.Copy(ioutil.Discard, ch.Stderr())
+
+		opening[msg.PeersId] = ch
+
+	case msgChannelData:
+		var msg channelDataMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			return nil
+		}
+
+		if ch, ok := channels[msg.PeersId]; ok {
+			if _, err := ch.Write(msg.Data); err != nil {
+				return err
+			}
+		}
+
+	case msgChannelRequest:
+		var msg channelRequestMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			return nil
+		}
+
+		// upstream's reply is the one downstream gets
+		if ch, ok := channels[msg.PeersId]; ok {
+			ch.SendRequest(msg.Request, false, msg.RequestSpecificData)
+		}
+
+	case msgChannelEOF:
+		var msg channelEOFMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			return nil
+		}
+
+		if ch, ok := channels[msg.PeersId]; ok {
+			ch.CloseWrite()
+		}
+
+	case msgChannelClose:
+		var msg channelCloseMsg
+		if err := ssh.Unmarshal(p, &msg); err != nil {
+			return nil
+		}
+
+		if ch, ok := channels[msg.PeersId]; ok {
+			ch.Close()
+			delete(channels, msg.PeersId)
+		}
+	}
+
+	return nil
+}
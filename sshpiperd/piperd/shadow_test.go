@@ -0,0 +1,177 @@
+package piperd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// execUpstream accepts authorized, prints name for each command and sends
+// the command and its stdin to got
+func execUpstream(t *testing.T, key ssh.Signer, name string, got chan<- string, authorized ssh.PublicKey) net.Listener {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+
+	return serveUpstream(t, key, config, func(conn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+		for newCh := range chans {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+
+			go func() {
+				defer ch.Close()
+
+				for req := range reqs {
+					if req.Type != "exec" {
+						req.Reply(false, nil)
+						continue
+					}
+
+					var payload struct{ Command string }
+					ssh.Unmarshal(req.Payload, &payload)
+					req.Reply(true, nil)
+
+					stdin, _ := ioutil.ReadAll(ch)
+					got <- payload.Command + ":" + string(stdin)
+
+					ch.Write([]byte(name))
+					ch.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{0}))
+					return
+				}
+			}()
+		}
+	})
+}
+
+// shadowProvider names a shadow for every pipe
+type shadowProvider struct {
+	*upstream.Fake
+	shadow  string
+	hostKey ssh.PublicKey
+}
+
+func (p *shadowProvider) FindUpstream(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+	c, config, err := p.Fake.FindUpstream(conn)
+	if err != nil {
+		return c, config, err
+	}
+	uc := &upstream.Conn{Conn: c, Shadow: p.shadow}
+	if p.hostKey != nil {
+		uc.ShadowHostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !bytes.Equal(key.Marshal(), p.hostKey.Marshal()) {
+				return fmt.Errorf("host key mismatch")
+			}
+			return nil
+		}
+	}
+	return uc, config, nil
+}
+
+func TestShadow(t *testing.T) {
+	key := newTestSigner(t)
+	client, mapped := newTestSigner(t), newTestSigner(t)
+
+	primaryGot, shadowGot := make(chan string, 1), make(chan string, 1)
+
+	primary := execUpstream(t, key, "primary", primaryGot, mapped.PublicKey())
+	defer primary.Close()
+
+	shadowed := execUpstream(t, key, "shadow", shadowGot, mapped.PublicKey())
+	defer shadowed.Close()
+
+	// without a host key check nothing goes to the shadow
+	for _, hostKey := range []ssh.PublicKey{key.PublicKey(), nil} {
+		provider := &shadowProvider{
+			Fake:    &upstream.Fake{Addr: primary.Addr().String(), AuthorizedKeys: []ssh.PublicKey{client.PublicKey()}, Signer: mapped},
+			shadow:  shadowed.Addr().String(),
+			hostKey: hostKey,
+		}
+
+		d, err := New(WithProvider(provider), WithHostKey(key), WithShadowPercent(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go d.Serve(l)
+
+		c, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(client)},
+		})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer c.Close()
+
+		session, err := c.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		session.Stdin = strings.NewReader("input")
+		out, err := session.Output("cat")
+		if err != nil {
+			t.Fatalf("cat: %v", err)
+		}
+
+		// downstream sees the primary only
+		if string(out) != "primary" {
+			t.Errorf("output %q, want primary", out)
+		}
+
+		select {
+		case s := <-primaryGot:
+			if s != "cat:input" {
+				t.Errorf("primary got %q, want cat:input", s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("primary got nothing")
+		}
+
+		if hostKey == nil {
+			select {
+			case s := <-shadowGot:
+				t.Errorf("shadow without host key check got %q", s)
+			case <-time.After(200 * time.Millisecond):
+			}
+			continue
+		}
+
+		select {
+		case s := <-shadowGot:
+			if s != "cat:input" {
+				t.Errorf("shadow got %q, want cat:input", s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("shadow got nothing")
+		}
+	}
+}
+
+func TestShadowPercentZero(t *testing.T) {
+	d := &Daemon{}
+	piper := &ssh.SSHPiper{}
+
+	d.withShadow(piper)
+	if piper.FindUpstream != nil || piper.PacketFilter != nil {
+		t.Errorf("shadowing hooked in with 0 percent")
+	}
+}
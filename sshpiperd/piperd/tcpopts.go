@@ -0,0 +1,89 @@
+package piperd
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"syscall"
+	"time"
+)
+
+// withTCPOptions sets the socket options of upstream.Conn on the tcp conn
+// the provider dialed. Failing to set them is logged, the pipe goes on.
+func (d *Daemon) withTCPOptions(piper *ssh.SSHPiper) {
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if err != nil {
+			return c, config, err
+		}
+
+		uc, ok := c.(*upstream.Conn)
+		if !ok || (uc.TCPKeepalive == 0 && uc.DSCP == 0) {
+			return c, config, nil
+		}
+
+		// e.g. the local shell is not tcp
+		tc, ok := uc.Conn.(*net.TCPConn)
+		if !ok {
+			return c, config, nil
+		}
+
+		if err := setTCPOptions(tc, uc.TCPKeepalive, uc.DSCP); err != nil {
+			d.logger.Printf("tcp options of [%v]: %v", c.RemoteAddr(), err)
+		}
+
+		return c, config, nil
+	}
+}
+
+// setTCPOptions sets tcp keepalive, negative disables it, and the dscp of
+// packets sent, 0 keeps the system's default
+func setTCPOptions(c *net.TCPConn, keepalive time.Duration, dscp int) error {
+	switch {
+	case keepalive < 0:
+		if err := c.SetKeepAlive(false); err != nil {
+			return err
+		}
+	case keepalive > 0:
+		if err := c.SetKeepAlive(true); err != nil {
+			return err
+		}
+
+		if err := c.SetKeepAlivePeriod(keepalive); err != nil {
+			return err
+		}
+	}
+
+	if dscp == 0 {
+		return nil
+	}
+
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("dscp %d out of range 0-63", dscp)
+	}
+
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	// dscp is the upper 6 bits of tos, or traffic class for ipv6
+	v4 := c.RemoteAddr().(*net.TCPAddr).IP.To4() != nil
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if v4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
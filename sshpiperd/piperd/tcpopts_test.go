@@ -0,0 +1,50 @@
+package piperd
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSetTCPOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tc := c.(*net.TCPConn)
+	if err := setTCPOptions(tc, 30*time.Second, 46); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tos, keepalive int
+	raw.Control(func(fd uintptr) {
+		tos, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+		keepalive, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	})
+
+	if tos != 46<<2 {
+		t.Errorf("got tos %d, want %d", tos, 46<<2)
+	}
+
+	if keepalive == 0 {
+		t.Errorf("tcp keepalive not enabled")
+	}
+
+	if err := setTCPOptions(tc, 0, 64); err == nil {
+		t.Errorf("dscp 64 set")
+	}
+}
@@ -0,0 +1,181 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// UpstreamStats is the utilization of one upstream, by address, since the
+// daemon started
+type UpstreamStats struct {
+	Addr string `json:"addr"`
+
+	// bytes read from and written to upstream, handshakes included
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	// pipes established, piped now and the most piped at once
+	Sessions  int64 `json:"sessions"`
+	Active    int64 `json:"active"`
+	MaxActive int64 `json:"max_active"`
+
+	// of the last pipe, and how often the host key differed from the one
+	// before, a moved or replaced upstream
+	HostKey        string `json:"host_key,omitempty"`
+	ServerVersion  string `json:"server_version,omitempty"`
+	HostKeyChanges int64  `json:"host_key_changes"`
+}
+
+type upstreamRegistry struct {
+	mu        sync.Mutex
+	upstreams map[string]*upstreamCounters
+}
+
+type upstreamCounters struct {
+	addr string
+
+	// counted by upstreamConn, atomic
+	in  int64
+	out int64
+
+	// under the registry's mu
+	sessions  int64
+	active    int64
+	maxActive int64
+
+	hostKey        string
+	serverVersion  string
+	hostKeyChanges int64
+}
+
+func (r *upstreamRegistry) get(addr string) *upstreamCounters {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.upstreams == nil {
+		r.upstreams = make(map[string]*upstreamCounters)
+	}
+
+	u, ok := r.upstreams[addr]
+	if !ok {
+		u = &upstreamCounters{addr: addr}
+		r.upstreams[addr] = u
+	}
+
+	return u
+}
+
+func (r *upstreamRegistry) piped(u *upstreamCounters, delta int64, id *ssh.UpstreamIdentity) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if delta > 0 {
+		u.sessions++
+	}
+
+	if id != nil && id.HostKey != nil {
+		key := fingerprint(id.HostKey)
+		if u.hostKey != "" && u.hostKey != key {
+			u.hostKeyChanges++
+		}
+		u.hostKey, u.serverVersion = key, id.ServerVersion
+	}
+
+	u.active += delta
+	if u.active > u.maxActive {
+		u.maxActive = u.active
+	}
+}
+
+// upstreamConn counts bytes of the upstream leg
+type upstreamConn struct {
+	net.Conn
+	counters *upstreamCounters
+}
+
+func (c *upstreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.counters.in, int64(n))
+	return n, err
+}
+
+func (c *upstreamConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.counters.out, int64(n))
+	return n, err
+}
+
+// withUpstreamStats counts the pipe toward the upstream FindUpstream dials.
+// The conn is wrapped, so it goes after every feature looking at the conn
+// of the provider.
+func (d *Daemon) withUpstreamStats(piper *ssh.SSHPiper, identity *upstreamIdentity) {
+	var counters *upstreamCounters
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		c, config, err := findUpstream(conn)
+		if err != nil {
+			return c, config, err
+		}
+
+		// e.g. the local shell is not an upstream
+		if _, ok := c.RemoteAddr().(*net.TCPAddr); !ok {
+			return c, config, nil
+		}
+
+		counters = d.upstreams.get(c.RemoteAddr().String())
+		return &upstreamConn{c, counters}, config, nil
+	}
+
+	piped := false
+
+	phaseHook := piper.PhaseHook
+	piper.PhaseHook = func(conn net.Conn, phase ssh.PipePhase) {
+		if phaseHook != nil {
+			phaseHook(conn, phase)
+		}
+
+		switch {
+		case phase == ssh.PhasePiping && counters != nil:
+			piped = true
+			d.upstreams.piped(counters, 1, identity.get())
+		case phase == ssh.PhaseClosed && piped:
+			d.upstreams.piped(counters, -1, nil)
+		}
+	}
+}
+
+// UpstreamStats returns the utilization of every upstream piped to, by
+// address
+func (d *Daemon) UpstreamStats() []UpstreamStats {
+	d.upstreams.mu.Lock()
+	defer d.upstreams.mu.Unlock()
+
+	var addrs []string
+	for addr := range d.upstreams.upstreams {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var stats []UpstreamStats
+	for _, addr := range addrs {
+		u := d.upstreams.upstreams[addr]
+		stats = append(stats, UpstreamStats{
+			Addr:      u.addr,
+			BytesIn:   atomic.LoadInt64(&u.in),
+			BytesOut:  atomic.LoadInt64(&u.out),
+			Sessions:  u.sessions,
+			Active:    u.active,
+			MaxActive: u.maxActive,
+
+			HostKey:        u.hostKey,
+			ServerVersion:  u.serverVersion,
+			HostKeyChanges: u.hostKeyChanges,
+		})
+	}
+
+	return stats
+}
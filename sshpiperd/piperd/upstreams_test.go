@@ -0,0 +1,74 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamStats(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(WithProvider(&upstream.Fake{Addr: up.Addr().String()}), WithHostKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	var clients []*ssh.Client
+	for i := 0; i < 2; i++ {
+		client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{ssh.Password("pw")},
+		})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		clients = append(clients, client)
+	}
+
+	stats := d.UpstreamStats()
+	if len(stats) != 1 {
+		t.Fatalf("got stats %+v", stats)
+	}
+
+	s := stats[0]
+	if s.Addr != up.Addr().String() || s.Sessions != 2 || s.Active != 2 || s.MaxActive != 2 || s.BytesIn == 0 || s.BytesOut == 0 {
+		t.Errorf("got %+v", s)
+	}
+
+	if s.HostKey != fingerprint(key.PublicKey()) || s.ServerVersion == "" || s.HostKeyChanges != 0 {
+		t.Errorf("got identity %+v", s)
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+
+	for i := 0; ; i++ {
+		s = d.UpstreamStats()[0]
+		if s.Active == 0 {
+			break
+		}
+
+		if i > 100 {
+			t.Fatalf("active after close: %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if s.Sessions != 2 || s.MaxActive != 2 {
+		t.Errorf("got %+v after close", s)
+	}
+}
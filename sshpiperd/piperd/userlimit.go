@@ -0,0 +1,189 @@
+package piperd
+
+import (
+	"errors"
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+	"sync"
+	"time"
+)
+
+// errUserRateLimited is returned by FindUpstream for users who logged in or
+// failed to too often within a minute
+var errUserRateLimited = errors.New("user rate limited")
+
+// logins are counted within this window
+const userLimitWindow = time.Minute
+
+// WithUserLoginLimit refuses logins of a downstream user who failed auth
+// failed times or logged in succeeded times within the last minute, from
+// whatever ip, 0 for no limit. Credential stuffing spread across many ips is
+// still throttled per targeted account.
+func WithUserLoginLimit(failed, succeeded int) Option {
+	return func(d *Daemon) {
+		d.userLimit.failed = failed
+		d.userLimit.succeeded = succeeded
+	}
+}
+
+// userLimiter tracks recent logins by downstream user
+type userLimiter struct {
+	failed    int
+	succeeded int
+
+	mu    sync.Mutex
+	users map[string]*userLogins
+}
+
+// userLogins keeps the times of the last logins of a user, at most as many
+// as the limit
+type userLogins struct {
+	failed    []time.Time
+	succeeded []time.Time
+}
+
+func (l *userLimiter) enabled() bool {
+	return l.failed > 0 || l.succeeded > 0
+}
+
+// limited tells whether times holds max logins within the window
+func limited(times []time.Time, max int, now time.Time) bool {
+	return max > 0 && len(times) >= max && now.Sub(times[len(times)-max]) < userLimitWindow
+}
+
+// check returns which limit user reached, empty if none
+func (l *userLimiter) check(user string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := l.users[user]
+	if r == nil {
+		return ""
+	}
+
+	now := time.Now()
+	switch {
+	case limited(r.failed, l.failed, now):
+		return "failed"
+	case limited(r.succeeded, l.succeeded, now):
+		return "successful"
+	}
+
+	return ""
+}
+
+// record counts a login of user
+func (l *userLimiter) record(user string, success bool) {
+	max := l.failed
+	if success {
+		max = l.succeeded
+	}
+
+	if max <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.users == nil {
+		l.users = make(map[string]*userLogins)
+	}
+
+	r := l.users[user]
+	if r == nil {
+		r = &userLogins{}
+		l.users[user] = r
+
+		// users of a stuffing run would pile up
+		time.AfterFunc(userLimitWindow, func() { l.expire(user) })
+	}
+
+	times := &r.failed
+	if success {
+		times = &r.succeeded
+	}
+
+	*times = append(*times, time.Now())
+	if len(*times) > max {
+		*times = append((*times)[:0], (*times)[len(*times)-max:]...)
+	}
+}
+
+// expire forgets user once its last login left the window, or checks again
+// when it will
+func (l *userLimiter) expire(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := l.users[user]
+	if r == nil {
+		return
+	}
+
+	last := latest(r.failed, latest(r.succeeded, time.Time{}))
+	if left := userLimitWindow - time.Since(last); left > 0 {
+		time.AfterFunc(left, func() { l.expire(user) })
+		return
+	}
+
+	delete(l.users, user)
+}
+
+// latest returns the last of times if after t, t otherwise
+func latest(times []time.Time, t time.Time) time.Time {
+	if len(times) > 0 && times[len(times)-1].After(t) {
+		return times[len(times)-1]
+	}
+	return t
+}
+
+// withUserLimit refuses rate limited users before the provider is asked.
+// Every failed auth attempt counts, a connection reaching the limit with
+// them is closed.
+func (d *Daemon) withUserLimit(piper *ssh.SSHPiper, c net.Conn) {
+	if !d.userLimit.enabled() {
+		return
+	}
+
+	findUpstream := piper.FindUpstream
+	piper.FindUpstream = func(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+		if which := d.userLimit.check(conn.User()); which != "" {
+			d.logger.Printf("user [%v] from [%v] refused, too many %v logins within %v", conn.User(), conn.RemoteAddr(), which, userLimitWindow)
+			return nil, nil, errUserRateLimited
+		}
+
+		return findUpstream(conn)
+	}
+
+	var user string
+
+	authLog := piper.DownstreamConfig.AuthLogCallback
+	piper.DownstreamConfig.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
+		if authLog != nil {
+			authLog(conn, method, err)
+		}
+
+		user = conn.User()
+		if method == "none" || err == nil {
+			return
+		}
+
+		d.userLimit.record(conn.User(), false)
+		if d.userLimit.check(conn.User()) == "failed" {
+			d.logger.Printf("user [%v] from [%v] disconnected, too many failed logins within %v", conn.User(), conn.RemoteAddr(), userLimitWindow)
+			c.Close()
+		}
+	}
+
+	phaseHook := piper.PhaseHook
+	piper.PhaseHook = func(conn net.Conn, phase ssh.PipePhase) {
+		if phaseHook != nil {
+			phaseHook(conn, phase)
+		}
+
+		if phase == ssh.PhasePiping && user != "" {
+			d.userLimit.record(user, true)
+		}
+	}
+}
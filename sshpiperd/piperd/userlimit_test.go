@@ -0,0 +1,159 @@
+package piperd
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserLimiter(t *testing.T) {
+	l := userLimiter{failed: 2, succeeded: 3}
+
+	l.record("alice", false)
+	if which := l.check("alice"); which != "" {
+		t.Errorf("limited after 1 failure: %v", which)
+	}
+
+	l.record("alice", false)
+	if which := l.check("alice"); which != "failed" {
+		t.Errorf("check after 2 failures = %q, want failed", which)
+	}
+
+	if which := l.check("bob"); which != "" {
+		t.Errorf("bob limited by alice's failures: %v", which)
+	}
+
+	for i := 0; i < 3; i++ {
+		l.record("bob", true)
+	}
+	if which := l.check("bob"); which != "successful" {
+		t.Errorf("check after 3 logins = %q, want successful", which)
+	}
+
+	// only the last logins within the limit are kept
+	if n := len(l.users["bob"].succeeded); n != 3 {
+		t.Errorf("kept %d logins, want 3", n)
+	}
+	l.record("bob", true)
+	if n := len(l.users["bob"].succeeded); n != 3 {
+		t.Errorf("kept %d logins, want 3", n)
+	}
+
+	// logins out of the window no longer count
+	old := time.Now().Add(-2 * userLimitWindow)
+	for i := range l.users["alice"].failed {
+		l.users["alice"].failed[i] = old
+	}
+	if which := l.check("alice"); which != "" {
+		t.Errorf("limited by old failures: %v", which)
+	}
+
+	// forgotten once out of the window
+	l.expire("alice")
+	if _, ok := l.users["alice"]; ok {
+		t.Errorf("alice kept after her logins left the window")
+	}
+	l.expire("bob")
+	if _, ok := l.users["bob"]; !ok {
+		t.Errorf("bob forgotten with recent logins")
+	}
+}
+
+func TestUserLoginLimit(t *testing.T) {
+	key := newTestSigner(t)
+
+	up := testUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(
+		WithProvider(&upstream.Fake{Addr: up.Addr().String()}),
+		WithHostKey(key),
+		WithUserLoginLimit(2, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	dial := func(user, password string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User: user,
+			Auth: []ssh.AuthMethod{ssh.Password(password)},
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := dial("alice", "wrong"); err == nil {
+			t.Fatalf("Dial with a wrong password succeeded")
+		}
+	}
+
+	if which := d.userLimit.check("alice"); which != "failed" {
+		t.Fatalf("alice not limited after 2 failed logins: %q", which)
+	}
+
+	if _, err := dial("alice", "pw"); err == nil || !strings.Contains(err.Error(), "too many logins of alice") {
+		t.Errorf("Dial of limited alice got %v, want the rate limit message", err)
+	}
+
+	// other users are not limited by alice's failures
+	c, err := dial("bob", "pw")
+	if err != nil {
+		t.Fatalf("Dial bob: %v", err)
+	}
+	c.Close()
+
+}
+
+func TestUserLoginLimitAttempts(t *testing.T) {
+	key := newTestSigner(t)
+
+	// each key is mapped to one upstream refuses
+	var signers []ssh.Signer
+	var keys []ssh.PublicKey
+	for i := 0; i < 3; i++ {
+		s := newTestSigner(t)
+		signers = append(signers, s)
+		keys = append(keys, s.PublicKey())
+	}
+
+	up := keyUpstream(t, key)
+	defer up.Close()
+
+	d, err := New(
+		WithProvider(&upstream.Fake{Addr: up.Addr().String(), AuthorizedKeys: keys, Signer: key}),
+		WithHostKey(key),
+		WithUserLoginLimit(2, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Serve(l)
+
+	// every key tried counts, not the connection once closed
+	_, err = ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User: "carol",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+	})
+	if err == nil {
+		t.Fatalf("Dial with refused keys succeeded")
+	}
+	if which := d.userLimit.check("carol"); which != "failed" {
+		t.Errorf("carol not limited after failed keys of one connection: %q", which)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// how often the working dir is scanned for prewarm= targets and pools are
+// topped up, more often for a short max age
+const prewarmInterval = 10 * time.Second
+
+// prewarmPool keeps upstream connections of targets with prewarm=n dialed
+// ahead of logins. Only tcp is dialed, the ssh handshake belongs to the
+// pipe. Connections are replaced after maxAge, upstream sshd closes ones
+// idle for its LoginGraceTime.
+type prewarmPool struct {
+	maxAge time.Duration
+	dial   func(network, addr, bind string) (net.Conn, error)
+
+	// refresh is kicked when a connection is taken
+	kick chan struct{}
+
+	mu    sync.Mutex
+	want  map[prewarmKey]int
+	conns map[prewarmKey][]warmConn
+}
+
+type prewarmKey struct {
+	addr string
+	bind string
+}
+
+type warmConn struct {
+	net.Conn
+	dialed time.Time
+}
+
+func newPrewarmPool(maxAge time.Duration, dial func(network, addr, bind string) (net.Conn, error)) *prewarmPool {
+	return &prewarmPool{
+		maxAge: maxAge,
+		dial:   dial,
+		kick:   make(chan struct{}, 1),
+		want:   make(map[prewarmKey]int),
+		conns:  make(map[prewarmKey][]warmConn),
+	}
+}
+
+// get takes a pre-dialed connection to addr, nil if none is ready
+func (p *prewarmPool) get(addr, bind string) net.Conn {
+	k := prewarmKey{addr, bind}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.conns[k]) > 0 {
+		c := p.conns[k][0]
+		p.conns[k] = p.conns[k][1:]
+
+		if time.Since(c.dialed) < p.maxAge {
+			select {
+			case p.kick <- struct{}{}:
+			default:
+			}
+
+			return c.Conn
+		}
+
+		c.Close()
+	}
+
+	return nil
+}
+
+// setWanted replaces the targets kept warm, pools of others are closed
+func (p *prewarmPool) setWanted(want map[prewarmKey]int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for k, conns := range p.conns {
+		for len(conns) > want[k] {
+			conns[0].Close()
+			conns = conns[1:]
+		}
+		p.conns[k] = conns
+	}
+
+	p.want = want
+}
+
+// refresh replaces old connections and dials the missing ones
+func (p *prewarmPool) refresh() {
+	p.mu.Lock()
+	missing := make(map[prewarmKey]int)
+	for k, n := range p.want {
+		conns := p.conns[k]
+		for len(conns) > 0 && time.Since(conns[0].dialed) >= p.maxAge {
+			conns[0].Close()
+			conns = conns[1:]
+		}
+		p.conns[k] = conns
+
+		if n > len(conns) {
+			missing[k] = n - len(conns)
+		}
+	}
+	p.mu.Unlock()
+
+	for k, n := range missing {
+		for i := 0; i < n; i++ {
+			c, err := p.dial("tcp", k.addr, k.bind)
+			if err != nil {
+				logger.Printf("prewarm [%v]: %v", k.addr, err)
+				break
+			}
+
+			p.mu.Lock()
+			if len(p.conns[k]) < p.want[k] {
+				p.conns[k] = append(p.conns[k], warmConn{c, time.Now()})
+			} else {
+				c.Close()
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// loop scans the working dir for prewarm= targets and keeps them warm
+func (p *prewarmPool) loop() {
+	interval := prewarmInterval
+	if p.maxAge/2 < interval {
+		interval = p.maxAge / 2
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	p.setWanted(prewarmTargets())
+
+	for {
+		p.refresh()
+
+		select {
+		case <-t.C:
+			p.setWanted(prewarmTargets())
+		case <-p.kick:
+		}
+	}
+}
+
+// prewarmTargets returns targets with prewarm= in sshpiper_upstream files of
+// WorkingDir and tenants, the largest count wins for targets of several users
+func prewarmTargets() map[prewarmKey]int {
+	want := make(map[prewarmKey]int)
+
+	for _, w := range workingDirs() {
+		users, err := w.users()
+		if err != nil {
+			continue
+		}
+
+		for _, user := range users {
+			if w.checkPerm(UserUpstreamFile, user) != nil {
+				continue
+			}
+
+			data, err := w.read(UserUpstreamFile, user)
+			if err != nil {
+				continue
+			}
+
+			for _, t := range parseUpstreamFile(string(data)) {
+				// only tcp is kept dialed
+				if t.addr.transport != transportTCP {
+					continue
+				}
+
+				k := prewarmKey{t.addr.addr, t.bind}
+				if t.prewarm > want[k] {
+					want[k] = t.prewarm
+				}
+			}
+		}
+	}
+
+	return want
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"os"
+)
+
+func init() {
+	subCommands["scaffold"] = runScaffold
+}
+
+// bits of upstream keys scaffold generates
+const scaffoldKeyBits = 3072
+
+// scaffold sets up a user in one go: dir, sshpiper_upstream, the
+// downstream's authorized_keys and the key mapped to upstream, whose public
+// key is printed for upstream's authorized_keys
+func runScaffold(args []string) error {
+	fs := flag.NewFlagSet("scaffold", flag.ExitOnError)
+	upstreamAddr := fs.String("upstream", "", "Upstream address, e.g. host:port")
+	mapUser := fs.String("map-user", "", "Login upstream as this user, empty for the same user")
+	bind := fs.String("bind", "", "Local ip or interface to dial upstream from, empty for -upstream-bind")
+	authorizedKey := fs.String("authorized-key", "", "Public keys the user logs in with, in authorized_keys format, copied as "+string(UserAuthorizedKeysFile))
+	key := fs.String("key", "", "Private key used to login upstream, copied as "+string(UserKeyFile))
+	generate := fs.Bool("generate-upstream-key", false, "Generate the key used to login upstream, its public key is printed")
+
+	user, err := pipeUser(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *upstreamAddr == "" {
+		return fmt.Errorf("-upstream is required")
+	}
+
+	if _, err := parseUpstreamAddr(*upstreamAddr); err != nil {
+		return fmt.Errorf("-upstream: %v", err)
+	}
+
+	if *key != "" && *generate {
+		return fmt.Errorf("-key and -generate-upstream-key exclude each other")
+	}
+
+	dir := userDir(user)
+	if dir == "" {
+		return fmt.Errorf("no dir for %v in working dir layout %v", user, userWorkingDir(user).layout)
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("pipe for %v already exists at %v", user, dir)
+	}
+
+	// everything is read and checked before the dir is made, nothing is
+	// left behind on a bad file
+	var authorizedKeys []byte
+	if *authorizedKey != "" {
+		if authorizedKeys, err = ioutil.ReadFile(*authorizedKey); err != nil {
+			return err
+		}
+
+		keys, err := upstream.ParseAuthorizedKeys(authorizedKeys)
+		if err != nil {
+			return fmt.Errorf("%v: %v", *authorizedKey, err)
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("%v has no keys", *authorizedKey)
+		}
+	}
+
+	var keyData []byte
+	var signer ssh.Signer
+	switch {
+	case *key != "":
+		if keyData, err = ioutil.ReadFile(*key); err != nil {
+			return err
+		}
+
+		if signer, err = ssh.ParsePrivateKey(keyData); err != nil {
+			return fmt.Errorf("%v: %v", *key, err)
+		}
+	case *generate:
+		if keyData, signer, err = generateUpstreamKey(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	target := *upstreamAddr
+	if *mapUser != "" {
+		target = *mapUser + "@" + target
+	}
+
+	line := target
+	if *bind != "" {
+		line += " bind=" + *bind
+	}
+
+	files := []struct {
+		file userFile
+		data []byte
+	}{
+		{UserUpstreamFile, []byte(line + "\n")},
+		{UserAuthorizedKeysFile, authorizedKeys},
+		{UserKeyFile, keyData},
+	}
+
+	for _, f := range files {
+		if f.data == nil {
+			continue
+		}
+
+		if err := ioutil.WriteFile(f.file.realPath(user), f.data, 0400); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+
+	fmt.Printf("added pipe %v -> %v at %v\n", user, target, dir)
+
+	if *authorizedKey == "" {
+		fmt.Printf("no %v, add the keys %v logs in with\n", UserAuthorizedKeysFile, user)
+	}
+
+	if signer != nil {
+		fmt.Printf("add to authorized_keys of %v on the upstream:\n", target)
+		fmt.Printf("%s sshpiper-%v\n", bytes.TrimSpace(ssh.MarshalAuthorizedKey(signer.PublicKey())), user)
+	}
+
+	return nil
+}
+
+// generateUpstreamKey returns a new rsa key in pem, as id_rsa is read
+func generateUpstreamKey() ([]byte, ssh.Signer, error) {
+	k, err := rsa.GenerateKey(rand.Reader, scaffoldKeyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+	return data, signer, nil
+}
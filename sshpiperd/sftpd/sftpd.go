@@ -0,0 +1,767 @@
+// Package sftpd is a minimal SFTP version 3 server serving one local
+// directory, used by sshpiperd for pipes ending in a local dir instead of an
+// upstream sshd.
+//
+// Clients see Root as /, paths and symlinks leading out of it are refused.
+// Files are read and written as the daemon's user.
+package sftpd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// packet types, see draft-ietf-secsh-filexfer-02
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+)
+
+// status codes
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// open flags
+const (
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfAppend = 0x04
+	fxfCreat  = 0x08
+	fxfTrunc  = 0x10
+	fxfExcl   = 0x20
+)
+
+// attr flags
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+)
+
+const (
+	// larger packets are refused, OpenSSH sends 32KiB of data at most
+	maxPacket = 256 << 10
+	// data returned by one read at most
+	maxRead = 32 << 10
+	// entries returned by one readdir at most
+	maxNames = 100
+)
+
+var errBadMessage = errors.New("sftp: bad message")
+
+// Server serves Root over SFTP
+type Server struct {
+	Root string
+
+	// ReadOnly refuses every request changing files
+	ReadOnly bool
+}
+
+type handle struct {
+	file *os.File
+	// names not returned by readdir yet, nil for files
+	names []os.FileInfo
+	dir   bool
+}
+
+// Serve answers requests read from rw until it is closed, e.g. the channel
+// of an sftp subsystem
+func (s *Server) Serve(rw io.ReadWriter) error {
+	root, err := filepath.Abs(s.Root)
+	if err != nil {
+		return err
+	}
+
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+
+	c := &conn{
+		Server:  s,
+		root:    root,
+		rw:      rw,
+		handles: make(map[string]*handle),
+	}
+	defer c.closeHandles()
+
+	for {
+		typ, data, err := c.readPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if typ == fxpInit {
+			// no extensions
+			if err := c.writePacket(fxpVersion, u32(nil, 3)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		r := &reader{b: data}
+		id := r.u32()
+		if r.err != nil {
+			return errBadMessage
+		}
+
+		if err := c.handle(typ, id, r); err != nil {
+			return err
+		}
+	}
+}
+
+type conn struct {
+	*Server
+	root string
+	rw   io.ReadWriter
+
+	handles map[string]*handle
+	next    uint64
+}
+
+func (c *conn) readPacket() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.rw, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 1 || n > maxPacket {
+		return 0, nil, errBadMessage
+	}
+
+	data := make([]byte, n-1)
+	if _, err := io.ReadFull(c.rw, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+
+	return hdr[4], data, nil
+}
+
+func (c *conn) writePacket(typ byte, payload []byte) error {
+	p := u32(nil, uint32(len(payload)+1))
+	p = append(p, typ)
+	p = append(p, payload...)
+
+	_, err := c.rw.Write(p)
+	return err
+}
+
+func (c *conn) status(id uint32, code uint32, msg string) error {
+	p := u32(nil, id)
+	p = u32(p, code)
+	p = str(p, msg)
+	p = str(p, "")
+	return c.writePacket(fxpStatus, p)
+}
+
+// errStatus answers id with the status of err, OK for nil
+func (c *conn) errStatus(id uint32, err error) error {
+	switch {
+	case err == nil:
+		return c.status(id, fxOK, "")
+	case err == errBadMessage:
+		return c.status(id, fxBadMessage, err.Error())
+	case os.IsNotExist(err):
+		return c.status(id, fxNoSuchFile, "no such file")
+	case os.IsPermission(err):
+		return c.status(id, fxPermissionDenied, "permission denied")
+	}
+
+	// errors tell local paths, the client sees only the cause
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	} else if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+
+	return c.status(id, fxFailure, err.Error())
+}
+
+// local returns the local path of p, relative to root whatever p says.
+// Symlinks out of root are refused, as if the file did not exist.
+func (c *conn) local(p string) (string, error) {
+	full := filepath.Join(c.root, filepath.FromSlash(path.Clean("/"+p)))
+
+	// the last existing part decides, the rest may be created
+	check := full
+	for {
+		resolved, err := filepath.EvalSymlinks(check)
+		if err == nil {
+			if resolved != c.root && !strings.HasPrefix(resolved, c.root+string(filepath.Separator)) {
+				return "", os.ErrPermission
+			}
+			return full, nil
+		}
+
+		if !os.IsNotExist(err) || check == c.root {
+			return "", err
+		}
+		check = filepath.Dir(check)
+	}
+}
+
+func (c *conn) handle(typ byte, id uint32, r *reader) error {
+	if c.ReadOnly {
+		switch typ {
+		case fxpWrite, fxpSetstat, fxpFsetstat, fxpRemove, fxpMkdir, fxpRmdir, fxpRename:
+			return c.status(id, fxPermissionDenied, "read only")
+		}
+	}
+
+	switch typ {
+	case fxpOpen:
+		return c.open(id, r)
+	case fxpClose:
+		return c.close(id, r)
+	case fxpRead:
+		return c.read(id, r)
+	case fxpWrite:
+		return c.write(id, r)
+	case fxpLstat, fxpStat:
+		return c.stat(id, r, typ == fxpLstat)
+	case fxpFstat:
+		return c.fstat(id, r)
+	case fxpSetstat:
+		return c.setstat(id, r)
+	case fxpFsetstat:
+		return c.fsetstat(id, r)
+	case fxpOpendir:
+		return c.opendir(id, r)
+	case fxpReaddir:
+		return c.readdir(id, r)
+	case fxpRemove:
+		return c.pathOp(id, r, os.Remove)
+	case fxpRmdir:
+		return c.pathOp(id, r, os.Remove)
+	case fxpMkdir:
+		return c.mkdir(id, r)
+	case fxpRealpath:
+		return c.realpath(id, r)
+	case fxpRename:
+		return c.rename(id, r)
+	}
+
+	return c.status(id, fxOpUnsupported, "unsupported")
+}
+
+func (c *conn) addHandle(h *handle) string {
+	c.next++
+	name := strconv.FormatUint(c.next, 10)
+	c.handles[name] = h
+	return name
+}
+
+func (c *conn) closeHandles() {
+	for _, h := range c.handles {
+		h.file.Close()
+	}
+}
+
+func (c *conn) getHandle(r *reader) (*handle, bool) {
+	name := r.str()
+	if r.err != nil {
+		return nil, false
+	}
+
+	h, ok := c.handles[name]
+	return h, ok
+}
+
+func (c *conn) writeHandle(id uint32, name string) error {
+	return c.writePacket(fxpHandle, str(u32(nil, id), name))
+}
+
+func (c *conn) open(id uint32, r *reader) error {
+	p, pflags := r.str(), r.u32()
+	attrs := r.attrs()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+
+	if c.ReadOnly && pflags&(fxfWrite|fxfCreat|fxfTrunc|fxfAppend) != 0 {
+		return c.status(id, fxPermissionDenied, "read only")
+	}
+
+	local, err := c.local(p)
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	var flags int
+	switch {
+	case pflags&fxfRead != 0 && pflags&fxfWrite != 0:
+		flags = os.O_RDWR
+	case pflags&fxfWrite != 0:
+		flags = os.O_WRONLY
+	default:
+		flags = os.O_RDONLY
+	}
+
+	// writes come with their offset, O_APPEND would fail them
+	if pflags&fxfCreat != 0 {
+		flags |= os.O_CREATE
+	}
+	if pflags&fxfTrunc != 0 {
+		flags |= os.O_TRUNC
+	}
+	if pflags&fxfExcl != 0 {
+		flags |= os.O_EXCL
+	}
+
+	mode := os.FileMode(0644)
+	if attrs.flags&attrPermissions != 0 {
+		mode = os.FileMode(attrs.mode & 0777)
+	}
+
+	f, err := os.OpenFile(local, flags, mode)
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		f.Close()
+		return c.status(id, fxFailure, "is a directory")
+	}
+
+	return c.writeHandle(id, c.addHandle(&handle{file: f}))
+}
+
+func (c *conn) close(id uint32, r *reader) error {
+	name := r.str()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+
+	h, ok := c.handles[name]
+	if !ok {
+		return c.status(id, fxFailure, "invalid handle")
+	}
+
+	delete(c.handles, name)
+	return c.errStatus(id, h.file.Close())
+}
+
+func (c *conn) read(id uint32, r *reader) error {
+	h, ok := c.getHandle(r)
+	off, n := r.u64(), r.u32()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+	if !ok || h.dir {
+		return c.status(id, fxFailure, "invalid handle")
+	}
+
+	if n > maxRead {
+		n = maxRead
+	}
+
+	buf := make([]byte, n)
+	read, err := h.file.ReadAt(buf, int64(off))
+	if read == 0 && err == io.EOF {
+		return c.status(id, fxEOF, "")
+	}
+	if read == 0 && err != nil {
+		return c.errStatus(id, err)
+	}
+
+	p := u32(nil, id)
+	p = u32(p, uint32(read))
+	p = append(p, buf[:read]...)
+	return c.writePacket(fxpData, p)
+}
+
+func (c *conn) write(id uint32, r *reader) error {
+	h, ok := c.getHandle(r)
+	off, data := r.u64(), r.str()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+	if !ok || h.dir {
+		return c.status(id, fxFailure, "invalid handle")
+	}
+
+	_, err := h.file.WriteAt([]byte(data), int64(off))
+	return c.errStatus(id, err)
+}
+
+func (c *conn) stat(id uint32, r *reader, lstat bool) error {
+	p := r.str()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+
+	local, err := c.local(p)
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	var fi os.FileInfo
+	if lstat {
+		fi, err = os.Lstat(local)
+	} else {
+		fi, err = os.Stat(local)
+	}
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	return c.writePacket(fxpAttrs, fileAttrs(u32(nil, id), fi))
+}
+
+func (c *conn) fstat(id uint32, r *reader) error {
+	h, ok := c.getHandle(r)
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+	if !ok {
+		return c.status(id, fxFailure, "invalid handle")
+	}
+
+	fi, err := h.file.Stat()
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	return c.writePacket(fxpAttrs, fileAttrs(u32(nil, id), fi))
+}
+
+// setAttrs applies size, permissions and times, owners are left alone
+func setAttrs(local string, a attrs) error {
+	if a.flags&attrSize != 0 {
+		if err := os.Truncate(local, int64(a.size)); err != nil {
+			return err
+		}
+	}
+
+	if a.flags&attrPermissions != 0 {
+		if err := os.Chmod(local, os.FileMode(a.mode&0777)); err != nil {
+			return err
+		}
+	}
+
+	if a.flags&attrACModTime != 0 {
+		if err := os.Chtimes(local, time.Unix(int64(a.atime), 0), time.Unix(int64(a.mtime), 0)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *conn) setstat(id uint32, r *reader) error {
+	p := r.str()
+	a := r.attrs()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+
+	local, err := c.local(p)
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	return c.errStatus(id, setAttrs(local, a))
+}
+
+func (c *conn) fsetstat(id uint32, r *reader) error {
+	h, ok := c.getHandle(r)
+	a := r.attrs()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+	if !ok {
+		return c.status(id, fxFailure, "invalid handle")
+	}
+
+	return c.errStatus(id, setAttrs(h.file.Name(), a))
+}
+
+func (c *conn) opendir(id uint32, r *reader) error {
+	p := r.str()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+
+	local, err := c.local(p)
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	names, err := f.Readdir(-1)
+	if err != nil {
+		f.Close()
+		return c.errStatus(id, err)
+	}
+
+	return c.writeHandle(id, c.addHandle(&handle{file: f, names: names, dir: true}))
+}
+
+func (c *conn) readdir(id uint32, r *reader) error {
+	h, ok := c.getHandle(r)
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+	if !ok || !h.dir {
+		return c.status(id, fxFailure, "invalid handle")
+	}
+
+	if len(h.names) == 0 {
+		return c.status(id, fxEOF, "")
+	}
+
+	names := h.names
+	if len(names) > maxNames {
+		names = names[:maxNames]
+	}
+	h.names = h.names[len(names):]
+
+	p := u32(nil, id)
+	p = u32(p, uint32(len(names)))
+	for _, fi := range names {
+		p = str(p, fi.Name())
+		p = str(p, longName(fi))
+		p = fileAttrs(p, fi)
+	}
+
+	return c.writePacket(fxpName, p)
+}
+
+func (c *conn) pathOp(id uint32, r *reader, op func(string) error) error {
+	p := r.str()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+
+	local, err := c.local(p)
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	if local == c.root {
+		return c.status(id, fxPermissionDenied, "permission denied")
+	}
+
+	return c.errStatus(id, op(local))
+}
+
+func (c *conn) mkdir(id uint32, r *reader) error {
+	p := r.str()
+	a := r.attrs()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+
+	local, err := c.local(p)
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	mode := os.FileMode(0755)
+	if a.flags&attrPermissions != 0 {
+		mode = os.FileMode(a.mode & 0777)
+	}
+
+	return c.errStatus(id, os.Mkdir(local, mode))
+}
+
+func (c *conn) realpath(id uint32, r *reader) error {
+	p := r.str()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+
+	clean := path.Clean("/" + p)
+
+	out := u32(nil, id)
+	out = u32(out, 1)
+	out = str(out, clean)
+	out = str(out, clean)
+	out = u32(out, 0)
+	return c.writePacket(fxpName, out)
+}
+
+func (c *conn) rename(id uint32, r *reader) error {
+	from, to := r.str(), r.str()
+	if r.err != nil {
+		return c.errStatus(id, errBadMessage)
+	}
+
+	localFrom, err := c.local(from)
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	localTo, err := c.local(to)
+	if err != nil {
+		return c.errStatus(id, err)
+	}
+
+	// version 3 renames never overwrite
+	if _, err := os.Lstat(localTo); err == nil {
+		return c.status(id, fxFailure, "file exists")
+	}
+
+	return c.errStatus(id, os.Rename(localFrom, localTo))
+}
+
+// longName is fi as ls -l prints it, shown by clients listing a dir
+func longName(fi os.FileInfo) string {
+	return fmt.Sprintf("%s %4d %-8d %-8d %8d %s %s", fi.Mode(), 1, 0, 0, fi.Size(), fi.ModTime().Format("Jan _2 15:04"), fi.Name())
+}
+
+// fileAttrs appends the attrs of fi to p
+func fileAttrs(p []byte, fi os.FileInfo) []byte {
+	mode := uint32(fi.Mode().Perm())
+	switch {
+	case fi.IsDir():
+		mode |= 0040000
+	case fi.Mode()&os.ModeSymlink != 0:
+		mode |= 0120000
+	case fi.Mode().IsRegular():
+		mode |= 0100000
+	}
+
+	mtime := uint32(fi.ModTime().Unix())
+
+	p = u32(p, attrSize|attrPermissions|attrACModTime)
+	p = u64(p, uint64(fi.Size()))
+	p = u32(p, mode)
+	p = u32(p, mtime)
+	p = u32(p, mtime)
+	return p
+}
+
+type attrs struct {
+	flags        uint32
+	size         uint64
+	mode         uint32
+	atime, mtime uint32
+}
+
+// reader decodes a packet, err is set once it is short
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) u32() uint32 {
+	if len(r.b) < 4 {
+		r.err = errBadMessage
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *reader) u64() uint64 {
+	if len(r.b) < 8 {
+		r.err = errBadMessage
+		return 0
+	}
+
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *reader) str() string {
+	n := r.u32()
+	if r.err != nil || uint32(len(r.b)) < n {
+		r.err = errBadMessage
+		return ""
+	}
+
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+func (r *reader) attrs() attrs {
+	a := attrs{flags: r.u32()}
+
+	if a.flags&attrSize != 0 {
+		a.size = r.u64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		r.u32()
+		r.u32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.mode = r.u32()
+	}
+	if a.flags&attrACModTime != 0 {
+		a.atime, a.mtime = r.u32(), r.u32()
+	}
+	if a.flags&attrExtended != 0 {
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			r.str()
+			r.str()
+		}
+	}
+
+	return a
+}
+
+func u32(p []byte, v uint32) []byte {
+	return append(p, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func u64(p []byte, v uint64) []byte {
+	return u32(u32(p, uint32(v>>32)), uint32(v))
+}
+
+func str(p []byte, s string) []byte {
+	return append(u32(p, uint32(len(s))), s...)
+}
@@ -0,0 +1,203 @@
+package sftpd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testClient speaks just enough sftp for tests
+type testClient struct {
+	t  *testing.T
+	c  *conn
+	id uint32
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	client, server := net.Pipe()
+	go func() {
+		s.Serve(server)
+		server.Close()
+	}()
+
+	tc := &testClient{t: t, c: &conn{rw: client}}
+
+	if err := tc.c.writePacket(fxpInit, u32(nil, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	typ, data, err := tc.c.readPacket()
+	if err != nil || typ != fxpVersion || len(data) < 4 {
+		t.Fatalf("init: type %d, %v", typ, err)
+	}
+
+	return tc
+}
+
+// call sends a request and returns the reply after its id
+func (tc *testClient) call(typ byte, payload []byte) (byte, *reader) {
+	tc.id++
+	if err := tc.c.writePacket(typ, append(u32(nil, tc.id), payload...)); err != nil {
+		tc.t.Fatal(err)
+	}
+
+	rtyp, data, err := tc.c.readPacket()
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+
+	r := &reader{b: data}
+	if id := r.u32(); id != tc.id {
+		tc.t.Fatalf("reply to %d, want %d", id, tc.id)
+	}
+
+	return rtyp, r
+}
+
+// status returns the status code of a request answered with a status
+func (tc *testClient) status(typ byte, payload []byte) uint32 {
+	rtyp, r := tc.call(typ, payload)
+	if rtyp != fxpStatus {
+		tc.t.Fatalf("request %d answered with %d, want status", typ, rtyp)
+	}
+	return r.u32()
+}
+
+func (tc *testClient) handle(typ byte, payload []byte) string {
+	rtyp, r := tc.call(typ, payload)
+	if rtyp != fxpHandle {
+		tc.t.Fatalf("request %d answered with %d, want handle", typ, rtyp)
+	}
+	return r.str()
+}
+
+func TestServer(t *testing.T) {
+	root, err := ioutil.TempDir("", "sftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	tc := newTestClient(t, &Server{Root: root})
+
+	if code := tc.status(fxpMkdir, u32(str(nil, "/in"), 0)); code != fxOK {
+		t.Fatalf("mkdir: status %d", code)
+	}
+
+	h := tc.handle(fxpOpen, u32(u32(str(nil, "in/file"), fxfWrite|fxfCreat|fxfTrunc), 0))
+	if code := tc.status(fxpWrite, str(u64(str(nil, h), 0), "hello")); code != fxOK {
+		t.Fatalf("write: status %d", code)
+	}
+	if code := tc.status(fxpWrite, str(u64(str(nil, h), 5), " world")); code != fxOK {
+		t.Fatalf("write: status %d", code)
+	}
+	if code := tc.status(fxpClose, str(nil, h)); code != fxOK {
+		t.Fatalf("close: status %d", code)
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(root, "in", "file")); err != nil || string(data) != "hello world" {
+		t.Errorf("file on disk %q, %v", data, err)
+	}
+
+	// read back
+	h = tc.handle(fxpOpen, u32(u32(str(nil, "/in/file"), fxfRead), 0))
+	typ, r := tc.call(fxpRead, u32(u64(str(nil, h), 6), 100))
+	if data := r.str(); typ != fxpData || data != "world" {
+		t.Errorf("read got type %d %q, want world", typ, data)
+	}
+	if code := tc.status(fxpRead, u32(u64(str(nil, h), 11), 100)); code != fxEOF {
+		t.Errorf("read at end: status %d, want eof", code)
+	}
+	tc.status(fxpClose, str(nil, h))
+
+	typ, r = tc.call(fxpStat, str(nil, "/in/file"))
+	if a := r.attrs(); typ != fxpAttrs || a.size != 11 || a.mode&0100000 == 0 {
+		t.Errorf("stat got type %d %+v", typ, a)
+	}
+
+	// listing
+	h = tc.handle(fxpOpendir, str(nil, "/in"))
+	typ, r = tc.call(fxpReaddir, str(nil, h))
+	if n, name := r.u32(), r.str(); typ != fxpName || n != 1 || name != "file" {
+		t.Errorf("readdir got type %d, %d names, first %q", typ, n, name)
+	}
+	if code := tc.status(fxpReaddir, str(nil, h)); code != fxEOF {
+		t.Errorf("second readdir: status %d, want eof", code)
+	}
+	tc.status(fxpClose, str(nil, h))
+
+	if code := tc.status(fxpRename, str(str(nil, "/in/file"), "/in/renamed")); code != fxOK {
+		t.Errorf("rename: status %d", code)
+	}
+	if code := tc.status(fxpRemove, str(nil, "/in/renamed")); code != fxOK {
+		t.Errorf("remove: status %d", code)
+	}
+	if code := tc.status(fxpRmdir, str(nil, "/in")); code != fxOK {
+		t.Errorf("rmdir: status %d", code)
+	}
+
+	typ, r = tc.call(fxpRealpath, str(nil, "../../a/./b/.."))
+	if n, name := r.u32(), r.str(); typ != fxpName || n != 1 || name != "/a" {
+		t.Errorf("realpath got type %d, %d names, %q, want /a", typ, n, name)
+	}
+
+	if code := tc.status(fxpRemove, str(nil, "/")); code != fxPermissionDenied {
+		t.Errorf("remove of root: status %d, want permission denied", code)
+	}
+}
+
+func TestServerConfined(t *testing.T) {
+	base, err := ioutil.TempDir("", "sftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	root := filepath.Join(base, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(base, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(base, filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	tc := newTestClient(t, &Server{Root: root})
+
+	// .. stops at root
+	if code := tc.status(fxpOpen, u32(u32(str(nil, "../secret"), fxfRead), 0)); code != fxNoSuchFile {
+		t.Errorf("open ../secret: status %d, want no such file", code)
+	}
+
+	if code := tc.status(fxpOpen, u32(u32(str(nil, "/out/secret"), fxfRead), 0)); code != fxPermissionDenied {
+		t.Errorf("open through a symlink out of root: status %d, want permission denied", code)
+	}
+
+	if code := tc.status(fxpOpen, u32(u32(str(nil, "/out/new"), fxfWrite|fxfCreat), 0)); code != fxPermissionDenied {
+		t.Errorf("create through a symlink out of root: status %d, want permission denied", code)
+	}
+}
+
+func TestServerReadOnly(t *testing.T) {
+	root, err := ioutil.TempDir("", "sftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	tc := newTestClient(t, &Server{Root: root, ReadOnly: true})
+
+	if code := tc.status(fxpOpen, u32(u32(str(nil, "/file"), fxfWrite|fxfCreat), 0)); code != fxPermissionDenied {
+		t.Errorf("open for write: status %d, want permission denied", code)
+	}
+
+	if code := tc.status(fxpMkdir, u32(str(nil, "/dir"), 0)); code != fxPermissionDenied {
+		t.Errorf("mkdir: status %d, want permission denied", code)
+	}
+}
@@ -1,16 +1,27 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/audit"
 	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"github.com/tg123/sshpiper/sshpiperd/password"
+	"github.com/tg123/sshpiper/sshpiperd/piperd"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
 )
 
 type userFile string
@@ -18,89 +29,838 @@ type userFile string
 var (
 	UserAuthorizedKeysFile userFile = "authorized_keys"
 	UserKeyFile            userFile = "id_rsa"
+	UserCertFile           userFile = "id_rsa-cert.pub"
 	UserUpstreamFile       userFile = "sshpiper_upstream"
+	UserKnownHostsFile     userFile = "known_hosts"
+	UserTOTPFile           userFile = "sshpiper_totp"
 )
 
 var (
-	ListenAddr   string
-	Port         uint
-	WorkingDir   string
-	PiperKeyFile string
-	ShowHelp     bool
-	Challenger   string
+	ListenAddr       string
+	Port             uint
+	WorkingDir       string
+	WorkingDirLayout string
+	PiperKeyFile     string
+	ShowHelp         bool
+	Challenger       string
+	Provider         string
+	MaxConn          uint
+	Backlog          uint
+	MaxBuffer        int
+
+	LoginGraceTime time.Duration
+	Timeouts       string
+	MetricsAddr    string
+
+	ClientAliveInterval time.Duration
+	ClientAliveCountMax int
+
+	MinRSABits   int
+	DenyKeyTypes string
+	AuthMethods  string
+	UpstreamAuth string
+
+	PasswordPrompt   string
+	PasswordVerifier string
+	LDAPPlaintext    bool
+	ClientEnv        bool
+	AuthTrace        bool
+
+	HostbasedKnownHosts string
+	HostbasedKeyFile    string
+	HostbasedName       string
+
+	OnConnect     string
+	OnClose       string
+	AuditSink     string
+	AuditQueue    string
+	AuditQueueMax int
+	MOTDFile      string
+
+	BannerFile    string
+	ListenersFile string
+	TenantsFile   string
+
+	MessagesFile string
+
+	PermMax        string
+	PermHostKeyMax string
+	PermOwner      string
+	PermIgnore     bool
+
+	QuotaFile    string
+	QuotaDaily   int64
+	QuotaMonthly int64
+
+	RateLimit int64
+	RateBurst int64
+
+	PassthroughFile string
+	ProxyProtocol   bool
+	DialAfterAuth   bool
+	Lockdown        bool
+
+	DNSServer    string
+	DNSCacheTTL  time.Duration
+	UpstreamBind string
+
+	UpstreamKeepalive time.Duration
+	DuplicateSessions string
+
+	UpstreamCA           string
+	UpstreamCAPrincipals string
+	upstreamCA           *upstream.HostCA
+
+	CertRulesFile string
+	CertRulesCA   string
+
+	ProbeBanAfter int
+	ProbeBanTime  time.Duration
+	Anomalies     string
+
+	UserMaxFailedLogins int
+	UserMaxLogins       int
+
+	ShadowPercent int
+
+	AdminAddr      string
+	AdminTokenFile string
+	Observe        bool
+
+	LocalShellUser    string
+	LocalShellKeys    string
+	LocalShellCommand string
+
+	upstreamDNS *upstreamDialer
+
+	PrewarmMaxAge time.Duration
+	upstreamPool  *prewarmPool
+
+	DrainTimeout time.Duration
+
+	ApprovalURL        string
+	ApprovalTokenFile  string
+	ApprovalSecretFile string
+	ApprovalTimeout    time.Duration
+
+	TOTPEnroll bool
+	TOTPIssuer string
 
 	logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+
+	// subcommands, e.g. sshpiperd bench, args after the name are passed in
+	subCommands = make(map[string]func(args []string) error)
 )
 
 func init() {
 	flag.StringVar(&ListenAddr, "l", "0.0.0.0", "Listening Address")
 	flag.UintVar(&Port, "p", 2222, "Listening Port")
 	flag.StringVar(&WorkingDir, "w", "/var/sshpiper", "Working Dir")
+	flag.StringVar(&WorkingDirLayout, "w-layout", "%d/%u", "Dir of each user in Working Dir, %d the Working Dir, %u the user, %u[i:j] part of it, %{domain} what follows @ in it")
 	flag.StringVar(&PiperKeyFile, "i", "/etc/ssh/ssh_host_rsa_key", "Key file for SSH Piper")
 	flag.StringVar(&Challenger, "c", "", "Additional challenger name, e.g. pam, emtpy for no additional challenge")
+	flag.StringVar(&Provider, "u", "workingdir", "Upstream provider name")
+	flag.UintVar(&MaxConn, "max-conn", 1024, "Max connections served at the same time")
+	flag.UintVar(&Backlog, "backlog", 128, "Accepted connections waiting for a free slot, connections beyond are refused")
+	flag.StringVar(&PassthroughFile, "passthrough", "", "Raw tcp passthrough rules file, empty for none")
+	flag.BoolVar(&ProxyProtocol, "proxy-protocol", false, "Read PROXY protocol v1 header from every connection")
+	flag.BoolVar(&DialAfterAuth, "dial-after-auth", false, "Dial upstream only after downstream signed with a mapped key or a password -password-verifier maps to one, and passed the additional challenge, other password users cannot login")
+	flag.BoolVar(&ClientEnv, "client-env", false, "Send upstream the client address and connection id as SSHPIPER_CLIENT and SSHPIPER_CONN env before each session, set if upstream's AcceptEnv allows")
+	flag.BoolVar(&Lockdown, "lockdown", false, "Start locked down, refusing every new login, SIGUSR1 or the admin api toggles it")
+	flag.StringVar(&DNSServer, "resolver", "", "DNS server host:port for upstream lookups, empty for system default")
+	flag.DurationVar(&DNSCacheTTL, "dns-cache-ttl", 5*time.Minute, "Max time to cache upstream lookups, shorter dns ttl wins, 0 to disable cache")
+	flag.DurationVar(&UpstreamKeepalive, "upstream-keepalive", 0, "Send upstream a keepalive after it was silent this long, whatever downstream does, 0 for none")
+	flag.DurationVar(&PrewarmMaxAge, "prewarm-max-age", time.Minute, "Pre-dialed upstream connections of prewarm= targets older than this are replaced, keep below upstream's LoginGraceTime, 0 to disable")
+	flag.StringVar(&DuplicateSessions, "duplicate-sessions", "allow", "When a user opens a second pipe to the same upstream: allow, deny it or takeover closing the older one")
+	flag.IntVar(&ProbeBanAfter, "probe-ban-after", 0, "Ban an ip after this many connections failed before key exchange within -probe-ban-time, 0 to never ban")
+	flag.DurationVar(&DrainTimeout, "drain-timeout", time.Hour, "After SIGUSR2 hands the listening sockets to a new binary, longest wait for pipes to end before exiting, 0 for no limit")
+	flag.IntVar(&UserMaxFailedLogins, "user-max-failed-logins", 0, "Refuse a downstream user after this many failed logins within a minute, from any ip, 0 for no limit")
+	flag.IntVar(&UserMaxLogins, "user-max-logins", 0, "Refuse a downstream user after this many successful logins within a minute, from any ip, 0 for no limit")
+	flag.DurationVar(&ProbeBanTime, "probe-ban-time", 10*time.Minute, "How long ips are banned for probing, and the window probes are counted in")
+	flag.StringVar(&Anomalies, "anomalies", "", "When a peer strays from the protocol, e.g. floods banners: log, terminate the connection or ban its ip as -probe-ban-time tells, empty to not check")
+	flag.IntVar(&ShadowPercent, "shadow-percent", 0, "Experimental, percent of pipes to upstreams with shadow= whose input is mirrored to the shadow, 0 for none")
+	flag.StringVar(&CertRulesFile, "cert-rules", "", "Rules routing downstream user certificates by principal to pipes and upstream users, needs -dial-after-auth, empty for none")
+	flag.StringVar(&CertRulesCA, "cert-rules-ca", "", "File of ca keys trusted to sign downstream user certificates -cert-rules route")
+	flag.StringVar(&UpstreamCA, "upstream-ca", "", "File of ca keys trusted to sign upstream host certificates of users without known_hosts, empty for none")
+	flag.StringVar(&UpstreamCAPrincipals, "upstream-ca-principals", "", "Comma separated patterns one principal of an upstream host certificate must match, empty for the host dialed")
+	flag.StringVar(&UpstreamBind, "upstream-bind", "", "Local ip or interface upstream connections are made from, empty for any")
+	flag.IntVar(&MaxBuffer, "max-buffer", 1<<20, "Max bytes buffered for both legs of a pipe together before reading from them stops")
+	flag.DurationVar(&LoginGraceTime, "login-grace-time", 2*time.Minute, "Time allowed for handshakes and auth on both legs, 0 for no limit")
+	flag.StringVar(&Timeouts, "timeouts", "", "Timeouts of login stages, comma separated stage=duration of "+strings.Join(timeoutStages, ", "))
+	flag.DurationVar(&ClientAliveInterval, "client-alive-interval", 0, "Probe downstream after it was silent this long, 0 for no probes")
+	flag.IntVar(&ClientAliveCountMax, "client-alive-count-max", 3, "Unanswered probes before downstream is disconnected, 0 to never disconnect")
+	flag.IntVar(&MinRSABits, "min-rsa-bits", 0, "Downstream rsa keys shorter than this are rejected, 0 for any")
+	flag.StringVar(&UpstreamAuth, "upstream-auth", "", "Comma separated auth methods tried toward upstream in this order, e.g. certificate,publickey, others are never relayed, empty for what downstream sends")
+	flag.StringVar(&PasswordPrompt, "password-prompt", "", "Answer keyboard-interactive from downstream with this prompt and relay the answer to upstream as password, empty to relay keyboard-interactive as is")
+	flag.StringVar(&PasswordVerifier, "password-verifier", "", "Check downstream passwords in sshpiperd and login upstream with the user's "+string(UserKeyFile)+" instead, htpasswd:<file>, ldap[s]://<host>/<bind dn with %s for the user> or pam, empty to relay passwords")
+	flag.BoolVar(&LDAPPlaintext, "ldap-plaintext", false, "Allow ldap:// password verifiers, which send passwords to the ldap server in cleartext")
+	flag.StringVar(&DenyKeyTypes, "deny-key-types", "", "Comma separated downstream key types rejected, e.g. ssh-dss")
+	flag.BoolVar(&AuthTrace, "auth-trace", false, "Log every state upstream auth of a connection enters and the packet type which led there, verbose")
+	flag.StringVar(&AuthMethods, "auth-methods", "", "Comma separated auth methods listed to downstream in this order, if upstream offers them, empty for upstream's list")
+	flag.StringVar(&HostbasedKnownHosts, "hostbased-known-hosts", "", "known_hosts of client hosts trusted for hostbased auth, empty to disable hostbased relay")
+	flag.StringVar(&HostbasedKeyFile, "hostbased-key", "", "Key file signing hostbased auth toward upstream, empty for the -i key")
+	flag.StringVar(&HostbasedName, "hostbased-name", "", "Client host name sent upstream in hostbased auth, empty for the system host name")
+	flag.StringVar(&AdminAddr, "admin", "", "Serve the admin api of temporary pipes at http://[addr]/pipes, empty to disable")
+	flag.StringVar(&AdminTokenFile, "admin-token-file", "", "File holding the bearer token of the admin api, checked as user files are")
+	flag.BoolVar(&Observe, "observe", false, "Let admin api clients list live sessions and watch their output read-only")
+	flag.StringVar(&LocalShellUser, "local-shell-user", "", "Downstream user piped to -local-shell-command on this host instead of an upstream, empty to disable")
+	flag.StringVar(&LocalShellKeys, "local-shell-keys", "", "authorized_keys of the local shell user, other auth methods are refused")
+	flag.StringVar(&ApprovalURL, "approval-url", "", "Webhook the approval challenger files requests at, required with -c approval")
+	flag.StringVar(&ApprovalTokenFile, "approval-token-file", "", "File holding the bearer token sent to -approval-url, checked as user files are, empty for none")
+	flag.StringVar(&ApprovalSecretFile, "approval-secret-file", "", "File holding the secret signing calls of -approval-url and verifying its answers, checked as user files are, empty for unsigned")
+	flag.DurationVar(&ApprovalTimeout, "approval-timeout", 5*time.Minute, "Longest time an approval request may stay pending")
+	flag.BoolVar(&TOTPEnroll, "totp-enroll", false, "Let the first login of a user without a totp secret enroll one, needs -dial-after-auth, only while users are rolled out")
+	flag.StringVar(&TOTPIssuer, "totp-issuer", "sshpiper", "Issuer authenticator apps show for totp secrets")
+	flag.StringVar(&LocalShellCommand, "local-shell-command", "", "Command run for the local shell user, the requested command in SSH_ORIGINAL_COMMAND, required with -local-shell-user")
+	flag.StringVar(&MetricsAddr, "metrics", "", "Serve metrics at http://[addr]/debug/vars, empty to disable")
+	flag.StringVar(&OnConnect, "on-connect", "", "Command run by sh when a connection is established, details in SSHPIPER_* env")
+	flag.StringVar(&OnClose, "on-close", "", "Command run by sh when an established connection is closed, details in SSHPIPER_* env")
+	flag.StringVar(&AuditSink, "audit", "", "Audit sink of connection, auth and session events as name:target, e.g. file:/var/log/sshpiper/audit.json, empty to disable")
+	flag.StringVar(&AuditQueue, "audit-queue", "", "Dir spooling audit events while the sink fails, sent in order with retries, empty to send directly")
+	flag.IntVar(&AuditQueueMax, "audit-queue-max", 100000, "Audit events spooled at most, more are dropped and counted")
+	flag.StringVar(&BannerFile, "banner", "", "File sent to downstream before auth, empty for none")
+	flag.StringVar(&ListenersFile, "listeners", "", "File of extra listeners with their own host keys, banner and crypto, empty for none")
+	flag.StringVar(&TenantsFile, "tenants", "", "File of tenants with working dirs of their own, picked by listener or user domain, empty for none")
+	flag.StringVar(&MOTDFile, "motd", "", "File printed to downstream when a shell starts, empty for none")
+	flag.StringVar(&MessagesFile, "messages", "", "File of messages shown to clients disconnected during auth, empty for defaults")
+	flag.StringVar(&QuotaFile, "quota-file", "", "File keeping transfer quota usage across restarts, empty for memory only")
+	flag.Int64Var(&QuotaDaily, "quota-daily", 0, "Bytes each user may transfer per day, 0 for no limit")
+	flag.Int64Var(&QuotaMonthly, "quota-monthly", 0, "Bytes each user may transfer per month, 0 for no limit")
+	flag.Int64Var(&RateLimit, "rate-limit", 0, "Bytes per second each pipe may transfer each way, rate= in sshpiper_upstream overrides it, 0 for no limit")
+	flag.Int64Var(&RateBurst, "rate-burst", 0, "Bytes a pipe may transfer at once after it was idle, 0 for one second of -rate-limit")
+	flag.StringVar(&PermMax, "perm-max", "0400", "Mode bits user files may have, octal, 0600 rejects group and world readable files only")
+	flag.StringVar(&PermHostKeyMax, "perm-host-key-max", "0600", "Mode bits host keys may have, octal")
+	flag.StringVar(&PermOwner, "perm-owner", "", "User name or uid owning user files and host keys, empty for any")
+	flag.BoolVar(&PermIgnore, "perm-ignore", false, "Skip mode and owner checks, e.g. on bind mounts whose modes cannot be set")
 	flag.BoolVar(&ShowHelp, "h", false, "Print help and exit")
 	flag.Parse()
 }
 
-func userSpecFile(user, file string) string {
-	return fmt.Sprintf("%s/%s/%s", WorkingDir, user, file)
+// file is the path of file of user in w, empty if user has no dir
+func (w workingDir) file(file userFile, user string) string {
+	dir := w.userDir(user)
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, string(file))
+}
+
+func (w workingDir) read(file userFile, user string) ([]byte, error) {
+	return ioutil.ReadFile(w.file(file, user))
+}
+
+// return error if missing or not as -perm-max and -perm-owner want
+func (w workingDir) checkPerm(file userFile, user string) error {
+	return upstream.CheckPerm(w.file(file, user))
 }
 
+// user files in the working dir of user's tenant, as subcommands manage
+// them, the daemon picks the same dir for users with a domain
+
 func (file userFile) read(user string) ([]byte, error) {
-	return ioutil.ReadFile(userSpecFile(user, string(file)))
+	return userWorkingDir(user).read(file, user)
 }
 
 func (file userFile) realPath(user string) string {
-	return userSpecFile(user, string(file))
+	return userWorkingDir(user).file(file, user)
+}
+
+func (file userFile) checkPerm(user string) error {
+	return userWorkingDir(user).checkPerm(file, user)
+}
+
+// workingDirProvider finds upstreams and keys from files in WorkingDir, or
+// in the working dir of the tenant a connection belongs to, see -tenants
+type workingDirProvider struct{}
+
+func init() {
+	upstream.Register("workingdir", workingDirProvider{})
+}
+
+func (workingDirProvider) FindUpstream(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+	return findUpstreamFromUserfile(tenantWorkingDir(conn), conn)
+}
+
+// Targets offers every line in sshpiper_upstream in the menu
+func (workingDirProvider) Targets(conn ssh.ConnMetadata) ([]string, error) {
+	targets, err := readUpstreamTargets(tenantWorkingDir(conn), conn.User())
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, t := range targets {
+		names = append(names, t.name)
+	}
+
+	return names, nil
+}
+
+func (workingDirProvider) FindTarget(conn ssh.ConnMetadata, name string) (net.Conn, *ssh.ClientConfig, error) {
+	w := tenantWorkingDir(conn)
+
+	targets, err := readUpstreamTargets(w, conn.User())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, t := range targets {
+		if t.name == name {
+			return dialUpstreamTarget(w, conn.User(), t)
+		}
+	}
+
+	return nil, nil, fmt.Errorf("no upstream %v for user %v", name, conn.User())
 }
 
-// return error if not 400, nil if 400 and no err occurs
-func (file userFile) check400(user string) error {
-	filename := userSpecFile(user, string(file))
-	f, err := os.Open(filename)
+// Check parses the files of every user in WorkingDir and the working dirs
+// of -tenants, perms are left to dumpconfig
+func (workingDirProvider) Check() error {
+	list, err := getTenants()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	fi, err := f.Stat()
+	dirs := []workingDir{defaultWorkingDir()}
+	for _, t := range list {
+		dirs = append(dirs, t.workingDir)
+	}
+
+	for _, w := range dirs {
+		if err := checkWorkingDir(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkWorkingDir(w workingDir) error {
+	users, err := w.users()
 	if err != nil {
 		return err
 	}
 
-	if fi.Mode().Perm() != 0400 {
-		return fmt.Errorf("%v's perm is too open, change it to 400", filename)
+	for _, user := range users {
+		data, err := w.read(UserUpstreamFile, user)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(parseUpstreamFile(string(data))) == 0 {
+			return fmt.Errorf("%v is empty", w.file(UserUpstreamFile, user))
+		}
+
+		if data, err := w.read(UserAuthorizedKeysFile, user); err == nil {
+			if _, err := upstream.ParseAuthorizedKeys(data); err != nil {
+				return fmt.Errorf("%v: %v", w.file(UserAuthorizedKeysFile, user), err)
+			}
+		}
+
+		if data, err := w.read(UserKnownHostsFile, user); err == nil {
+			if _, err := upstream.ParseKnownHosts(data); err != nil {
+				return fmt.Errorf("%v: %v", w.file(UserKnownHostsFile, user), err)
+			}
+		}
+
+		data, err = w.read(UserKeyFile, user)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		key, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return fmt.Errorf("%v: %v", w.file(UserKeyFile, user), err)
+		}
+
+		if _, err := os.Stat(w.file(UserCertFile, user)); err == nil {
+			if _, err := readCertSigner(w.file(UserCertFile, user), key); err != nil {
+				return fmt.Errorf("%v: %v", w.file(UserCertFile, user), err)
+			}
+		}
 	}
 
 	return nil
 }
 
-func findUpstreamFromUserfile(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+func (workingDirProvider) MapPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
+	return mapPublicKeyFromUserfile(tenantWorkingDir(conn), conn, key)
+}
+
+// MapPassword logs in users with an id_rsa by it once -password-verifier
+// verified their password, or -cert-rules routed their certificate to the
+// user's pipe, others are relayed the password
+func (workingDirProvider) MapPassword(conn ssh.ConnMetadata) (ssh.Signer, error) {
+	w := tenantWorkingDir(conn)
 	user := conn.User()
 
-	err := UserUpstreamFile.check400(user)
+	if _, err := os.Stat(w.file(UserKeyFile, user)); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	private, err := upstream.ReadPrivateKeyFile(w.file(UserKeyFile, user))
 	if err != nil {
-		return nil, nil, err
+		logger.Printf("mapping private key error: %v, password auth denied for [%v] from [%v]", err, user, conn.RemoteAddr())
+		return nil, err
 	}
 
-	addr, err := UserUpstreamFile.read(user)
+	// a certificate of the key is tried first, see -upstream-auth
+	if _, err := os.Stat(w.file(UserCertFile, user)); err == nil {
+		if private, err = readCertSigner(w.file(UserCertFile, user), private); err != nil {
+			return nil, err
+		}
+	}
+
+	return private, nil
+}
+
+// getProvider returns the provider selected by -u
+func getProvider() (upstream.Provider, error) {
+	p, err := upstream.GetProvider(Provider)
 	if err != nil {
-		return nil, nil, err
+		return nil, fmt.Errorf("%v, available: %v", err, upstream.Providers())
+	}
+
+	return p, nil
+}
+
+// getAuditSink splits -audit into the sink name and its target
+func getAuditSink() (name, target string, err error) {
+	kv := strings.SplitN(AuditSink, ":", 2)
+	if len(kv) != 2 {
+		return "", "", fmt.Errorf("audit: want <sink>:<target>, got %v", AuditSink)
+	}
+
+	for _, s := range audit.Sinks() {
+		if s == kv[0] {
+			return kv[0], kv[1], nil
+		}
+	}
+
+	return "", "", fmt.Errorf("no such audit sink: %v, available: %v", kv[0], audit.Sinks())
+}
+
+// getPermPolicy returns the policy of -perm-* flags
+func getPermPolicy() (upstream.PermPolicy, error) {
+	p := upstream.PermPolicy{Owner: -1, Ignore: PermIgnore}
+
+	mode, err := strconv.ParseUint(PermMax, 8, 32)
+	if err != nil || mode > 0777 {
+		return p, fmt.Errorf("perm-max: want octal mode, got %v", PermMax)
+	}
+	p.MaxMode = os.FileMode(mode)
+
+	mode, err = strconv.ParseUint(PermHostKeyMax, 8, 32)
+	if err != nil || mode > 0777 {
+		return p, fmt.Errorf("perm-host-key-max: want octal mode, got %v", PermHostKeyMax)
 	}
+	p.HostKeyMaxMode = os.FileMode(mode)
 
-	saddr := strings.TrimSpace(string(addr))
+	if PermOwner != "" {
+		uid := PermOwner
+		if u, err := user.Lookup(PermOwner); err == nil {
+			uid = u.Uid
+		}
+
+		if p.Owner, err = strconv.Atoi(uid); err != nil {
+			return p, fmt.Errorf("perm-owner: no such user %v", PermOwner)
+		}
+	}
+
+	return p, nil
+}
+
+// readSecretFile reads a token or secret from file, checked as user files
+// are, empty file for none
+func readSecretFile(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+
+	if err := upstream.CheckPerm(file); err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("%v is empty", file)
+	}
+
+	return secret, nil
+}
+
+// setupApproval hands the approval flags to the challenger, the token and
+// secret are read from files so they do not show in ps
+func setupApproval() (err error) {
+	challenger.ApprovalURL = ApprovalURL
+	challenger.ApprovalTimeout = ApprovalTimeout
+
+	if challenger.ApprovalToken, err = readSecretFile(ApprovalTokenFile); err != nil {
+		return err
+	}
+
+	challenger.ApprovalSecret, err = readSecretFile(ApprovalSecretFile)
+	return err
+}
+
+// getUpstreamCA reads the ca keys of -upstream-ca, in authorized_keys format
+func getUpstreamCA() (*upstream.HostCA, error) {
+	data, err := ioutil.ReadFile(UpstreamCA)
+	if err != nil {
+		return nil, err
+	}
+
+	cas, err := upstream.ParseAuthorizedKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", UpstreamCA, err)
+	}
+
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("%v has no ca key", UpstreamCA)
+	}
+
+	var principals []string
+	if UpstreamCAPrincipals != "" {
+		principals = strings.Split(UpstreamCAPrincipals, ",")
+	}
 
-	logger.Printf("mapping user [%s] to [%s]", user, saddr)
+	return upstream.NewHostCA(cas, principals), nil
+}
 
-	c, err := net.Dial("tcp", saddr)
+// getCertRules reads -cert-rules and the ca keys of -cert-rules-ca, in
+// authorized_keys format
+func getCertRules() (piperd.CertRules, error) {
+	rules, err := piperd.LoadCertRules(CertRulesFile)
+	if err != nil {
+		return piperd.CertRules{}, err
+	}
+
+	if CertRulesCA == "" {
+		return piperd.CertRules{}, fmt.Errorf("-cert-rules needs -cert-rules-ca")
+	}
+
+	data, err := ioutil.ReadFile(CertRulesCA)
+	if err != nil {
+		return piperd.CertRules{}, err
+	}
+
+	cas, err := upstream.ParseAuthorizedKeys(data)
+	if err != nil {
+		return piperd.CertRules{}, fmt.Errorf("%v: %v", CertRulesCA, err)
+	}
+
+	if len(cas) == 0 {
+		return piperd.CertRules{}, fmt.Errorf("%v has no ca key", CertRulesCA)
+	}
+
+	return piperd.CertRules{CAs: cas, Rules: rules}, nil
+}
+
+func findUpstreamFromUserfile(w workingDir, conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+	targets, err := readUpstreamTargets(w, conn.User())
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return c, &ssh.ClientConfig{}, nil
+	return dialUpstreamTarget(w, conn.User(), targets[0])
+}
+
+// upstreamTarget is a line in sshpiper_upstream
+type upstreamTarget struct {
+	name string
+	// empty if not mapped
+	user string
+	addr upstreamAddr
+	// local ip or interface dialed from, empty for -upstream-bind
+	bind string
+	// zero for -upstream-keepalive
+	keepalive time.Duration
+	// tcp keepalive period, zero for the system's, negative for none
+	tcpKeepalive time.Duration
+	// zero for the system's
+	dscp int
+	// nil for none
+	labels map[string]string
+	// connections kept dialed ahead of logins
+	prewarm int
+	// empty for -duplicate-sessions
+	duplicate string
+	// nil for -upstream-auth
+	auth []string
+	// empty for what downstream requests
+	command string
+	// empty for no shadow
+	shadow string
+	// zero rate for -rate-limit
+	rateLimit ssh.RateLimit
+}
+
+func (t upstreamTarget) String() string {
+	if t.user == "" {
+		return t.addr.String()
+	}
+	return t.user + "@" + t.addr.String()
+}
+
+// readUpstreamTargets reads sshpiper_upstream of user, the first target is
+// used unless the user picks one from the menu
+func readUpstreamTargets(w workingDir, user string) ([]upstreamTarget, error) {
+	err := w.checkPerm(UserUpstreamFile, user)
+	if os.IsNotExist(err) {
+		logger.Printf("no pipe for user [%s]: %v", user, err)
+		return nil, upstream.ErrNoPipe
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := w.read(UserUpstreamFile, user)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := parseUpstreamFile(string(data))
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%v is empty", w.file(UserUpstreamFile, user))
+	}
+
+	return targets, nil
+}
+
+func dialUpstreamTarget(w workingDir, user string, t upstreamTarget) (net.Conn, *ssh.ClientConfig, error) {
+	if t.addr.transport == transportSFTP {
+		dir := t.addr.addr
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(w.userDir(user), dir)
+		}
+
+		return &upstream.Conn{
+			LocalSFTP:       dir,
+			Labels:          t.labels,
+			DuplicatePolicy: t.duplicate,
+			RateLimit:       t.rateLimit,
+		}, &ssh.ClientConfig{User: t.user}, nil
+	}
+
+	if t.bind != "" {
+		logger.Printf("mapping user [%s] to [%s] from [%s]", user, t, t.bind)
+	} else {
+		logger.Printf("mapping user [%s] to [%s]", user, t)
+	}
+
+	config := &ssh.ClientConfig{User: t.user}
+
+	// upstream host keys are checked only if the user has a known_hosts or
+	// there is -upstream-ca, shadows are not shadowed otherwise
+	var hostKeyCallback func(addr string) func(hostname string, remote net.Addr, key ssh.PublicKey) error
+	if _, err := os.Stat(w.file(UserKnownHostsFile, user)); err == nil {
+		knownHosts, err := upstream.ReadKnownHostsFile(w.file(UserKnownHostsFile, user))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		hostKeyCallback = knownHosts.HostKeyCallback
+	} else if upstreamCA != nil {
+		hostKeyCallback = upstreamCA.HostKeyCallback
+	}
+
+	var shadowHostKey func(hostname string, remote net.Addr, key ssh.PublicKey) error
+	if hostKeyCallback != nil {
+		config.HostKeyCallback = hostKeyCallback(t.addr.hostKeyAddr())
+		if t.shadow != "" {
+			shadowHostKey = hostKeyCallback(t.shadow)
+		}
+	}
+
+	var c net.Conn
+	if t.prewarm > 0 && t.addr.transport == transportTCP {
+		c = upstreamPool.get(t.addr.addr, t.bind)
+	}
+
+	if c == nil {
+		var err error
+		if c, err = t.addr.dial(t.bind); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if t.keepalive != 0 || t.tcpKeepalive != 0 || t.dscp != 0 || len(t.labels) > 0 || t.duplicate != "" || t.auth != nil || t.command != "" || t.shadow != "" || t.rateLimit.Rate != 0 {
+		c = &upstream.Conn{
+			Conn:              c,
+			KeepaliveInterval: t.keepalive,
+			TCPKeepalive:      t.tcpKeepalive,
+			DSCP:              t.dscp,
+			Labels:            t.labels,
+			DuplicatePolicy:   t.duplicate,
+			UpstreamAuth:      t.auth,
+			ForceCommand:      t.command,
+			Shadow:            t.shadow,
+			RateLimit:         t.rateLimit,
+
+			ShadowHostKeyCallback: shadowHostKey,
+		}
+	}
+
+	return c, config, nil
 }
 
-func mapPublicKeyFromUserfile(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
+// parseUpstreamFile parses sshpiper_upstream, one target per line
+//
+//	[name] [user@]address [bind=ip|interface] [keepalive=duration] [prewarm=n]
+//	[tcp-keepalive=duration] [dscp=n] [duplicate=allow|deny|takeover]
+//	[auth=method,...] [command="..."] [shadow=host:port] [rate=bytes/s]
+//	[burst=bytes] [label.key=value ...]
+//
+// address is one parseUpstreamAddr takes, name defaults to [user@]address,
+// lines starting with # are ignored
+func parseUpstreamFile(data string) []upstreamTarget {
+	var targets []upstreamTarget
+
+	for _, line := range strings.Split(data, "\n") {
+		fields := splitFields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var t upstreamTarget
+
+		// options after the address
+	options:
+		for len(fields) > 1 {
+			last := fields[len(fields)-1]
+
+			switch {
+			case strings.HasPrefix(last, "bind="):
+				t.bind = strings.TrimPrefix(last, "bind=")
+			case strings.HasPrefix(last, "keepalive="):
+				d, err := time.ParseDuration(strings.TrimPrefix(last, "keepalive="))
+				if err != nil {
+					logger.Printf("ignoring %v in %v: %v", last, UserUpstreamFile, err)
+				}
+				t.keepalive = d
+			case strings.HasPrefix(last, "tcp-keepalive="):
+				d, err := time.ParseDuration(strings.TrimPrefix(last, "tcp-keepalive="))
+				if err != nil {
+					logger.Printf("ignoring %v in %v: %v", last, UserUpstreamFile, err)
+				}
+				t.tcpKeepalive = d
+			case strings.HasPrefix(last, "dscp="):
+				n, err := strconv.Atoi(strings.TrimPrefix(last, "dscp="))
+				if err != nil {
+					logger.Printf("ignoring %v in %v: %v", last, UserUpstreamFile, err)
+				}
+				t.dscp = n
+			case strings.HasPrefix(last, "auth="):
+				t.auth = strings.Split(strings.TrimPrefix(last, "auth="), ",")
+			case strings.HasPrefix(last, "command="):
+				t.command = strings.TrimPrefix(last, "command=")
+			case strings.HasPrefix(last, "shadow="):
+				t.shadow = strings.TrimPrefix(last, "shadow=")
+			case strings.HasPrefix(last, "duplicate="):
+				t.duplicate = strings.TrimPrefix(last, "duplicate=")
+			case strings.HasPrefix(last, "rate="), strings.HasPrefix(last, "burst="):
+				kv := strings.SplitN(last, "=", 2)
+				n, err := strconv.ParseInt(kv[1], 10, 64)
+				if err != nil {
+					logger.Printf("ignoring %v in %v: %v", last, UserUpstreamFile, err)
+				}
+				if kv[0] == "rate" {
+					t.rateLimit.Rate = n
+				} else {
+					t.rateLimit.Burst = n
+				}
+			case strings.HasPrefix(last, "prewarm="):
+				n, err := strconv.Atoi(strings.TrimPrefix(last, "prewarm="))
+				if err != nil {
+					logger.Printf("ignoring %v in %v: %v", last, UserUpstreamFile, err)
+				}
+				t.prewarm = n
+			case strings.HasPrefix(last, "label.") && strings.Contains(last, "="):
+				kv := strings.SplitN(strings.TrimPrefix(last, "label."), "=", 2)
+				if t.labels == nil {
+					t.labels = make(map[string]string)
+				}
+				t.labels[kv[0]] = kv[1]
+			default:
+				break options
+			}
+
+			fields = fields[:len(fields)-1]
+		}
+
+		addr := fields[len(fields)-1]
+
+		// user@ goes before the scheme, or in the url
+		userEnd := len(addr)
+		if i := strings.Index(addr, "://"); i >= 0 {
+			userEnd = i
+		}
+		if i := strings.LastIndex(addr[:userEnd], "@"); i >= 0 {
+			t.user, addr = addr[:i], addr[i+1:]
+		}
+
+		var err error
+		if t.addr, err = parseUpstreamAddr(addr); err != nil {
+			logger.Printf("ignoring target %v in %v: %v", addr, UserUpstreamFile, err)
+			continue
+		}
+
+		if t.user == "" {
+			t.user = t.addr.user
+		}
+
+		t.name = strings.Join(fields[:len(fields)-1], " ")
+		if t.name == "" {
+			t.name = t.String()
+		}
+
+		targets = append(targets, t)
+	}
+
+	return targets
+}
+
+// splitFields splits line around spaces like strings.Fields, except within
+// double quotes, which are removed, e.g. command="git-shell -c ls"
+func splitFields(line string) []string {
+	var fields []string
+	var field []rune
+	inField, quoted := false, false
+
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inField = true
+		case unicode.IsSpace(r) && !quoted:
+			if inField {
+				fields = append(fields, string(field))
+				field, inField = field[:0], false
+			}
+		default:
+			field = append(field, r)
+			inField = true
+		}
+	}
+
+	if inField {
+		fields = append(fields, string(field))
+	}
+
+	return fields
+}
+
+func mapPublicKeyFromUserfile(w workingDir, conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
 	user := conn.User()
 
 	var err error
@@ -110,67 +870,289 @@ func mapPublicKeyFromUserfile(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Sig
 		}
 	}()
 
-	err = UserAuthorizedKeysFile.check400(user)
+	var authedPubkeys []ssh.PublicKey
+	authedPubkeys, err = upstream.ReadAuthorizedKeysFile(w.file(UserAuthorizedKeysFile, user))
 	if err != nil {
 		return nil, err
 	}
 
-	keydata := key.Marshal()
+	if upstream.ContainsKey(authedPubkeys, key) {
+		var private ssh.Signer
+		private, err = upstream.ReadPrivateKeyFile(w.file(UserKeyFile, user))
+		if err != nil {
+			return nil, err
+		}
+
+		// a certificate of the key is tried first, see -upstream-auth
+		if _, statErr := os.Stat(w.file(UserCertFile, user)); statErr == nil {
+			private, err = readCertSigner(w.file(UserCertFile, user), private)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// in log may see this twice, one is for query the other is real sign again
+		logger.Printf("auth succ, using mapped private key [%v] for user [%v] from [%v]", w.file(UserKeyFile, user), user, conn.RemoteAddr())
+		return private, nil
+	}
+
+	logger.Printf("public key auth failed user [%v] from [%v]", conn.User(), conn.RemoteAddr())
+
+	return nil, nil
+}
+
+func readCertSigner(file string, signer ssh.Signer) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
 
-	var rest []byte
-	rest, err = UserAuthorizedKeysFile.read(user)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
 	if err != nil {
 		return nil, err
 	}
 
-	var authedPubkey ssh.PublicKey
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a certificate", file)
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+func main() {
+
+	if ShowHelp {
+		flag.PrintDefaults()
+
+		var names []string
+		for name := range subCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Printf("subcommands: %v\n", strings.Join(names, ", "))
+		return
+	}
+
+	if err := checkWorkingDirLayout(WorkingDirLayout); err != nil {
+		logger.Fatalln(err)
+	}
+
+	perm, err := getPermPolicy()
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	upstream.SetPermPolicy(perm)
+
+	if tenants, err = getTenants(); err != nil {
+		logger.Fatalln(err)
+	}
+
+	challenger.TOTPSecretFile = func(user string) string {
+		return userWorkingDir(user).file(UserTOTPFile, user)
+	}
+
+	challenger.TOTPEnroll = TOTPEnroll
+	challenger.TOTPIssuer = TOTPIssuer
+
+	if err := setupApproval(); err != nil {
+		logger.Fatalln(err)
+	}
+
+	if UpstreamCA != "" {
+		if upstreamCA, err = getUpstreamCA(); err != nil {
+			logger.Fatalln(err)
+		}
+	}
+
+	timeouts, dialTimeout, err := parseTimeouts(Timeouts)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	upstreamDNS = newUpstreamDialer(DNSServer, DNSCacheTTL, UpstreamBind, dialTimeout)
+	upstreamPool = newPrewarmPool(PrewarmMaxAge, upstreamDNS.DialBind)
+
+	if run, ok := subCommands[flag.Arg(0)]; ok {
+		if err := run(flag.Args()[1:]); err != nil {
+			logger.Fatalln(err)
+		}
+		return
+	}
+
+	provider, err := getProvider()
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	// prewarm= is an option of working dir files
+	if Provider == "workingdir" && PrewarmMaxAge > 0 {
+		go upstreamPool.loop()
+	}
+
+	opts := []piperd.Option{
+		piperd.WithProvider(provider),
+		piperd.WithProviderName(Provider),
+		piperd.WithLogger(logger),
+		piperd.WithMaxConn(MaxConn),
+		piperd.WithBacklog(Backlog),
+		piperd.WithMaxBuffer(MaxBuffer),
+		piperd.WithLoginGraceTime(LoginGraceTime),
+		piperd.WithTimeouts(timeouts),
+		piperd.WithPhaseHook(trackPhase),
+		piperd.WithProbeHook(countProbe),
+		piperd.WithProxyProtocol(ProxyProtocol),
+		piperd.WithDialAfterAuth(DialAfterAuth),
+		piperd.WithLockdown(Lockdown),
+		piperd.WithClientAlive(ClientAliveInterval, ClientAliveCountMax),
+		piperd.WithUpstreamKeepalive(UpstreamKeepalive),
+		piperd.WithDialer(upstreamDNS.Dial),
+		piperd.WithListen(sockets.listen),
+		piperd.WithListening(sockets.serving),
+		piperd.WithObservers(Observe),
+		piperd.WithDuplicatePolicy(DuplicateSessions),
+		piperd.WithClientEnv(ClientEnv),
+		piperd.WithAuthTrace(AuthTrace),
+		piperd.WithShadowPercent(ShadowPercent),
+		piperd.WithAnomalyPolicy(Anomalies),
+	}
+
+	if ProbeBanAfter > 0 {
+		logger.Printf("banning ips for %v after %d probes", ProbeBanTime, ProbeBanAfter)
+		opts = append(opts, piperd.WithProbeBan(ProbeBanAfter, ProbeBanTime))
+	}
+
+	if UserMaxFailedLogins > 0 || UserMaxLogins > 0 {
+		opts = append(opts, piperd.WithUserLoginLimit(UserMaxFailedLogins, UserMaxLogins))
+	}
+
+	if AuthMethods != "" {
+		opts = append(opts, piperd.WithAuthMethods(strings.Split(AuthMethods, ",")))
+	}
+
+	if UpstreamAuth != "" {
+		opts = append(opts, piperd.WithUpstreamAuth(strings.Split(UpstreamAuth, ",")))
+	}
+
+	if PasswordPrompt != "" {
+		opts = append(opts, piperd.WithPasswordPrompt(PasswordPrompt))
+	}
 
-	for len(rest) > 0 {
-		authedPubkey, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+	if RateLimit > 0 {
+		opts = append(opts, piperd.WithRateLimit(ssh.RateLimit{Rate: RateLimit, Burst: RateBurst}))
+	}
 
+	if PasswordVerifier != "" {
+		password.LDAPPlaintext = LDAPPlaintext
+		v, err := password.Parse(PasswordVerifier)
 		if err != nil {
-			return nil, err
+			logger.Fatalln(err)
 		}
+		opts = append(opts, piperd.WithPasswordVerifier(v))
+	}
+
+	if CertRulesFile != "" {
+		rules, err := getCertRules()
+		if err != nil {
+			logger.Fatalln(err)
+		}
+
+		logger.Printf("routing user certificates by %d rules from %s", len(rules.Rules), CertRulesFile)
+		opts = append(opts, piperd.WithCertRules(rules))
+	}
 
-		if bytes.Equal(authedPubkey.Marshal(), keydata) {
-			err = UserKeyFile.check400(user)
+	if MinRSABits > 0 || DenyKeyTypes != "" {
+		policy := piperd.KeyPolicy{MinRSABits: MinRSABits}
+		if DenyKeyTypes != "" {
+			policy.DenyTypes = strings.Split(DenyKeyTypes, ",")
+		}
+		opts = append(opts, piperd.WithKeyPolicy(policy))
+	}
+
+	if AuditSink != "" {
+		name, target, err := getAuditSink()
+		if err != nil {
+			logger.Fatalln(err)
+		}
+
+		sink, err := audit.Open(name, target)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+
+		if AuditQueue != "" {
+			q, err := audit.NewQueue(sink, AuditQueue, AuditQueueMax)
 			if err != nil {
-				return nil, err
+				logger.Fatalln(err)
 			}
 
-			var privateBytes []byte
-			privateBytes, err = UserKeyFile.read(user)
-			if err != nil {
-				return nil, err
+			if MetricsAddr != "" {
+				publishAuditQueue(q)
 			}
 
-			var private ssh.Signer
-			private, err = ssh.ParsePrivateKey(privateBytes)
-			if err != nil {
-				return nil, err
+			logger.Printf("audit events queued in %s, %d pending", AuditQueue, q.Pending())
+			sink = q
+		}
+
+		logger.Printf("audit events to %s %s", name, target)
+		opts = append(opts, piperd.WithAuditSink(sink))
+	}
+
+	var hooks []func(event piperd.ConnEvent)
+	if OnConnect != "" || OnClose != "" {
+		hooks = append(hooks, execConnHook)
+	}
+
+	if MetricsAddr != "" {
+		hooks = append(hooks, countLabels)
+	}
+
+	if len(hooks) > 0 {
+		opts = append(opts, piperd.WithConnHook(func(event piperd.ConnEvent) {
+			for _, hook := range hooks {
+				hook(event)
 			}
+		}))
+	}
 
-			// in log may see this twice, one is for query the other is real sign again
-			logger.Printf("auth succ, using mapped private key [%v] for user [%v] from [%v]", UserKeyFile.realPath(user), user, conn.RemoteAddr())
-			return private, nil
+	if MOTDFile != "" {
+		motd, err := ioutil.ReadFile(MOTDFile)
+		if err != nil {
+			logger.Fatalln(err)
 		}
+
+		opts = append(opts, piperd.WithMOTD(string(motd)))
 	}
 
-	logger.Printf("public key auth failed user [%v] from [%v]", conn.User(), conn.RemoteAddr())
+	if BannerFile != "" {
+		banner, err := ioutil.ReadFile(BannerFile)
+		if err != nil {
+			logger.Fatalln(err)
+		}
 
-	return nil, nil
-}
+		opts = append(opts, piperd.WithBanner(string(banner)))
+	}
 
-func main() {
+	if MessagesFile != "" {
+		messages, err := piperd.LoadMessages(MessagesFile)
+		if err != nil {
+			logger.Fatalln(err)
+		}
 
-	if ShowHelp {
-		flag.PrintDefaults()
-		return
+		opts = append(opts, piperd.WithMessages(messages))
+	}
+
+	if QuotaDaily > 0 || QuotaMonthly > 0 {
+		logger.Printf("transfer quota %d bytes daily, %d bytes monthly, usage in [%s]", QuotaDaily, QuotaMonthly, QuotaFile)
+		opts = append(opts, piperd.WithQuota(QuotaFile, QuotaDaily, QuotaMonthly))
 	}
 
-	piper := &ssh.SSHPiper{
-		FindUpstream: findUpstreamFromUserfile,
-		MapPublicKey: mapPublicKeyFromUserfile,
+	if MetricsAddr != "" {
+		if err := startMetrics(MetricsAddr); err != nil {
+			logger.Fatalln(err)
+		}
+
+		logger.Printf("metrics at http://%s/debug/vars", MetricsAddr)
 	}
 
 	if Challenger != "" {
@@ -179,8 +1161,26 @@ func main() {
 			logger.Fatalln(err)
 		}
 
+		// approval refuses logins the piper did not verify before
+		if Challenger == "approval" && !DialAfterAuth {
+			logger.Fatalln("challenger approval needs -dial-after-auth")
+		}
+
+		if Challenger == "approval" && ApprovalURL == "" {
+			logger.Fatalln("challenger approval needs -approval-url")
+		}
+
+		// as approval, whoever enrolls must hold the user's credential
+		if Challenger == "totp" && TOTPEnroll && !DialAfterAuth {
+			logger.Fatalln("-totp-enroll needs -dial-after-auth")
+		}
+
 		logger.Printf("using additional challenger %s", Challenger)
-		piper.AdditionalChallenge = ac
+		opts = append(opts, piperd.WithChallenger(ac))
+	}
+
+	if err := upstream.CheckHostKeyPerm(PiperKeyFile); err != nil {
+		logger.Fatalln(err)
 	}
 
 	privateBytes, err := ioutil.ReadFile(PiperKeyFile)
@@ -193,27 +1193,168 @@ func main() {
 		logger.Fatalln(err)
 	}
 
-	piper.DownstreamConfig.AddHostKey(private)
+	opts = append(opts, piperd.WithHostKey(private))
+
+	if HostbasedKnownHosts != "" {
+		data, err := ioutil.ReadFile(HostbasedKnownHosts)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+
+		trusted, err := upstream.ParseKnownHosts(data)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+
+		key := private
+		if HostbasedKeyFile != "" {
+			if err := upstream.CheckHostKeyPerm(HostbasedKeyFile); err != nil {
+				logger.Fatalln(err)
+			}
+
+			data, err := ioutil.ReadFile(HostbasedKeyFile)
+			if err != nil {
+				logger.Fatalln(err)
+			}
+
+			if key, err = ssh.ParsePrivateKey(data); err != nil {
+				logger.Fatalln(err)
+			}
+		}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", ListenAddr, Port))
+		name := HostbasedName
+		if name == "" {
+			if name, err = os.Hostname(); err != nil {
+				logger.Fatalln(err)
+			}
+		}
+
+		logger.Printf("relaying hostbased auth as [%s]", name)
+		opts = append(opts, piperd.WithHostbased(trusted, key, name))
+	}
+
+	if LocalShellUser != "" {
+		if strings.TrimSpace(LocalShellCommand) == "" {
+			logger.Fatalln("-local-shell-user needs -local-shell-command, e.g. a constrained diagnostics script")
+		}
+
+		data, err := ioutil.ReadFile(LocalShellKeys)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+
+		keys, err := upstream.ParseAuthorizedKeys(data)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+
+		logger.Printf("user [%s] piped to local shell [%s], %d keys", LocalShellUser, LocalShellCommand, len(keys))
+		opts = append(opts, piperd.WithLocalShell(piperd.LocalShell{
+			User:           LocalShellUser,
+			AuthorizedKeys: keys,
+			Command:        strings.Fields(LocalShellCommand),
+		}))
+	}
+
+	if PassthroughFile != "" {
+		passthroughs, err := piperd.LoadPassthroughRules(PassthroughFile)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+
+		logger.Printf("using %d passthrough rules from %s", len(passthroughs), PassthroughFile)
+		opts = append(opts, piperd.WithPassthrough(passthroughs))
+	}
+
+	var listeners []piperd.Listener
+	if ListenersFile != "" {
+		if listeners, err = piperd.LoadListeners(ListenersFile); err != nil {
+			logger.Fatalln(err)
+		}
+	}
+
+	d, err := piperd.New(opts...)
 	if err != nil {
-		logger.Fatalln("failed to listen for connection")
+		logger.Fatalln(err)
 	}
-	defer listener.Close()
 
-	logger.Printf("listening at %s:%d, server key file %s, working dir %s", ListenAddr, Port, PiperKeyFile, WorkingDir)
+	if MetricsAddr != "" {
+		publishUpstreams(d)
+		publishCredentials(d)
+	}
 
-	for {
-		c, err := listener.Accept()
+	for _, config := range listeners {
+		l, err := sockets.listen("tcp", config.Addr)
 		if err != nil {
-			logger.Printf("failed to accept connection: %v", err)
-			continue
+			logger.Fatalln(err)
+		}
+
+		logger.Printf("listening on %s, %d host keys of its own", config.Addr, len(config.HostKeys))
+		go d.ServeListener(l, config)
+	}
+
+	logger.Printf("server key file %s, working dir %s", PiperKeyFile, WorkingDir)
+	for _, t := range tenants {
+		logger.Printf("tenant %s, working dir %s", t, t.root)
+	}
+
+	if AdminAddr != "" {
+		if err := startAdmin(d, AdminAddr, AdminTokenFile); err != nil {
+			logger.Fatalln(err)
+		}
+
+		logger.Printf("admin api at http://%s/pipes", AdminAddr)
+	}
+
+	// lockdown during an incident without a restart, pipes stay up
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			d.SetLockdown(!d.Lockdown())
+		}
+	}()
+
+	// stop listening on signals, so state like quota usage is saved
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		logger.Printf("%v received, closing", <-sigs)
+		d.Close()
+	}()
+
+	// hand the listening sockets to the binary on disk, pipes up drain here
+	draining := make(chan struct{})
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			pid, err := sockets.upgrade()
+			if err != nil {
+				logger.Printf("upgrade failed, still serving: %v", err)
+				continue
+			}
+
+			logger.Printf("upgraded to pid %d, closing", pid)
+			close(draining)
+			d.Close()
+			sockets.close()
+			return
 		}
+	}()
+
+	if err := d.ListenAndServe(fmt.Sprintf("%s:%d", ListenAddr, Port)); err != nil {
+		logger.Fatalln(err)
+	}
+
+	select {
+	case <-draining:
+	default:
+		return
+	}
 
-		logger.Printf("connection accepted: %v", c.RemoteAddr())
-		go func() {
-			err := piper.Serve(c)
-			logger.Printf("connection %v closed reason: %v", c.RemoteAddr(), err)
-		}()
+	logger.Printf("draining %d connections", d.Active())
+	if !d.Drain(DrainTimeout) {
+		logger.Printf("%d connections dropped after %v", d.Active(), DrainTimeout)
 	}
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+	"os"
+	"strings"
+)
+
+// tenant is a working dir of its own in one daemon, picked by the listener
+// a connection is accepted on or by the domain of its user
+type tenant struct {
+	workingDir
+
+	// host:port of the listener, host empty or unspecified for any
+	listen string
+	// what follows @ in users
+	domain string
+}
+
+func (t tenant) String() string {
+	if t.domain != "" {
+		return "@" + t.domain
+	}
+	return t.listen
+}
+
+// tenants of -tenants, set in main
+var tenants []tenant
+
+// getTenants reads -tenants, one tenant per line
+//
+//	# <listener addr|@domain> <working dir> [layout=...]
+//	10.0.0.1:22   /srv/sshpiper/acme
+//	@example.com  /srv/sshpiper/example layout=%d/%u[0:1]/%u
+//
+// layout defaults to -w-layout
+func getTenants() ([]tenant, error) {
+	if TenantsFile == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(TenantsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var list []tenant
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%v:%d: want <listener addr|@domain> <working dir>", TenantsFile, n)
+		}
+
+		t := tenant{workingDir: workingDir{fields[1], WorkingDirLayout}}
+		if strings.HasPrefix(fields[0], "@") {
+			t.domain = fields[0][1:]
+		} else if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", TenantsFile, n, err)
+		} else {
+			t.listen = fields[0]
+		}
+
+		for _, option := range fields[2:] {
+			kv := strings.SplitN(option, "=", 2)
+			if len(kv) != 2 || kv[0] != "layout" {
+				return nil, fmt.Errorf("%v:%d: unknown option %v", TenantsFile, n, option)
+			}
+
+			if err := checkWorkingDirLayout(kv[1]); err != nil {
+				return nil, fmt.Errorf("%v:%d: %v", TenantsFile, n, err)
+			}
+			t.layout = kv[1]
+		}
+
+		list = append(list, t)
+	}
+
+	return list, scanner.Err()
+}
+
+// tenantWorkingDir is the working dir of the tenant of conn's listener, else
+// of its user's domain, else -w
+func tenantWorkingDir(conn ssh.ConnMetadata) workingDir {
+	for _, t := range tenants {
+		if t.listen != "" && listensOn(t.listen, conn.LocalAddr()) {
+			return t.workingDir
+		}
+	}
+
+	return userWorkingDir(conn.User())
+}
+
+// userWorkingDir is the working dir of the tenant of user's domain, else -w
+func userWorkingDir(user string) workingDir {
+	if i := strings.LastIndex(user, "@"); i >= 0 {
+		for _, t := range tenants {
+			if t.domain != "" && t.domain == user[i+1:] {
+				return t.workingDir
+			}
+		}
+	}
+
+	return defaultWorkingDir()
+}
+
+// workingDirs is -w and the working dirs of tenants
+func workingDirs() []workingDir {
+	dirs := []workingDir{defaultWorkingDir()}
+	for _, t := range tenants {
+		dirs = append(dirs, t.workingDir)
+	}
+	return dirs
+}
+
+// listensOn tells whether addr is accepted by a listener on listen
+func listensOn(listen string, addr net.Addr) bool {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	if port != fmt.Sprint(tcp.Port) {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return host == "" || ip.IsUnspecified() || ip.Equal(tcp.IP)
+}
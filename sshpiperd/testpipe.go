@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"github.com/tg123/sshpiper/sshpiperd/upstream"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+func init() {
+	subCommands["test-pipe"] = runTestPipe
+}
+
+// offlineConn is the ConnMetadata of a downstream that does not exist,
+// used to run the piper callbacks without a client
+type offlineConn struct {
+	user string
+}
+
+func (c offlineConn) User() string          { return c.user }
+func (c offlineConn) SessionID() []byte     { return nil }
+func (c offlineConn) ClientVersion() []byte { return nil }
+func (c offlineConn) ServerVersion() []byte { return nil }
+func (c offlineConn) RemoteAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c offlineConn) LocalAddr() net.Addr   { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func fingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return fmt.Sprintf("%v SHA256:%v", key.Type(), base64.RawStdEncoding.EncodeToString(sum[:]))
+}
+
+// readDownstreamKey reads a public key from an authorized_keys style file
+// or from a private key file
+func readDownstreamKey(file string) (ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, _, _, _, err := ssh.ParseAuthorizedKey(data); err == nil {
+		return key, nil
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v is neither a public nor a private key", file)
+	}
+
+	return signer.PublicKey(), nil
+}
+
+// test-pipe runs what the piper does for a user, without a downstream, and
+// prints each step
+func runTestPipe(args []string) error {
+	fs := flag.NewFlagSet("test-pipe", flag.ExitOnError)
+	keyFile := fs.String("key", "", "Downstream public or private key to check against authorized_keys")
+	target := fs.String("target", "", "Upstream picked from the menu, empty for the default one")
+
+	user, err := pipeUser(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ok := func(format string, a ...interface{}) {
+		fmt.Printf("[ok]   "+format+"\n", a...)
+	}
+
+	fail := func(step string, err error) error {
+		fmt.Printf("[fail] %v: %v\n", step, err)
+		return fmt.Errorf("pipe for %v does not work", user)
+	}
+
+	conn := offlineConn{user}
+
+	var downKey ssh.PublicKey
+	if *keyFile != "" {
+		downKey, err = readDownstreamKey(*keyFile)
+		if err != nil {
+			return fail("read key", err)
+		}
+	}
+
+	provider, err := getProvider()
+	if err != nil {
+		return fail("upstream provider", err)
+	}
+
+	if Provider == "workingdir" {
+		up, err := UserUpstreamFile.read(user)
+		if err != nil {
+			return fail("upstream file", err)
+		}
+
+		for _, t := range parseUpstreamFile(string(up)) {
+			if t.name != t.String() {
+				ok("upstream file %v: %v %v", UserUpstreamFile.realPath(user), t.name, t)
+			} else {
+				ok("upstream file %v: %v", UserUpstreamFile.realPath(user), t)
+			}
+		}
+	}
+
+	var signer ssh.Signer
+	if downKey != nil {
+		signer, err = provider.MapPublicKey(conn, downKey)
+		if err != nil {
+			return fail("map key", err)
+		}
+
+		if signer == nil {
+			return fail("map key", fmt.Errorf("%v is not allowed", fingerprint(downKey)))
+		}
+
+		ok("key %v mapped to %v", fingerprint(downKey), fingerprint(signer.PublicKey()))
+	}
+
+	start := time.Now()
+	var c net.Conn
+	var config *ssh.ClientConfig
+
+	if tp, ok := provider.(upstream.TargetProvider); ok && *target != "" {
+		c, config, err = tp.FindTarget(conn, *target)
+	} else {
+		c, config, err = provider.FindUpstream(conn)
+	}
+
+	if err != nil {
+		return fail("dial upstream", err)
+	}
+	defer c.Close()
+
+	ok("dialed %v in %v", c.RemoteAddr(), time.Since(start))
+
+	var hostKey ssh.PublicKey
+	var hostKeyErr error
+	verify := config.HostKeyCallback
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKey = key
+		if verify != nil {
+			hostKeyErr = verify(hostname, remote, key)
+		}
+		return hostKeyErr
+	}
+
+	if config.User == "" {
+		config.User = user
+	}
+
+	if signer != nil {
+		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	}
+
+	client, _, _, err := ssh.NewClientConn(c, c.RemoteAddr().String(), config)
+
+	if hostKey == nil {
+		return fail("upstream handshake", err)
+	}
+
+	if hostKeyErr != nil {
+		return fail("verify upstream host key "+fingerprint(hostKey), hostKeyErr)
+	}
+
+	ok("upstream handshake, host key %v", fingerprint(hostKey))
+
+	if err != nil {
+		if signer == nil {
+			// none auth only, show what upstream wants
+			fmt.Printf("[info] upstream auth without -key: %v\n", err)
+			return nil
+		}
+
+		return fail("upstream auth", err)
+	}
+	defer client.Close()
+
+	ok("upstream %s accepted mapped key for user %v", client.ServerVersion(), config.User)
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"strings"
+	"time"
+)
+
+// stages -timeouts may bound, in the order a login goes through them
+var timeoutStages = []string{
+	"downstream-kex",
+	"first-auth",
+	"challenge",
+	"provider",
+	"upstream-dial",
+	"upstream-kex",
+	"upstream-auth",
+}
+
+// parseTimeouts parses -timeouts, e.g. "downstream-kex=10s,upstream-dial=5s".
+// upstream-dial bounds the dialer of the working dir provider, the other
+// stages are the ssh.Timeouts of the piper.
+func parseTimeouts(s string) (t ssh.Timeouts, dial time.Duration, err error) {
+	if s == "" {
+		return t, 0, nil
+	}
+
+	stages := map[string]*time.Duration{
+		"downstream-kex": &t.DownstreamKex,
+		"first-auth":     &t.FirstAuth,
+		"challenge":      &t.Challenge,
+		"provider":       &t.FindUpstream,
+		"upstream-dial":  &dial,
+		"upstream-kex":   &t.UpstreamKex,
+		"upstream-auth":  &t.UpstreamAuth,
+	}
+
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return t, 0, fmt.Errorf("-timeouts: %q is not stage=duration", kv)
+		}
+
+		v, ok := stages[parts[0]]
+		if !ok {
+			return t, 0, fmt.Errorf("-timeouts: unknown stage %q, stages are %v", parts[0], strings.Join(timeoutStages, ", "))
+		}
+
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d < 0 {
+			return t, 0, fmt.Errorf("-timeouts: bad duration %q of %v", parts[1], parts[0])
+		}
+
+		*v = d
+	}
+
+	return t, dial, nil
+}
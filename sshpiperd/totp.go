@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/tg123/sshpiper/sshpiperd/challenger"
+	"os"
+)
+
+func init() {
+	subCommands["totp"] = runTOTP
+}
+
+const totpUsage = "usage: sshpiperd totp enroll <user> [-issuer name] [-force]"
+
+// totp enrolls users of the totp challenger, the secret is stored in the
+// user's dir with the perms sshpiperd requires
+func runTOTP(args []string) error {
+	if len(args) == 0 || args[0] != "enroll" {
+		return fmt.Errorf(totpUsage)
+	}
+
+	fs := flag.NewFlagSet("totp enroll", flag.ExitOnError)
+	issuer := fs.String("issuer", TOTPIssuer, "Issuer shown by authenticator apps, -totp-issuer by default")
+	force := fs.Bool("force", false, "Replace the secret of a user enrolled before")
+
+	user, err := pipeUser(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	w := userWorkingDir(user)
+	dir := w.userDir(user)
+	if dir == "" {
+		return fmt.Errorf("no dir for %v in working dir layout %v", user, w.layout)
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("no pipe for %v: %v", user, err)
+	}
+
+	// where the challenger reads it, see challenger.TOTPSecretFile
+	file := w.file(UserTOTPFile, user)
+	if _, err := os.Stat(file); err == nil {
+		if !*force {
+			return fmt.Errorf("%v is enrolled at %v, -force replaces the secret", user, file)
+		}
+
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+
+	secret, err := challenger.NewTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	if err := challenger.WriteTOTPSecret(user, secret); err != nil {
+		return err
+	}
+
+	fmt.Printf("enrolled %v, secret %v\n", user, secret)
+	fmt.Println(challenger.TOTPURL(*issuer, user, secret))
+	return nil
+}
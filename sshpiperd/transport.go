@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// transports a target in sshpiper_upstream is dialed with, picked by the
+// scheme of its address
+const (
+	transportTCP  = "tcp"
+	transportUnix = "unix"
+	transportWS   = "ws"
+	// served by the daemon, see localSFTPPrefix
+	transportSFTP = "sftp"
+)
+
+// localSFTPPrefix marks a dir served by the daemon itself in
+// sshpiper_upstream, relative to the user's dir unless absolute
+const localSFTPPrefix = "sftp:"
+
+// unixPrefix is the short form of unix://, e.g. unix:/run/sshd.sock
+const unixPrefix = "unix:"
+
+// upstreamAddr is where a target is dialed
+type upstreamAddr struct {
+	transport string
+	// host:port for tcp and ws, the socket path for unix, the dir for sftp
+	addr string
+	// request path of ws
+	path string
+	// from the userinfo of a url, empty if none
+	user string
+}
+
+// parseUpstreamAddr parses the address of a target in sshpiper_upstream:
+//
+//	host, host:port, [ipv6], [ipv6]:port, tcp://host[:port]
+//	unix:/path/to/sock, unix:///path/to/sock
+//	ws://host[:port]/path
+//	sftp:dir
+//
+// port defaults to 22, 80 for ws
+func parseUpstreamAddr(s string) (upstreamAddr, error) {
+	if strings.HasPrefix(s, localSFTPPrefix) && !strings.HasPrefix(s, localSFTPPrefix+"//") {
+		return upstreamAddr{transport: transportSFTP, addr: strings.TrimPrefix(s, localSFTPPrefix)}, nil
+	}
+
+	if strings.HasPrefix(s, unixPrefix) && !strings.HasPrefix(s, unixPrefix+"//") {
+		path := strings.TrimPrefix(s, unixPrefix)
+		if path == "" {
+			return upstreamAddr{}, fmt.Errorf("no socket path in %v", s)
+		}
+		return upstreamAddr{transport: transportUnix, addr: path}, nil
+	}
+
+	if !strings.Contains(s, "://") {
+		addr, err := hostPort(s, "22")
+		return upstreamAddr{transport: transportTCP, addr: addr}, err
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return upstreamAddr{}, err
+	}
+
+	a := upstreamAddr{transport: u.Scheme}
+	if u.User != nil {
+		a.user = u.User.Username()
+	}
+
+	switch u.Scheme {
+	case transportTCP:
+		a.addr, err = hostPort(u.Host, "22")
+	case transportWS:
+		a.addr, err = hostPort(u.Host, "80")
+		a.path = u.RequestURI()
+	case transportUnix:
+		a.addr = u.Host + u.Path
+		if a.addr == "" {
+			err = fmt.Errorf("no socket path in %v", s)
+		}
+	default:
+		err = fmt.Errorf("unknown scheme %v in %v", u.Scheme, s)
+	}
+
+	return a, err
+}
+
+// hostPort adds port to host if it has none, ipv6 literals may or may not
+// be in brackets
+func hostPort(host, port string) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("no host")
+	}
+
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host, nil
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.ContainsAny(host, "[]") || (strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+		return "", fmt.Errorf("bad host %v", host)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+func (a upstreamAddr) String() string {
+	switch a.transport {
+	case transportTCP:
+		return a.addr
+	case transportSFTP:
+		return localSFTPPrefix + a.addr
+	case transportUnix:
+		return unixPrefix + a.addr
+	case transportWS:
+		return a.transport + "://" + a.addr + a.path
+	}
+	return a.transport + "://" + a.addr
+}
+
+// hostKeyAddr is the host:port upstream host keys are checked by. sshd
+// behind a websocket gateway is on port 22 of the gateway host, behind a
+// unix socket on localhost.
+func (a upstreamAddr) hostKeyAddr() string {
+	switch a.transport {
+	case transportUnix:
+		return "localhost:22"
+	case transportWS:
+		host, _, _ := net.SplitHostPort(a.addr)
+		return net.JoinHostPort(host, "22")
+	}
+	return a.addr
+}
+
+// dial connects to a, tcp and ws from bind
+func (a upstreamAddr) dial(bind string) (net.Conn, error) {
+	switch a.transport {
+	case transportUnix:
+		return net.DialTimeout("unix", a.addr, upstreamDNS.timeout)
+	case transportWS:
+		c, err := upstreamDNS.DialBind("tcp", a.addr, bind)
+		if err != nil {
+			return nil, err
+		}
+
+		ws, err := newWebsocketClient(c, a.addr, a.path)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return ws, nil
+	}
+
+	return upstreamDNS.DialBind("tcp", a.addr, bind)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// env of an upgraded sshpiperd, addr=fd of each listening socket it inherits
+// and the fd it reports being ready on
+const (
+	listenFdsEnv = "SSHPIPER_LISTEN_FDS"
+	readyFdEnv   = "SSHPIPER_READY_FD"
+)
+
+// how long the old binary waits for the new one to load its config
+const upgradeReadyTimeout = 30 * time.Second
+
+// sockets are every listener of this process by addr, opened on sockets
+// inherited from the binary upgraded if there are any
+var sockets = inheritSockets()
+
+type socketSet struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	listeners map[string]net.Listener
+	addrs     []string
+	ready     *os.File
+}
+
+func inheritSockets() *socketSet {
+	s := &socketSet{
+		inherited: make(map[string]*os.File),
+		listeners: make(map[string]net.Listener),
+	}
+
+	parseFd := func(v string) (*os.File, bool) {
+		fd, err := strconv.Atoi(v)
+		if err != nil || fd < 3 {
+			return nil, false
+		}
+		return os.NewFile(uintptr(fd), "fd"+v), true
+	}
+
+	for _, kv := range strings.Split(os.Getenv(listenFdsEnv), ",") {
+		i := strings.LastIndex(kv, "=")
+		if i < 0 {
+			continue
+		}
+
+		if f, ok := parseFd(kv[i+1:]); ok {
+			s.inherited[kv[:i]] = f
+		}
+	}
+
+	s.ready, _ = parseFd(os.Getenv(readyFdEnv))
+
+	// not passed on to commands run by the daemon
+	os.Unsetenv(listenFdsEnv)
+	os.Unsetenv(readyFdEnv)
+
+	return s
+}
+
+// listen opens a listener on addr, on the socket inherited for addr if any
+func (s *socketSet) listen(network, addr string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var l net.Listener
+	var err error
+
+	if f, ok := s.inherited[addr]; ok {
+		delete(s.inherited, addr)
+		l, err = net.FileListener(f)
+		f.Close()
+	} else {
+		l, err = net.Listen(network, addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.listeners[addr]; !ok {
+		s.addrs = append(s.addrs, addr)
+	}
+	s.listeners[addr] = l
+
+	return l, nil
+}
+
+// serving tells the binary that upgraded to this one it may stop listening,
+// sockets inherited and not listened on again are closed
+func (s *socketSet) serving() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for addr, f := range s.inherited {
+		logger.Printf("socket of %s inherited and not listened on, closing", addr)
+		f.Close()
+	}
+	s.inherited = nil
+
+	if s.ready != nil {
+		s.ready.Write([]byte{1})
+		s.ready.Close()
+		s.ready = nil
+	}
+}
+
+// upgrade starts the sshpiperd binary on disk with the same args and the
+// listening sockets of this one, and waits until it is serving. Connections
+// go to both until this one stops listening.
+func (s *socketSet) upgrade() (pid int, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+
+	var files []*os.File
+	var fds []string
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, addr := range s.addrs {
+		l, ok := s.listeners[addr].(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			continue
+		}
+
+		f, err := l.File()
+		if err != nil {
+			s.mu.Unlock()
+			return 0, fmt.Errorf("socket of %s: %v", addr, err)
+		}
+
+		// ExtraFiles start at fd 3
+		fds = append(fds, fmt.Sprintf("%s=%d", addr, 3+len(files)))
+		files = append(files, f)
+	}
+
+	s.mu.Unlock()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, listenFdsEnv+"=") && !strings.HasPrefix(e, readyFdEnv+"=") {
+			env = append(env, e)
+		}
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(env,
+		listenFdsEnv+"="+strings.Join(fds, ","),
+		fmt.Sprintf("%s=%d", readyFdEnv, 3+len(files)),
+	)
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// reaped here, it is not a child sshpiperd waits for
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ready := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := r.Read(b)
+		ready <- n == 1
+	}()
+
+	select {
+	case ok := <-ready:
+		if ok {
+			return cmd.Process.Pid, nil
+		}
+		return 0, fmt.Errorf("new binary exited: %v", <-exited)
+	case <-time.After(upgradeReadyTimeout):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("new binary not serving after %v, killed", upgradeReadyTimeout)
+	}
+}
+
+// close stops every listener, admin api and metrics included, the upgraded
+// binary serves them from now on
+func (s *socketSet) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+}
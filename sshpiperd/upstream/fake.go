@@ -0,0 +1,60 @@
+package upstream
+
+import (
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+	"sync"
+)
+
+// Fake is a Provider for tests, every user goes to Addr, or has no pipe if
+// Addr is empty, and keys in AuthorizedKeys are mapped to Signer, as are
+// passwords if PasswordSigner
+type Fake struct {
+	Addr           string
+	User           string
+	AuthorizedKeys []ssh.PublicKey
+	Signer         ssh.Signer
+	PasswordSigner bool
+
+	mu    sync.Mutex
+	users []string
+}
+
+func (f *Fake) FindUpstream(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error) {
+	f.mu.Lock()
+	f.users = append(f.users, conn.User())
+	f.mu.Unlock()
+
+	if f.Addr == "" {
+		return nil, nil, ErrNoPipe
+	}
+
+	c, err := net.Dial("tcp", f.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, &ssh.ClientConfig{User: f.User}, nil
+}
+
+func (f *Fake) MapPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error) {
+	if ContainsKey(f.AuthorizedKeys, key) {
+		return f.Signer, nil
+	}
+	return nil, nil
+}
+
+func (f *Fake) MapPassword(conn ssh.ConnMetadata) (ssh.Signer, error) {
+	if f.PasswordSigner {
+		return f.Signer, nil
+	}
+	return nil, nil
+}
+
+// Users returns users FindUpstream was called for, in order
+func (f *Fake) Users() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.users...)
+}
@@ -0,0 +1,77 @@
+package upstream
+
+import (
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+)
+
+// HostCA verifies upstream host certificates signed by trusted CAs, so hosts
+// need no known_hosts lines of their own
+type HostCA struct {
+	cas []ssh.PublicKey
+
+	// patterns, as in known_hosts, one principal of a certificate must
+	// match, the host dialed must be a principal if none
+	principals []string
+}
+
+// NewHostCA trusts host certificates signed by cas, with a principal
+// matching one of principals, or naming the host dialed if principals is
+// empty
+func NewHostCA(cas []ssh.PublicKey, principals []string) *HostCA {
+	return &HostCA{cas: cas, principals: principals}
+}
+
+// Check verifies key of upstream addr, host:port as dialed before any dns
+// lookup. Plain keys are rejected.
+func (c *HostCA) Check(addr string, key ssh.PublicKey) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("host key of %v is not a certificate", addr)
+	}
+
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf("host certificate of %v has type %d", addr, cert.CertType)
+	}
+
+	principal := host
+	if len(c.principals) > 0 {
+		principal = ""
+		for _, p := range cert.ValidPrincipals {
+			if matchHosts(c.principals, p) {
+				principal = p
+				break
+			}
+		}
+
+		if principal == "" {
+			return fmt.Errorf("host certificate of %v: no principal of %v is trusted", addr, cert.ValidPrincipals)
+		}
+	}
+
+	checker := &ssh.CertChecker{
+		IsAuthority: func(auth ssh.PublicKey) bool {
+			return ContainsKey(c.cas, auth)
+		},
+	}
+
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return fmt.Errorf("host certificate of %v: %v", addr, err)
+	}
+
+	return nil
+}
+
+// HostKeyCallback returns a ClientConfig.HostKeyCallback checking keys of
+// addr, see KnownHosts.HostKeyCallback
+func (c *HostCA) HostKeyCallback(addr string) func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return c.Check(addr, key)
+	}
+}
@@ -0,0 +1,62 @@
+package upstream
+
+import (
+	"crypto/rand"
+	"github.com/tg123/sshpiper/ssh"
+	"testing"
+)
+
+func TestHostCA(t *testing.T) {
+	ca := newTestSigner(t)
+	host := newTestSigner(t)
+
+	newCert := func(signer ssh.Signer, certType uint32, principals ...string) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             host.PublicKey(),
+			CertType:        certType,
+			ValidPrincipals: principals,
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	c := NewHostCA([]ssh.PublicKey{ca.PublicKey()}, nil)
+
+	if err := c.Check("up.example:2222", newCert(ca, ssh.HostCert, "up.example")); err != nil {
+		t.Errorf("valid host cert: %v", err)
+	}
+
+	if err := c.Check("10.0.0.5:22", newCert(ca, ssh.HostCert, "up.example")); err == nil {
+		t.Errorf("cert not naming the host dialed accepted without principals")
+	}
+
+	if err := c.Check("up.example:22", newCert(newTestSigner(t), ssh.HostCert, "up.example")); err == nil {
+		t.Errorf("cert of an untrusted ca accepted")
+	}
+
+	if err := c.Check("up.example:22", newCert(ca, ssh.UserCert, "up.example")); err == nil {
+		t.Errorf("user cert accepted as host cert")
+	}
+
+	if err := c.Check("up.example:22", host.PublicKey()); err == nil {
+		t.Errorf("plain key accepted")
+	}
+
+	// dialed by ip, the principal list vouches for the name in the cert
+	c = NewHostCA([]ssh.PublicKey{ca.PublicKey()}, []string{"*.internal", "!db.internal"})
+
+	if err := c.Check("10.0.0.5:22", newCert(ca, ssh.HostCert, "web.internal")); err != nil {
+		t.Errorf("cert with a trusted principal: %v", err)
+	}
+
+	if err := c.Check("10.0.0.6:22", newCert(ca, ssh.HostCert, "db.internal")); err == nil {
+		t.Errorf("cert with a negated principal accepted")
+	}
+
+	if err := c.Check("10.0.0.7:22", newCert(ca, ssh.HostCert, "up.example")); err == nil {
+		t.Errorf("cert without a trusted principal accepted")
+	}
+}
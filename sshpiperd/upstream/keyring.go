@@ -0,0 +1,79 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/tg123/sshpiper/ssh"
+	"sync"
+)
+
+// CredentialVersioner is implemented by providers naming the version of the
+// keys MapPublicKey returns, shown for every pipe so a rotation can be
+// followed until no pipe uses the old key. Empty for the key's fingerprint.
+type CredentialVersioner interface {
+	CredentialVersion(signer ssh.Signer) string
+}
+
+// KeyFingerprint is the SHA256 fingerprint of key as OpenSSH prints it, the
+// version of keys without one of their own
+func KeyFingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Keyring holds the mapped upstream key of each name, e.g. a user, for
+// providers rotating keys without a restart. A key Set is used by new pipes
+// at once, pipes already up keep the key they logged in with.
+//
+// Keyring implements CredentialVersioner, providers embedding it show the
+// version of the key each pipe uses.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys map[string]ssh.Signer
+	// of keys set, by fingerprint, old ones too as pipes may still use them
+	versions map[string]string
+}
+
+// Set makes signer the key of name, version empty for its fingerprint
+func (k *Keyring) Set(name string, signer ssh.Signer, version string) {
+	fp := KeyFingerprint(signer.PublicKey())
+	if version == "" {
+		version = fp
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys == nil {
+		k.keys = make(map[string]ssh.Signer)
+		k.versions = make(map[string]string)
+	}
+
+	k.keys[name] = signer
+	k.versions[fp] = version
+}
+
+// Get returns the key of name, nil if none
+func (k *Keyring) Get(name string) ssh.Signer {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.keys[name]
+}
+
+// Delete removes the key of name, pipes using it are left alone
+func (k *Keyring) Delete(name string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.keys, name)
+}
+
+// CredentialVersion returns the version signer was set with, empty if it
+// never was
+func (k *Keyring) CredentialVersion(signer ssh.Signer) string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.versions[KeyFingerprint(signer.PublicKey())]
+}
@@ -0,0 +1,40 @@
+package upstream
+
+import (
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	var k Keyring
+
+	if k.Get("alice") != nil {
+		t.Errorf("empty keyring has a key")
+	}
+
+	old, rotated := newTestSigner(t), newTestSigner(t)
+
+	k.Set("alice", old, "v1")
+	k.Set("alice", rotated, "")
+
+	if k.Get("alice") != rotated {
+		t.Errorf("Get did not return the rotated key")
+	}
+
+	// pipes still on the old key are named
+	if v := k.CredentialVersion(old); v != "v1" {
+		t.Errorf("version of the old key %q, want v1", v)
+	}
+
+	if v, want := k.CredentialVersion(rotated), KeyFingerprint(rotated.PublicKey()); v != want {
+		t.Errorf("version of the rotated key %q, want %v", v, want)
+	}
+
+	if v := k.CredentialVersion(newTestSigner(t)); v != "" {
+		t.Errorf("version of a key never set %q", v)
+	}
+
+	k.Delete("alice")
+	if k.Get("alice") != nil {
+		t.Errorf("key left after Delete")
+	}
+}
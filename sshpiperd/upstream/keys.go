@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"bytes"
+	"github.com/tg123/sshpiper/ssh"
+	"io/ioutil"
+)
+
+// ReadPrivateKeyFile reads a private key from file, the file must pass
+// CheckPerm
+func ReadPrivateKeyFile(file string) (ssh.Signer, error) {
+	if err := CheckPerm(file); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(data)
+}
+
+// ParseAuthorizedKeys parses all keys in authorized_keys format data
+func ParseAuthorizedKeys(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+		data = rest
+	}
+
+	return keys, nil
+}
+
+// ReadAuthorizedKeysFile reads keys from an authorized_keys file, the file
+// must pass CheckPerm
+func ReadAuthorizedKeysFile(file string) ([]ssh.PublicKey, error) {
+	if err := CheckPerm(file); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseAuthorizedKeys(data)
+}
+
+// ContainsKey reports whether key is in keys
+func ContainsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	data := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), data) {
+			return true
+		}
+	}
+	return false
+}
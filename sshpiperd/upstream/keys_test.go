@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/tg123/sshpiper/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestCheckPerm400(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckPerm400(file); err == nil {
+		t.Errorf("CheckPerm400 accepted 644")
+	}
+
+	os.Chmod(file, 0400)
+
+	if err := CheckPerm400(file); err != nil {
+		t.Errorf("CheckPerm400: %v", err)
+	}
+
+	if err := CheckPerm400(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("CheckPerm400 accepted missing file")
+	}
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	a := newTestSigner(t).PublicKey()
+	b := newTestSigner(t).PublicKey()
+	c := newTestSigner(t).PublicKey()
+
+	data := append(ssh.MarshalAuthorizedKey(a), "\n# comment\n"...)
+	data = append(data, ssh.MarshalAuthorizedKey(b)...)
+
+	keys, err := ParseAuthorizedKeys(data)
+	if err != nil {
+		t.Fatalf("ParseAuthorizedKeys: %v", err)
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+
+	if !ContainsKey(keys, a) || !ContainsKey(keys, b) {
+		t.Errorf("parsed keys do not contain the written ones")
+	}
+
+	if ContainsKey(keys, c) {
+		t.Errorf("ContainsKey found a key not in list")
+	}
+
+	if _, err := ParseAuthorizedKeys([]byte("garbage")); err == nil {
+		t.Errorf("ParseAuthorizedKeys accepted garbage")
+	}
+}
+
+type testConn struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c testConn) User() string { return c.user }
+
+func TestFake(t *testing.T) {
+	allowed := newTestSigner(t)
+	signer := newTestSigner(t)
+
+	f := &Fake{
+		AuthorizedKeys: []ssh.PublicKey{allowed.PublicKey()},
+		Signer:         signer,
+	}
+
+	conn := testConn{user: "alice"}
+
+	if s, _ := f.MapPublicKey(conn, allowed.PublicKey()); s != signer {
+		t.Errorf("allowed key not mapped")
+	}
+
+	if s, _ := f.MapPublicKey(conn, signer.PublicKey()); s != nil {
+		t.Errorf("unknown key mapped")
+	}
+
+	if _, _, err := f.FindUpstream(conn); err == nil {
+		t.Errorf("FindUpstream without Addr should fail")
+	}
+
+	if users := f.Users(); len(users) != 1 || users[0] != "alice" {
+		t.Errorf("got users %v", users)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	f := &Fake{}
+	Register("fake", f)
+
+	p, err := GetProvider("fake")
+	if err != nil || p != f {
+		t.Errorf("GetProvider: %v %v", p, err)
+	}
+
+	if _, err := GetProvider("missing"); err == nil {
+		t.Errorf("GetProvider found missing provider")
+	}
+}
@@ -0,0 +1,259 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// KnownHosts verifies upstream host keys against OpenSSH known_hosts lines,
+// hashed host names and the @revoked and @cert-authority markers included.
+type KnownHosts struct {
+	lines []knownHostsLine
+}
+
+type knownHostsLine struct {
+	// "", "@revoked" or "@cert-authority"
+	marker string
+	hosts  []string
+	key    ssh.PublicKey
+}
+
+// ParseKnownHosts parses data in known_hosts format, lines with keys which
+// do not parse are skipped
+func ParseKnownHosts(data []byte) (*KnownHosts, error) {
+	k := &KnownHosts{}
+
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		var l knownHostsLine
+
+		if line[0] == '@' {
+			var marker []byte
+			marker, line = nextField(line)
+
+			l.marker = string(marker)
+			if l.marker != "@revoked" && l.marker != "@cert-authority" {
+				return nil, fmt.Errorf("known_hosts line %d: unknown marker %v", n+1, l.marker)
+			}
+		}
+
+		hosts, rest := nextField(line)
+		if len(rest) == 0 {
+			return nil, fmt.Errorf("known_hosts line %d: no key", n+1)
+		}
+
+		l.hosts = strings.Split(string(hosts), ",")
+
+		// skipped like OpenSSH does, e.g. key types unknown here
+		key, _, _, _, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			continue
+		}
+
+		l.key = key
+		k.lines = append(k.lines, l)
+	}
+
+	return k, nil
+}
+
+// nextField splits off the first space or tab separated field of line
+func nextField(line []byte) (field, rest []byte) {
+	i := bytes.IndexAny(line, " \t")
+	if i < 0 {
+		return line, nil
+	}
+
+	return line[:i], bytes.TrimSpace(line[i:])
+}
+
+// ReadKnownHostsFile reads a known_hosts file, the file must pass CheckPerm
+func ReadKnownHostsFile(file string) (*KnownHosts, error) {
+	if err := CheckPerm(file); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseKnownHosts(data)
+}
+
+// Check verifies key of upstream addr, host:port as dialed before any dns
+// lookup, so lines naming the host match.
+func (k *KnownHosts) Check(addr string, key ssh.PublicKey) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	// known_hosts writes hosts on non default ports as [host]:port
+	name := host
+	if port != "22" {
+		name = "[" + host + "]:" + port
+	}
+
+	cert, isCert := key.(*ssh.Certificate)
+
+	for _, l := range k.lines {
+		if l.marker != "@revoked" {
+			continue
+		}
+
+		if keyEqual(l.key, key) || (isCert && keyEqual(l.key, cert.SignatureKey)) {
+			return fmt.Errorf("host key of %v is revoked", addr)
+		}
+	}
+
+	if isCert {
+		checker := &ssh.CertChecker{
+			IsAuthority: func(auth ssh.PublicKey) bool {
+				for _, l := range k.lines {
+					if l.marker == "@cert-authority" && keyEqual(l.key, auth) && matchHosts(l.hosts, name) {
+						return true
+					}
+				}
+				return false
+			},
+		}
+
+		if cert.CertType != ssh.HostCert {
+			return fmt.Errorf("host certificate of %v has type %d", addr, cert.CertType)
+		}
+
+		// principals of host certificates are host names, no port
+		if err := checker.CheckCert(host, cert); err != nil {
+			return fmt.Errorf("host certificate of %v: %v", addr, err)
+		}
+
+		return nil
+	}
+
+	known := false
+	for _, l := range k.lines {
+		if l.marker != "" || !matchHosts(l.hosts, name) {
+			continue
+		}
+
+		if keyEqual(l.key, key) {
+			return nil
+		}
+
+		known = true
+	}
+
+	if known {
+		return fmt.Errorf("host key of %v does not match known_hosts", addr)
+	}
+
+	return fmt.Errorf("%v is not in known_hosts", addr)
+}
+
+// HostKeyCallback returns a ClientConfig.HostKeyCallback checking keys of
+// addr, the address dialed may be a resolved one which known_hosts does not
+// name.
+func (k *KnownHosts) HostKeyCallback(addr string) func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return k.Check(addr, key)
+	}
+}
+
+func keyEqual(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// matchHosts reports whether name matches patterns of a line, at least one
+// and none negated with !
+func matchHosts(patterns []string, name string) bool {
+	matched := false
+
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		if negated {
+			p = p[1:]
+		}
+
+		if !matchHost(p, name) {
+			continue
+		}
+
+		if negated {
+			return false
+		}
+
+		matched = true
+	}
+
+	return matched
+}
+
+func matchHost(pattern, name string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		return matchHashedHost(pattern, name)
+	}
+
+	return wildcardMatch(strings.ToLower(pattern), strings.ToLower(name))
+}
+
+// wildcardMatch matches * and ? only, brackets are part of [host]:port
+func wildcardMatch(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// matchHashedHost matches |1|base64(salt)|base64(hmac-sha1(salt, name))
+func matchHashedHost(pattern, name string) bool {
+	parts := strings.Split(pattern[len("|1|"):], "|")
+	if len(parts) != 2 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+
+	return hmac.Equal(mac.Sum(nil), hash)
+}
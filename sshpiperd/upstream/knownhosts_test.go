@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"github.com/tg123/sshpiper/ssh"
+	"strings"
+	"testing"
+)
+
+func hashHost(name string) string {
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func hostLine(hosts string, key ssh.PublicKey) string {
+	return hosts + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + "\n"
+}
+
+func TestKnownHosts(t *testing.T) {
+	plain := newTestSigner(t).PublicKey()
+	hashed := newTestSigner(t).PublicKey()
+	revoked := newTestSigner(t).PublicKey()
+	other := newTestSigner(t).PublicKey()
+
+	data := "# comment\n" +
+		hostLine("plain.example,10.0.0.1", plain) +
+		hostLine(hashHost("[hashed.example]:2222"), hashed) +
+		hostLine("*.wild.example,!bad.wild.example", plain) +
+		"@revoked " + hostLine("*", revoked) +
+		hostLine("revoked.example", revoked) +
+		"plain.example ssh-unknown AAAA\n"
+
+	k, err := ParseKnownHosts([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		addr string
+		key  ssh.PublicKey
+		ok   bool
+	}{
+		{"plain.example:22", plain, true},
+		{"PLAIN.example:22", plain, true},
+		{"10.0.0.1:22", plain, true},
+		{"plain.example:2222", plain, false},
+		{"plain.example:22", other, false},
+		{"hashed.example:2222", hashed, true},
+		{"hashed.example:22", hashed, false},
+		{"a.wild.example:22", plain, true},
+		{"bad.wild.example:22", plain, false},
+		{"revoked.example:22", revoked, false},
+		{"unknown.example:22", plain, false},
+	} {
+		err := k.Check(c.addr, c.key)
+		if (err == nil) != c.ok {
+			t.Errorf("Check(%v) got %v, want ok %v", c.addr, err, c.ok)
+		}
+	}
+}
+
+func TestKnownHostsCertAuthority(t *testing.T) {
+	ca := newTestSigner(t)
+	host := newTestSigner(t)
+
+	k, err := ParseKnownHosts([]byte("@cert-authority " + hostLine("*.example", ca.PublicKey())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCert := func(principal string, certType uint32) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             host.PublicKey(),
+			CertType:        certType,
+			ValidPrincipals: []string{principal},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	if err := k.Check("up.example:22", newCert("up.example", ssh.HostCert)); err != nil {
+		t.Errorf("valid host cert: %v", err)
+	}
+
+	if err := k.Check("other.example:22", newCert("up.example", ssh.HostCert)); err == nil {
+		t.Errorf("cert for another principal accepted")
+	}
+
+	if err := k.Check("up.example:22", newCert("up.example", ssh.UserCert)); err == nil {
+		t.Errorf("user cert accepted as host cert")
+	}
+
+	if err := k.Check("up.other:22", newCert("up.other", ssh.HostCert)); err == nil {
+		t.Errorf("cert authority used for host it is not listed for")
+	}
+
+	// a plain key is not vouched for by the authority
+	if err := k.Check("up.example:22", host.PublicKey()); err == nil {
+		t.Errorf("plain key accepted by cert authority line")
+	}
+}
+
+func TestParseKnownHostsErrors(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+
+	for _, data := range []string{
+		"host.example\n",
+		"@unknown " + hostLine("host.example", key),
+	} {
+		if _, err := ParseKnownHosts([]byte(data)); err == nil {
+			t.Errorf("ParseKnownHosts(%q) got no error", data)
+		}
+	}
+
+}
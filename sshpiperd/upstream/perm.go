@@ -0,0 +1,88 @@
+package upstream
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// PermPolicy is what user files and host keys must satisfy before they are
+// read, see SetPermPolicy
+type PermPolicy struct {
+	// mode bits a user file may have, 0600 allows the owner to write but
+	// rejects group and world readable files
+	MaxMode os.FileMode
+
+	// mode bits a host key may have
+	HostKeyMaxMode os.FileMode
+
+	// uid owning every file, -1 for any
+	Owner int
+
+	// skip mode and owner checks, e.g. on bind mounts in containers whose
+	// modes cannot be set, missing files are still errors
+	Ignore bool
+}
+
+// DefaultPermPolicy wants user files 400 and host keys 600 as openssh does
+var DefaultPermPolicy = PermPolicy{MaxMode: 0400, HostKeyMaxMode: 0600, Owner: -1}
+
+var (
+	permMu     sync.RWMutex
+	permPolicy = DefaultPermPolicy
+)
+
+// SetPermPolicy replaces DefaultPermPolicy for every check after
+func SetPermPolicy(p PermPolicy) {
+	permMu.Lock()
+	defer permMu.Unlock()
+	permPolicy = p
+}
+
+// CheckPerm returns error if user file is missing or not as the policy wants
+func CheckPerm(file string) error {
+	permMu.RLock()
+	p := permPolicy
+	permMu.RUnlock()
+
+	return p.check(file, p.MaxMode)
+}
+
+// CheckHostKeyPerm returns error if host key file is missing or not as the
+// policy wants
+func CheckHostKeyPerm(file string) error {
+	permMu.RLock()
+	p := permPolicy
+	permMu.RUnlock()
+
+	return p.check(file, p.HostKeyMaxMode)
+}
+
+// CheckPerm400 returns error if file is missing or not as the policy wants,
+// 400 unless SetPermPolicy changed it
+//
+// Deprecated: use CheckPerm
+func CheckPerm400(file string) error {
+	return CheckPerm(file)
+}
+
+func (p PermPolicy) check(file string, maxMode os.FileMode) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	if p.Ignore {
+		return nil
+	}
+
+	if perm := fi.Mode().Perm(); perm&^maxMode != 0 {
+		return fmt.Errorf("%v's perm %o is too open, change it to %o", file, perm, maxMode)
+	}
+
+	if uid, ok := fileOwner(fi); ok && p.Owner >= 0 && uid != p.Owner {
+		return fmt.Errorf("%v is owned by uid %d, want %d", file, uid, p.Owner)
+	}
+
+	return nil
+}
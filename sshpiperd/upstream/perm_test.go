@@ -0,0 +1,60 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPermPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetPermPolicy(DefaultPermPolicy)
+
+	file := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckPerm(file); err == nil {
+		t.Errorf("CheckPerm accepted 600 by default")
+	}
+
+	if err := CheckHostKeyPerm(file); err != nil {
+		t.Errorf("CheckHostKeyPerm rejected 600 by default: %v", err)
+	}
+
+	SetPermPolicy(PermPolicy{MaxMode: 0600, HostKeyMaxMode: 0600, Owner: -1})
+
+	if err := CheckPerm(file); err != nil {
+		t.Errorf("CheckPerm rejected 600 with max 600: %v", err)
+	}
+
+	os.Chmod(file, 0640)
+
+	if err := CheckPerm(file); err == nil {
+		t.Errorf("CheckPerm accepted group readable 640 with max 600")
+	}
+
+	SetPermPolicy(PermPolicy{MaxMode: 0600, Owner: os.Getuid() + 1})
+	os.Chmod(file, 0400)
+
+	if err := CheckPerm(file); err == nil {
+		t.Errorf("CheckPerm accepted a file of another owner")
+	}
+
+	SetPermPolicy(PermPolicy{Owner: -1, Ignore: true})
+	os.Chmod(file, 0666)
+
+	if err := CheckPerm(file); err != nil {
+		t.Errorf("CheckPerm with Ignore: %v", err)
+	}
+
+	if err := CheckPerm(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("CheckPerm with Ignore got %v for a missing file, want not exist", err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package upstream
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileOwner(fi os.FileInfo) (int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Uid), true
+}
@@ -0,0 +1,170 @@
+// Package upstream is the API for sshpiperd upstream providers.
+//
+// A provider tells sshpiperd where a downstream connection goes and which key
+// is used to login upstream. Providers register themselves in init, the same
+// way as database/sql drivers, and are picked by name with sshpiperd -u.
+// Flags a provider needs can be registered in init with package flag as well.
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tg123/sshpiper/ssh"
+	"net"
+	"sort"
+	"time"
+)
+
+// Provider finds the upstream for downstream connections
+type Provider interface {
+	// FindUpstream dials the upstream of conn and returns the config used to
+	// connect to it, ClientConfig.User empty for the same user as downstream
+	FindUpstream(conn ssh.ConnMetadata) (net.Conn, *ssh.ClientConfig, error)
+
+	// MapPublicKey returns the signer used to login upstream in place of
+	// the downstream key, nil signer if key is not allowed
+	MapPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (ssh.Signer, error)
+}
+
+// errors FindUpstream returns, so downstream can be told why it is
+// disconnected. net errors tell upstream is unreachable, other errors close
+// the connection without a message.
+var (
+	// no upstream configured for the user
+	ErrNoPipe = errors.New("no pipe configured")
+	// the user or source is not allowed to connect
+	ErrBanned = errors.New("banned")
+)
+
+// Conn may be returned by FindUpstream in place of the dialed conn, to set
+// options of the pipe
+type Conn struct {
+	net.Conn
+
+	// KeepaliveInterval, if not zero, overrides the daemon's upstream
+	// keepalive interval
+	KeepaliveInterval time.Duration
+
+	// TCPKeepalive, if not zero, sets the period of tcp keepalive probes
+	// of the tcp conn to upstream, negative disables them. Unlike
+	// KeepaliveInterval nothing is sent in the pipe.
+	TCPKeepalive time.Duration
+
+	// DSCP, if not zero, marks packets to upstream with this differentiated
+	// services code point, e.g. 46 for expedited forwarding, so the network
+	// may prioritize interactive pipes over bulk transfers
+	DSCP int
+
+	// DuplicatePolicy, if not empty, overrides the daemon's policy for a
+	// user opening a second pipe to the same upstream
+	DuplicatePolicy string
+
+	// UpstreamAuth, if not nil, overrides the daemon's auth methods tried
+	// toward upstream, in order, e.g. certificate, publickey. Methods not
+	// listed are never relayed.
+	UpstreamAuth []string
+
+	// ForceCommand, if not empty, is run upstream in place of any shell,
+	// command or subsystem downstream requests, like command= in
+	// authorized_keys, e.g. a menu script or git-shell
+	ForceCommand string
+
+	// Shadow, if not empty, is the address of a second upstream, e.g. a
+	// staging replica, sent what downstream sends in sessions of the pipes
+	// the daemon picks to shadow. Its output is discarded.
+	Shadow string
+
+	// ShadowHostKeyCallback checks the host key of Shadow, which is not
+	// shadowed without one, as what the user types goes there
+	ShadowHostKeyCallback func(hostname string, remote net.Addr, key ssh.PublicKey) error
+
+	// LocalSFTP, if not empty, is a dir served over the sftp subsystem by
+	// the daemon itself, e.g. a per-user file drop on local disk or NFS.
+	// Conn is not used and may be nil, only the mapped key logs in, for a
+	// downstream key or a verified password.
+	LocalSFTP string
+
+	// Labels, e.g. team, environment or ticket id, are shown in logs,
+	// connection events and the admin api of the pipe
+	Labels map[string]string
+
+	// RateLimit, if its Rate is not zero, overrides the daemon's bandwidth
+	// limit of the pipe, e.g. more for premium tenants, negative for none
+	RateLimit ssh.RateLimit
+}
+
+// duplicate policies, what happens when a user opens a second pipe to the
+// same upstream
+const (
+	DuplicateAllow = "allow"
+	// the new pipe is refused
+	DuplicateDeny = "deny"
+	// the older pipe is closed
+	DuplicateTakeover = "takeover"
+)
+
+// Checker is implemented by providers able to check their config and
+// backends, e.g. database connectivity or an LDAP bind, run by sshpiperd
+// check before a deploy
+type Checker interface {
+	Check() error
+}
+
+// MOTDProvider is implemented by providers with a message of the day of
+// their own, printed to downstream when a shell starts. Empty for the
+// daemon's default.
+type MOTDProvider interface {
+	MOTD(conn ssh.ConnMetadata) (string, error)
+}
+
+// TargetProvider is implemented by providers letting a user pick one of
+// several upstreams from a menu shown before upstream auth
+type TargetProvider interface {
+	// Targets returns names of upstreams conn may pick from, no menu is
+	// shown for less than 2
+	Targets(conn ssh.ConnMetadata) ([]string, error)
+
+	// FindTarget is FindUpstream for the picked target
+	FindTarget(conn ssh.ConnMetadata, target string) (net.Conn, *ssh.ClientConfig, error)
+}
+
+// PasswordMapper is implemented by providers logging in upstream with a key
+// for downstreams authed by password, the password is checked by the
+// daemon's password verifier instead of upstream. Downstreams whose user
+// certificate the daemon routed to a pipe are logged in the same way.
+type PasswordMapper interface {
+	// MapPassword returns the signer used to login upstream once the
+	// password of conn is verified, nil signer relays the password as is
+	MapPassword(conn ssh.ConnMetadata) (ssh.Signer, error)
+}
+
+var providers = make(map[string]Provider)
+
+// copied from database/sql
+
+func Register(name string, provider Provider) {
+	if provider == nil {
+		panic("upstream provider is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic("Register twice for upstream provider " + name)
+	}
+	providers[name] = provider
+}
+
+func Providers() []string {
+	var list []string
+	for name := range providers {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func GetProvider(name string) (Provider, error) {
+	provider, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("no such upstream provider: %v", name)
+	}
+	return provider, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// websocket opcodes, RFC 6455 section 5.2
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketConn carries the ssh stream in binary messages, for upstreams
+// behind a websocket gateway, e.g. websockify in front of sshd
+type websocketConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// left of the frame being read
+	remaining uint64
+	mask      []byte
+	maskPos   int
+
+	wmu sync.Mutex
+}
+
+// newWebsocketClient upgrades c, dialed to host, to a websocket at path
+func newWebsocketClient(c net.Conn, host, path string) (*websocketConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	if path == "" {
+		path = "/"
+	}
+
+	req := fmt.Sprintf("GET %v HTTP/1.1\r\nHost: %v\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %v\r\nSec-WebSocket-Version: 13\r\n\r\n", path, host, key)
+	if _, err := io.WriteString(c, req); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade at %v%v: %v", host, path, resp.Status)
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("websocket upgrade at %v%v: bad Sec-WebSocket-Accept", host, path)
+	}
+
+	return &websocketConn{Conn: c, r: r}, nil
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.r.Read(p)
+	c.remaining -= uint64(n)
+
+	if c.mask != nil {
+		for i := range p[:n] {
+			p[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+
+	return n, err
+}
+
+// nextFrame reads the header of the next data frame, control frames are
+// handled on the way
+func (c *websocketConn) nextFrame() error {
+	for {
+		var h [2]byte
+		if _, err := io.ReadFull(c.r, h[:]); err != nil {
+			return err
+		}
+
+		opcode := h[0] & 0x0f
+		length := uint64(h[1] & 0x7f)
+
+		switch length {
+		case 126:
+			var l [2]byte
+			if _, err := io.ReadFull(c.r, l[:]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(l[:]))
+		case 127:
+			var l [8]byte
+			if _, err := io.ReadFull(c.r, l[:]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(l[:])
+		}
+
+		// servers do not mask, read it anyway
+		var mask []byte
+		if h[1]&0x80 != 0 {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(c.r, mask); err != nil {
+				return err
+			}
+		}
+
+		switch opcode {
+		case wsContinuation, wsText, wsBinary:
+			c.remaining, c.mask, c.maskPos = length, mask, 0
+			return nil
+		case wsClose:
+			return io.EOF
+		}
+
+		if length > 125 {
+			return fmt.Errorf("websocket control frame of %d bytes", length)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+
+		if opcode == wsPing {
+			for i := range payload {
+				if mask != nil {
+					payload[i] ^= mask[i%4]
+				}
+			}
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends p in one frame, masked as clients must
+func (c *websocketConn) writeFrame(opcode byte, p []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	frame := make([]byte, 0, 14+len(p))
+	frame = append(frame, 0x80|opcode)
+
+	switch {
+	case len(p) < 126:
+		frame = append(frame, 0x80|byte(len(p)))
+	case len(p) <= 0xffff:
+		frame = append(frame, 0x80|126, byte(len(p)>>8), byte(len(p)))
+	default:
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(len(p)))
+		frame = append(append(frame, 0x80|127), l[:]...)
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+
+	for i, b := range p {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *websocketConn) Close() error {
+	c.writeFrame(wsClose, nil)
+	return c.Conn.Close()
+}